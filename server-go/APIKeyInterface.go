@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+// API Key的权限范围
+const (
+	ScopeChat      = "chat"
+	ScopeUpload    = "upload"
+	ScopeWeather   = "weather"
+	ScopeDiagnosis = "diagnosis"
+)
+
+// APIKeyScopes 所有合法的权限范围
+var APIKeyScopes = []string{ScopeChat, ScopeUpload, ScopeWeather, ScopeDiagnosis}
+
+const (
+	// API Key统一前缀，用于和访问令牌区分
+	apiKeyPrefix = "cak_"
+	// 除Authorization外也可以通过该请求头传递API Key
+	apiKeyHeader = "X-API-Key"
+	// API Key最近使用时间的最小刷新间隔
+	apiKeyTouchInterval = time.Minute
+	// 每个用户最多持有的有效API Key数量
+	maxAPIKeysPerUser = 20
+)
+
+// HasScope 判断请求方是否拥有权限范围之一，登录会话拥有全部权限
+func (i *Identity) HasScope(scopes ...string) bool {
+	if i.APIKeyID == 0 {
+		return true
+	}
+	for _, scope := range scopes {
+		if slices.Contains(i.Scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKey 判断凭据是否为API Key
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// hashAPIKey 计算API Key的哈希，数据库只保存哈希
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey 生成新的API Key，返回完整Key和用于展示的前缀
+func generateAPIKey() (string, string, error) {
+	idBytes := make([]byte, 4)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+	prefix := apiKeyPrefix + hex.EncodeToString(idBytes)
+	return prefix + "_" + base64.RawURLEncoding.EncodeToString(secretBytes), prefix, nil
+}
+
+// authenticateAPIKey 校验API Key并写入请求方身份
+func authenticateAPIKey(c *gin.Context, key string) {
+	var apiKey models.APIKeys
+	result := DB.Where("key_hash = ?", hashAPIKey(key)).First(&apiKey)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API Key无效"})
+		return
+	} else if result.Error != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	now := time.Now()
+	if apiKey.RevokedAt != nil || (apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt)) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API Key已失效"})
+		return
+	}
+
+	user, ok := loadActiveUser(c, apiKey.Username)
+	if !ok {
+		return
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= apiKeyTouchInterval {
+		DB.Model(&models.APIKeys{}).Where("id = ?", apiKey.ID).Update("last_used_at", now)
+	}
+
+	c.Set(identityContextKey, &Identity{
+		Username: apiKey.Username,
+		Role:     user.Role,
+		APIKeyID: apiKey.ID,
+		Scopes:   apiKey.ScopeList(),
+	})
+	c.Next()
+}
+
+// RequireScope 权限范围守卫，API Key需要拥有scopes之一，登录会话直接放行
+func RequireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := CurrentIdentity(c)
+		if identity == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录或登录已过期"})
+			return
+		}
+		if !identity.HasScope(scopes...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":           "API Key权限不足",
+				"required_scopes": scopes,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// apiKeyView 返回给前端的API Key信息，不包含Key本身
+func apiKeyView(apiKey *models.APIKeys) gin.H {
+	view := gin.H{
+		"id":           apiKey.ID,
+		"name":         apiKey.Name,
+		"prefix":       apiKey.Prefix,
+		"scopes":       apiKey.ScopeList(),
+		"created_at":   apiKey.CreatedAt.Format(time.RFC3339),
+		"expires_at":   nil,
+		"last_used_at": nil,
+		"revoked":      apiKey.RevokedAt != nil,
+	}
+	if apiKey.ExpiresAt != nil {
+		view["expires_at"] = apiKey.ExpiresAt.Format(time.RFC3339)
+	}
+	if apiKey.LastUsedAt != nil {
+		view["last_used_at"] = apiKey.LastUsedAt.Format(time.RFC3339)
+	}
+	return view
+}
+
+// CreateAPIKey 为当前用户创建API Key，完整Key只在创建时返回一次
+func CreateAPIKey(c *gin.Context) {
+	var requestData struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	requestData.Name = strings.TrimSpace(requestData.Name)
+	if requestData.Name == "" || len([]rune(requestData.Name)) > 50 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "名称为必填项且不超过50个字符"})
+		return
+	}
+
+	if len(requestData.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "至少需要一个权限范围", "scopes": APIKeyScopes})
+		return
+	}
+	scopes := []string{}
+	for _, scope := range requestData.Scopes {
+		if !slices.Contains(APIKeyScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "权限范围不合法: " + scope, "scopes": APIKeyScopes})
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if requestData.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "有效期不合法"})
+		return
+	}
+
+	identity := CurrentIdentity(c)
+
+	var activeCount int64
+	err := DB.Model(&models.APIKeys{}).
+		Where("username = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", identity.Username, time.Now()).
+		Count(&activeCount).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if activeCount >= maxAPIKeysPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API Key数量已达上限，请先撤销不用的Key"})
+		return
+	}
+
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "API Key生成失败"})
+		return
+	}
+
+	apiKey := models.APIKeys{
+		Username: identity.Username,
+		Name:     requestData.Name,
+		Prefix:   prefix,
+		KeyHash:  hashAPIKey(key),
+		Scopes:   strings.Join(scopes, ","),
+	}
+	if requestData.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, requestData.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	if err := DB.Create(&apiKey).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "API Key保存失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditAPIKeyCreate,
+		Target:  identity.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"key_id": apiKey.ID, "prefix": apiKey.Prefix, "scopes": scopes},
+	})
+
+	view := apiKeyView(&apiKey)
+	view["key"] = key
+	c.JSON(http.StatusOK, gin.H{
+		"message": "API Key已创建，请妥善保存，之后将无法再次查看",
+		"api_key": view,
+	})
+}
+
+// ListAPIKeys 列出当前用户的API Key
+func ListAPIKeys(c *gin.Context) {
+	identity := CurrentIdentity(c)
+
+	var apiKeys []models.APIKeys
+	err := DB.Where("username = ?", identity.Username).Order("created_at DESC").Find(&apiKeys).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(apiKeys))
+	for i := range apiKeys {
+		data[i] = apiKeyView(&apiKeys[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": data})
+}
+
+// RevokeAPIKey 撤销当前用户的API Key
+func RevokeAPIKey(c *gin.Context) {
+	identity := CurrentIdentity(c)
+
+	id, err := strconv.ParseUint(c.Param("key_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API Key ID不合法"})
+		return
+	}
+
+	result := DB.Model(&models.APIKeys{}).
+		Where("id = ? AND username = ? AND revoked_at IS NULL", id, identity.Username).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "API Key撤销失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API Key不存在"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditAPIKeyRevoke,
+		Target:  identity.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"key_id": id},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "API Key已撤销", "id": id})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"server-env.com/server/models"
+)
+
+// createTestAPIKey 通过接口为用户创建API Key并返回完整Key
+func createTestAPIKey(t *testing.T, router http.Handler, token string, scopes ...string) string {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"name": "测试", "scopes": scopes})
+	w := performRequest(router, http.MethodPost, "/api/user/api-keys", string(body), bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("创建API Key失败: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		APIKey struct {
+			Key string `json:"key"`
+		} `json:"api_key"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.APIKey.Key
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "mia"}, "")
+	token := testAccessToken(t, "mia")
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"缺少名称", `{"name":" ","scopes":["chat"]}`, http.StatusBadRequest},
+		{"名称过长", `{"name":"` + strings.Repeat("名", 51) + `","scopes":["chat"]}`, http.StatusBadRequest},
+		{"缺少权限范围", `{"name":"脚本","scopes":[]}`, http.StatusBadRequest},
+		{"未知权限范围", `{"name":"脚本","scopes":["admin"]}`, http.StatusBadRequest},
+		{"有效期为负", `{"name":"脚本","scopes":["chat"],"expires_in_days":-1}`, http.StatusBadRequest},
+		{"正常", `{"name":"脚本","scopes":["chat","chat","weather"],"expires_in_days":30}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := performRequest(router, http.MethodPost, "/api/user/api-keys", tt.body, bearer(token))
+		if w.Code != tt.code {
+			t.Errorf("%s: 期望 %d，实际 %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	// 数据库只保存哈希，列表中不返回完整Key
+	var apiKey models.APIKeys
+	DB.First(&apiKey)
+	if apiKey.Scopes != "chat,weather" || apiKey.ExpiresAt == nil || !strings.HasPrefix(apiKey.Prefix, apiKeyPrefix) || len(apiKey.KeyHash) != 64 {
+		t.Fatalf("API Key保存错误: %+v", apiKey)
+	}
+	w := performRequest(router, http.MethodGet, "/api/user/api-keys", "", bearer(token))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"key"`) {
+		t.Fatalf("列表不应包含完整Key: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	setupTestDB(t)
+	setupFakeDify(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "nina"}, "")
+	token := testAccessToken(t, "nina")
+	chatKey := createTestAPIKey(t, router, token, ScopeChat)
+	diagnosisKey := createTestAPIKey(t, router, token, ScopeDiagnosis)
+	uploadKey := createTestAPIKey(t, router, token, ScopeUpload)
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		headers map[string]string
+		code    int
+	}{
+		{"chat权限聊天", http.MethodPost, "/api/chat", chatBody("nina", "你好", ""), bearer(chatKey), http.StatusOK},
+		{"通过X-API-Key传递", http.MethodPost, "/api/chat", chatBody("nina", "你好", ""), map[string]string{"X-API-Key": chatKey}, http.StatusOK},
+		{"chat权限诊断", http.MethodPost, "/api/chat", chatBody(DiagnosisUsername, "你好", ""), bearer(chatKey), http.StatusForbidden},
+		{"diagnosis权限诊断", http.MethodPost, "/api/chat", chatBody(DiagnosisUsername, "你好", ""), bearer(diagnosisKey), http.StatusOK},
+		{"diagnosis权限聊天", http.MethodPost, "/api/chat", chatBody("nina", "你好", ""), bearer(diagnosisKey), http.StatusForbidden},
+		{"diagnosis权限查看会话", http.MethodGet, "/api/conversations/list/nina", "", bearer(diagnosisKey), http.StatusForbidden},
+		{"upload权限聊天", http.MethodPost, "/api/chat", chatBody("nina", "你好", ""), bearer(uploadKey), http.StatusForbidden},
+		{"chat权限查询天气", http.MethodGet, "/api/geo/weather?city=110000", "", bearer(chatKey), http.StatusForbidden},
+		{"只接受登录会话的接口", http.MethodGet, "/api/user/info/nina", "", bearer(chatKey), http.StatusForbidden},
+		{"不能用API Key创建API Key", http.MethodPost, "/api/user/api-keys", `{"name":"x","scopes":["chat"]}`, bearer(chatKey), http.StatusForbidden},
+		{"无效的API Key", http.MethodPost, "/api/chat", chatBody("nina", "你好", ""), bearer(apiKeyPrefix + "00000000_x"), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := performRequest(router, tt.method, tt.target, tt.body, tt.headers)
+		if w.Code != tt.code {
+			t.Errorf("%s: 期望 %d，实际 %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAPIKeyRevokedOrExpired(t *testing.T) {
+	setupTestDB(t)
+	setupFakeDify(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "otto"}, "")
+	createTestUser(t, models.Users{Username: "pia"}, "")
+	token := testAccessToken(t, "otto")
+	key := createTestAPIKey(t, router, token, ScopeChat)
+	chat := func() int {
+		return performRequest(router, http.MethodPost, "/api/chat", chatBody("", "你好", ""), bearer(key)).Code
+	}
+	if code := chat(); code != http.StatusOK {
+		t.Fatalf("有效的API Key应能访问，实际 %d", code)
+	}
+
+	var apiKey models.APIKeys
+	DB.First(&apiKey)
+	if apiKey.LastUsedAt == nil {
+		t.Fatal("使用后应记录最近使用时间")
+	}
+
+	// 其他用户不能撤销
+	w := performRequest(router, http.MethodDelete, "/api/user/api-keys/"+jsonInt(int64(apiKey.ID)), "", bearer(testAccessToken(t, "pia")))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("撤销其他用户的API Key应返回404，实际 %d", w.Code)
+	}
+
+	// 禁用账户后API Key不可用
+	DB.Model(&models.Users{}).Where("username = ?", "otto").Update("disabled", true)
+	if code := chat(); code != http.StatusForbidden {
+		t.Fatalf("账户禁用后应返回403，实际 %d", code)
+	}
+	DB.Model(&models.Users{}).Where("username = ?", "otto").Update("disabled", false)
+
+	expired := time.Now().Add(-time.Minute)
+	DB.Model(&apiKey).Update("expires_at", expired)
+	if code := chat(); code != http.StatusUnauthorized {
+		t.Fatalf("过期的API Key应返回401，实际 %d", code)
+	}
+	DB.Model(&apiKey).Update("expires_at", nil)
+
+	w = performRequest(router, http.MethodDelete, "/api/user/api-keys/"+jsonInt(int64(apiKey.ID)), "", bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("撤销API Key失败: %d %s", w.Code, w.Body.String())
+	}
+	if code := chat(); code != http.StatusUnauthorized {
+		t.Fatalf("撤销后应返回401，实际 %d", code)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 内置的常见弱密码列表
+//
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+// 默认允许的用户名字符：汉字、字母、数字、下划线和连字符
+const defaultUsernamePattern = `^[\p{Han}A-Za-z0-9_-]+$`
+
+// 默认保留的用户名，比较时忽略大小写
+var defaultReservedUsernames = []string{
+	DiagnosisUsername,
+	"admin",
+	"administrator",
+	"root",
+	"system",
+	"support",
+	"dify",
+}
+
+// AccountPolicy 注册和修改密码共用的账户策略
+type AccountPolicy struct {
+	UsernameMinLength int
+	UsernameMaxLength int
+	UsernamePattern   *regexp.Regexp
+	ReservedUsernames map[string]bool
+
+	PasswordMinLength int
+	// bcrypt只使用前72字节，超出部分会被忽略
+	PasswordMaxBytes int
+	// 密码至少包含的字符种类数：小写字母、大写字母、数字、符号
+	PasswordMinClasses    int
+	RejectCommonPasswords bool
+	CommonPasswords       map[string]bool
+}
+
+// PolicyViolation 描述违反的具体规则
+type PolicyViolation struct {
+	Rule    string
+	Message string
+}
+
+func (v *PolicyViolation) Error() string {
+	return v.Message
+}
+
+// Response 转换为接口错误响应
+func (v *PolicyViolation) Response() gin.H {
+	return gin.H{"error": v.Message, "rule": v.Rule}
+}
+
+// 账户策略，可通过环境变量调整
+var accountPolicy = NewAccountPolicyFromEnv()
+
+// NewAccountPolicyFromEnv 从环境变量读取账户策略
+func NewAccountPolicyFromEnv() *AccountPolicy {
+	reserved := map[string]bool{}
+	for _, name := range defaultReservedUsernames {
+		reserved[strings.ToLower(name)] = true
+	}
+	for _, name := range strings.Split(os.Getenv("RESERVED_USERNAMES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			reserved[strings.ToLower(name)] = true
+		}
+	}
+
+	pattern, err := regexp.Compile(getEnvOrDefault("USERNAME_PATTERN", defaultUsernamePattern))
+	if err != nil {
+		panic(fmt.Sprintf("USERNAME_PATTERN 不是合法的正则表达式: %v", err))
+	}
+
+	return &AccountPolicy{
+		UsernameMinLength:     getEnvIntOrDefault("USERNAME_MIN_LENGTH", 3),
+		UsernameMaxLength:     getEnvIntOrDefault("USERNAME_MAX_LENGTH", 32),
+		UsernamePattern:       pattern,
+		ReservedUsernames:     reserved,
+		PasswordMinLength:     getEnvIntOrDefault("PASSWORD_MIN_LENGTH", 8),
+		PasswordMaxBytes:      72,
+		PasswordMinClasses:    getEnvIntOrDefault("PASSWORD_MIN_CLASSES", 2),
+		RejectCommonPasswords: getEnvOrDefault("PASSWORD_REJECT_COMMON", "true") == "true",
+		CommonPasswords:       loadCommonPasswords(commonPasswordsFile),
+	}
+}
+
+// loadCommonPasswords 解析弱密码列表，忽略空行和#开头的注释
+func loadCommonPasswords(content string) map[string]bool {
+	passwords := map[string]bool{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords[strings.ToLower(line)] = true
+	}
+	return passwords
+}
+
+// ValidateUsername 校验用户名是否符合策略
+func (p *AccountPolicy) ValidateUsername(username string) *PolicyViolation {
+	length := utf8.RuneCountInString(username)
+	if length < p.UsernameMinLength || length > p.UsernameMaxLength {
+		return &PolicyViolation{
+			Rule:    "username_length",
+			Message: fmt.Sprintf("用户名长度须为%d到%d个字符", p.UsernameMinLength, p.UsernameMaxLength),
+		}
+	}
+
+	if !p.UsernamePattern.MatchString(username) {
+		return &PolicyViolation{
+			Rule:    "username_charset",
+			Message: "用户名只能包含汉字、字母、数字、下划线和连字符",
+		}
+	}
+
+	if p.ReservedUsernames[strings.ToLower(username)] {
+		return &PolicyViolation{
+			Rule:    "username_reserved",
+			Message: "该用户名为系统保留，请更换",
+		}
+	}
+
+	return nil
+}
+
+// passwordClasses 统计密码包含的字符种类数
+func passwordClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+// ValidatePassword 校验密码是否符合策略，username用于检查密码是否包含用户名
+func (p *AccountPolicy) ValidatePassword(username, password string) *PolicyViolation {
+	if utf8.RuneCountInString(password) < p.PasswordMinLength {
+		return &PolicyViolation{
+			Rule:    "password_too_short",
+			Message: fmt.Sprintf("密码长度至少为%d位", p.PasswordMinLength),
+		}
+	}
+
+	if len(password) > p.PasswordMaxBytes {
+		return &PolicyViolation{
+			Rule:    "password_too_long",
+			Message: fmt.Sprintf("密码长度不能超过%d字节", p.PasswordMaxBytes),
+		}
+	}
+
+	if passwordClasses(password) < p.PasswordMinClasses {
+		return &PolicyViolation{
+			Rule:    "password_complexity",
+			Message: fmt.Sprintf("密码须至少包含小写字母、大写字母、数字、符号中的%d种", p.PasswordMinClasses),
+		}
+	}
+
+	if p.RejectCommonPasswords && p.CommonPasswords[strings.ToLower(password)] {
+		return &PolicyViolation{
+			Rule:    "password_common",
+			Message: "密码过于常见，请更换",
+		}
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return &PolicyViolation{
+			Rule:    "password_contains_username",
+			Message: "密码不能包含用户名",
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// parsePagination 解析分页参数page和page_size
+func parsePagination(c *gin.Context) (int, int) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	return page, pageSize
+}
+
+// escapeLike 转义LIKE查询中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// adminUserView 管理接口返回的用户信息，不包含密码哈希
+func adminUserView(user *models.Users) gin.H {
+	return gin.H{
+		"username":                user.Username,
+		"avatar":                  avatarURL(user.Avatar),
+		"phone":                   user.Phone,
+		"email":                   user.Email,
+		"role":                    user.Role,
+		"disabled":                user.Disabled,
+		"password_reset_required": user.PasswordResetRequired,
+		"totp_enabled":            user.TOTPEnabled,
+		"display_name":            user.DisplayName,
+		"region_adcode":           user.RegionAdcode,
+		"crop_varieties":          user.CropVarietyList(),
+		"farm_size":               user.FarmSize,
+		"language":                user.Language,
+		"timezone":                user.Timezone,
+		"created_at":              user.CreatedAt.Format(time.RFC3339),
+		"updated_at":              user.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// loadTargetUser 查询管理操作的目标用户，失败时直接写入响应
+func loadTargetUser(c *gin.Context) (*models.Users, bool) {
+	var user models.Users
+	result := DB.Where("username = ?", c.Param("username")).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return nil, false
+	} else if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return nil, false
+	}
+	return &user, true
+}
+
+// rejectSelfTarget 禁止管理员对自己执行禁用、删除等操作
+func rejectSelfTarget(c *gin.Context, user *models.Users) bool {
+	if user.Username == CurrentIdentity(c).Username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能对自己的账户执行该操作"})
+		return true
+	}
+	return false
+}
+
+// AdminListUsers 分页列出和搜索用户
+func AdminListUsers(c *gin.Context) {
+	page, pageSize := parsePagination(c)
+
+	query := DB.Model(&models.Users{})
+	if keyword := strings.TrimSpace(c.Query("q")); keyword != "" {
+		like := "%" + escapeLike(keyword) + "%"
+		query = query.Where("username LIKE ? OR display_name LIKE ? OR phone LIKE ? OR email LIKE ?", like, like, like, like)
+	}
+	if role := c.Query("role"); role != "" {
+		query = query.Where("role = ?", role)
+	}
+	if disabled := c.Query("disabled"); disabled != "" {
+		query = query.Where("disabled = ?", disabled == "true")
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var users []models.Users
+	err := query.Order("created_at DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&users).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(users))
+	for i := range users {
+		data[i] = adminUserView(&users[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users":     data,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// AdminGetUser 查看单个用户的资料和最近活动
+func AdminGetUser(c *gin.Context) {
+	user, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	var sessions []models.Sessions
+	err := DB.Where("username = ?", user.Username).
+		Order("created_at DESC").
+		Limit(10).
+		Find(&sessions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var activeSessions int64
+	err = DB.Model(&models.Sessions{}).
+		Where("username = ? AND revoked_at IS NULL AND expires_at > ?", user.Username, time.Now()).
+		Count(&activeSessions).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	recentSessions := make([]gin.H, len(sessions))
+	var lastSeenAt *time.Time
+	for i, session := range sessions {
+		recentSessions[i] = gin.H{
+			"id":           session.ID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt.Format(time.RFC3339),
+			"last_seen_at": session.LastSeenAt.Format(time.RFC3339),
+			"revoked":      session.RevokedAt != nil,
+		}
+		if lastSeenAt == nil || session.LastSeenAt.After(*lastSeenAt) {
+			seen := session.LastSeenAt
+			lastSeenAt = &seen
+		}
+	}
+
+	activity := gin.H{
+		"active_sessions": activeSessions,
+		"recent_sessions": recentSessions,
+		"last_seen_at":    nil,
+	}
+	if lastSeenAt != nil {
+		activity["last_seen_at"] = lastSeenAt.Format(time.RFC3339)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":     adminUserView(user),
+		"activity": activity,
+	})
+}
+
+// setUserDisabled 禁用或启用账户，禁用时同时注销其全部会话
+func setUserDisabled(c *gin.Context, disabled bool) {
+	user, ok := loadTargetUser(c)
+	if !ok || rejectSelfTarget(c, user) {
+		return
+	}
+
+	if err := DB.Model(user).Update("disabled", disabled).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "账户状态修改失败"})
+		return
+	}
+
+	if disabled {
+		if _, err := RevokeUserSessions(user.Username, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "账户已禁用，但会话注销失败"})
+			return
+		}
+	}
+
+	message := "账户已启用"
+	if disabled {
+		message = "账户已禁用"
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message, "username": user.Username})
+}
+
+// AdminDisableUser 禁用账户
+func AdminDisableUser(c *gin.Context) {
+	setUserDisabled(c, true)
+}
+
+// AdminEnableUser 重新启用账户
+func AdminEnableUser(c *gin.Context) {
+	setUserDisabled(c, false)
+}
+
+// AdminForcePasswordReset 强制用户重置密码
+// 注销该用户全部会话，之后必须通过验证码重置密码才能登录
+// 用户没有绑定手机号和邮箱时无法接收验证码，改为生成一次性密码，登录后必须修改
+// 不能对自己或其他管理员执行
+func AdminForcePasswordReset(c *gin.Context) {
+	user, ok := loadTargetUser(c)
+	if !ok || rejectSelfTarget(c, user) {
+		return
+	}
+	// 管理员账户的密码只能由本人修改，避免通过一次性密码接管其他管理员
+	if user.Role == models.RoleAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "不能强制重置管理员的密码"})
+		return
+	}
+
+	if _, destination := resetDestination(user, ""); destination == "" {
+		forceTemporaryPassword(c, user)
+		return
+	}
+
+	previous := user.PasswordResetRequired
+	if err := DB.Model(user).Update("password_reset_required", true).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "强制重置密码失败"})
+		return
+	}
+
+	// 验证码发送失败时撤销重置要求，否则用户既无法登录也收不到验证码
+	sent, err := SendPasswordResetCode(c.Request.Context(), user, "")
+	if err != nil || !sent {
+		fmt.Println("密码重置验证码发送失败:", err, user.Username)
+		if err := DB.Model(user).Update("password_reset_required", previous).Error; err != nil {
+			fmt.Println("撤销密码重置要求失败:", err, user.Username)
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "验证码发送失败，未要求用户重置密码"})
+		return
+	}
+
+	if _, err := RevokeUserSessions(user.Username, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "会话注销失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "已要求用户重置密码",
+		"username":  user.Username,
+		"code_sent": true,
+	})
+}
+
+// forceTemporaryPassword 为没有联系方式的用户生成一次性密码，由管理员线下转交
+func forceTemporaryPassword(c *gin.Context, user *models.Users) {
+	password, err := generateInitialPassword(user.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	hashedPassword, err := passwordHasher.Hash(password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码加密失败"})
+		return
+	}
+
+	err = DB.Model(user).Updates(map[string]interface{}{
+		"password":                 hashedPassword,
+		"password_reset_required":  false,
+		"password_change_required": true,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "强制重置密码失败"})
+		return
+	}
+
+	if _, err := RevokeUserSessions(user.Username, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "会话注销失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":            "用户未绑定手机号或邮箱，已生成一次性密码，登录后必须修改",
+		"username":           user.Username,
+		"code_sent":          false,
+		"temporary_password": password,
+	})
+}
+
+// AdminClearAvatar 清除用户头像
+func AdminClearAvatar(c *gin.Context) {
+	user, ok := loadTargetUser(c)
+	if !ok {
+		return
+	}
+
+	oldAvatar := user.Avatar
+	if err := DB.Model(user).Update("avatar", "").Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "头像清除失败"})
+		return
+	}
+
+	if err := avatarService.Remove(c.Request.Context(), oldAvatar); err != nil {
+		fmt.Println("头像文件删除失败:", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "头像已清除", "username": user.Username})
+}
+
+// AdminDeleteUser 删除用户及其Dify会话、头像文件和关联数据
+func AdminDeleteUser(c *gin.Context) {
+	user, ok := loadTargetUser(c)
+	if !ok || rejectSelfTarget(c, user) {
+		return
+	}
+
+	report, err := deleteUserAccount(c.Request.Context(), user)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error":  fmt.Sprintf("用户删除失败: %v", err),
+			"report": report,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "用户已删除",
+		"report":  report,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+func TestAdminForcePasswordResetWithoutContact(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "admin", Role: models.RoleAdmin}, "Admin-Passw0rd")
+	createTestUser(t, models.Users{Username: "henry"}, "Old-Passw0rd")
+	adminToken := testAccessToken(t, "admin")
+	testAccessToken(t, "henry")
+
+	w := performRequest(router, http.MethodPost, "/api/admin/users/henry/force-password-reset", "", map[string]string{
+		"Authorization": "Bearer " + adminToken,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("期望200，实际 %d %s", w.Code, w.Body.String())
+	}
+	password, _ := decodeBody(t, w)["temporary_password"].(string)
+	if password == "" {
+		t.Fatalf("没有联系方式时应返回一次性密码: %s", w.Body.String())
+	}
+
+	var user models.Users
+	DB.Where("username = ?", "henry").First(&user)
+	if user.PasswordResetRequired || !user.PasswordChangeRequired || !passwordHasher.Verify(user.Password, password) {
+		t.Fatalf("账户状态不正确: reset=%v change=%v", user.PasswordResetRequired, user.PasswordChangeRequired)
+	}
+	var sessions int64
+	DB.Model(&models.Sessions{}).Where("username = ? AND revoked_at IS NULL", "henry").Count(&sessions)
+	if sessions != 0 {
+		t.Fatalf("应注销用户的全部会话，剩余 %d", sessions)
+	}
+}
+
+func TestAdminForcePasswordResetRejectsAdmins(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "admin", Role: models.RoleAdmin}, "Admin-Passw0rd")
+	createTestUser(t, models.Users{Username: "root", Role: models.RoleAdmin}, "Admin-Passw0rd")
+	adminToken := testAccessToken(t, "admin")
+
+	for _, target := range []string{"admin", "root"} {
+		w := performRequest(router, http.MethodPost, "/api/admin/users/"+target+"/force-password-reset", "", bearer(adminToken))
+		if w.Code == http.StatusOK || decodeBody(t, w)["temporary_password"] != nil {
+			t.Fatalf("%s: 不能强制重置管理员的密码，实际 %d %s", target, w.Code, w.Body.String())
+		}
+		var user models.Users
+		DB.Where("username = ?", target).First(&user)
+		if user.PasswordChangeRequired || user.PasswordResetRequired || !passwordHasher.Verify(user.Password, "Admin-Passw0rd") {
+			t.Fatalf("%s: 账户不应被修改", target)
+		}
+	}
+}
+
+func TestAdminForcePasswordResetSendFailure(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	notifier := setupNotifiers(t, NotifyChannelSMS)
+	notifier.err = errors.New("gateway down")
+	createTestUser(t, models.Users{Username: "admin", Role: models.RoleAdmin}, "Admin-Passw0rd")
+	createTestUser(t, models.Users{Username: "ivan", Phone: "13800000002"}, "Old-Passw0rd")
+	adminToken := testAccessToken(t, "admin")
+	testAccessToken(t, "ivan")
+
+	// 发送失败时返回错误，不要求重置，也不注销会话
+	w := performRequest(router, http.MethodPost, "/api/admin/users/ivan/force-password-reset", "", bearer(adminToken))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("期望502，实际 %d %s", w.Code, w.Body.String())
+	}
+	var user models.Users
+	DB.Where("username = ?", "ivan").First(&user)
+	if user.PasswordResetRequired {
+		t.Fatal("发送失败时应撤销重置要求")
+	}
+	var sessions int64
+	DB.Model(&models.Sessions{}).Where("username = ? AND revoked_at IS NULL", "ivan").Count(&sessions)
+	if sessions == 0 {
+		t.Fatal("发送失败时不应注销会话")
+	}
+
+	// 发送成功后要求重置并注销会话
+	notifier.err = nil
+	w = performRequest(router, http.MethodPost, "/api/admin/users/ivan/force-password-reset", "", bearer(adminToken))
+	if w.Code != http.StatusOK || len(notifier.sent) != 1 {
+		t.Fatalf("期望200并发送验证码，实际 %d %s", w.Code, w.Body.String())
+	}
+	DB.Where("username = ?", "ivan").First(&user)
+	if !user.PasswordResetRequired {
+		t.Fatal("应要求用户重置密码")
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+// 审计结果
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// 审计事件类型
+const (
+	AuditRegister           = "user.register"
+	AuditLogin              = "user.login"
+	AuditLoginTwoFactor     = "user.login_2fa"
+	AuditLoginOIDC          = "user.login_oidc"
+	AuditLogout             = "user.logout"
+	AuditPasswordChange     = "user.password_change"
+	AuditPasswordReset      = "user.password_reset"
+	AuditAvatarChange       = "user.avatar_change"
+	AuditProfileUpdate      = "user.profile_update"
+	AuditAccountDelete      = "user.account_delete"
+	AuditAccountActivate    = "user.account_activate"
+	AuditSessionRevoke      = "user.session_revoke"
+	AuditAPIKeyCreate       = "user.api_key_create"
+	AuditAPIKeyRevoke       = "user.api_key_revoke"
+	AuditTwoFactorEnable    = "user.2fa_enable"
+	AuditTwoFactorDisable   = "user.2fa_disable"
+	AuditConversationDelete = "conversation.delete"
+	AuditOrgCreate          = "org.create"
+	AuditOrgDelete          = "org.delete"
+	AuditOrgInvite          = "org.invite"
+	AuditOrgJoin            = "org.join"
+	AuditOrgMemberRole      = "org.member_role"
+	AuditOrgMemberRemove    = "org.member_remove"
+	AuditOrgShare           = "org.share"
+	AuditOrgUnshare         = "org.unshare"
+	AuditInviteCodeCreate   = "invite_code.create"
+	AuditInviteCodeRevoke   = "invite_code.revoke"
+	AuditUserImport         = "user.import"
+	AuditAuditExport        = "admin.audit_export"
+)
+
+// 单次导出的最大条数
+const maxAuditExportRows = 100000
+
+// AuditEvent 一条待记录的审计事件
+type AuditEvent struct {
+	Action string
+	// Actor 为空时使用当前请求方
+	Actor   string
+	Target  string
+	Outcome string
+	Detail  gin.H
+}
+
+// RecordAudit 记录审计日志，写入失败只打印错误，不影响请求
+func RecordAudit(c *gin.Context, event AuditEvent) {
+	actor := event.Actor
+	if actor == "" {
+		if identity := CurrentIdentity(c); identity != nil {
+			actor = identity.Username
+		}
+	}
+
+	detail := ""
+	if identity := CurrentIdentity(c); identity != nil && identity.APIKeyID != 0 {
+		if event.Detail == nil {
+			event.Detail = gin.H{}
+		}
+		event.Detail["api_key_id"] = identity.APIKeyID
+	}
+	if len(event.Detail) > 0 {
+		data, err := json.Marshal(event.Detail)
+		if err == nil {
+			detail = string(data)
+		}
+	}
+
+	// 按列长截断，列长按字符计算
+	entry := models.AuditLogs{
+		Action:    event.Action,
+		Actor:     truncateRunes(actor, 50),
+		Target:    truncateRunes(event.Target, 255),
+		IP:        c.ClientIP(),
+		UserAgent: truncateRunes(c.Request.UserAgent(), 255),
+		Outcome:   event.Outcome,
+		Detail:    detail,
+	}
+	if err := DB.Create(&entry).Error; err != nil {
+		fmt.Println("审计日志写入失败:", err, event.Action, actor, event.Target)
+	}
+}
+
+// truncateRunes 将字符串截断为最多n个字符，不会截断多字节字符
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// auditOutcome 根据响应状态码判断操作结果
+func auditOutcome(status int) string {
+	if status < http.StatusBadRequest {
+		return AuditSuccess
+	}
+	return AuditFailure
+}
+
+// auditResult 根据错误判断操作结果
+func auditResult(err error) string {
+	if err != nil {
+		return AuditFailure
+	}
+	return AuditSuccess
+}
+
+// AuditAdminActions 管理接口的审计中间件，记录所有修改类请求
+// 放在角色守卫之前，非管理员的越权尝试同样会被记录
+func AuditAdminActions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			return
+		}
+		RecordAudit(c, AuditEvent{
+			Action:  "admin." + strings.ToLower(c.Request.Method) + " " + c.FullPath(),
+			Target:  c.Param("username"),
+			Outcome: auditOutcome(c.Writer.Status()),
+			Detail:  gin.H{"status": c.Writer.Status()},
+		})
+	}
+}
+
+// parseAuditTime 解析筛选时间，支持RFC3339和日期
+func parseAuditTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// auditQuery 根据查询参数构造筛选条件
+func auditQuery(c *gin.Context) (*gorm.DB, error) {
+	query := DB.Model(&models.AuditLogs{})
+	for _, field := range []string{"action", "actor", "target", "outcome", "ip"} {
+		if value := c.Query(field); value != "" {
+			query = query.Where(field+" = ?", value)
+		}
+	}
+	if prefix := c.Query("action_prefix"); prefix != "" {
+		query = query.Where("action LIKE ?", escapeLike(prefix)+"%")
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := parseAuditTime(since, false)
+		if err != nil {
+			return nil, fmt.Errorf("since 时间格式错误")
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := parseAuditTime(until, true)
+		if err != nil {
+			return nil, fmt.Errorf("until 时间格式错误")
+		}
+		query = query.Where("created_at < ?", t)
+	}
+	return query, nil
+}
+
+// auditLogView 审计日志的接口输出
+func auditLogView(entry *models.AuditLogs) gin.H {
+	var detail any
+	if entry.Detail != "" {
+		if err := json.Unmarshal([]byte(entry.Detail), &detail); err != nil {
+			detail = entry.Detail
+		}
+	}
+	return gin.H{
+		"id":         entry.ID,
+		"action":     entry.Action,
+		"actor":      entry.Actor,
+		"target":     entry.Target,
+		"ip":         entry.IP,
+		"user_agent": entry.UserAgent,
+		"outcome":    entry.Outcome,
+		"detail":     detail,
+		"created_at": entry.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// ListAuditLogs 管理员分页查询审计日志
+func ListAuditLogs(c *gin.Context) {
+	page, pageSize := parsePagination(c)
+
+	query, err := auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var entries []models.AuditLogs
+	err = query.Order("id DESC").
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&entries).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(entries))
+	for i := range entries {
+		data[i] = auditLogView(&entries[i])
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"logs":      data,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// ExportAuditLogs 管理员按筛选条件导出审计日志，支持csv和json格式
+func ExportAuditLogs(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "导出格式只支持csv或json"})
+		return
+	}
+
+	query, err := auditQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var entries []models.AuditLogs
+	if err := query.Order("id ASC").Limit(maxAuditExportRows).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	// 导出操作本身也需要留痕
+	RecordAudit(c, AuditEvent{
+		Action:  AuditAuditExport,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"format": format, "rows": len(entries), "query": c.Request.URL.RawQuery},
+	})
+
+	filename := "audit-logs-" + time.Now().Format("20060102-150405") + "." + format
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if format == "json" {
+		data := make([]gin.H, len(entries))
+		for i := range entries {
+			data[i] = auditLogView(&entries[i])
+		}
+		c.JSON(http.StatusOK, data)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+	// 写入BOM，Excel打开时才能正确识别UTF-8中文
+	c.Writer.WriteString("\ufeff")
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"id", "created_at", "action", "actor", "target", "outcome", "ip", "user_agent", "detail"})
+	for _, entry := range entries {
+		writer.Write([]string{
+			strconv.FormatUint(uint64(entry.ID), 10),
+			entry.CreatedAt.Format(time.RFC3339),
+			entry.Action,
+			csvSafe(entry.Actor),
+			csvSafe(entry.Target),
+			entry.Outcome,
+			entry.IP,
+			csvSafe(entry.UserAgent),
+			csvSafe(entry.Detail),
+		})
+	}
+	writer.Flush()
+}
+
+// csvSafe 防止单元格内容在表格软件中被当作公式执行
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
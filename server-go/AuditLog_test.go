@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"server-env.com/server/models"
+)
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"farmer", 10, "farmer"},
+		{"farmer", 4, "farm"},
+		{"玉米病害诊断", 4, "玉米病害"},
+		{"玉米abc", 3, "玉米a"},
+		{"", 5, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateRunes(tt.in, tt.n); got != tt.want {
+			t.Errorf("truncateRunes(%q, %d) = %q，期望 %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRecordAuditTruncatesByRunes(t *testing.T) {
+	setupTestDB(t)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.Header.Set("User-Agent", strings.Repeat("浏", 300))
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditLogin,
+		Actor:   strings.Repeat("农", 60),
+		Target:  strings.Repeat("田", 300),
+		Outcome: AuditSuccess,
+	})
+
+	var entry models.AuditLogs
+	if err := DB.First(&entry).Error; err != nil {
+		t.Fatalf("审计日志未写入: %v", err)
+	}
+	for name, value := range map[string]string{"actor": entry.Actor, "target": entry.Target, "user_agent": entry.UserAgent} {
+		if !utf8.ValidString(value) {
+			t.Errorf("%s 截断后不是合法的UTF-8", name)
+		}
+	}
+	if utf8.RuneCountInString(entry.Actor) != 50 || utf8.RuneCountInString(entry.Target) != 255 || utf8.RuneCountInString(entry.UserAgent) != 255 {
+		t.Errorf("截断长度不正确: %d %d %d", utf8.RuneCountInString(entry.Actor), utf8.RuneCountInString(entry.Target), utf8.RuneCountInString(entry.UserAgent))
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+var (
+	AUTH_TOKEN_SECRET = []byte(os.Getenv("AUTH_TOKEN_SECRET"))
+	AUTH_TOKEN_TTL    = 24 * time.Hour
+)
+
+// 诊断页面使用的公共用户名，所有诊断对话都挂在该用户下
+const DiagnosisUsername = "____FORDIAGNOSIS____"
+
+// gin.Context 中保存请求方身份的键
+const identityContextKey = "identity"
+
+var (
+	ErrTokenMalformed = errors.New("token格式错误")
+	ErrTokenSignature = errors.New("token签名无效")
+	ErrTokenExpired   = errors.New("token已过期")
+)
+
+func init() {
+	// 未配置密钥时随机生成，重启后已签发的token全部失效
+	if len(AUTH_TOKEN_SECRET) == 0 {
+		AUTH_TOKEN_SECRET = make([]byte, 32)
+		if _, err := rand.Read(AUTH_TOKEN_SECRET); err != nil {
+			panic(err)
+		}
+		fmt.Println("AUTH_TOKEN_SECRET 未设置，使用随机密钥签发token")
+	}
+}
+
+// Identity 是认证中间件解析出的请求方身份
+type Identity struct {
+	Username  string
+	SessionID string
+	Role      string
+	// 通过API Key访问时为对应的Key ID和权限范围
+	APIKeyID uint
+	Scopes   []string
+}
+
+// HasRole 判断请求方是否属于给定角色之一
+func (i *Identity) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if i.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenClaims 是访问令牌中携带的声明
+type TokenClaims struct {
+	Subject   string `json:"sub"`
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// 令牌头部固定为HS256, 与JWT格式兼容
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signToken 对令牌的头部和载荷部分签名
+func signToken(unsigned string) string {
+	mac := hmac.New(sha256.New, AUTH_TOKEN_SECRET)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeSignedValue 将数据编码为带签名的字符串
+// purpose参与签名，不同用途的签名值不能互相替换
+func encodeSignedValue(purpose string, v any) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signToken(purpose+":"+encoded), nil
+}
+
+// decodeSignedValue 校验encodeSignedValue生成的签名并解析数据
+func decodeSignedValue(purpose, value string, v any) error {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signToken(purpose+":"+encoded)), []byte(signature)) {
+		return ErrTokenSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ErrTokenMalformed
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return ErrTokenMalformed
+	}
+	return nil
+}
+
+// IssueAccessToken 为用户的某个会话签发访问令牌
+func IssueAccessToken(username, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(AUTH_TOKEN_TTL)
+	claims := TokenClaims{
+		Subject:   username,
+		SessionID: sessionID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signToken(unsigned), expiresAt, nil
+}
+
+// ParseAccessToken 校验访问令牌的签名和有效期并返回声明
+func ParseAccessToken(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, ErrTokenMalformed
+	}
+
+	expected := signToken(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, ErrTokenSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" || claims.SessionID == "" {
+		return nil, ErrTokenMalformed
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	return &claims, nil
+}
+
+// bearerToken 从Authorization请求头中取出Bearer令牌
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// AuthRequired 认证中间件，只接受登录会话签发的访问令牌
+func AuthRequired() gin.HandlerFunc {
+	return authenticate(false)
+}
+
+// AuthRequiredOrAPIKey 认证中间件，同时接受访问令牌和API Key
+// API Key的权限范围需要再由RequireScope检查
+func AuthRequiredOrAPIKey() gin.HandlerFunc {
+	return authenticate(true)
+}
+
+// authenticate 从Authorization或X-API-Key请求头解析请求方身份
+func authenticate(allowAPIKey bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if apiKey := c.GetHeader(apiKeyHeader); apiKey != "" {
+			token = apiKey
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录或登录已过期"})
+			return
+		}
+
+		if IsAPIKey(token) {
+			if !allowAPIKey {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "该接口不支持API Key访问"})
+				return
+			}
+			authenticateAPIKey(c, token)
+			return
+		}
+
+		claims, err := ParseAccessToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录或登录已过期"})
+			return
+		}
+
+		// 令牌对应的会话必须仍然有效
+		if err := ValidateSession(claims.SessionID, claims.Subject); err != nil {
+			if err == ErrSessionInvalid {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "会话已注销，请重新登录"})
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+			}
+			return
+		}
+
+		user, ok := loadActiveUser(c, claims.Subject)
+		if !ok {
+			return
+		}
+
+		c.Set(identityContextKey, &Identity{
+			Username:  claims.Subject,
+			SessionID: claims.SessionID,
+			Role:      user.Role,
+		})
+		c.Next()
+	}
+}
+
+// loadActiveUser 查询请求方用户的角色和禁用状态，失败时中止请求
+// 角色和禁用状态以数据库为准，调整后立即生效
+func loadActiveUser(c *gin.Context, username string) (*models.Users, bool) {
+	var user models.Users
+	result := DB.Select("username", "role", "disabled", "totp_enabled", "password_change_required").Where("username = ?", username).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "用户不存在"})
+		return nil, false
+	} else if result.Error != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return nil, false
+	}
+	if user.Disabled {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "账户已被禁用"})
+		return nil, false
+	}
+
+	// 角色要求两步验证时，未绑定的用户只能访问绑定相关接口
+	required, err := twoFactorEnrollmentRequired(&user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return nil, false
+	}
+	if required && !twoFactorEnrollmentAllowed(c) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error":                          "当前角色必须启用两步验证，请先完成绑定",
+			"two_factor_enrollment_required": true,
+		})
+		return nil, false
+	}
+
+	// 使用初始密码的账户必须先修改密码
+	if user.PasswordChangeRequired && !passwordChangeAllowed(c) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error":                    "请先修改初始密码",
+			"password_change_required": true,
+		})
+		return nil, false
+	}
+	return &user, true
+}
+
+// passwordChangeAllowed 未修改初始密码时仍可访问的接口
+func passwordChangeAllowed(c *gin.Context) bool {
+	path := c.FullPath()
+	return path == "/api/user/change-password" || path == "/api/user/logout"
+}
+
+// CurrentIdentity 获取认证中间件写入的请求方身份
+func CurrentIdentity(c *gin.Context) *Identity {
+	value, ok := c.Get(identityContextKey)
+	if !ok {
+		return nil
+	}
+	identity, _ := value.(*Identity)
+	return identity
+}
+
+// resolveUsername 以令牌中的身份为准确定本次请求的用户名
+// 客户端传入的用户名为空时直接使用令牌身份，不一致时返回403并中止请求
+func resolveUsername(c *gin.Context, claimed string) (string, bool) {
+	identity := CurrentIdentity(c)
+	if identity == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录或登录已过期"})
+		return "", false
+	}
+
+	if claimed != "" && claimed != identity.Username {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "无权访问其他用户的数据"})
+		return "", false
+	}
+
+	return identity.Username, true
+}
+
+// resolveChatUsername 与resolveUsername相同，但允许诊断页面使用公共诊断用户名
+// API Key使用诊断用户名需要diagnosis权限，使用自己的用户名需要chat权限
+func resolveChatUsername(c *gin.Context, claimed string) (string, bool) {
+	identity := CurrentIdentity(c)
+	if claimed == DiagnosisUsername && identity != nil {
+		if !identity.HasScope(ScopeDiagnosis) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API Key缺少diagnosis权限"})
+			return "", false
+		}
+		return DiagnosisUsername, true
+	}
+	if identity != nil && !identity.HasScope(ScopeChat) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API Key缺少chat权限"})
+		return "", false
+	}
+	return resolveUsername(c, claimed)
+}
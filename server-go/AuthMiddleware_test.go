@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedTestToken 用当前密钥为任意载荷签名，构造通过签名校验的令牌
+func signedTestToken(header, payload string) string {
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return unsigned + "." + signToken(unsigned)
+}
+
+func TestParseAccessToken(t *testing.T) {
+	token, _, err := IssueAccessToken("alice", "session-1")
+	if err != nil {
+		t.Fatalf("签发令牌失败: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(TokenClaims{Subject: "admin", SessionID: "session-1", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	otherHeader := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	future := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"有效令牌", token, nil},
+		{"空令牌", "", ErrTokenMalformed},
+		{"缺少签名", parts[0] + "." + parts[1], ErrTokenMalformed},
+		{"多余的段", token + ".x", ErrTokenMalformed},
+		{"替换头部", otherHeader + "." + parts[1] + "." + parts[2], ErrTokenMalformed},
+		{"篡改载荷", parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2], ErrTokenSignature},
+		{"篡改签名", parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2])), ErrTokenSignature},
+		{"空签名", parts[0] + "." + parts[1] + ".", ErrTokenSignature},
+		{"载荷不是JSON", signedTestToken(tokenHeader, "not-json"), ErrTokenMalformed},
+		{"缺少用户名", signedTestToken(tokenHeader, `{"sid":"s","exp":`+jsonInt(future)+`}`), ErrTokenMalformed},
+		{"缺少会话ID", signedTestToken(tokenHeader, `{"sub":"alice","exp":`+jsonInt(future)+`}`), ErrTokenMalformed},
+		{"已过期", signedTestToken(tokenHeader, `{"sub":"alice","sid":"s","exp":`+jsonInt(time.Now().Unix()-1)+`}`), ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseAccessToken(tt.token)
+			if err != tt.err {
+				t.Fatalf("期望错误 %v，实际 %v", tt.err, err)
+			}
+			if tt.err == nil && (claims.Subject != "alice" || claims.SessionID != "session-1") {
+				t.Fatalf("声明解析错误: %+v", claims)
+			}
+		})
+	}
+}
+
+func jsonInt(v int64) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func TestDecodeSignedValue(t *testing.T) {
+	type payload struct {
+		Username string `json:"username"`
+	}
+	value, err := encodeSignedValue("test_purpose", payload{Username: "alice"})
+	if err != nil {
+		t.Fatalf("签名失败: %v", err)
+	}
+	encoded, signature, _ := strings.Cut(value, ".")
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"username":"admin"}`))
+
+	tests := []struct {
+		name    string
+		purpose string
+		value   string
+		err     error
+	}{
+		{"有效签名", "test_purpose", value, nil},
+		{"用途不同", "other_purpose", value, ErrTokenSignature},
+		{"缺少签名", "test_purpose", encoded, ErrTokenSignature},
+		{"篡改数据", "test_purpose", tampered + "." + signature, ErrTokenSignature},
+		{"篡改签名", "test_purpose", encoded + "." + strings.Repeat("A", len(signature)), ErrTokenSignature},
+		{"空值", "test_purpose", "", ErrTokenSignature},
+		{"数据不是base64", "test_purpose", "!!!." + signToken("test_purpose:!!!"), ErrTokenMalformed},
+		{"数据不是JSON", "test_purpose", "bm90LWpzb24." + signToken("test_purpose:bm90LWpzb24"), ErrTokenMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got payload
+			err := decodeSignedValue(tt.purpose, tt.value, &got)
+			if err != tt.err {
+				t.Fatalf("期望错误 %v，实际 %v", tt.err, err)
+			}
+			if tt.err == nil && got.Username != "alice" {
+				t.Fatalf("数据解析错误: %+v", got)
+			}
+		})
+	}
+}
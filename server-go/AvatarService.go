@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"server-env.com/server/models"
+)
+
+var (
+	ErrAvatarTooLarge    = errors.New("头像文件过大")
+	ErrAvatarUnsupported = errors.New("只支持JPEG、PNG、GIF或WebP格式的图片")
+	ErrAvatarInvalid     = errors.New("头像文件不是有效的图片")
+)
+
+// 头像主图边长（像素）和JPEG编码质量
+const (
+	avatarSize        = 512
+	avatarJPEGQuality = 85
+)
+
+var avatarThumbnailSizes = []int{256, 128, 64}
+
+// 按内容哈希命名的头像文件，缩略图在文件名后追加边长
+var avatarFilePattern = regexp.MustCompile(`^([0-9a-f]{32})(?:_(\d+))?\.(jpg|png)$`)
+
+// 上传时允许的图片格式，以文件内容识别的结果为准
+var avatarContentTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// AvatarService 头像处理服务，注册和修改头像共用
+// 上传的图片会被重新编码，原文件中的EXIF等元数据不会被保留
+type AvatarService struct {
+	MaxBytes  int64
+	MaxPixels int
+}
+
+// StoredAvatar 保存后的头像文件键
+type StoredAvatar struct {
+	Key        string
+	Thumbnails map[int]string
+}
+
+// 头像在文件存储中的目录
+const avatarKeyPrefix = "avatars/"
+
+// 旧版本保存头像的目录，相对于工作目录，启动时迁移到文件存储
+var AVATAR_LEGACY_DIR = getEnvOrDefault("AVATAR_LEGACY_DIR", filepath.Join("static", "avatars"))
+
+var avatarService = &AvatarService{
+	MaxBytes:  int64(getEnvIntOrDefault("AVATAR_MAX_BYTES", 5<<20)),
+	MaxPixels: getEnvIntOrDefault("AVATAR_MAX_PIXELS", 25000000),
+}
+
+// Save 校验并处理上传的头像，返回保存后的文件键
+func (s *AvatarService) Save(ctx context.Context, r io.Reader) (*StoredAvatar, error) {
+	data, err := io.ReadAll(io.LimitReader(r, s.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > s.MaxBytes {
+		return nil, ErrAvatarTooLarge
+	}
+
+	src, err := decodeImage(data, s.MaxPixels)
+	if err != nil {
+		return nil, err
+	}
+
+	main := applyOrientation(resizeSquare(src, avatarSize), jpegOrientation(data))
+	opaque := isOpaque(main)
+
+	encoded, ext, err := encodeAvatar(main, opaque)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(encoded)
+	name := hex.EncodeToString(sum[:16])
+
+	stored := &StoredAvatar{
+		Key:        avatarKeyPrefix + name + ext,
+		Thumbnails: map[int]string{},
+	}
+	if err := putBlobIfMissing(ctx, stored.Key, encoded); err != nil {
+		return nil, err
+	}
+
+	for _, size := range avatarThumbnailSizes {
+		thumbnail, _, err := encodeAvatar(resizeSquare(main, size), opaque)
+		if err != nil {
+			return nil, err
+		}
+		key := avatarKeyPrefix + name + "_" + strconv.Itoa(size) + ext
+		if err := putBlobIfMissing(ctx, key, thumbnail); err != nil {
+			return nil, err
+		}
+		stored.Thumbnails[size] = key
+	}
+
+	return stored, nil
+}
+
+// Remove 删除头像及其缩略图，其他用户仍在使用同一文件时保留
+func (s *AvatarService) Remove(ctx context.Context, avatar string) error {
+	key := avatarKey(avatar)
+	if key == "" {
+		return nil
+	}
+
+	var references int64
+	if err := DB.Model(&models.Users{}).Where("avatar = ?", avatar).Count(&references).Error; err != nil {
+		return err
+	}
+	if references > 0 {
+		return nil
+	}
+
+	keys := []string{key}
+	for _, thumbnail := range avatarThumbnails(key) {
+		keys = append(keys, thumbnail)
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if err := blobStore.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// avatarKey 将用户记录中的头像转换为文件键
+// 旧版本保存的是 static/avatars/文件名 形式的相对路径
+func avatarKey(avatar string) string {
+	key := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(avatar), "/"), "static/")
+	if !strings.HasPrefix(key, avatarKeyPrefix) || !ValidBlobKey(key) {
+		return ""
+	}
+	return key
+}
+
+// avatarThumbnails 返回按内容哈希命名的头像对应的缩略图文件键
+// 旧版本保存的头像没有缩略图，返回空
+func avatarThumbnails(key string) map[int]string {
+	thumbnails := map[int]string{}
+	match := avatarFilePattern.FindStringSubmatch(path.Base(key))
+	if match == nil || match[2] != "" {
+		return thumbnails
+	}
+	for _, size := range avatarThumbnailSizes {
+		thumbnails[size] = path.Dir(key) + "/" + match[1] + "_" + strconv.Itoa(size) + "." + match[3]
+	}
+	return thumbnails
+}
+
+// avatarURL 头像的访问地址
+func avatarURL(avatar string) string {
+	return BlobURL(avatarKey(avatar))
+}
+
+// avatarURLs 缩略图的访问地址，键为边长
+func avatarURLs(avatar string) map[string]string {
+	urls := map[string]string{}
+	for size, key := range avatarThumbnails(avatarKey(avatar)) {
+		urls[strconv.Itoa(size)] = BlobURL(key)
+	}
+	return urls
+}
+
+// listLegacyAvatarKeys 列出旧版本按 用户名_时间戳.扩展名 命名的头像文件
+// 旧版本替换头像时不会删除旧文件，注销账户时需要一并清理
+func listLegacyAvatarKeys(ctx context.Context, username string) ([]string, error) {
+	keys, err := blobStore.List(ctx, avatarKeyPrefix+username+"_")
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(username) + `_\d+(\.[^._]*)?$`)
+	result := []string{}
+	for _, key := range keys {
+		if pattern.MatchString(path.Base(key)) {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// migrateLegacyAvatars 将旧版本保存在legacyDir下的头像迁移到文件存储，返回迁移的文件数
+// 旧版本把头像写在工作目录的 static/avatars 下，而本地文件存储以可执行文件所在目录为根，
+// 两者不同时旧头像会找不到。迁移后的文件从旧目录删除，目录就是文件存储的头像目录时跳过
+func migrateLegacyAvatars(ctx context.Context, store BlobStore, legacyDir string) (int, error) {
+	entries, err := os.ReadDir(legacyDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if local, ok := store.(*LocalBlobStore); ok && sameDirectory(legacyDir, filepath.Join(local.Root, "avatars")) {
+		return 0, nil
+	}
+
+	migrated := 0
+	var errs []error
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		key := avatarKeyPrefix + entry.Name()
+		if !ValidBlobKey(key) {
+			errs = append(errs, fmt.Errorf("文件名不合法: %s", entry.Name()))
+			continue
+		}
+		filePath := filepath.Join(legacyDir, entry.Name())
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// 文件存储中已有同名文件时以文件存储中的为准
+		exists, err := store.Exists(ctx, key)
+		if err == nil && !exists {
+			err = store.Put(ctx, key, data, blobContentType(key))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		if err := os.Remove(filePath); err != nil {
+			errs = append(errs, err)
+		}
+		migrated++
+	}
+	return migrated, errors.Join(errs...)
+}
+
+// sameDirectory 判断两个路径是否指向同一个已存在的目录
+// decodeImage 识别并解码上传的图片
+func decodeImage(data []byte, maxPixels int) (image.Image, error) {
+	// 根据文件头识别格式，不信任客户端提供的Content-Type和扩展名
+	format, ok := avatarContentTypes[http.DetectContentType(data)]
+	if !ok {
+		return nil, ErrAvatarUnsupported
+	}
+
+	// 先读取尺寸，防止超大分辨率的图片在解码时耗尽内存
+	config, configFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || configFormat != format {
+		return nil, ErrAvatarInvalid
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return nil, ErrAvatarInvalid
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarInvalid
+	}
+	return src, nil
+}
+
+// reencodeImage 按EXIF方向旋转后重新编码为JPEG或PNG，不保留原文件的元数据
+// GIF只保留第一帧，WebP同样转换格式
+func reencodeImage(data []byte, maxPixels int) ([]byte, string, error) {
+	src, err := decodeImage(data, maxPixels)
+	if err != nil {
+		return nil, "", err
+	}
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	img := applyOrientation(rgba, jpegOrientation(data))
+	return encodeAvatar(img, isOpaque(img))
+}
+
+func sameDirectory(a, b string) bool {
+	statA, errA := os.Stat(a)
+	statB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(statA, statB)
+}
+
+// putBlobIfMissing 写入文件，内容哈希相同的文件已存在时直接复用
+func putBlobIfMissing(ctx context.Context, key string, data []byte) error {
+	exists, err := blobStore.Exists(ctx, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return blobStore.Put(ctx, key, data, blobContentType(key))
+}
+
+// encodeAvatar 不透明图片编码为JPEG，带透明通道的编码为PNG
+func encodeAvatar(img image.Image, opaque bool) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if opaque {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: avatarJPEGQuality}); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), ".jpg", nil
+	}
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), ".png", nil
+}
+
+// resizeSquare 居中裁剪为正方形并缩放到指定边长
+func resizeSquare(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	crop := image.Rect(0, 0, side, side).Add(image.Pt(
+		bounds.Min.X+(bounds.Dx()-side)/2,
+		bounds.Min.Y+(bounds.Dy()-side)/2,
+	))
+
+	if side < size {
+		size = side
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// isOpaque 判断图片是否完全不透明
+func isOpaque(img *image.RGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// jpegOrientation 读取JPEG中EXIF的方向标记，读取失败时返回1（不旋转）
+// 重新编码会丢弃EXIF，需要先按方向标记旋转，否则手机拍摄的照片会显示倒转
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return 1
+		}
+		marker := data[pos+1]
+		// 图像数据开始后不会再有EXIF
+		if marker == 0xda || marker == 0xd9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation 从TIFF结构的IFD0中查找方向标记(0x0112)
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation 按EXIF方向标记旋转或翻转图片
+func applyOrientation(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// avatarErrorMessage 将头像处理错误转换为返回给用户的提示
+func avatarErrorMessage(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrAvatarTooLarge):
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("头像文件不能超过%dMB", avatarService.MaxBytes>>20)
+	case errors.Is(err, ErrAvatarUnsupported), errors.Is(err, ErrAvatarInvalid):
+		return http.StatusBadRequest, err.Error()
+	default:
+		return http.StatusInternalServerError, "头像保存失败"
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+// testAvatarService 使用临时文件存储的头像服务，返回服务和头像目录
+func testAvatarService(t *testing.T) (*AvatarService, string) {
+	t.Helper()
+	dir := setupAvatarDir(t)
+	return &AvatarService{MaxBytes: 5 << 20, MaxPixels: 25000000}, dir
+}
+
+// quadrantImage 左上四分之一为红色，其余为蓝色的图片
+func quadrantImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 && y < height/2 {
+				img.SetRGBA(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.SetRGBA(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	return img
+}
+
+// jpegWithExif 在JPEG的SOI之后插入带方向标记和GPS信息的EXIF段
+func jpegWithExif(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("编码JPEG失败: %v", err)
+	}
+
+	// 小端TIFF头，IFD0中只有一个方向标记
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0, 0x12, 0x01, 3, 0, 1, 0, 0, 0, byte(orientation), 0, 0, 0, 0, 0, 0, 0}
+	tiff = append(tiff, "GPS 39.9042N 116.4074E"...)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("编码PNG失败: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// readBlob 读取文件存储中的文件
+func readBlob(t *testing.T, key string) []byte {
+	t.Helper()
+	reader, _, err := blobStore.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("读取 %s 失败: %v", key, err)
+	}
+	defer reader.Close()
+	data, _ := io.ReadAll(reader)
+	return data
+}
+
+func decodeBlob(t *testing.T, key string) image.Image {
+	t.Helper()
+	data := readBlob(t, key)
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("解码 %s 失败: %v", key, err)
+	}
+	return img
+}
+
+func isReddish(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xc000 && g < 0x4000 && b < 0x4000
+}
+
+func TestAvatarSaveStripsMetadataAndAppliesOrientation(t *testing.T) {
+	service, _ := testAvatarService(t)
+	upload := jpegWithExif(t, quadrantImage(64, 64), 6)
+	if jpegOrientation(upload) != 6 {
+		t.Fatal("测试图片的方向标记应为6")
+	}
+
+	stored, err := service.Save(context.Background(), bytes.NewReader(upload))
+	if err != nil {
+		t.Fatalf("保存头像失败: %v", err)
+	}
+	if path.Ext(stored.Key) != ".jpg" {
+		t.Fatalf("不透明图片应保存为JPEG，实际 %s", stored.Key)
+	}
+
+	data := readBlob(t, stored.Key)
+	if bytes.Contains(data, []byte("Exif")) || bytes.Contains(data, []byte("GPS")) {
+		t.Fatal("保存的头像不应保留EXIF信息")
+	}
+
+	// 方向6表示顺时针旋转90度，左上角的红色应转到右上角
+	img := decodeBlob(t, stored.Key)
+	if !isReddish(img.At(48, 16)) {
+		t.Fatalf("旋转后右上角应为红色，实际 %v", img.At(48, 16))
+	}
+	if isReddish(img.At(16, 16)) {
+		t.Fatalf("旋转后左上角不应为红色，实际 %v", img.At(16, 16))
+	}
+}
+
+func TestStoreUploadedImageReencodes(t *testing.T) {
+	setupAvatarDir(t)
+	ctx := context.Background()
+
+	// 聊天上传的图片同样去掉EXIF并按方向旋转，分辨率不变
+	key, err := storeUploadedImage(ctx, jpegWithExif(t, quadrantImage(64, 32), 6))
+	if err != nil {
+		t.Fatalf("保存上传图片失败: %v", err)
+	}
+	if path.Ext(key) != ".jpg" {
+		t.Fatalf("JPEG应保存为JPEG，实际 %s", key)
+	}
+	data := readBlob(t, key)
+	if bytes.Contains(data, []byte("Exif")) || bytes.Contains(data, []byte("GPS")) {
+		t.Fatal("保存的图片不应保留EXIF信息")
+	}
+	if bounds := decodeBlob(t, key).Bounds(); bounds.Dx() != 32 || bounds.Dy() != 64 {
+		t.Fatalf("旋转后尺寸应为32x64，实际 %v", bounds)
+	}
+
+	// GIF转换为PNG或JPEG保存
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, quadrantImage(16, 16), nil); err != nil {
+		t.Fatalf("编码GIF失败: %v", err)
+	}
+	key, err = storeUploadedImage(ctx, buf.Bytes())
+	if err != nil {
+		t.Fatalf("保存GIF失败: %v", err)
+	}
+	if ext := path.Ext(key); ext != ".jpg" && ext != ".png" {
+		t.Fatalf("GIF应转换格式保存，实际 %s", key)
+	}
+
+	// 不是图片时不保存，损坏的图片返回错误
+	if key, err := storeUploadedImage(ctx, []byte("plain text")); key != "" || err != nil {
+		t.Fatalf("非图片不应保存: %q %v", key, err)
+	}
+	if _, err := storeUploadedImage(ctx, []byte("\x89PNG\r\n\x1a\nbroken")); !errors.Is(err, ErrAvatarInvalid) {
+		t.Fatalf("损坏的图片应返回ErrAvatarInvalid，实际 %v", err)
+	}
+}
+
+func TestAvatarSaveThumbnails(t *testing.T) {
+	service, _ := testAvatarService(t)
+
+	stored, err := service.Save(context.Background(), bytes.NewReader(encodePNG(t, quadrantImage(600, 400))))
+	if err != nil {
+		t.Fatalf("保存头像失败: %v", err)
+	}
+
+	// 主图居中裁剪为正方形，且不会放大
+	if bounds := decodeBlob(t, stored.Key).Bounds(); bounds.Dx() != 400 || bounds.Dy() != 400 {
+		t.Fatalf("主图应为400x400，实际 %v", bounds)
+	}
+	if len(stored.Thumbnails) != len(avatarThumbnailSizes) {
+		t.Fatalf("应生成 %d 张缩略图，实际 %d", len(avatarThumbnailSizes), len(stored.Thumbnails))
+	}
+	for _, size := range avatarThumbnailSizes {
+		key := stored.Thumbnails[size]
+		if key != avatarThumbnails(stored.Key)[size] {
+			t.Fatalf("缩略图 %d 的文件键应可由主图文件键推出，实际 %s", size, key)
+		}
+		if bounds := decodeBlob(t, key).Bounds(); bounds.Dx() != size || bounds.Dy() != size {
+			t.Fatalf("缩略图应为 %dx%d，实际 %v", size, size, bounds)
+		}
+	}
+}
+
+func TestAvatarSaveKeepsTransparency(t *testing.T) {
+	service, _ := testAvatarService(t)
+	img := quadrantImage(32, 32)
+	img.SetRGBA(0, 0, color.RGBA{})
+
+	stored, err := service.Save(context.Background(), bytes.NewReader(encodePNG(t, img)))
+	if err != nil {
+		t.Fatalf("保存头像失败: %v", err)
+	}
+	if path.Ext(stored.Key) != ".png" {
+		t.Fatalf("带透明通道的图片应保存为PNG，实际 %s", stored.Key)
+	}
+}
+
+func TestAvatarSaveDeduplicatesByContent(t *testing.T) {
+	service, dir := testAvatarService(t)
+	upload := encodePNG(t, quadrantImage(32, 32))
+
+	first, err := service.Save(context.Background(), bytes.NewReader(upload))
+	if err != nil {
+		t.Fatalf("保存头像失败: %v", err)
+	}
+	second, err := service.Save(context.Background(), bytes.NewReader(upload))
+	if err != nil {
+		t.Fatalf("保存头像失败: %v", err)
+	}
+	if first.Key != second.Key {
+		t.Fatalf("相同内容应复用同一文件: %s != %s", first.Key, second.Key)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1+len(avatarThumbnailSizes) {
+		t.Fatalf("目录中应只有一份头像和缩略图，实际 %d 个文件", len(entries))
+	}
+}
+
+func TestAvatarSaveRejectsInvalidUploads(t *testing.T) {
+	valid := encodePNG(t, quadrantImage(32, 32))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		service func(*AvatarService)
+		want    error
+	}{
+		{name: "文本文件", data: []byte("not an image at all"), want: ErrAvatarUnsupported},
+		{name: "SVG", data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), want: ErrAvatarUnsupported},
+		{name: "损坏的PNG", data: append([]byte{}, valid[:40]...), want: ErrAvatarInvalid},
+		{name: "文件过大", data: valid, service: func(s *AvatarService) { s.MaxBytes = int64(len(valid) - 1) }, want: ErrAvatarTooLarge},
+		{name: "像素过多", data: valid, service: func(s *AvatarService) { s.MaxPixels = 32*32 - 1 }, want: ErrAvatarInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service, dir := testAvatarService(t)
+			if tt.service != nil {
+				tt.service(service)
+			}
+			if _, err := service.Save(context.Background(), bytes.NewReader(tt.data)); !errors.Is(err, tt.want) {
+				t.Fatalf("应返回 %v，实际 %v", tt.want, err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Fatalf("被拒绝的上传不应写入文件，实际 %d 个", len(entries))
+			}
+		})
+	}
+}
+
+func TestAvatarRemoveKeepsSharedFiles(t *testing.T) {
+	setupTestDB(t)
+	service, dir := testAvatarService(t)
+	ctx := context.Background()
+
+	stored, err := service.Save(ctx, bytes.NewReader(encodePNG(t, quadrantImage(32, 32))))
+	if err != nil {
+		t.Fatalf("保存头像失败: %v", err)
+	}
+	createTestUser(t, models.Users{Username: "tom", Avatar: stored.Key}, "")
+
+	// 仍有用户引用时不删除
+	if err := service.Remove(ctx, stored.Key); err != nil {
+		t.Fatalf("删除头像失败: %v", err)
+	}
+	if exists, _ := blobStore.Exists(ctx, stored.Key); !exists {
+		t.Fatal("仍被引用的头像不应被删除")
+	}
+
+	DB.Model(&models.Users{}).Where("username = ?", "tom").Update("avatar", "")
+	if err := service.Remove(ctx, stored.Key); err != nil {
+		t.Fatalf("删除头像失败: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("头像及缩略图应全部删除，实际剩余 %d 个文件", len(entries))
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// 存储后端：local 或 s3
+	BLOB_STORE     = getEnvOrDefault("BLOB_STORE", "local")
+	BLOB_LOCAL_DIR = os.Getenv("BLOB_LOCAL_DIR")
+	// 大于0时公开文件的访问地址也需要签名，单位为秒
+	BLOB_SIGNED_URL_TTL = time.Duration(getEnvIntOrDefault("BLOB_SIGNED_URL_TTL", 0)) * time.Second
+)
+
+// 未开启签名时，非公开文件的访问地址有效期
+const privateBlobURLTTL = time.Hour
+
+// 文件访问路由前缀
+const blobRoutePrefix = "/files/"
+
+var ErrBlobNotFound = errors.New("文件不存在")
+
+// 文件键只允许由字母(含中文等Unicode字母)、数字、_、-和.组成的相对路径
+// 每段不能以.开头，因此不会出现 .. 等跳出存储目录的写法，也不允许控制字符和反斜杠
+var blobKeyPattern = regexp.MustCompile(`^[\p{L}\p{N}_\-][\p{L}\p{M}\p{N}_\-]*(/[\p{L}\p{N}_\-][\p{L}\p{M}\p{N}_.\-]*)*$`)
+
+// 无需签名即可访问的文件前缀
+var publicBlobPrefixes = []string{"avatars/"}
+
+// BlobInfo 文件元信息
+type BlobInfo struct {
+	Size        int64
+	ContentType string
+	ETag        string
+	ModTime     time.Time
+}
+
+// BlobStore 文件存储接口，键使用/分隔的相对路径
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, key string) error
+	// List 列出以prefix开头的全部文件键
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// 全局文件存储，在main中根据环境变量初始化
+var blobStore BlobStore
+
+// NewBlobStoreFromEnv 根据环境变量创建文件存储
+func NewBlobStoreFromEnv() (BlobStore, error) {
+	switch BLOB_STORE {
+	case "local":
+		root := BLOB_LOCAL_DIR
+		if root == "" {
+			root = staticDir
+		}
+		return &LocalBlobStore{Root: root}, nil
+	case "s3":
+		return NewS3BlobStoreFromEnv()
+	default:
+		return nil, fmt.Errorf("不支持的 BLOB_STORE: %s", BLOB_STORE)
+	}
+}
+
+// ValidBlobKey 判断文件键是否合法
+func ValidBlobKey(key string) bool {
+	return blobKeyPattern.MatchString(key) && path.Clean(key) == key
+}
+
+// blobContentType 根据扩展名推断文件类型
+func blobContentType(key string) string {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// LocalBlobStore 本地文件系统存储
+type LocalBlobStore struct {
+	Root string
+}
+
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if !ValidBlobKey(key) {
+		return "", fmt.Errorf("文件键不合法: %s", key)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	// 先写临时文件再重命名，读取方不会看到写了一半的文件
+	// 每次写入使用不同的临时文件，同时写入同一个键时互不影响
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if stat.IsDir() {
+		file.Close()
+		return nil, nil, ErrBlobNotFound
+	}
+	return file, &BlobInfo{
+		Size:        stat.Size(),
+		ContentType: blobContentType(key),
+		ETag:        fmt.Sprintf(`"%x-%x"`, stat.ModTime().UnixNano(), stat.Size()),
+		ModTime:     stat.ModTime(),
+	}, nil
+}
+
+func (s *LocalBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	filePath, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !stat.IsDir(), nil
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	filePath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	dir := path.Dir(prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir = strings.TrimSuffix(prefix, "/")
+	}
+	if !ValidBlobKey(dir) {
+		return nil, fmt.Errorf("文件前缀不合法: %s", prefix)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.Root, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, entry := range entries {
+		key := dir + "/" + entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(key, prefix) && !strings.HasSuffix(key, ".tmp") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// isPublicBlob 判断文件是否无需签名即可访问
+func isPublicBlob(key string) bool {
+	for _, prefix := range publicBlobPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// signBlobURL 计算文件访问地址的签名
+func signBlobURL(key string, expires int64) string {
+	return signToken("blob:" + key + ":" + strconv.FormatInt(expires, 10))
+}
+
+// BlobURL 返回文件的访问地址，需要签名时附带过期时间和签名
+func BlobURL(key string) string {
+	if key == "" {
+		return ""
+	}
+
+	ttl := BLOB_SIGNED_URL_TTL
+	if ttl <= 0 {
+		if isPublicBlob(key) {
+			return blobRoutePrefix + escapeBlobKey(key)
+		}
+		ttl = privateBlobURLTTL
+	}
+
+	// 过期时间按有效期取整，同一时间窗口内地址不变，便于浏览器缓存
+	expires := time.Now().Truncate(ttl).Add(2 * ttl).Unix()
+	query := url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {signBlobURL(key, expires)},
+	}
+	return blobRoutePrefix + escapeBlobKey(key) + "?" + query.Encode()
+}
+
+// escapeBlobKey 对文件键的每一段做URL编码，中文文件名也能放进访问地址
+func escapeBlobKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// verifyBlobURL 校验文件访问地址的签名和有效期
+func verifyBlobURL(c *gin.Context, key string) bool {
+	if BLOB_SIGNED_URL_TTL <= 0 && isPublicBlob(key) {
+		return true
+	}
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(signBlobURL(key, expires)), []byte(c.Query("sig")))
+}
+
+// ServeBlob 通过文件存储提供文件访问
+func ServeBlob(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if !ValidBlobKey(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrBlobNotFound.Error()})
+		return
+	}
+
+	if !verifyBlobURL(c, key) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "访问地址无效或已过期"})
+		return
+	}
+
+	reader, info, err := blobStore.Get(c.Request.Context(), key)
+	if err == ErrBlobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrBlobNotFound.Error()})
+		return
+	} else if err != nil {
+		fmt.Println("读取文件失败:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取文件失败"})
+		return
+	}
+	defer reader.Close()
+
+	// 文件按内容哈希命名，内容不会变化，可以长期缓存
+	if BLOB_SIGNED_URL_TTL <= 0 && isPublicBlob(key) {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "private, max-age=3600")
+	}
+	if info.ETag != "" {
+		c.Header("ETag", info.ETag)
+		if c.GetHeader("If-None-Match") == info.ETag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.DataFromReader(http.StatusOK, info.Size, info.ContentType, reader, nil)
+}
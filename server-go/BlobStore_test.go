@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestValidBlobKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"avatars/0123456789abcdef0123456789abcdef.jpg", true},
+		{"avatars/张三_1700000000.jpg", true},
+		{"uploads/farmer/2024/leaf-1.png", true},
+		{"avatars/José_1.png", true},
+		{"", false},
+		{"avatars/", false},
+		{"/avatars/a.jpg", false},
+		{"avatars/../secret", false},
+		{"avatars/..", false},
+		{"avatars/.hidden", false},
+		{"avatars//a.jpg", false},
+		{`avatars\..\secret`, false},
+		{"avatars/a\x00.jpg", false},
+		{"avatars/a\n.jpg", false},
+		{"avatars/a b.jpg", false},
+	}
+	for _, tt := range tests {
+		if got := ValidBlobKey(tt.key); got != tt.valid {
+			t.Errorf("ValidBlobKey(%q) = %v，期望 %v", tt.key, got, tt.valid)
+		}
+	}
+}
+
+func TestBlobURLEscapesKey(t *testing.T) {
+	if got := BlobURL("avatars/张三_1.jpg"); got != "/files/avatars/%E5%BC%A0%E4%B8%89_1.jpg" {
+		t.Fatalf("访问地址未编码: %s", got)
+	}
+}
+
+func TestMigrateLegacyAvatars(t *testing.T) {
+	legacyDir := t.TempDir()
+	store := &LocalBlobStore{Root: t.TempDir()}
+	ctx := context.Background()
+
+	os.WriteFile(filepath.Join(legacyDir, "张三_1700000000.jpg"), []byte("legacy"), 0644)
+	os.WriteFile(filepath.Join(legacyDir, "李四_1700000000.jpg"), []byte("legacy"), 0644)
+	store.Put(ctx, "avatars/李四_1700000000.jpg", []byte("current"), "image/jpeg")
+
+	migrated, err := migrateLegacyAvatars(ctx, store, legacyDir)
+	if err != nil || migrated != 2 {
+		t.Fatalf("迁移结果 %d %v", migrated, err)
+	}
+
+	previous := blobStore
+	blobStore = store
+	t.Cleanup(func() { blobStore = previous })
+	keys, _ := listLegacyAvatarKeys(ctx, "张三")
+	if len(keys) != 1 {
+		t.Fatalf("迁移后应能按用户名找到旧头像，实际 %v", keys)
+	}
+	data, _ := os.ReadFile(filepath.Join(store.Root, "avatars", "李四_1700000000.jpg"))
+	if string(data) != "current" {
+		t.Fatal("文件存储中已有的文件不应被覆盖")
+	}
+	if entries, _ := os.ReadDir(legacyDir); len(entries) != 0 {
+		t.Fatalf("迁移后的文件应从旧目录删除，剩余 %d 个", len(entries))
+	}
+
+	// 旧目录就是文件存储的头像目录时不做任何处理
+	migrated, err = migrateLegacyAvatars(ctx, store, filepath.Join(store.Root, "avatars"))
+	if err != nil || migrated != 0 {
+		t.Fatalf("同一目录不应迁移，实际 %d %v", migrated, err)
+	}
+}
+
+func TestLocalBlobStoreConcurrentPut(t *testing.T) {
+	store := &LocalBlobStore{Root: t.TempDir()}
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("x"), 1<<16)
+
+	// 并发写入同一个键不能互相覆盖临时文件
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.Put(ctx, "uploads/same.png", data, "image/png")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("并发写入失败: %v", err)
+		}
+	}
+
+	reader, _, err := store.Get(ctx, "uploads/same.png")
+	if err != nil {
+		t.Fatalf("读取失败: %v", err)
+	}
+	defer reader.Close()
+	got, _ := io.ReadAll(reader)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("文件内容不完整，长度 %d", len(got))
+	}
+	entries, _ := os.ReadDir(filepath.Join(store.Root, "uploads"))
+	if len(entries) != 1 {
+		t.Fatalf("不应留下临时文件，实际 %d 个文件", len(entries))
+	}
+}
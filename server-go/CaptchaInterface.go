@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"server-env.com/server/models"
+)
+
+var (
+	// 图形验证码存储方式: memory(单实例) 或 db(多实例共享)，默认与登录失败计数一致
+	CAPTCHA_STORE = getEnvOrDefault("CAPTCHA_STORE", LOGIN_ATTEMPT_STORE)
+	// 图形验证码有效期(秒)
+	CAPTCHA_TTL = time.Duration(getEnvIntOrDefault("CAPTCHA_TTL", 300)) * time.Second
+	// 登录失败达到该次数后要求填写图形验证码，0表示每次登录都需要
+	LOGIN_CAPTCHA_AFTER = getEnvIntOrDefault("LOGIN_CAPTCHA_AFTER", 3)
+)
+
+var captchaStore = NewCaptchaStore(CAPTCHA_STORE)
+
+const (
+	// 去掉了容易混淆的 0/O、1/I/L
+	captchaAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	captchaLength   = 5
+	captchaWidth    = 160
+	captchaHeight   = 60
+)
+
+var (
+	ErrCaptchaRequired = errors.New("请输入图形验证码")
+	ErrCaptchaInvalid  = errors.New("图形验证码错误或已过期")
+	ErrCaptchaBusy     = errors.New("验证码服务繁忙，请稍后再试")
+)
+
+// CaptchaChallenge 是存储中保存的一个验证码
+type CaptchaChallenge struct {
+	AnswerHash string
+	ExpiresAt  time.Time
+}
+
+// CaptchaStore 图形验证码答案的存储接口
+type CaptchaStore interface {
+	// Save 保存验证码答案的哈希
+	Save(id string, challenge CaptchaChallenge) error
+	// Take 取出并删除验证码，同一个验证码只能被取出一次，不存在时返回false
+	Take(id string) (CaptchaChallenge, bool, error)
+}
+
+// NewCaptchaStore 按名称创建图形验证码存储
+func NewCaptchaStore(kind string) CaptchaStore {
+	switch kind {
+	case "db":
+		return &DBCaptchaStore{}
+	case "memory":
+		return NewMemoryCaptchaStore()
+	default:
+		fmt.Printf("未知的 CAPTCHA_STORE=%s，使用内存存储\n", kind)
+		return NewMemoryCaptchaStore()
+	}
+}
+
+// MemoryCaptchaStore 进程内的图形验证码存储，仅适用于单实例部署
+type MemoryCaptchaStore struct {
+	mu         sync.Mutex
+	challenges map[string]CaptchaChallenge
+}
+
+const (
+	// 内存存储超过该数量时清理过期验证码
+	memoryCaptchaSweepSize = 10000
+	// 清理后仍超过该数量时拒绝生成新验证码，防止刷接口耗尽内存
+	memoryCaptchaMaxSize = 100000
+)
+
+func NewMemoryCaptchaStore() *MemoryCaptchaStore {
+	return &MemoryCaptchaStore{challenges: make(map[string]CaptchaChallenge)}
+}
+
+func (s *MemoryCaptchaStore) Save(id string, challenge CaptchaChallenge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.challenges) >= memoryCaptchaSweepSize {
+		now := time.Now()
+		for k, c := range s.challenges {
+			if now.After(c.ExpiresAt) {
+				delete(s.challenges, k)
+			}
+		}
+	}
+	if len(s.challenges) >= memoryCaptchaMaxSize {
+		return ErrCaptchaBusy
+	}
+
+	s.challenges[id] = challenge
+	return nil
+}
+
+func (s *MemoryCaptchaStore) Take(id string) (CaptchaChallenge, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.challenges[id]
+	delete(s.challenges, id)
+	return challenge, ok, nil
+}
+
+// DBCaptchaStore 基于数据库的图形验证码存储，多实例共享
+type DBCaptchaStore struct{}
+
+func (s *DBCaptchaStore) Save(id string, challenge CaptchaChallenge) error {
+	// 顺便清理已过期的验证码
+	if err := DB.Where("expires_at < ?", time.Now()).Delete(&models.CaptchaChallenges{}).Error; err != nil {
+		return err
+	}
+	return DB.Create(&models.CaptchaChallenges{
+		ID:         id,
+		AnswerHash: challenge.AnswerHash,
+		ExpiresAt:  challenge.ExpiresAt,
+	}).Error
+}
+
+func (s *DBCaptchaStore) Take(id string) (CaptchaChallenge, bool, error) {
+	var record models.CaptchaChallenges
+	result := DB.Where("id = ?", id).Limit(1).Find(&record)
+	if result.Error != nil {
+		return CaptchaChallenge{}, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return CaptchaChallenge{}, false, nil
+	}
+
+	// 并发校验同一个验证码时只有删除成功的一方有效
+	result = DB.Where("id = ?", id).Delete(&models.CaptchaChallenges{})
+	if result.Error != nil {
+		return CaptchaChallenge{}, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return CaptchaChallenge{}, false, nil
+	}
+	return CaptchaChallenge{AnswerHash: record.AnswerHash, ExpiresAt: record.ExpiresAt}, true, nil
+}
+
+// hashCaptchaAnswer 计算验证码答案的哈希，答案不区分大小写
+func hashCaptchaAnswer(id, answer string) string {
+	sum := sha256.Sum256([]byte(id + ":" + strings.ToUpper(strings.TrimSpace(answer))))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyCaptcha 校验图形验证码，无论结果如何验证码都会失效
+func VerifyCaptcha(id, answer string) error {
+	if id == "" || strings.TrimSpace(answer) == "" {
+		return ErrCaptchaRequired
+	}
+	challenge, ok, err := captchaStore.Take(id)
+	if err != nil {
+		return err
+	}
+	if !ok || time.Now().After(challenge.ExpiresAt) {
+		return ErrCaptchaInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashCaptchaAnswer(id, answer)), []byte(challenge.AnswerHash)) != 1 {
+		return ErrCaptchaInvalid
+	}
+	return nil
+}
+
+// captchaErrorResponse 将验证码校验错误转换为响应，返回false表示已写入响应
+func captchaErrorResponse(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case ErrCaptchaRequired, ErrCaptchaInvalid:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "captcha_required": true})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+	}
+	return false
+}
+
+// loginCaptchaRequired 判断本次登录是否需要图形验证码
+func loginCaptchaRequired(username, ip string) (bool, error) {
+	if LOGIN_CAPTCHA_AFTER <= 0 {
+		return true, nil
+	}
+	failures, err := loginGuard.Failures(username, ip)
+	if err != nil {
+		return false, err
+	}
+	return failures >= LOGIN_CAPTCHA_AFTER, nil
+}
+
+// captchaSeed 为绘制干扰元素生成随机种子
+func captchaSeed() int64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+	var seed int64
+	for _, v := range b {
+		seed = seed<<8 | int64(v)
+	}
+	return seed
+}
+
+// renderCaptcha 绘制验证码图片：字符随机缩放、旋转并整体做正弦扭曲，叠加干扰线和噪点
+func renderCaptcha(text string) ([]byte, error) {
+	rnd := mathrand.New(mathrand.NewSource(captchaSeed()))
+	img := image.NewRGBA(image.Rect(0, 0, captchaWidth, captchaHeight))
+	background := color.RGBA{uint8(225 + rnd.Intn(30)), uint8(225 + rnd.Intn(30)), uint8(225 + rnd.Intn(30)), 255}
+	draw.Draw(img, img.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+
+	randomDark := func() color.RGBA {
+		return color.RGBA{uint8(rnd.Intn(120)), uint8(rnd.Intn(120)), uint8(rnd.Intn(120)), 255}
+	}
+
+	// 背景噪点
+	for i := 0; i < captchaWidth*captchaHeight/12; i++ {
+		shade := uint8(120 + rnd.Intn(100))
+		img.Set(rnd.Intn(captchaWidth), rnd.Intn(captchaHeight), color.RGBA{shade, shade, shade, 255})
+	}
+
+	// 整体正弦扭曲的参数
+	amplitude := 2 + rnd.Float64()*2
+	period := 40 + rnd.Float64()*30
+	phase := rnd.Float64() * 2 * math.Pi
+
+	face := basicfont.Face7x13
+	glyphWidth, glyphHeight := face.Advance, face.Height
+	slot := float64(captchaWidth-20) / float64(len(text))
+	for i, ch := range text {
+		// 先把字符画到小尺寸的蒙版上
+		mask := image.NewAlpha(image.Rect(0, 0, glyphWidth, glyphHeight))
+		drawer := font.Drawer{Dst: mask, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+		drawer.DrawString(string(ch))
+
+		scale := 2.9 + rnd.Float64()*0.6
+		angle := (rnd.Float64() - 0.5) * 0.7
+		cx := 10 + slot*(float64(i)+0.5) + (rnd.Float64()-0.5)*6
+		cy := float64(captchaHeight)/2 + (rnd.Float64()-0.5)*8
+		sin, cos := math.Sin(angle), math.Cos(angle)
+		ink := randomDark()
+
+		// 反向映射目标像素到蒙版坐标，落在字形内的像素着色
+		radius := int(scale * float64(glyphHeight) * 0.75)
+		for y := int(cy) - radius; y <= int(cy)+radius; y++ {
+			for x := int(cx) - radius; x <= int(cx)+radius; x++ {
+				if x < 0 || y < 0 || x >= captchaWidth || y >= captchaHeight {
+					continue
+				}
+				dy := float64(y) - cy + amplitude*math.Sin(float64(x)/period*2*math.Pi+phase)
+				dx := float64(x) - cx
+				sx := (dx*cos+dy*sin)/scale + float64(glyphWidth)/2
+				sy := (-dx*sin+dy*cos)/scale + float64(glyphHeight)/2
+				if sx < 0 || sy < 0 || sx >= float64(glyphWidth) || sy >= float64(glyphHeight) {
+					continue
+				}
+				if mask.AlphaAt(int(sx), int(sy)).A > 0 {
+					img.Set(x, y, ink)
+				}
+			}
+		}
+	}
+
+	// 穿过字符的干扰曲线
+	for i := 0; i < 3; i++ {
+		ink := randomDark()
+		baseline := float64(captchaHeight)*0.25 + rnd.Float64()*float64(captchaHeight)*0.5
+		lineAmplitude := 4 + rnd.Float64()*8
+		linePeriod := 50 + rnd.Float64()*80
+		linePhase := rnd.Float64() * 2 * math.Pi
+		for x := 0; x < captchaWidth; x++ {
+			y := int(baseline + lineAmplitude*math.Sin(float64(x)/linePeriod*2*math.Pi+linePhase))
+			img.Set(x, y, ink)
+			img.Set(x, y+1, ink)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewCaptcha 生成图形验证码，返回验证码ID和PNG图片
+// 注册时必须提交，登录失败次数过多后也需要提交
+func NewCaptcha(c *gin.Context) {
+	id, err := randomString(captchaAlphabet, 32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证码生成失败"})
+		return
+	}
+	answer, err := randomString(captchaAlphabet, captchaLength)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证码生成失败"})
+		return
+	}
+	picture, err := renderCaptcha(answer)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "验证码生成失败"})
+		return
+	}
+
+	err = captchaStore.Save(id, CaptchaChallenge{
+		AnswerHash: hashCaptchaAnswer(id, answer),
+		ExpiresAt:  time.Now().Add(CAPTCHA_TTL),
+	})
+	if err == ErrCaptchaBusy {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"captcha_id": id,
+		"image":      "data:image/png;base64," + base64.StdEncoding.EncodeToString(picture),
+		"expires_in": int(CAPTCHA_TTL.Seconds()),
+	})
+}
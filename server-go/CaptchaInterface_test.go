@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"server-env.com/server/models"
+)
+
+// registerRequest 以表单方式提交注册请求
+func registerRequest(t *testing.T, router http.Handler, fields map[string]string) (int, map[string]any) {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	writer.Close()
+
+	w := performRequest(router, http.MethodPost, "/api/user/register", buf.String(), map[string]string{"Content-Type": writer.FormDataContentType()})
+	var body map[string]any
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func TestNewCaptcha(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+
+	w := performRequest(router, http.MethodGet, "/api/captcha", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("生成验证码失败: %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatal("验证码响应不应被缓存")
+	}
+	var resp struct {
+		CaptchaID string `json:"captcha_id"`
+		Image     string `json:"image"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(resp.Image, "data:image/png;base64,"))
+	if err != nil {
+		t.Fatalf("验证码图片不是base64: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("验证码图片不是PNG: %v", err)
+	}
+	if img.Bounds().Dx() != captchaWidth || img.Bounds().Dy() != captchaHeight {
+		t.Fatalf("验证码图片尺寸错误: %v", img.Bounds())
+	}
+
+	// 答案只保存哈希，猜错一次后验证码立即失效
+	if err := VerifyCaptcha(resp.CaptchaID, "WRONG"); err != ErrCaptchaInvalid {
+		t.Fatalf("答案错误应返回 ErrCaptchaInvalid，实际 %v", err)
+	}
+	if _, ok, _ := captchaStore.Take(resp.CaptchaID); ok {
+		t.Fatal("校验失败后验证码应被删除")
+	}
+}
+
+func TestVerifyCaptcha(t *testing.T) {
+	for _, kind := range []string{"memory", "db"} {
+		t.Run(kind, func(t *testing.T) {
+			setupTestDB(t)
+			previous := captchaStore
+			captchaStore = NewCaptchaStore(kind)
+			t.Cleanup(func() { captchaStore = previous })
+
+			if err := VerifyCaptcha("", "ABCDE"); err != ErrCaptchaRequired {
+				t.Fatalf("缺少验证码应返回 ErrCaptchaRequired，实际 %v", err)
+			}
+			if err := VerifyCaptcha("unknown", "ABCDE"); err != ErrCaptchaInvalid {
+				t.Fatalf("验证码不存在应返回 ErrCaptchaInvalid，实际 %v", err)
+			}
+
+			// 答案不区分大小写，同一个验证码只能使用一次
+			createTestCaptcha(t, "captcha-1", "ABCDE")
+			if err := VerifyCaptcha("captcha-1", " abcde "); err != nil {
+				t.Fatalf("答案正确应校验通过，实际 %v", err)
+			}
+			if err := VerifyCaptcha("captcha-1", "ABCDE"); err != ErrCaptchaInvalid {
+				t.Fatalf("重复使用验证码应返回 ErrCaptchaInvalid，实际 %v", err)
+			}
+
+			captchaStore.Save("captcha-2", CaptchaChallenge{
+				AnswerHash: hashCaptchaAnswer("captcha-2", "ABCDE"),
+				ExpiresAt:  time.Now().Add(-time.Second),
+			})
+			if err := VerifyCaptcha("captcha-2", "ABCDE"); err != ErrCaptchaInvalid {
+				t.Fatalf("过期的验证码应返回 ErrCaptchaInvalid，实际 %v", err)
+			}
+		})
+	}
+}
+
+func TestRegisterRequiresCaptcha(t *testing.T) {
+	setupTestDB(t)
+	setupAvatarDir(t)
+	router := newTestRouter()
+	fields := map[string]string{"username": "nora", "password": "Corn-Harvest-2024"}
+
+	code, body := registerRequest(t, router, fields)
+	if code != http.StatusBadRequest || body["captcha_required"] != true {
+		t.Fatalf("缺少验证码时应返回400 captcha_required，实际 %d %v", code, body)
+	}
+
+	createTestCaptcha(t, "captcha-1", "ABCDE")
+	fields["captcha_id"], fields["captcha_answer"] = "captcha-1", "ABCDX"
+	if code, body := registerRequest(t, router, fields); code != http.StatusBadRequest || body["captcha_required"] != true {
+		t.Fatalf("验证码错误时应返回400 captcha_required，实际 %d %v", code, body)
+	}
+
+	createTestCaptcha(t, "captcha-2", "ABCDE")
+	fields["captcha_id"], fields["captcha_answer"] = "captcha-2", "ABCDE"
+	if code, body := registerRequest(t, router, fields); code != http.StatusOK {
+		t.Fatalf("注册失败: %d %v", code, body)
+	}
+}
+
+func TestLoginCaptchaAfterFailures(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "otto"}, "Otto-Passw0rd")
+	// 不测试登录延迟，把延迟阈值调到验证码阈值之后
+	loginGuard.DelayAfter = LOGIN_CAPTCHA_AFTER + 1
+
+	login := func(body string) (int, map[string]any) {
+		w := performRequest(router, http.MethodPost, "/api/user/login", body, nil)
+		var resp map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	for i := 1; i <= LOGIN_CAPTCHA_AFTER; i++ {
+		code, body := login(`{"username":"otto","password":"wrong"}`)
+		if code != http.StatusUnauthorized {
+			t.Fatalf("第%d次密码错误应返回401，实际 %d", i, code)
+		}
+		// 达到阈值的那次失败提前告知前端
+		if (body["captcha_required"] == true) != (i == LOGIN_CAPTCHA_AFTER) {
+			t.Fatalf("第%d次失败 captcha_required 错误: %v", i, body)
+		}
+	}
+
+	// 达到阈值后即使密码正确也需要验证码
+	if code, body := login(`{"username":"otto","password":"Otto-Passw0rd"}`); code != http.StatusBadRequest || body["captcha_required"] != true {
+		t.Fatalf("缺少验证码时应返回400 captcha_required，实际 %d %v", code, body)
+	}
+
+	createTestCaptcha(t, "captcha-1", "ABCDE")
+	code, body := login(`{"username":"otto","password":"Otto-Passw0rd","captcha_id":"captcha-1","captcha_answer":"ABCDE"}`)
+	if code != http.StatusOK || body["access_token"] == nil {
+		t.Fatalf("验证码正确时应登录成功，实际 %d %v", code, body)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 聊天后端：dify、openai(兼容OpenAI chat completions的服务) 或 fake(开发测试用)
+var CHAT_BACKEND = getEnvOrDefault("CHAT_BACKEND", "dify")
+
+// ChatBackendRequest 是发给聊天后端的一次提问
+type ChatBackendRequest struct {
+	Username       string
+	Query          string
+	ConversationID string
+	FileIDs        []string
+}
+
+// ChatStreamEvent 是聊天后端产生的一条事件
+// Type 为聊天协议的事件类型，Data 为对应的事件数据，原样写给前端
+type ChatStreamEvent struct {
+	Type string
+	Data any
+	// 事件所属的对话、消息和任务，后端尚未得知时为空
+	ConversationID string
+	MessageID      string
+	TaskID         string
+}
+
+// terminal 判断事件是否结束本次回答
+func (e ChatStreamEvent) terminal() bool {
+	return e.Type == ChatEventMessageEnd || e.Type == ChatEventError
+}
+
+// ChatConversation 是会话列表中的一项，时间为Unix秒
+type ChatConversation struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"created_at"`
+	UpdatedAt int64  `json:"updated_at"`
+}
+
+// ChatMessageFile 是消息附带的文件
+type ChatMessageFile struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	URL       string `json:"url"`
+	BelongsTo string `json:"belongs_to"`
+}
+
+// ChatHistoryMessage 是一轮问答，时间为Unix秒
+type ChatHistoryMessage struct {
+	ID           string            `json:"id"`
+	Query        string            `json:"query"`
+	Answer       string            `json:"answer"`
+	MessageFiles []ChatMessageFile `json:"message_files"`
+	CreatedAt    int64             `json:"created_at"`
+}
+
+// ChatBackend 聊天后端接口，聊天相关接口都通过它访问大模型服务
+type ChatBackend interface {
+	// StreamChat 发起一次流式提问，请求失败时直接返回错误
+	// 成功时返回的事件通道以 message_end 或 error 事件结束后关闭，ctx取消时提前关闭
+	StreamChat(ctx context.Context, req ChatBackendRequest) (<-chan ChatStreamEvent, error)
+	// StopChat 停止正在生成的回答，后端不支持时返回nil，由调用方取消本地请求
+	StopChat(ctx context.Context, username, taskID string) error
+	// Suggestions 返回某条回答之后推荐的问题
+	Suggestions(ctx context.Context, username, messageID string) ([]string, error)
+	// ListConversations 返回用户的一页会话，按创建时间倒序
+	// lastID为上一页最后一个会话，为空时从第一页开始，该会话已不存在时返回ErrConversationNotFound
+	// hasMore表示之后还有会话
+	ListConversations(ctx context.Context, username, lastID string, limit int) ([]ChatConversation, bool, error)
+	// ListAllConversationIDs 返回用户的全部会话ID
+	ListAllConversationIDs(ctx context.Context, username string) ([]string, error)
+	// History 返回会话的全部消息，按时间正序，会话不存在时返回ErrConversationNotFound
+	History(ctx context.Context, username, conversationID string) ([]ChatHistoryMessage, error)
+	// ConversationExists 判断会话是否存在且属于该用户
+	ConversationExists(ctx context.Context, username, conversationID string) (bool, error)
+	// DeleteConversation 删除会话，不存在时返回ErrConversationNotFound
+	DeleteConversation(ctx context.Context, username, conversationID string) error
+	// UploadFile 上传提问附带的图片，返回提问时使用的文件ID
+	UploadFile(ctx context.Context, username, filename string, data []byte) (string, error)
+}
+
+// 全局聊天后端，在main中根据环境变量初始化
+var chatBackend ChatBackend
+
+// NewChatBackendFromEnv 根据环境变量创建聊天后端
+func NewChatBackendFromEnv() (ChatBackend, error) {
+	switch CHAT_BACKEND {
+	case "dify":
+		return &DifyBackend{}, nil
+	case "openai":
+		return NewOpenAIBackendFromEnv()
+	case "fake":
+		return NewFakeBackend(), nil
+	default:
+		return nil, fmt.Errorf("不支持的 CHAT_BACKEND: %s", CHAT_BACKEND)
+	}
+}
+
+// sendChatEvent 向事件通道发送事件，ctx取消时返回false
+func sendChatEvent(ctx context.Context, events chan<- ChatStreamEvent, event ChatStreamEvent) bool {
+	select {
+	case events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// localConversation 是保存在本进程中的一个会话
+type localConversation struct {
+	ChatConversation
+	owner    string
+	messages []ChatHistoryMessage
+}
+
+// 进程内最多保存的会话数，超出时丢弃最久未更新的会话
+const localConversationLimit = 1000
+
+// localConversationStore 为fake后端在进程内保存会话，重启后丢失
+type localConversationStore struct {
+	mu            sync.Mutex
+	conversations map[string]*localConversation
+	// 消息ID到会话ID的索引
+	messages map[string]string
+}
+
+func newLocalConversationStore() *localConversationStore {
+	return &localConversationStore{
+		conversations: make(map[string]*localConversation),
+		messages:      make(map[string]string),
+	}
+}
+
+// lookup 查找属于owner的会话，调用方需持有锁
+func (s *localConversationStore) lookup(owner, conversationID string) (*localConversation, bool) {
+	conversation, ok := s.conversations[conversationID]
+	if !ok || conversation.owner != owner {
+		return nil, false
+	}
+	return conversation, true
+}
+
+// conversationName 以第一个问题的开头作为会话名称
+func conversationName(query string) string {
+	name := []rune(query)
+	if len(name) > 20 {
+		name = name[:20]
+	}
+	return string(name)
+}
+
+// create 新建会话，以第一个问题作为会话名称
+func (s *localConversationStore) create(owner, conversationID, query string) {
+	now := time.Now().Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.conversations) >= localConversationLimit {
+		s.evictOldest()
+	}
+	s.conversations[conversationID] = &localConversation{
+		ChatConversation: ChatConversation{ID: conversationID, Name: conversationName(query), CreatedAt: now, UpdatedAt: now},
+		owner:            owner,
+	}
+}
+
+// messagesOf 返回会话全部消息的副本
+func (s *localConversationStore) messagesOf(owner, conversationID string) ([]ChatHistoryMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversation, ok := s.lookup(owner, conversationID)
+	if !ok {
+		return nil, ErrConversationNotFound
+	}
+	return append([]ChatHistoryMessage{}, conversation.messages...), nil
+}
+
+// append 在会话末尾追加一轮问答
+func (s *localConversationStore) append(owner, conversationID string, message ChatHistoryMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversation, ok := s.lookup(owner, conversationID)
+	if !ok {
+		return ErrConversationNotFound
+	}
+	conversation.messages = append(conversation.messages, message)
+	conversation.UpdatedAt = message.CreatedAt
+	s.messages[message.ID] = conversationID
+	return nil
+}
+
+// conversationOf 返回消息所在的会话ID
+func (s *localConversationStore) conversationOf(owner, messageID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversationID, ok := s.messages[messageID]
+	if !ok {
+		return "", false
+	}
+	if _, ok := s.lookup(owner, conversationID); !ok {
+		return "", false
+	}
+	return conversationID, true
+}
+
+func (s *localConversationStore) list(owner string, limit int) []ChatConversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversations := []ChatConversation{}
+	for _, conversation := range s.conversations {
+		if conversation.owner == owner {
+			conversations = append(conversations, conversation.ChatConversation)
+		}
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		if conversations[i].CreatedAt != conversations[j].CreatedAt {
+			return conversations[i].CreatedAt > conversations[j].CreatedAt
+		}
+		return conversations[i].ID > conversations[j].ID
+	})
+	if limit > 0 && len(conversations) > limit {
+		conversations = conversations[:limit]
+	}
+	return conversations
+}
+
+// page 返回lastID之后的一页会话，lastID不存在时返回ErrConversationNotFound
+func (s *localConversationStore) page(owner, lastID string, limit int) ([]ChatConversation, bool, error) {
+	conversations := s.list(owner, 0)
+	if lastID != "" {
+		index := slices.IndexFunc(conversations, func(c ChatConversation) bool { return c.ID == lastID })
+		if index == -1 {
+			return nil, false, ErrConversationNotFound
+		}
+		conversations = conversations[index+1:]
+	}
+	if len(conversations) > limit {
+		return conversations[:limit], true, nil
+	}
+	return conversations, false, nil
+}
+
+// ids 返回owner的全部会话ID
+func (s *localConversationStore) ids(owner string) []string {
+	conversations := s.list(owner, 0)
+	ids := make([]string, len(conversations))
+	for i, conversation := range conversations {
+		ids[i] = conversation.ID
+	}
+	return ids
+}
+
+func (s *localConversationStore) exists(owner, conversationID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.lookup(owner, conversationID)
+	return ok
+}
+
+// evictOldest 丢弃最久未更新的会话，调用方需持有锁
+func (s *localConversationStore) evictOldest() {
+	var oldest *localConversation
+	for _, conversation := range s.conversations {
+		if oldest == nil || conversation.UpdatedAt < oldest.UpdatedAt {
+			oldest = conversation
+		}
+	}
+	if oldest != nil {
+		s.remove(oldest)
+	}
+}
+
+// remove 删除会话及其消息索引，调用方需持有锁
+func (s *localConversationStore) remove(conversation *localConversation) {
+	for _, message := range conversation.messages {
+		delete(s.messages, message.ID)
+	}
+	delete(s.conversations, conversation.ID)
+}
+
+func (s *localConversationStore) delete(owner, conversationID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversation, ok := s.lookup(owner, conversationID)
+	if !ok {
+		return ErrConversationNotFound
+	}
+	s.remove(conversation)
+	return nil
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"server-env.com/server/models"
+)
+
+// 会话和消息在聊天接口流式返回时保存到数据库，会话列表和历史优先从数据库读取
+// 聊天后端只用于补全尚未同步的数据：接入本功能之前的会话，以及地址会过期的文件
+
+// 同步历史时下载的单个文件大小上限
+const maxArchivedChatFileSize = 20 << 20
+
+// storedChatFile 是保存在消息中的文件，Key非空时文件已保存到文件存储
+type storedChatFile struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	BelongsTo string `json:"belongs_to"`
+	URL       string `json:"url,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// chatUsage 是 message_end 元数据中的用量
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// chatRecorder 收集一次回答的事件，回答结束或被停止后保存到数据库
+type chatRecorder struct {
+	username string
+	query    string
+	// 请求中没有会话ID时为新会话
+	newConversation bool
+	files           []storedChatFile
+
+	conversationID string
+	messageID      string
+	taskID         string
+	answer         strings.Builder
+	usage          chatUsage
+	// finished 收到了 message_end，stopped 回答被用户停止或客户端断开
+	finished bool
+	stopped  bool
+	saved    bool
+}
+
+func newChatRecorder(req ChatBackendRequest) *chatRecorder {
+	r := &chatRecorder{
+		username:        req.Username,
+		query:           req.Query,
+		newConversation: req.ConversationID == "",
+		conversationID:  req.ConversationID,
+		files:           []storedChatFile{},
+	}
+	for _, fileID := range req.FileIDs {
+		file := storedChatFile{ID: fileID, Type: "image", BelongsTo: "user"}
+		// 文件ID是文件存储的键时图片已在本地，否则需要从聊天后端同步地址
+		if strings.HasPrefix(fileID, uploadKeyPrefix) {
+			file.Key = fileID
+		}
+		r.files = append(r.files, file)
+	}
+	return r
+}
+
+// observe 记录一条将要发给前端的事件
+func (r *chatRecorder) observe(event ChatStreamEvent) {
+	if event.ConversationID != "" {
+		r.conversationID = event.ConversationID
+	}
+	if event.MessageID != "" {
+		r.messageID = event.MessageID
+	}
+	if event.TaskID != "" {
+		r.taskID = event.TaskID
+	}
+	switch data := event.Data.(type) {
+	case ChatDeltaEvent:
+		r.answer.WriteString(data.Text)
+	case ChatReplaceEvent:
+		r.answer.Reset()
+		r.answer.WriteString(data.Text)
+	case ChatFileEvent:
+		r.files = append(r.files, storedChatFile{ID: data.ID, Type: data.Type, BelongsTo: data.BelongsTo, URL: data.URL})
+	case ChatMessageEndEvent:
+		var metadata struct {
+			Usage chatUsage `json:"usage"`
+		}
+		if len(data.Metadata) > 0 {
+			json.Unmarshal(data.Metadata, &metadata)
+		}
+		r.usage = metadata.Usage
+		r.finished = true
+	}
+}
+
+// save 保存本次问答，只保存一次，出错或尚未得知消息ID时不保存
+func (r *chatRecorder) save() {
+	if r.saved || (!r.finished && !r.stopped) || r.conversationID == "" || r.messageID == "" {
+		return
+	}
+	r.saved = true
+	// 聊天后端返回的文件地址会过期，留待同步历史时下载
+	synced := true
+	for _, file := range r.files {
+		if file.Key == "" {
+			synced = false
+		}
+	}
+	files, _ := json.Marshal(r.files)
+	now := time.Now()
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		conversation := models.ChatConversations{
+			ID:        r.conversationID,
+			Username:  r.username,
+			Name:      conversationName(r.query),
+			Backend:   CHAT_BACKEND,
+			Synced:    r.newConversation && synced,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&conversation).Error; err != nil {
+			return err
+		}
+		updates := map[string]any{"updated_at": now}
+		if !synced {
+			updates["synced"] = false
+		}
+		err := tx.Model(&models.ChatConversations{}).
+			Where("id = ? AND username = ?", r.conversationID, r.username).
+			Updates(updates).Error
+		if err != nil {
+			return err
+		}
+
+		message := models.ChatMessages{
+			ID:               r.messageID,
+			ConversationID:   r.conversationID,
+			Username:         r.username,
+			TaskID:           r.taskID,
+			Query:            r.query,
+			Answer:           r.answer.String(),
+			Files:            string(files),
+			Stopped:          r.stopped && !r.finished,
+			PromptTokens:     r.usage.PromptTokens,
+			CompletionTokens: r.usage.CompletionTokens,
+			TotalTokens:      r.usage.TotalTokens,
+			CreatedAt:        now,
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&message).Error
+	})
+	if err != nil {
+		fmt.Println("保存聊天记录失败:", err, r.conversationID, r.messageID)
+	}
+}
+
+// findStoredConversation 查询属于username的本地会话，不存在时返回nil
+func findStoredConversation(username, conversationID string) (*models.ChatConversations, error) {
+	var conversation models.ChatConversations
+	err := DB.Where("id = ? AND username = ?", conversationID, username).First(&conversation).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// storedMessageConversation 返回属于username的消息所在的会话ID，消息不存在时返回空
+func storedMessageConversation(username, messageID string) (string, error) {
+	var message models.ChatMessages
+	err := DB.Select("conversation_id").Where("id = ? AND username = ?", messageID, username).First(&message).Error
+	if err == gorm.ErrRecordNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return message.ConversationID, nil
+}
+
+// storedHistory 从数据库读取会话的全部消息，按时间正序
+func storedHistory(username, conversationID string) ([]ChatHistoryMessage, error) {
+	var messages []models.ChatMessages
+	err := DB.Where("conversation_id = ? AND username = ?", conversationID, username).
+		Order("created_at ASC, id ASC").
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]ChatHistoryMessage, len(messages))
+	for i, message := range messages {
+		var files []storedChatFile
+		if message.Files != "" {
+			json.Unmarshal([]byte(message.Files), &files)
+		}
+		messageFiles := make([]ChatMessageFile, len(files))
+		for j, file := range files {
+			url := file.URL
+			if file.Key != "" {
+				url = BlobURL(file.Key)
+			}
+			messageFiles[j] = ChatMessageFile{ID: file.ID, Type: file.Type, URL: url, BelongsTo: file.BelongsTo}
+		}
+		history[i] = ChatHistoryMessage{
+			ID:           message.ID,
+			Query:        message.Query,
+			Answer:       message.Answer,
+			MessageFiles: messageFiles,
+			CreatedAt:    message.CreatedAt.Unix(),
+		}
+	}
+	return history, nil
+}
+
+// conversationHistory 返回会话的全部消息，未同步的会话先从聊天后端同步到数据库
+// 聊天后端不可用时返回本地已保存的部分
+func conversationHistory(ctx context.Context, username, conversationID string) ([]ChatHistoryMessage, error) {
+	conversation, err := findStoredConversation(username, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conversation != nil && (conversation.Synced || conversation.Backend != CHAT_BACKEND) {
+		return storedHistory(username, conversationID)
+	}
+
+	history, err := chatBackend.History(ctx, username, conversationID)
+	if err == ErrConversationNotFound && conversation != nil {
+		// 聊天后端中已没有该会话，本地保存的就是全部
+		DB.Model(conversation).Update("synced", true)
+		return storedHistory(username, conversationID)
+	} else if err != nil {
+		if conversation != nil {
+			fmt.Println("同步聊天历史失败，返回本地记录:", err, conversationID)
+			return storedHistory(username, conversationID)
+		}
+		return nil, err
+	}
+
+	if err := importConversationHistory(ctx, username, conversationID, history); err != nil {
+		fmt.Println("保存聊天历史失败:", err, conversationID)
+		return history, nil
+	}
+	return storedHistory(username, conversationID)
+}
+
+// importConversationHistory 将聊天后端返回的历史写入数据库，并下载消息中的文件
+// 已有消息的用量和停止状态保留，内容以聊天后端为准
+func importConversationHistory(ctx context.Context, username, conversationID string, history []ChatHistoryMessage) error {
+	synced := true
+	messages := make([]models.ChatMessages, len(history))
+	for i, message := range history {
+		files := make([]storedChatFile, len(message.MessageFiles))
+		for j, file := range message.MessageFiles {
+			var archived bool
+			files[j], archived = archiveChatFile(ctx, file)
+			synced = synced && archived
+		}
+		data, _ := json.Marshal(files)
+		messages[i] = models.ChatMessages{
+			ID:             message.ID,
+			ConversationID: conversationID,
+			Username:       username,
+			Query:          message.Query,
+			Answer:         message.Answer,
+			Files:          string(data),
+			CreatedAt:      time.Unix(message.CreatedAt, 0),
+		}
+	}
+
+	now := time.Now()
+	conversation := models.ChatConversations{
+		ID:        conversationID,
+		Username:  username,
+		Backend:   CHAT_BACKEND,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if len(history) > 0 {
+		conversation.Name = conversationName(history[0].Query)
+		conversation.CreatedAt = time.Unix(history[0].CreatedAt, 0)
+		conversation.UpdatedAt = time.Unix(history[len(history)-1].CreatedAt, 0)
+	}
+
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&conversation).Error; err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			err := tx.Clauses(clause.OnConflict{
+				DoUpdates: clause.AssignmentColumns([]string{"query", "answer", "files", "created_at"}),
+			}).Create(&messages).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.ChatConversations{}).
+			Where("id = ? AND username = ?", conversationID, username).
+			Update("synced", synced).Error
+	})
+}
+
+// archiveChatFile 下载聊天后端中的图片保存到文件存储
+// 下载失败时保留原地址并返回false，下次查看历史时重试
+func archiveChatFile(ctx context.Context, file ChatMessageFile) (storedChatFile, bool) {
+	stored := storedChatFile{ID: file.ID, Type: file.Type, BelongsTo: file.BelongsTo, URL: file.URL}
+	if file.URL == "" {
+		return stored, true
+	}
+	data, err := fetchChatFile(ctx, file.URL)
+	if err != nil {
+		fmt.Println("下载聊天文件失败:", err, file.ID)
+		return stored, false
+	}
+	key, err := storeUploadedImage(ctx, data)
+	if err != nil {
+		fmt.Println("保存聊天文件失败:", err, file.ID)
+		return stored, false
+	}
+	if key != "" {
+		stored.Key = key
+		stored.URL = ""
+	}
+	// 不是图片时无法保存，只保留原地址
+	return stored, true
+}
+
+// fetchChatFile 下载聊天后端中的文件，与访问Dify使用同样的代理设置
+func fetchChatFile(ctx context.Context, url string) ([]byte, error) {
+	resp, err := difyClient.R().
+		SetContext(ctx).
+		SetDoNotParseResponse(true).
+		Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.RawResponse.Body.Close()
+	if resp.IsError() {
+		return nil, errors.New(resp.Status())
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.RawResponse.Body, maxArchivedChatFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxArchivedChatFileSize {
+		return nil, errors.New("文件过大")
+	}
+	return data, nil
+}
+
+// 导入会话列表时每页的会话数，以及每次查看会话列表最多导入的页数
+const (
+	importConversationPageSize = 100
+	importConversationMaxPages = 5
+)
+
+// importBackendConversations 查看会话列表时从聊天后端分页导入用户的会话
+// 每导入一页记录一次进度，会话较多时分多次查看导入，全部导入后不再访问聊天后端
+// 之后的新会话由聊天接口保存
+func importBackendConversations(ctx context.Context, username string) error {
+	state := models.ChatSyncStates{Username: username, Backend: CHAT_BACKEND}
+	err := DB.Where("username = ? AND backend = ?", username, CHAT_BACKEND).First(&state).Error
+	if err == nil && state.Completed {
+		return nil
+	} else if err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	for page := 0; page < importConversationMaxPages; page++ {
+		conversations, hasMore, err := chatBackend.ListConversations(ctx, username, state.LastID, importConversationPageSize)
+		if errors.Is(err, ErrConversationNotFound) && state.LastID != "" {
+			// 上次导入到的会话已被删除，从头重新导入，已导入的会话不会重复
+			state.LastID = ""
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		rows := make([]models.ChatConversations, len(conversations))
+		for i, conversation := range conversations {
+			rows[i] = models.ChatConversations{
+				ID:        conversation.ID,
+				Username:  username,
+				Name:      conversation.Name,
+				Backend:   CHAT_BACKEND,
+				CreatedAt: time.Unix(conversation.CreatedAt, 0),
+				UpdatedAt: time.Unix(conversation.UpdatedAt, 0),
+			}
+		}
+		if len(conversations) > 0 {
+			state.LastID = conversations[len(conversations)-1].ID
+		}
+		state.Completed = !hasMore
+		state.SyncedAt = time.Now()
+
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			if len(rows) > 0 {
+				if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&state).Error
+		})
+		if err != nil {
+			return err
+		}
+		if state.Completed {
+			return nil
+		}
+	}
+	return nil
+}
+
+// recentConversations 从数据库返回用户最近的会话，按创建时间倒序
+func recentConversations(ctx context.Context, username string, limit int) ([]ChatConversation, error) {
+	if err := importBackendConversations(ctx, username); err != nil {
+		// 导入失败不影响返回已保存的会话，下次查看时重试
+		fmt.Println("导入会话列表失败:", err, username)
+	}
+
+	var rows []models.ChatConversations
+	err := DB.Where("username = ?", username).
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	conversations := make([]ChatConversation, len(rows))
+	for i, row := range rows {
+		conversations[i] = ChatConversation{
+			ID:        row.ID,
+			Name:      row.Name,
+			CreatedAt: row.CreatedAt.Unix(),
+			UpdatedAt: row.UpdatedAt.Unix(),
+		}
+	}
+	return conversations, nil
+}
+
+// conversationExists 判断会话是否存在且属于该用户，本地没有时询问聊天后端
+func conversationExists(ctx context.Context, username, conversationID string) (bool, error) {
+	conversation, err := findStoredConversation(username, conversationID)
+	if err != nil {
+		return false, err
+	}
+	if conversation != nil {
+		return true, nil
+	}
+	return chatBackend.ConversationExists(ctx, username, conversationID)
+}
+
+// deleteStoredConversation 删除本地保存的会话及其消息，返回会话是否存在
+func deleteStoredConversation(tx *gorm.DB, username, conversationID string) (bool, error) {
+	if err := tx.Where("conversation_id = ? AND username = ?", conversationID, username).Delete(&models.ChatMessages{}).Error; err != nil {
+		return false, err
+	}
+	result := tx.Where("id = ? AND username = ?", conversationID, username).Delete(&models.ChatConversations{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// deleteConversation 删除聊天后端和数据库中的会话，两处都不存在时返回ErrConversationNotFound
+func deleteConversation(ctx context.Context, username, conversationID string) error {
+	backendErr := chatBackend.DeleteConversation(ctx, username, conversationID)
+	if backendErr != nil && backendErr != ErrConversationNotFound {
+		return backendErr
+	}
+	deleted, err := deleteStoredConversation(DB, username, conversationID)
+	if err != nil {
+		return err
+	}
+	if backendErr == ErrConversationNotFound && !deleted {
+		return ErrConversationNotFound
+	}
+	return nil
+}
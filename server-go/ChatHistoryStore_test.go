@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"server-env.com/server/models"
+)
+
+func TestChatHistoryStoredInDatabase(t *testing.T) {
+	setupTestDB(t)
+	backend := setupFakeBackend(t, 0)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "xena"}, "Xena-Passw0rd")
+	token := testAccessToken(t, "xena")
+
+	w := performRequest(router, http.MethodPost, "/api/chat", chatBody("xena", "玉米什么时候追肥", ""), bearer(token))
+	events := readSSEEvents(t, w.Body.String())
+	conversationID := events[len(events)-1].Data["conversation_id"].(string)
+
+	// 会话列表和历史从数据库读取，聊天后端丢失会话后仍可查看
+	backend.store.delete("xena", conversationID)
+	w = performRequest(router, http.MethodGet, "/api/conversations/list/xena", "", bearer(token))
+	var list struct {
+		Conversations []ChatConversation `json:"conversations"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Conversations) != 1 || list.Conversations[0].ID != conversationID || list.Conversations[0].Name != "玉米什么时候追肥" {
+		t.Fatalf("会话列表错误: %s", w.Body.String())
+	}
+	w = performRequest(router, http.MethodGet, "/api/conversations/"+conversationID+"/history?username=xena", "", bearer(token))
+	var history []ChatHistoryMessage
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history) != 1 || history[0].Query != "玉米什么时候追肥" || history[0].Answer != fakeAnswer("玉米什么时候追肥") {
+		t.Fatalf("聊天历史错误: %d %s", w.Code, w.Body.String())
+	}
+
+	// 聊天后端中已不存在时仍删除本地保存的会话
+	w = performRequest(router, http.MethodDelete, "/api/conversations/"+conversationID+"/delete?username=xena", "", bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("删除会话失败: %d %s", w.Code, w.Body.String())
+	}
+	var count int64
+	DB.Model(&models.ChatMessages{}).Where("conversation_id = ?", conversationID).Count(&count)
+	if count != 0 {
+		t.Fatalf("删除会话后应删除其消息，剩余 %d", count)
+	}
+	w = performRequest(router, http.MethodDelete, "/api/conversations/"+conversationID+"/delete?username=xena", "", bearer(token))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("重复删除应返回404，实际 %d", w.Code)
+	}
+}
+
+func TestImportConversationsFromBackend(t *testing.T) {
+	setupTestDB(t)
+	backend := setupFakeBackend(t, 0)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "yuri"}, "Yuri-Passw0rd")
+	token := testAccessToken(t, "yuri")
+
+	// 接入数据库之前已保存在聊天后端中的会话
+	backend.store.create("yuri", "old-conversation", "以前的问题")
+	backend.store.append("yuri", "old-conversation", ChatHistoryMessage{
+		ID: "old-message", Query: "以前的问题", Answer: "以前的回答", CreatedAt: time.Now().Unix(),
+	})
+
+	w := performRequest(router, http.MethodGet, "/api/conversations/list/yuri", "", bearer(token))
+	var list struct {
+		Conversations []ChatConversation `json:"conversations"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Conversations) != 1 || list.Conversations[0].ID != "old-conversation" {
+		t.Fatalf("首次查看应导入聊天后端的会话: %s", w.Body.String())
+	}
+	var conversation models.ChatConversations
+	DB.First(&conversation, "id = ?", "old-conversation")
+	if conversation.Synced {
+		t.Fatal("只导入了会话，消息尚未同步")
+	}
+
+	// 查看历史时同步消息，之后不再访问聊天后端
+	w = performRequest(router, http.MethodGet, "/api/conversations/old-conversation/history?username=yuri", "", bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("获取历史失败: %d %s", w.Code, w.Body.String())
+	}
+	DB.First(&conversation, "id = ?", "old-conversation")
+	var message models.ChatMessages
+	if err := DB.First(&message, "id = ?", "old-message").Error; err != nil || message.Answer != "以前的回答" || !conversation.Synced {
+		t.Fatalf("历史应同步到数据库: %+v %+v %v", conversation, message, err)
+	}
+	backend.store.delete("yuri", "old-conversation")
+	w = performRequest(router, http.MethodGet, "/api/conversations/old-conversation/history?username=yuri", "", bearer(token))
+	var history []ChatHistoryMessage
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history) != 1 || history[0].Answer != "以前的回答" {
+		t.Fatalf("已同步的历史应从数据库读取: %s", w.Body.String())
+	}
+}
+
+func TestImportConversationsInPages(t *testing.T) {
+	setupTestDB(t)
+	backend := setupFakeBackend(t, 0)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "zoe"}, "Zoe-Passw0rd")
+	token := testAccessToken(t, "zoe")
+
+	// 会话数超过一次查看能导入的数量
+	total := importConversationPageSize*importConversationMaxPages + 3
+	for i := 0; i < total; i++ {
+		backend.store.create("zoe", fmt.Sprintf("conversation-%04d", i), "问题")
+	}
+	imported := func() int64 {
+		var count int64
+		DB.Model(&models.ChatConversations{}).Where("username = ?", "zoe").Count(&count)
+		return count
+	}
+	state := func() models.ChatSyncStates {
+		var state models.ChatSyncStates
+		DB.First(&state, "username = ? AND backend = ?", "zoe", CHAT_BACKEND)
+		return state
+	}
+
+	// 第一次查看导入一部分并记录进度
+	performRequest(router, http.MethodGet, "/api/conversations/list/zoe", "", bearer(token))
+	if n := imported(); n != int64(total-3) {
+		t.Fatalf("第一次应导入 %d 个会话，实际 %d", total-3, n)
+	}
+	if s := state(); s.Completed || s.LastID == "" {
+		t.Fatalf("应记录导入进度: %+v", s)
+	}
+
+	// 再次查看从上次的位置继续，全部导入后标记完成
+	performRequest(router, http.MethodGet, "/api/conversations/list/zoe", "", bearer(token))
+	if n := imported(); n != int64(total) {
+		t.Fatalf("应导入全部 %d 个会话，实际 %d", total, n)
+	}
+	if s := state(); !s.Completed {
+		t.Fatalf("全部导入后应标记完成: %+v", s)
+	}
+
+	// 记录的位置已被删除时从头重新导入，不会重复
+	DB.Model(&models.ChatSyncStates{}).Where("username = ?", "zoe").
+		Updates(map[string]interface{}{"last_id": "deleted", "completed": false})
+	backend.store.create("zoe", "conversation-new", "新问题")
+	performRequest(router, http.MethodGet, "/api/conversations/list/zoe", "", bearer(token))
+	if n := imported(); n != int64(total+1) {
+		t.Fatalf("应重新导入并补上新会话，实际 %d", n)
+	}
+}
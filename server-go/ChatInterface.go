@@ -1,43 +1,26 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"sort"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-resty/resty/v2"
+	"server-env.com/server/models"
 )
 
-var (
-	DIFY_API_KEY  = os.Getenv("DIFY_API_KEY")
-	DIFY_BASE_URL = getEnvOrDefault("DIFY_BASE_URL", "https://api.dify.ai/v1")
-	ALL_PROXY     = os.Getenv("ALL_PROXY")
-	USE_PROXY     = ALL_PROXY != ""
-	PAGE_LIMIT    = 20
-	difyClient    = resty.New()
-)
-
-func init() {
-	// 配置Dify客户端
-	difyClient.SetBaseURL(DIFY_BASE_URL)
-
-	// 配置代理
-	if USE_PROXY && ALL_PROXY != "" {
-		difyClient.SetProxy(ALL_PROXY)
-	}
+var ErrConversationNotFound = errors.New("对话不存在")
 
-	// 设置超时时间
-	difyClient.SetTimeout(10 * time.Minute)
-}
+// 会话列表返回的最近会话数量
+const recentConversationLimit = 20
 
 // getEnvOrDefault 获取环境变量，如果不存在则返回默认值
 func getEnvOrDefault(key, defaultValue string) string {
@@ -48,6 +31,15 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return value
 }
 
+// getEnvIntOrDefault 获取整数环境变量，不存在或格式错误时返回默认值
+func getEnvIntOrDefault(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
 // ChatRequest 是前端发来的请求调用聊天接口的结构体
 type ChatRequest struct {
 	Message        string   `json:"message"`
@@ -56,23 +48,7 @@ type ChatRequest struct {
 	FileIDs        []string `json:"file_ids"`
 }
 
-// ChatMessageRequest 是向Dify发送的聊天消息请求结构体
-type ChatMessageRequest struct {
-	Query          string                 `json:"query"`
-	User           string                 `json:"user"`
-	Inputs         map[string]interface{} `json:"inputs"`
-	Files          []map[string]string    `json:"files"`
-	ConversationID string                 `json:"conversation_id"`
-	Stream         string                 `json:"response_mode"`
-}
-
-// ChatMessageResponseChunk 是转发给前端的SSE Message
-type ChatMessageResponseChunk struct {
-	Event  string  `json:"event"`
-	Answer *string `json:"answer"`
-}
-
-// 聊天接口
+// 聊天接口，以SSE流式返回回答，协议见 ChatStream.go
 func Chat(c *gin.Context) {
 	var req ChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -83,286 +59,270 @@ func Chat(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "消息内容不能为空"})
 		return
 	}
-	files := make([]map[string]string, len(req.FileIDs))
-	for i, fileID := range req.FileIDs {
-		files[i] = map[string]string{
-			"type":            "image",
-			"transfer_method": "local_file",
-			"upload_file_id":  fileID,
+	username, ok := resolveChatUsername(c, req.Username)
+	if !ok {
+		return
+	}
+	caller := CurrentIdentity(c).Username
+
+	// 诊断会话共用诊断用户名，只能继续本人发起的会话
+	if username == DiagnosisUsername && req.ConversationID != "" {
+		owned, err := diagnosisConversationOwned(req.ConversationID, caller)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+			return
+		}
+		if !owned {
+			c.JSON(http.StatusNotFound, gin.H{"error": "对话不存在"})
+			return
 		}
 	}
 
-	// 构建Dify请求
-	chatReq := ChatMessageRequest{
+	// 客户端断开或调用停止接口时取消上游请求
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	backendReq := ChatBackendRequest{
+		Username:       username,
 		Query:          req.Message,
-		User:           req.Username,
-		Inputs:         make(map[string]interface{}),
-		Files:          files,
 		ConversationID: req.ConversationID,
-		Stream:         "streaming",
+		FileIDs:        req.FileIDs,
 	}
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Header().Set("Transfer-Encoding", "chunked")
-	c.Writer.Flush()
-	resp, err := difyClient.R().
-		SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
-		SetHeader("Content-Type", "application/json").
-		SetBody(chatReq).
-		SetDoNotParseResponse(true).
-		Post("/chat-messages")
-	if err != nil {
-		c.String(http.StatusOK, "data: [ERROR] AI服务异常: %v\n\n", err)
-		c.Writer.Flush()
+	backend := chatBackend
+	events, err := backend.StreamChat(ctx, backendReq)
+	if err == ErrConversationNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "对话不存在"})
 		return
-	}
-	if resp.IsError() {
-		c.String(http.StatusOK, "data: [ERROR] AI服务异常: %s\n\n", resp.Status())
-		c.Writer.Flush()
+	} else if err != nil {
+		fmt.Println("请求AI服务出错:", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "AI服务异常"})
 		return
 	}
 
-	// 转发消息流给前端
-	reader := bufio.NewReader(resp.RawResponse.Body)
-	var messageID string
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
+	stream := newChatStream(c)
+	ticker := time.NewTicker(CHAT_PING_INTERVAL / 2)
+	defer ticker.Stop()
+	var conversationID, messageID, taskID string
+	var task *chatTask
+	defer func() {
+		if task != nil {
+			chatTasks.remove(taskID, task)
+		}
+	}()
+	// 回答结束或被停止后保存到数据库
+	recorder := newChatRecorder(backendReq)
+	defer recorder.save()
+	// 上游请求被取消时区分客户端断开和用户主动停止
+	finishCanceled := func() {
+		recorder.stopped = true
+		if c.Request.Context().Err() != nil {
+			// 客户端已断开，通知后端停止生成，避免继续消耗额度
+			if taskID != "" {
+				go stopBackendTask(backend, username, taskID)
 			}
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Read error:%v", err)})
-			break
+			return
 		}
+		// 用户通过停止接口结束了本次回答，先保存再通知前端，继续提问时能读到这次回答
+		recorder.save()
+		stream.send(ChatEventMessageEnd, ChatMessageEndEvent{
+			ConversationID: conversationID,
+			MessageID:      messageID,
+			TaskID:         taskID,
+			Stopped:        true,
+		})
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			finishCanceled()
+			return
+		case now := <-ticker.C:
+			if err := stream.pingIfIdle(now); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					finishCanceled()
+					return
+				}
+				// 后端在回答结束前关闭了事件流
+				stream.sendError(ChatErrorIncomplete, "AI服务响应意外中断")
+				return
+			}
+			if event.ConversationID != "" {
+				conversationID = event.ConversationID
+			}
+			if event.MessageID != "" && event.MessageID != messageID {
+				messageID = event.MessageID
+				// 记录诊断消息的发起者，之后凭此判断会话归属
+				if username == DiagnosisUsername {
+					if err := recordDiagnosisMessage(messageID, conversationID, caller); err != nil {
+						fmt.Println("记录诊断消息出错:", err)
+					}
+				}
+			}
+			if task == nil && event.TaskID != "" {
+				taskID = event.TaskID
+				task = chatTasks.add(taskID, caller, cancel)
+			}
 
-		line = strings.TrimSpace(line)
-		if line == "" || !strings.HasPrefix(line, "data:") {
-			continue
-		}
-		// 移除SSE Message的 "data:" 并解析对应的JSON转发
-		jsonStr := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-		var payload map[string]interface{}
-		if err := json.Unmarshal([]byte(jsonStr), &payload); err != nil {
-			fmt.Println("JSON parse error:", err)
-			continue
-		}
-		switch event := payload["event"].(string); event {
-		case "message":
-			answer := payload["answer"].(string)
-			messageID = payload["message_id"].(string)
-			fmt.Fprintf(c.Writer, "%s", answer)
-			c.Writer.Flush()
-		case "message_end":
-			fmt.Fprintf(c.Writer, "[MESSAGE_ID:%s]", messageID)
-			c.Writer.Flush()
+			recorder.observe(event)
+			if event.terminal() {
+				recorder.save()
+			}
+			if err := stream.send(event.Type, event.Data); err != nil || event.terminal() {
+				return
+			}
 		}
 	}
 }
 
-// 获取下一个问题建议接口
-func GetNextProblemSuggestion(c *gin.Context) {
-	messageID := c.Param("message_id")
-	username := c.Query("username")
+// chatTask 是本实例上正在生成的一次回答，owner为发起请求的真实用户
+type chatTask struct {
+	owner  string
+	cancel context.CancelFunc
+}
 
-	if username == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "用户名不能为空"})
-		return
-	}
+// chatTaskRegistry 按task_id记录正在生成的回答，供停止接口结束对应的流
+type chatTaskRegistry struct {
+	mu    sync.Mutex
+	tasks map[string]*chatTask
+}
 
-	// 发送请求到Dify API
-	resp, err := difyClient.R().
-		SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
-		SetHeader("Content-Type", "application/json").
-		SetQueryParam("user", username).
-		Get(fmt.Sprintf("/messages/%s/suggested", messageID))
+var chatTasks = &chatTaskRegistry{tasks: make(map[string]*chatTask)}
 
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+func (r *chatTaskRegistry) add(taskID, owner string, cancel context.CancelFunc) *chatTask {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task := &chatTask{owner: owner, cancel: cancel}
+	r.tasks[taskID] = task
+	return task
+}
+
+// remove 回答结束后移除记录，只移除自己添加的那一条
+func (r *chatTaskRegistry) remove(taskID string, task *chatTask) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tasks[taskID] == task {
+		delete(r.tasks, taskID)
 	}
+}
 
-	if resp.IsError() {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": resp.Status()})
-		return
+// ownedBy 判断本实例上是否有该用户发起的回答
+func (r *chatTaskRegistry) ownedBy(taskID, owner string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task, ok := r.tasks[taskID]
+	return ok && task.owner == owner
+}
+
+// stop 结束该用户发起的回答流，本实例上没有该回答时返回false
+func (r *chatTaskRegistry) stop(taskID, owner string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task, ok := r.tasks[taskID]
+	if !ok || task.owner != owner {
+		return false
 	}
+	task.cancel()
+	return true
+}
 
-	// 解析响应
-	var result map[string]interface{}
-	if err := json.Unmarshal(resp.Body(), &result); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// stopBackendTask 客户端断开后通知生成回答的后端停止生成
+func stopBackendTask(backend ChatBackend, username, taskID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := backend.StopChat(ctx, username, taskID); err != nil {
+		fmt.Println("停止AI生成出错:", err)
 	}
+}
 
-	// 返回数据字段
-	data, ok := result["data"]
+// StopChat 停止正在生成的回答，task_id来自流中的事件
+// 多实例部署时回答流可能不在本实例上，此时仅通过后端停止生成，流由后端结束
+// 诊断回答共用诊断用户名，只能在回答流所在的实例上停止本人发起的回答
+func StopChat(c *gin.Context) {
+	taskID := c.Param("task_id")
+	username, ok := resolveChatUsername(c, c.Query("username"))
 	if !ok {
-		c.JSON(http.StatusOK, gin.H{"data": []interface{}{}})
+		return
+	}
+	caller := CurrentIdentity(c).Username
+	if username == DiagnosisUsername && !chatTasks.ownedBy(taskID, caller) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "回答不存在或已结束"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": data})
-}
-
-// 获取用户会话列表接口
-func ListConversations(c *gin.Context) {
-	username := c.Param("username")
-
-	// 发送请求到Dify API
-	resp, err := difyClient.R().
-		SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
-		SetHeader("Content-Type", "application/json").
-		SetQueryParam("user", username).
-		SetQueryParam("limit", "20").
-		Get("/conversations")
-
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+	defer cancel()
+	err := chatBackend.StopChat(ctx, username, taskID)
+	stopped := chatTasks.stop(taskID, caller)
+	if err != nil && !stopped {
+		fmt.Println("停止AI生成出错:", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "AI服务异常"})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"result": "success"})
+}
 
-	if resp.IsError() {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": resp.Status()})
+// 获取下一个问题建议接口
+func GetNextProblemSuggestion(c *gin.Context) {
+	messageID := c.Param("message_id")
+	username, ok := resolveChatUsername(c, c.Query("username"))
+	if !ok {
 		return
 	}
+	if username == DiagnosisUsername {
+		owned, err := diagnosisMessageOwned(messageID, CurrentIdentity(c).Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+			return
+		}
+		if !owned {
+			c.JSON(http.StatusNotFound, gin.H{"error": "消息不存在"})
+			return
+		}
+	}
 
-	// 解析响应
-	var result map[string]interface{}
-	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+	suggestions, err := chatBackend.Suggestions(c.Request.Context(), username, messageID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// 获取数据字段
-	data, ok := result["data"]
+	c.JSON(http.StatusOK, gin.H{"data": suggestions})
+}
+
+// 获取用户会话列表接口
+func ListConversations(c *gin.Context) {
+	username, ok := resolveUsername(c, c.Param("username"))
 	if !ok {
-		c.JSON(http.StatusOK, gin.H{"conversations": []interface{}{}})
 		return
 	}
 
-	// 转换为前端需要的格式
-	conversations, ok := data.([]interface{})
-	if !ok {
-		c.JSON(http.StatusOK, gin.H{"conversations": []interface{}{}})
+	conversations, err := recentConversations(c.Request.Context(), username, recentConversationLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// 按创建时间倒序排序
-	sort.Slice(conversations, func(i, j int) bool {
-		convI, okI := conversations[i].(map[string]interface{})
-		convJ, okJ := conversations[j].(map[string]interface{})
-
-		if !okI || !okJ {
-			return false
-		}
-
-		createdAtI, okI := convI["created_at"].(string)
-		createdAtJ, okJ := convJ["created_at"].(string)
-
-		if !okI || !okJ {
-			return false
-		}
-
-		return createdAtI > createdAtJ
-	})
-
 	c.JSON(http.StatusOK, gin.H{"conversations": conversations})
 }
 
 // 获取聊天历史接口
 func GetChatHistory(c *gin.Context) {
 	conversationID := c.Param("conversation_id")
-	username := c.Query("username")
-
-	if username == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "用户名不能为空"})
+	username, ok := resolveUsername(c, c.Query("username"))
+	if !ok {
 		return
 	}
 
-	// 获取所有消息
-	allMessages := []map[string]interface{}{}
-	firstID := ""
-
-	for {
-		// 构建请求参数
-		params := map[string]string{
-			"conversation_id": conversationID,
-			"user":            username,
-			"limit":           fmt.Sprintf("%d", PAGE_LIMIT),
-		}
-
-		if firstID != "" {
-			params["first_id"] = firstID
-		}
-
-		// 发送请求到Dify API
-		resp, err := difyClient.R().
-			SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
-			SetHeader("Content-Type", "application/json").
-			SetQueryParams(params).
-			Get("/messages")
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		if resp.IsError() {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": resp.Status()})
-			return
-		}
-
-		// 解析响应
-		var result map[string]interface{}
-		if err := json.Unmarshal(resp.Body(), &result); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		// 获取数据字段
-		data, ok := result["data"]
-		if !ok {
-			break
-		}
-
-		// 转换为消息切片
-		messages, ok := data.([]interface{})
-		if !ok {
-			break
-		}
-
-		// 转换为map格式并添加到结果中
-		for _, msg := range messages {
-			if msgMap, ok := msg.(map[string]interface{}); ok {
-				allMessages = append([]map[string]interface{}{msgMap}, allMessages...)
-			}
-		}
-
-		// 检查是否还有更多消息
-		hasMore, hasMoreOk := result["has_more"].(bool)
-		if !hasMoreOk || !hasMore || len(messages) == 0 {
-			break
-		}
-
-		// 设置下一次请求的first_id
-		if len(messages) > 0 {
-			if firstMsg, ok := messages[0].(map[string]interface{}); ok {
-				if id, idOk := firstMsg["id"].(string); idOk {
-					firstID = id
-				}
-			}
-		}
-	}
-
-	// 转换为前端需要的格式
-	history := make([]map[string]interface{}, len(allMessages))
-	for i, msg := range allMessages {
-		history[i] = map[string]interface{}{
-			"query":         msg["query"],
-			"answer":        msg["answer"],
-			"message_files": msg["message_files"],
-			"created_at":    msg["created_at"],
-		}
+	history, err := conversationHistory(c.Request.Context(), username, conversationID)
+	if err == ErrConversationNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "对话不存在"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, history)
@@ -371,34 +331,31 @@ func GetChatHistory(c *gin.Context) {
 // 删除会话接口
 func DeleteConversation(c *gin.Context) {
 	conversationID := c.Param("conversation_id")
-	username := c.Query("username")
-
-	if username == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "用户名不能为空"})
+	username, ok := resolveUsername(c, c.Query("username"))
+	if !ok {
 		return
 	}
 
-	// 发送删除请求到Dify API
-	resp, err := difyClient.R().
-		SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]string{"user": username}).
-		Delete(fmt.Sprintf("/conversations/%s", conversationID))
-
-	if err != nil {
+	err := deleteConversation(c.Request.Context(), username, conversationID)
+	RecordAudit(c, AuditEvent{
+		Action:  AuditConversationDelete,
+		Target:  conversationID,
+		Outcome: auditResult(err),
+		Detail:  gin.H{"owner": username},
+	})
+	if err == ErrConversationNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "对话不存在"})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	unshareResource(models.ResourceConversation, conversationID, username)
 
-	// 检查响应状态
-	if resp.StatusCode() == 204 {
-		c.JSON(http.StatusOK, gin.H{
-			"message":         "对话已删除",
-			"conversation_id": conversationID,
-		})
-	} else {
-		c.JSON(http.StatusNotFound, gin.H{"error": "对话不存在"})
-	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "对话已删除",
+		"conversation_id": conversationID,
+	})
 }
 
 // 文件上传接口
@@ -410,14 +367,14 @@ func UploadFiles(ctx *gin.Context) {
 	}
 
 	files := form.File["files"]
-	username := ctx.PostForm("username")
-	if username == "" {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "用户名不能为空"})
+	username, ok := resolveUsername(ctx, ctx.PostForm("username"))
+	if !ok {
 		return
 	}
 
 	fileIDs := []string{}
-	// 上传每个文件到Dify API
+	uploaded := []gin.H{}
+	// 上传每个文件到聊天后端
 	for _, fileHeader := range files {
 		file, err := fileHeader.Open()
 		if err != nil {
@@ -431,62 +388,52 @@ func UploadFiles(ctx *gin.Context) {
 			return
 		}
 
-		var buf bytes.Buffer
-		writer := multipart.NewWriter(&buf)
-		fileField, err := writer.CreateFormFile("file", fileHeader.Filename)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("创建表单文件字段失败: %v", err)})
-			return
-		}
-
-		_, err = fileField.Write(fileContent)
+		id, err := chatBackend.UploadFile(ctx.Request.Context(), username, fileHeader.Filename, fileContent)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("写入文件内容失败: %v", err)})
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("文件上传失败: %v", err)})
 			return
 		}
-
-		err = writer.WriteField("user", username)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("写入用户字段失败: %v", err)})
-			return
+		if id == "" {
+			continue
 		}
+		fileIDs = append(fileIDs, id)
 
-		err = writer.Close()
+		// 图片同时保存到文件存储，之后可以通过签名地址查看
+		entry := gin.H{"file_id": id, "name": fileHeader.Filename, "url": nil}
+		key, err := storeUploadedImage(ctx.Request.Context(), fileContent)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("关闭表单写入器失败: %v", err)})
-			return
+			fmt.Println("上传图片保存失败:", err)
+		} else if key != "" {
+			entry["key"] = key
+			entry["url"] = BlobURL(key)
 		}
+		uploaded = append(uploaded, entry)
+	}
 
-		// 发送请求到Dify API
-		resp, err := difyClient.R().
-			SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
-			SetHeader("Content-Type", writer.FormDataContentType()).
-			SetBody(buf.Bytes()).
-			Post("/files/upload")
+	ctx.JSON(http.StatusOK, gin.H{"file_ids": fileIDs, "files": uploaded})
+}
 
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("文件上传失败: %v", err)})
-			return
-		}
-		if resp.IsError() {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("文件上传失败: %s", resp.Status())})
-			return
-		}
+// 上传图片在文件存储中的目录
+const uploadKeyPrefix = "uploads/"
 
-		// 解析响应
-		var uploadResp map[string]interface{}
-		if err := json.Unmarshal(resp.Body(), &uploadResp); err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("响应解析失败: %v", err)})
-			return
-		}
+// storeUploadedImage 按内容哈希保存上传的图片，不是图片时返回空
+// 图片重新编码后再保存，去掉EXIF中的位置等信息，GIF和WebP转换为PNG或JPEG
+func storeUploadedImage(ctx context.Context, data []byte) (string, error) {
+	if _, ok := avatarContentTypes[http.DetectContentType(data)]; !ok {
+		return "", nil
+	}
 
-		// 获取文件ID
-		if id, ok := uploadResp["id"].(string); ok {
-			fileIDs = append(fileIDs, id)
-		}
+	encoded, ext, err := reencodeImage(data, avatarService.MaxPixels)
+	if err != nil {
+		return "", err
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"file_ids": fileIDs})
+	sum := sha256.Sum256(encoded)
+	key := uploadKeyPrefix + hex.EncodeToString(sum[:16]) + ext
+	if err := putBlobIfMissing(ctx, key, encoded); err != nil {
+		return "", err
+	}
+	return key, nil
 }
 
 // // 提供qa页面文本文件
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server-env.com/server/models"
+)
+
+// sseEvent 是聊天流中的一条消息
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  map[string]any
+}
+
+// readSSEEvent 从聊天流中读取下一条消息，流结束时返回io.EOF
+func readSSEEvent(reader *bufio.Reader) (sseEvent, error) {
+	var event sseEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return event, err
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if event.Event != "" {
+				return event, nil
+			}
+		case strings.HasPrefix(line, "id:"):
+			event.ID = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			event.Event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event.Data)
+		}
+	}
+}
+
+// readSSEEvents 读取聊天流中的全部消息
+func readSSEEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	reader := bufio.NewReader(strings.NewReader(body))
+	events := []sseEvent{}
+	for {
+		event, err := readSSEEvent(reader)
+		if err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatalf("读取聊天流失败: %v", err)
+		}
+		events = append(events, event)
+	}
+}
+
+// sseAnswer 拼接聊天流中的回答文本
+func sseAnswer(events []sseEvent) string {
+	var answer strings.Builder
+	for _, event := range events {
+		if event.Event == ChatEventDelta {
+			answer.WriteString(event.Data["text"].(string))
+		}
+	}
+	return answer.String()
+}
+
+// setupFakeDify 用本地HTTP服务代替Dify，回答为对提问的复述，测试结束后恢复
+func setupFakeDify(t *testing.T) {
+	t.Helper()
+	var seq atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /chat-messages", func(w http.ResponseWriter, r *http.Request) {
+		var req ChatMessageRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		conversationID := req.ConversationID
+		if conversationID == "" {
+			conversationID = fmt.Sprintf("conversation-%d", seq.Add(1))
+		}
+		messageID := fmt.Sprintf("message-%d", seq.Add(1))
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []map[string]any{
+			{"event": "message", "answer": "回答：", "conversation_id": conversationID, "message_id": messageID},
+			{"event": "message", "answer": req.Query, "conversation_id": conversationID, "message_id": messageID},
+			{"event": "message_end", "conversation_id": conversationID, "message_id": messageID},
+		} {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	})
+	mux.HandleFunc("GET /messages/{id}/suggested", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"result":"success","data":["问题一"]}`)
+	})
+	setupDifyServer(t, mux)
+}
+
+// setupDifyServer 使用Dify聊天后端并将请求转发到handler，测试结束后恢复
+func setupDifyServer(t *testing.T, handler http.Handler) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	previous := chatBackend
+	chatBackend = &DifyBackend{}
+	difyClient.SetBaseURL(server.URL)
+	t.Cleanup(func() {
+		chatBackend = previous
+		difyClient.SetBaseURL(DIFY_BASE_URL)
+		server.Close()
+	})
+}
+
+// setupFakeBackend 使用fake聊天后端，delay为每段回答之间的间隔
+func setupFakeBackend(t *testing.T, delay time.Duration) *FakeBackend {
+	t.Helper()
+	previous := chatBackend
+	backend := NewFakeBackend()
+	backend.delay = delay
+	chatBackend = backend
+	t.Cleanup(func() { chatBackend = previous })
+	return backend
+}
+
+func chatBody(username, message, conversationID string) string {
+	data, _ := json.Marshal(ChatRequest{Message: message, Username: username, ConversationID: conversationID})
+	return string(data)
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestDiagnosisConversationScopedToCaller(t *testing.T) {
+	setupTestDB(t)
+	setupFakeDify(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "ivan"}, "Ivan-Passw0rd")
+	createTestUser(t, models.Users{Username: "judy"}, "Judy-Passw0rd")
+	ivan, judy := testAccessToken(t, "ivan"), testAccessToken(t, "judy")
+
+	w := performRequest(router, http.MethodPost, "/api/chat", chatBody(DiagnosisUsername, "叶片发黄", ""), bearer(ivan))
+	events := readSSEEvents(t, w.Body.String())
+	if sseAnswer(events) != "回答：叶片发黄" || events[len(events)-1].Data["message_id"] != "message-2" {
+		t.Fatalf("回答错误: %q", w.Body.String())
+	}
+	var owner models.DiagnosisMessages
+	if err := DB.First(&owner, "id = ?", "message-2").Error; err != nil || owner.Username != "ivan" || owner.ConversationID != "conversation-1" {
+		t.Fatalf("应记录诊断消息的发起者，实际 %+v %v", owner, err)
+	}
+
+	// 其他用户不能继续该诊断会话，也不能获取其问题建议
+	w = performRequest(router, http.MethodPost, "/api/chat", chatBody(DiagnosisUsername, "继续", "conversation-1"), bearer(judy))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("其他用户继续诊断会话应返回404，实际 %d %s", w.Code, w.Body.String())
+	}
+	w = performRequest(router, http.MethodGet, "/api/chat/next_suggest/message-2?username="+DiagnosisUsername, "", bearer(judy))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("其他用户获取诊断问题建议应返回404，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	w = performRequest(router, http.MethodPost, "/api/chat", chatBody(DiagnosisUsername, "继续", "conversation-1"), bearer(ivan))
+	if w.Code != http.StatusOK || sseAnswer(readSSEEvents(t, w.Body.String())) != "回答：继续" {
+		t.Fatalf("发起者应能继续诊断会话，实际 %d %s", w.Code, w.Body.String())
+	}
+	w = performRequest(router, http.MethodGet, "/api/chat/next_suggest/message-2?username="+DiagnosisUsername, "", bearer(ivan))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "问题一") {
+		t.Fatalf("发起者应能获取问题建议，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChatRequiresOwnUsername(t *testing.T) {
+	setupTestDB(t)
+	setupFakeDify(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "ivan"}, "Ivan-Passw0rd")
+	ivan := testAccessToken(t, "ivan")
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		code    int
+	}{
+		{"未登录", nil, chatBody("ivan", "你好", ""), http.StatusUnauthorized},
+		{"令牌无效", bearer(ivan + "x"), chatBody("ivan", "你好", ""), http.StatusUnauthorized},
+		{"其他用户名", bearer(ivan), chatBody("judy", "你好", ""), http.StatusForbidden},
+		{"本人", bearer(ivan), chatBody("ivan", "你好", ""), http.StatusOK},
+		{"省略用户名", bearer(ivan), chatBody("", "你好", ""), http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := performRequest(router, http.MethodPost, "/api/chat", tt.body, tt.headers)
+		if w.Code != tt.code {
+			t.Errorf("%s: 期望 %d，实际 %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestChatStreamEvents(t *testing.T) {
+	setupTestDB(t)
+	createTestUser(t, models.Users{Username: "ivan"}, "Ivan-Passw0rd")
+	router := newTestRouter()
+	ivan := testAccessToken(t, "ivan")
+
+	tests := []struct {
+		name   string
+		frames []string
+		events []string
+		code   string
+	}{
+		{"正常结束", []string{
+			`{"event":"message","answer":"你好","conversation_id":"c1","message_id":"m1"}`,
+			`{"event":"message_end","conversation_id":"c1","message_id":"m1","metadata":{"usage":{"total_tokens":3}}}`,
+		}, []string{ChatEventDelta, ChatEventMessageEnd}, ""},
+		{"上游返回错误", []string{
+			`{"event":"message","answer":"你","conversation_id":"c1","message_id":"m1"}`,
+			`{"event":"error","code":"provider_quota","message":"额度不足"}`,
+		}, []string{ChatEventDelta, ChatEventError}, ChatErrorUpstream},
+		{"回答中途断开", []string{
+			`{"event":"message","answer":"你","conversation_id":"c1","message_id":"m1"}`,
+		}, []string{ChatEventDelta, ChatEventError}, ChatErrorIncomplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDifyServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				for _, frame := range tt.frames {
+					fmt.Fprintf(w, "data: %s\n\n", frame)
+				}
+			}))
+
+			w := performRequest(router, http.MethodPost, "/api/chat", chatBody("", "你好", ""), bearer(ivan))
+			if w.Header().Get("X-Chat-Protocol") != "1" {
+				t.Fatalf("缺少协议版本响应头: %v", w.Header())
+			}
+			events := readSSEEvents(t, w.Body.String())
+			if len(events) != len(tt.events) {
+				t.Fatalf("期望 %d 个事件，实际 %+v", len(tt.events), events)
+			}
+			for i, event := range events {
+				if event.Event != tt.events[i] || event.ID != fmt.Sprint(i+1) {
+					t.Fatalf("第%d个事件错误: %+v", i+1, event)
+				}
+			}
+			last := events[len(events)-1]
+			if tt.code != "" && last.Data["code"] != tt.code {
+				t.Fatalf("错误码应为 %s，实际 %v", tt.code, last.Data)
+			}
+			if tt.code == "" && last.Data["metadata"] == nil {
+				t.Fatalf("message_end 应携带上游的元数据: %v", last.Data)
+			}
+		})
+	}
+
+	// 流开始前的上游错误仍以JSON返回
+	setupDifyServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	w := performRequest(router, http.MethodPost, "/api/chat", chatBody("", "你好", ""), bearer(ivan))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("上游请求失败时应返回502 JSON，实际 %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+// slowDify 模拟逐段输出回答的Dify，记录收到的停止请求和被取消的上游请求
+type slowDify struct {
+	seq      atomic.Int64
+	aborted  atomic.Int64
+	mu       sync.Mutex
+	stopUser map[string]string
+}
+
+func setupSlowDify(t *testing.T) *slowDify {
+	t.Helper()
+	dify := &slowDify{stopUser: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /chat-messages", func(w http.ResponseWriter, r *http.Request) {
+		n := dify.seq.Add(1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 200; i++ {
+			data, _ := json.Marshal(map[string]any{
+				"event": "message", "answer": "段", "task_id": fmt.Sprintf("task-%d", n),
+				"conversation_id": fmt.Sprintf("conversation-%d", n), "message_id": fmt.Sprintf("message-%d", n),
+			})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				dify.aborted.Add(1)
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	})
+	mux.HandleFunc("POST /chat-messages/{task_id}/stop", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			User string `json:"user"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		dify.mu.Lock()
+		dify.stopUser[r.PathValue("task_id")] = body.User
+		dify.mu.Unlock()
+		fmt.Fprint(w, `{"result":"success"}`)
+	})
+	setupDifyServer(t, mux)
+	return dify
+}
+
+// stoppedBy 返回Dify收到的停止请求中的用户名
+func (d *slowDify) stoppedBy(taskID string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	user, ok := d.stopUser[taskID]
+	return user, ok
+}
+
+// startChatStream 通过真实的HTTP连接发起聊天请求，返回逐条读取事件的reader
+func startChatStream(t *testing.T, baseURL, token, body string) (*bufio.Reader, func()) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, baseURL+"/api/chat", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("请求聊天接口失败: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		t.Fatalf("聊天接口返回 %d %s", resp.StatusCode, data)
+	}
+	return bufio.NewReader(resp.Body), func() { resp.Body.Close() }
+}
+
+// waitFor 等待条件成立，超时后测试失败
+func waitFor(t *testing.T, message string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readUntilMessageEnd 读取到message_end为止，之后流应结束
+func readUntilMessageEnd(t *testing.T, reader *bufio.Reader) sseEvent {
+	t.Helper()
+	for {
+		event, err := readSSEEvent(reader)
+		if err != nil {
+			t.Fatalf("停止后应收到message_end: %v", err)
+		}
+		if event.Event == ChatEventMessageEnd {
+			if _, err := readSSEEvent(reader); err != io.EOF {
+				t.Fatalf("message_end之后流应结束，实际 %v", err)
+			}
+			return event
+		}
+	}
+}
+
+func TestStopChat(t *testing.T) {
+	setupTestDB(t)
+	dify := setupSlowDify(t)
+	router := newTestRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	createTestUser(t, models.Users{Username: "vera"}, "Vera-Passw0rd")
+	createTestUser(t, models.Users{Username: "judy"}, "Judy-Passw0rd")
+	vera, judy := testAccessToken(t, "vera"), testAccessToken(t, "judy")
+
+	reader, closeStream := startChatStream(t, server.URL, vera, chatBody("vera", "请详细介绍玉米螟的防治方法", ""))
+	defer closeStream()
+	first, err := readSSEEvent(reader)
+	if err != nil || first.Event != ChatEventDelta {
+		t.Fatalf("应先收到delta，实际 %v %v", first, err)
+	}
+	taskID := first.Data["task_id"].(string)
+
+	// 不能以他人的用户名停止回答
+	w := performRequest(router, http.MethodPost, "/api/chat/"+taskID+"/stop?username=vera", "", bearer(judy))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("停止他人的回答应返回403，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	w = performRequest(router, http.MethodPost, "/api/chat/"+taskID+"/stop", "", bearer(vera))
+	if w.Code != http.StatusOK {
+		t.Fatalf("停止回答失败 %d %s", w.Code, w.Body.String())
+	}
+	if end := readUntilMessageEnd(t, reader); end.Data["stopped"] != true || end.Data["task_id"] != taskID {
+		t.Fatalf("message_end应标记stopped: %v", end.Data)
+	}
+	if user, ok := dify.stoppedBy(taskID); !ok || user != "vera" {
+		t.Fatalf("应以本人的用户名通知Dify停止生成，实际 %q %v", user, ok)
+	}
+	waitFor(t, "停止后应取消上游请求", func() bool { return dify.aborted.Load() == 1 })
+
+	// message_end发出前回答已保存，继续提问时能读到
+	var message models.ChatMessages
+	if err := DB.First(&message, "id = ?", first.Data["message_id"]).Error; err != nil || !message.Stopped {
+		t.Fatalf("被停止的回答应保存并标记stopped: %+v %v", message, err)
+	}
+	waitFor(t, "停止后应移除回答记录", func() bool { return !chatTasks.ownedBy(taskID, "vera") })
+}
+
+func TestStopDiagnosisChatScopedToCaller(t *testing.T) {
+	setupTestDB(t)
+	dify := setupSlowDify(t)
+	router := newTestRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	createTestUser(t, models.Users{Username: "ivan"}, "Ivan-Passw0rd")
+	createTestUser(t, models.Users{Username: "judy"}, "Judy-Passw0rd")
+	ivan, judy := testAccessToken(t, "ivan"), testAccessToken(t, "judy")
+
+	reader, closeStream := startChatStream(t, server.URL, ivan, chatBody(DiagnosisUsername, "玉米叶片出现褐色斑点怎么办", ""))
+	defer closeStream()
+	first, err := readSSEEvent(reader)
+	if err != nil || first.Event != ChatEventDelta {
+		t.Fatalf("应先收到delta，实际 %v %v", first, err)
+	}
+	taskID := first.Data["task_id"].(string)
+
+	// 诊断回答共用诊断用户名，其他用户不能停止，也不会通知Dify
+	w := performRequest(router, http.MethodPost, "/api/chat/"+taskID+"/stop?username="+DiagnosisUsername, "", bearer(judy))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("其他用户停止诊断回答应返回404，实际 %d %s", w.Code, w.Body.String())
+	}
+	if _, ok := dify.stoppedBy(taskID); ok {
+		t.Fatal("其他用户的停止请求不应转发给Dify")
+	}
+
+	w = performRequest(router, http.MethodPost, "/api/chat/"+taskID+"/stop?username="+DiagnosisUsername, "", bearer(ivan))
+	if w.Code != http.StatusOK {
+		t.Fatalf("发起者应能停止诊断回答，实际 %d %s", w.Code, w.Body.String())
+	}
+	if end := readUntilMessageEnd(t, reader); end.Data["stopped"] != true {
+		t.Fatalf("message_end应标记stopped: %v", end.Data)
+	}
+}
+
+func TestChatClientDisconnect(t *testing.T) {
+	setupTestDB(t)
+	dify := setupSlowDify(t)
+	router := newTestRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	createTestUser(t, models.Users{Username: "wade"}, "Wade-Passw0rd")
+	token := testAccessToken(t, "wade")
+
+	reader, closeStream := startChatStream(t, server.URL, token, chatBody("wade", "请详细介绍玉米大斑病的症状", ""))
+	first, err := readSSEEvent(reader)
+	if err != nil || first.Event != ChatEventDelta {
+		t.Fatalf("应先收到delta，实际 %v %v", first, err)
+	}
+	taskID := first.Data["task_id"].(string)
+	closeStream()
+
+	// 客户端断开后取消上游请求，并通知Dify停止生成
+	waitFor(t, "客户端断开后应通知Dify停止生成", func() bool {
+		user, ok := dify.stoppedBy(taskID)
+		return ok && user == "wade"
+	})
+	waitFor(t, "客户端断开后应取消上游请求", func() bool { return dify.aborted.Load() == 1 })
+	waitFor(t, "客户端断开后应移除回答记录", func() bool { return !chatTasks.ownedBy(taskID, "wade") })
+}
+
+func TestChatWithFakeBackend(t *testing.T) {
+	setupTestDB(t)
+	setupFakeBackend(t, 0)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "uma"}, "Uma-Passw0rd")
+	token := testAccessToken(t, "uma")
+
+	tests := []struct {
+		name    string
+		message string
+		last    string
+		answer  string
+	}{
+		{"完整回答", "玉米什么时候追肥", ChatEventMessageEnd, fakeAnswer("玉米什么时候追肥")},
+		{"后端返回错误", fakeErrorPrefix + "出错", ChatEventError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(router, http.MethodPost, "/api/chat", chatBody("uma", tt.message, ""), bearer(token))
+			if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/event-stream" {
+				t.Fatalf("应返回事件流，实际 %d %s", w.Code, w.Body.String())
+			}
+			events := readSSEEvents(t, w.Body.String())
+			for i, event := range events {
+				if event.ID != strconv.Itoa(i+1) {
+					t.Fatalf("事件序号应从1递增，实际 %+v", events)
+				}
+			}
+			end := events[len(events)-1]
+			if end.Event != tt.last || sseAnswer(events) != tt.answer {
+				t.Fatalf("期望以 %s 结束、回答 %q，实际 %s %q", tt.last, tt.answer, end.Event, sseAnswer(events))
+			}
+			if tt.last != ChatEventMessageEnd {
+				return
+			}
+
+			var message models.ChatMessages
+			if err := DB.First(&message, "id = ?", end.Data["message_id"]).Error; err != nil {
+				t.Fatalf("回答应保存到数据库: %v", err)
+			}
+			if message.Answer != tt.answer || message.Stopped || message.TotalTokens == 0 {
+				t.Fatalf("保存的回答错误: %+v", message)
+			}
+		})
+	}
+
+	// 不存在的会话在流开始前返回404
+	w := performRequest(router, http.MethodPost, "/api/chat", chatBody("uma", "继续", "fake-conversation-404"), bearer(token))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("不存在的会话应返回404，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestStopChatWithFakeBackend(t *testing.T) {
+	setupTestDB(t)
+	setupFakeBackend(t, 50*time.Millisecond)
+	router := newTestRouter()
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	createTestUser(t, models.Users{Username: "vera"}, "Vera-Passw0rd")
+	token := testAccessToken(t, "vera")
+
+	reader, closeStream := startChatStream(t, server.URL, token, chatBody("vera", "请详细介绍玉米螟的防治方法", ""))
+	defer closeStream()
+	first, err := readSSEEvent(reader)
+	if err != nil || first.Event != ChatEventDelta {
+		t.Fatalf("应先收到delta，实际 %v %v", first, err)
+	}
+	taskID := first.Data["task_id"].(string)
+
+	w := performRequest(router, http.MethodPost, "/api/chat/"+taskID+"/stop", "", bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("停止回答失败 %d %s", w.Code, w.Body.String())
+	}
+	if end := readUntilMessageEnd(t, reader); end.Data["stopped"] != true {
+		t.Fatalf("message_end应标记stopped: %v", end.Data)
+	}
+	if _, err := readSSEEvent(reader); err != io.EOF {
+		t.Fatalf("message_end之后流应结束，实际 %v", err)
+	}
+
+	// message_end发出前回答已保存，继续提问时能读到
+	var message models.ChatMessages
+	if err := DB.First(&message, "id = ?", first.Data["message_id"]).Error; err != nil || !message.Stopped {
+		t.Fatalf("被停止的回答应保存并标记stopped: %+v %v", message, err)
+	}
+	waitFor(t, "停止后应移除回答记录", func() bool { return !chatTasks.ownedBy(taskID, "vera") })
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"server-env.com/server/models"
+)
+
+const (
+	// 搜索关键词的最大长度和最多关键词数
+	maxSearchQueryLength = 100
+	maxSearchTerms       = 5
+	// MySQL ngram分词的默认长度，更短的关键词无法使用全文索引
+	ngramTokenSize = 2
+	// 高亮片段中关键词前后保留的字数
+	snippetRadius = 40
+)
+
+// searchTerms 将搜索内容按空白拆分为关键词，去掉全文检索的布尔运算符并去重
+func searchTerms(q string) []string {
+	operators := strings.NewReplacer(`+`, ` `, `-`, ` `, `<`, ` `, `>`, ` `, `(`, ` `, `)`, ` `,
+		`~`, ` `, `*`, ` `, `"`, ` `, `@`, ` `)
+	terms := []string{}
+	seen := map[string]bool{}
+	for _, term := range strings.Fields(operators.Replace(q)) {
+		key := strings.ToLower(term)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		terms = append(terms, term)
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+// isCJK 判断是否为中日韩文字，这些文字之间没有空格，需要按ngram切分
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// ngramTokens 将关键词切分为全文索引能匹配的词元
+// 连续的中日韩文字按ngramTokenSize切成相互重叠的片段，其余文字保持整段
+// 不足ngramTokenSize的片段无法使用全文索引，放在short中改用LIKE
+func ngramTokens(term string) (tokens, short []string) {
+	runes := []rune(term)
+	seen := map[string]bool{}
+	add := func(piece []rune) {
+		token := string(piece)
+		if seen[token] {
+			return
+		}
+		seen[token] = true
+		if len(piece) < ngramTokenSize {
+			short = append(short, token)
+		} else {
+			tokens = append(tokens, token)
+		}
+	}
+	for i := 0; i < len(runes); {
+		cjk := isCJK(runes[i])
+		j := i
+		for j < len(runes) && isCJK(runes[j]) == cjk {
+			j++
+		}
+		run := runes[i:j]
+		if cjk && len(run) > ngramTokenSize {
+			for k := 0; k+ngramTokenSize <= len(run); k++ {
+				add(run[k : k+ngramTokenSize])
+			}
+		} else {
+			add(run)
+		}
+		i = j
+	}
+	return tokens, short
+}
+
+// searchCondition 为关键词构造查询条件，所有关键词都要出现在提问或回答中
+// 能使用全文索引的词元都必须匹配，过短的片段使用LIKE
+func searchCondition(query *gorm.DB, terms []string) *gorm.DB {
+	phrases := []string{}
+	for _, term := range terms {
+		tokens, short := ngramTokens(term)
+		for _, token := range tokens {
+			phrases = append(phrases, `+"`+token+`"`)
+		}
+		for _, piece := range short {
+			pattern := "%" + escapeLike(piece) + "%"
+			query = query.Where("(chat_messages.query LIKE ? OR chat_messages.answer LIKE ?)", pattern, pattern)
+		}
+	}
+	if len(phrases) > 0 {
+		query = query.Where("MATCH(chat_messages.query, chat_messages.answer) AGAINST(? IN BOOLEAN MODE)", strings.Join(phrases, " "))
+	}
+	return query
+}
+
+// searchableMessages 用户可以搜索的消息
+// 诊断消息保存在公共诊断用户名下，diagnosis为true时包含其中由用户发起的部分
+func searchableMessages(username string, diagnosis bool) *gorm.DB {
+	owned := DB.Where("chat_messages.username = ?", username)
+	if diagnosis {
+		owned = owned.Or("chat_messages.username = ? AND chat_messages.id IN (?)", DiagnosisUsername,
+			DB.Model(&models.DiagnosisMessages{}).Select("id").Where("username = ?", username))
+	}
+	return DB.Model(&models.ChatMessages{}).Where(owned)
+}
+
+// lowerRunes 逐字转为小写，字数不变，文本和关键词都用它转换才能按位置对应
+func lowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// highlightSnippet 截取文本中第一个关键词附近的片段，关键词用<mark>标出，其余内容做HTML转义
+// 文本中没有关键词时返回开头的片段
+func highlightSnippet(text string, terms []string) string {
+	runes := []rune(text)
+	lower := lowerRunes(text)
+
+	// 标记每个字是否属于某个关键词
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		needle := lowerRunes(term)
+		if len(needle) == 0 {
+			continue
+		}
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if string(lower[i:i+len(needle)]) != string(needle) {
+				continue
+			}
+			for j := i; j < i+len(needle); j++ {
+				marked[j] = true
+			}
+			if first == -1 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start, end := 0, min(len(runes), 2*snippetRadius)
+	if first != -1 {
+		start = max(0, first-snippetRadius)
+		end = min(len(runes), first+snippetRadius)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		segment := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			b.WriteString("<mark>" + segment + "</mark>")
+		} else {
+			b.WriteString(segment)
+		}
+		i = j
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// userLocation 返回用户资料中的时区，未设置或无效时使用服务器时区
+func userLocation(username string) *time.Location {
+	var user models.Users
+	if err := DB.Select("timezone").Where("username = ?", username).First(&user).Error; err != nil {
+		return time.Local
+	}
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil || user.Timezone == "" {
+		return time.Local
+	}
+	return location
+}
+
+// parseSearchDate 解析日期筛选，支持RFC3339和按用户时区解释的日期，endOfDay为true时取次日零点
+func parseSearchDate(value string, location *time.Location, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// SearchChatHistory 按关键词搜索用户的聊天记录，可按日期范围筛选
+// 只搜索已保存到数据库的消息，结果按相关度排序，diagnosis为true的结果属于诊断会话
+func SearchChatHistory(c *gin.Context) {
+	username, ok := resolveUsername(c, c.Query("username"))
+	if !ok {
+		return
+	}
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "搜索内容不能为空"})
+		return
+	}
+	if utf8.RuneCountInString(q) > maxSearchQueryLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "搜索内容过长"})
+		return
+	}
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "搜索内容不能为空"})
+		return
+	}
+	page, pageSize := parsePagination(c)
+
+	query := searchCondition(searchableMessages(username, CurrentIdentity(c).HasScope(ScopeDiagnosis)), terms)
+	location := userLocation(username)
+	if from := c.Query("from"); from != "" {
+		t, err := parseSearchDate(from, location, false)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from 日期格式错误"})
+			return
+		}
+		query = query.Where("chat_messages.created_at >= ?", t)
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := parseSearchDate(to, location, true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to 日期格式错误"})
+			return
+		}
+		query = query.Where("chat_messages.created_at < ?", t)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var results []struct {
+		models.ChatMessages
+		ConversationName string
+	}
+	err := query.Select("chat_messages.*, chat_conversations.name AS conversation_name").
+		Joins("LEFT JOIN chat_conversations ON chat_conversations.id = chat_messages.conversation_id").
+		// 按相关度排序，相关度相同时较新的在前
+		Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "MATCH(chat_messages.query, chat_messages.answer) AGAINST(? IN NATURAL LANGUAGE MODE) DESC, chat_messages.created_at DESC",
+			Vars:               []any{strings.Join(terms, " ")},
+			WithoutParentheses: true,
+		}}).
+		Offset((page - 1) * pageSize).
+		Limit(pageSize).
+		Find(&results).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(results))
+	for i, result := range results {
+		data[i] = gin.H{
+			"conversation_id":   result.ConversationID,
+			"conversation_name": result.ConversationName,
+			"message_id":        result.ID,
+			"query":             highlightSnippet(result.Query, terms),
+			"answer":            highlightSnippet(result.Answer, terms),
+			"created_at":        result.CreatedAt.Unix(),
+			"diagnosis":         result.Username == DiagnosisUsername,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"results": data, "total": total, "page": page, "page_size": pageSize})
+}
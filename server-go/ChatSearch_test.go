@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+func TestHighlightSnippet(t *testing.T) {
+	long := strings.Repeat("甲", 50) + "关键词" + strings.Repeat("乙", 50)
+	tests := []struct {
+		name    string
+		text    string
+		terms   []string
+		snippet string
+	}{
+		{"忽略大小写", "Hello World", []string{"world"}, "Hello <mark>World</mark>"},
+		{"非ASCII字母大小写", "İstanbul gezisi", []string{"İstanbul"}, "<mark>İstanbul</mark> gezisi"},
+		{"关键词大写文本小写", "istanbul gezisi", []string{"İSTANBUL"}, "<mark>istanbul</mark> gezisi"},
+		{"多个关键词", "土壤施肥与土壤改良", []string{"土壤", "改良"}, "<mark>土壤</mark>施肥与<mark>土壤改良</mark>"},
+		{"转义HTML", "a<b>c", []string{"b"}, "a&lt;<mark>b</mark>&gt;c"},
+		{"截取关键词附近", long, []string{"关键词"},
+			"…" + strings.Repeat("甲", snippetRadius) + "<mark>关键词</mark>" + strings.Repeat("乙", snippetRadius-3) + "…"},
+		{"没有关键词时取开头", long, []string{"不存在"}, strings.Repeat("甲", 50) + "关键词" + strings.Repeat("乙", 2*snippetRadius-53) + "…"},
+	}
+	for _, tt := range tests {
+		if got := highlightSnippet(tt.text, tt.terms); got != tt.snippet {
+			t.Errorf("%s:\n期望 %s\n实际 %s", tt.name, tt.snippet, got)
+		}
+	}
+}
+
+func TestNgramTokens(t *testing.T) {
+	tests := []struct {
+		term   string
+		tokens []string
+		short  []string
+	}{
+		{"玉米", []string{"玉米"}, nil},
+		{"土壤改良", []string{"土壤", "壤改", "改良"}, nil},
+		{"病", nil, []string{"病"}},
+		{"fertilizer", []string{"fertilizer"}, nil},
+		{"N肥", nil, []string{"N", "肥"}},
+		{"pH值偏低", []string{"pH", "值偏", "偏低"}, nil},
+		{"哈哈哈", []string{"哈哈"}, nil},
+	}
+	for _, tt := range tests {
+		tokens, short := ngramTokens(tt.term)
+		if !slices.Equal(tokens, tt.tokens) || !slices.Equal(short, tt.short) {
+			t.Errorf("%s: 期望 %v %v，实际 %v %v", tt.term, tt.tokens, tt.short, tokens, short)
+		}
+	}
+}
+
+func TestSearchableMessagesIncludesOwnDiagnosis(t *testing.T) {
+	setupTestDB(t)
+	DB.Create(&[]models.ChatMessages{
+		{ID: "m1", ConversationID: "c1", Username: "alice"},
+		{ID: "m2", ConversationID: "c2", Username: "bob"},
+		{ID: "d1", ConversationID: "d", Username: DiagnosisUsername},
+		{ID: "d2", ConversationID: "d", Username: DiagnosisUsername},
+	})
+	recordDiagnosisMessage("d1", "d", "alice")
+	recordDiagnosisMessage("d2", "d", "bob")
+
+	var ids []string
+	searchableMessages("alice", true).Order("id").Pluck("id", &ids)
+	if !slices.Equal(ids, []string{"d1", "m1"}) {
+		t.Fatalf("应包含自己发起的诊断消息，实际 %v", ids)
+	}
+	ids = nil
+	searchableMessages("alice", false).Order("id").Pluck("id", &ids)
+	if !slices.Equal(ids, []string{"m1"}) {
+		t.Fatalf("没有诊断权限时只包含自己的消息，实际 %v", ids)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 聊天接口的SSE协议
+//
+// 响应头 X-Chat-Protocol 为协议版本，协议有不兼容的变更时递增。
+// 每条消息由 id(从1递增的序号)、event(事件类型)和 data(JSON) 组成:
+//
+//	id: 1
+//	event: delta
+//	data: {"conversation_id":"...","message_id":"...","task_id":"...","text":"你好"}
+//
+// 事件类型:
+//   - delta: 回答的增量文本，前端按顺序拼接，task_id 用于调用停止接口
+//   - message_end: 回答结束，携带对话ID、消息ID和用量等元数据，之后连接关闭
+//     通过停止接口提前结束时 stopped 为true
+//   - error: 出错，携带错误码和错误信息，之后连接关闭
+//   - ping: 心跳，模型长时间没有输出时定期发送，前端忽略即可
+//   - replace: 用 text 替换已输出的全部回答，内容审查命中时出现
+//   - agent_step: 智能体的思考和工具调用步骤，同一步骤会以相同 id 多次发送，前端按 id 更新
+//   - file: 回答中生成的文件，如图片
+//   - workflow: 工作流和节点的开始、结束，phase 为 started、node_started、node_finished 或 finished
+//   - audio: 语音合成的音频片段(base64)，end 为true时表示音频结束
+//
+// 前端应忽略不认识的事件类型，新增事件类型不会提升协议版本。
+//
+// 一次回答以 message_end 或 error 之一结束。上游请求失败等流开始前的错误
+// 仍以普通JSON响应和对应的HTTP状态码返回。
+const chatStreamProtocolVersion = 1
+
+// 聊天流事件类型
+const (
+	ChatEventDelta      = "delta"
+	ChatEventMessageEnd = "message_end"
+	ChatEventError      = "error"
+	ChatEventPing       = "ping"
+	ChatEventReplace    = "replace"
+	ChatEventAgentStep  = "agent_step"
+	ChatEventFile       = "file"
+	ChatEventWorkflow   = "workflow"
+	ChatEventAudio      = "audio"
+)
+
+// error 事件的错误码
+const (
+	// 上游在流中返回了错误
+	ChatErrorUpstream = "upstream_error"
+	// 读取上游响应出错
+	ChatErrorUpstreamRead = "upstream_read_error"
+	// 上游响应在回答结束前中断
+	ChatErrorIncomplete = "stream_incomplete"
+)
+
+// 模型没有输出超过该时长时发送心跳(秒)
+var CHAT_PING_INTERVAL = time.Duration(getEnvIntOrDefault("CHAT_PING_INTERVAL", 15)) * time.Second
+
+func init() {
+	if CHAT_PING_INTERVAL < 2*time.Second {
+		CHAT_PING_INTERVAL = 2 * time.Second
+	}
+}
+
+// ChatDeltaEvent 是 delta 事件的数据
+type ChatDeltaEvent struct {
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"message_id"`
+	TaskID         string `json:"task_id"`
+	Text           string `json:"text"`
+}
+
+// ChatMessageEndEvent 是 message_end 事件的数据
+type ChatMessageEndEvent struct {
+	ConversationID string          `json:"conversation_id"`
+	MessageID      string          `json:"message_id"`
+	TaskID         string          `json:"task_id"`
+	Metadata       json.RawMessage `json:"metadata,omitempty"`
+	// 通过停止接口提前结束时为true
+	Stopped bool `json:"stopped,omitempty"`
+}
+
+// ChatErrorEvent 是 error 事件的数据
+type ChatErrorEvent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// 上游返回的原始错误码
+	UpstreamCode string `json:"upstream_code,omitempty"`
+}
+
+// ChatReplaceEvent 是 replace 事件的数据
+type ChatReplaceEvent struct {
+	ConversationID string `json:"conversation_id"`
+	MessageID      string `json:"message_id"`
+	TaskID         string `json:"task_id"`
+	Text           string `json:"text"`
+}
+
+// ChatAgentStepEvent 是 agent_step 事件的数据
+type ChatAgentStepEvent struct {
+	ID          string   `json:"id"`
+	MessageID   string   `json:"message_id"`
+	Position    int      `json:"position"`
+	Thought     string   `json:"thought"`
+	Tool        string   `json:"tool"`
+	ToolInput   string   `json:"tool_input"`
+	Observation string   `json:"observation"`
+	FileIDs     []string `json:"file_ids"`
+}
+
+// ChatFileEvent 是 file 事件的数据
+type ChatFileEvent struct {
+	ID        string `json:"id"`
+	MessageID string `json:"message_id"`
+	Type      string `json:"type"`
+	BelongsTo string `json:"belongs_to"`
+	URL       string `json:"url"`
+}
+
+// ChatWorkflowEvent 是 workflow 事件的数据
+type ChatWorkflowEvent struct {
+	Phase         string  `json:"phase"`
+	WorkflowRunID string  `json:"workflow_run_id"`
+	NodeID        string  `json:"node_id,omitempty"`
+	NodeType      string  `json:"node_type,omitempty"`
+	Title         string  `json:"title,omitempty"`
+	Index         int     `json:"index,omitempty"`
+	Status        string  `json:"status,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	ElapsedTime   float64 `json:"elapsed_time,omitempty"`
+	TotalTokens   int     `json:"total_tokens,omitempty"`
+}
+
+// ChatAudioEvent 是 audio 事件的数据
+type ChatAudioEvent struct {
+	MessageID string `json:"message_id"`
+	Audio     string `json:"audio"`
+	End       bool   `json:"end"`
+}
+
+// ChatPingEvent 是 ping 事件的数据
+type ChatPingEvent struct {
+	Time int64 `json:"time"`
+}
+
+// chatStream 按聊天SSE协议向前端写事件
+type chatStream struct {
+	c   *gin.Context
+	seq int
+	// 最后一次写事件的时间，用于决定是否需要发送心跳
+	lastWrite time.Time
+}
+
+// newChatStream 写入SSE响应头并开始事件流
+func newChatStream(c *gin.Context) *chatStream {
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// 关闭Nginx等反向代理的缓冲，保证事件及时送达
+	header.Set("X-Accel-Buffering", "no")
+	header.Set("X-Chat-Protocol", strconv.Itoa(chatStreamProtocolVersion))
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	return &chatStream{c: c, lastWrite: time.Now()}
+}
+
+// send 写入一个事件并立即刷新
+func (s *chatStream) send(event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	if _, err := fmt.Fprintf(s.c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", s.seq, event, payload); err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	s.lastWrite = time.Now()
+	return nil
+}
+
+// sendError 写入 error 事件
+func (s *chatStream) sendError(code, message string) error {
+	return s.send(ChatEventError, ChatErrorEvent{Code: code, Message: message})
+}
+
+// pingIfIdle 距上次写事件超过心跳间隔时发送 ping
+func (s *chatStream) pingIfIdle(now time.Time) error {
+	if now.Sub(s.lastWrite) < CHAT_PING_INTERVAL {
+		return nil
+	}
+	return s.send(ChatEventPing, ChatPingEvent{Time: now.Unix()})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestChatStream() (*chatStream, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+	return newChatStream(c), w
+}
+
+func TestChatStreamHeaders(t *testing.T) {
+	_, w := newTestChatStream()
+	tests := map[string]string{
+		"Content-Type":      "text/event-stream",
+		"Cache-Control":     "no-cache",
+		"X-Accel-Buffering": "no",
+		"X-Chat-Protocol":   "1",
+	}
+	for name, value := range tests {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("响应头 %s 应为 %s，实际 %s", name, value, got)
+		}
+	}
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("开始事件流时只写响应头，实际 %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestChatStreamFraming(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		data  any
+		frame string
+	}{
+		{"增量", ChatEventDelta, ChatDeltaEvent{ConversationID: "c", MessageID: "m", TaskID: "t", Text: "你好"},
+			"id: 1\nevent: delta\ndata: {\"conversation_id\":\"c\",\"message_id\":\"m\",\"task_id\":\"t\",\"text\":\"你好\"}\n\n"},
+		{"换行在data中转义", ChatEventDelta, ChatDeltaEvent{Text: "第一行\n\ndata: 伪造"},
+			"id: 2\nevent: delta\ndata: {\"conversation_id\":\"\",\"message_id\":\"\",\"task_id\":\"\",\"text\":\"第一行\\n\\ndata: 伪造\"}\n\n"},
+		{"停止", ChatEventMessageEnd, ChatMessageEndEvent{ConversationID: "c", MessageID: "m", TaskID: "t", Stopped: true},
+			"id: 3\nevent: message_end\ndata: {\"conversation_id\":\"c\",\"message_id\":\"m\",\"task_id\":\"t\",\"stopped\":true}\n\n"},
+		{"错误", ChatEventError, ChatErrorEvent{Code: ChatErrorIncomplete, Message: "中断"},
+			"id: 4\nevent: error\ndata: {\"code\":\"stream_incomplete\",\"message\":\"中断\"}\n\n"},
+	}
+	stream, w := newTestChatStream()
+	for _, tt := range tests {
+		w.Body.Reset()
+		if err := stream.send(tt.event, tt.data); err != nil {
+			t.Fatalf("%s: 写入失败: %v", tt.name, err)
+		}
+		if got := w.Body.String(); got != tt.frame {
+			t.Errorf("%s:\n期望 %q\n实际 %q", tt.name, tt.frame, got)
+		}
+	}
+
+	// 无法编码的数据不写入，也不占用序号
+	w.Body.Reset()
+	if err := stream.send(ChatEventDelta, make(chan int)); err == nil || w.Body.Len() != 0 {
+		t.Fatalf("无法编码的数据应返回错误且不写入，实际 %v %q", err, w.Body.String())
+	}
+	stream.send(ChatEventPing, ChatPingEvent{Time: 1})
+	if events := readSSEEvents(t, w.Body.String()); len(events) != 1 || events[0].ID != "5" {
+		t.Fatalf("序号应连续，实际 %+v", events)
+	}
+}
+
+func TestChatStreamPingIfIdle(t *testing.T) {
+	stream, w := newTestChatStream()
+	start := stream.lastWrite
+
+	tests := []struct {
+		name  string
+		now   time.Time
+		pings int
+	}{
+		{"未到心跳间隔", start.Add(CHAT_PING_INTERVAL - time.Millisecond), 0},
+		{"到达心跳间隔", start.Add(CHAT_PING_INTERVAL), 1},
+	}
+	for _, tt := range tests {
+		w.Body.Reset()
+		stream.lastWrite = start
+		if err := stream.pingIfIdle(tt.now); err != nil {
+			t.Fatalf("%s: 写入失败: %v", tt.name, err)
+		}
+		events := readSSEEvents(t, w.Body.String())
+		if len(events) != tt.pings {
+			t.Fatalf("%s: 期望 %d 个心跳，实际 %+v", tt.name, tt.pings, events)
+		}
+		if tt.pings > 0 && (events[0].Event != ChatEventPing || int64(events[0].Data["time"].(float64)) != tt.now.Unix()) {
+			t.Fatalf("%s: 心跳内容错误 %+v", tt.name, events[0])
+		}
+	}
+
+	// 写入事件后重新计时
+	stream.send(ChatEventDelta, ChatDeltaEvent{Text: "x"})
+	w.Body.Reset()
+	stream.pingIfIdle(time.Now().Add(CHAT_PING_INTERVAL / 2))
+	if w.Body.Len() != 0 {
+		t.Fatalf("刚写过事件时不应发送心跳: %q", w.Body.String())
+	}
+}
@@ -13,6 +13,31 @@ import (
 
 var DB *gorm.DB
 
+// databaseModels 需要自动迁移的数据表
+var databaseModels = []interface{}{
+	&models.Users{},
+	&models.DiagnosisMessages{},
+	&models.Sessions{},
+	&models.LoginAttempts{},
+	&models.CaptchaChallenges{},
+	&models.PasswordResets{},
+	&models.ExternalIdentities{},
+	&models.APIKeys{},
+	&models.RecoveryCodes{},
+	&models.Settings{},
+	&models.AuditLogs{},
+	&models.Organizations{},
+	&models.OrganizationMembers{},
+	&models.OrganizationInvitations{},
+	&models.SharedResources{},
+	&models.DiagnosisRecords{},
+	&models.FieldRecords{},
+	&models.InvitationCodes{},
+	&models.ChatConversations{},
+	&models.ChatMessages{},
+	&models.ChatSyncStates{},
+}
+
 // 数据库配置结构体
 type DatabaseConfig struct {
 	DBName   string
@@ -71,7 +96,7 @@ func InitDatabase() error {
 	sqlDB.SetConnMaxLifetime(time.Hour) // 连接最大生命周期
 
 	// 自动迁移模型
-	err = db.AutoMigrate(&models.Users{})
+	err = db.AutoMigrate(databaseModels...)
 	if err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
@@ -84,3 +109,24 @@ func InitDatabase() error {
 func GetDB() *gorm.DB {
 	return DB
 }
+
+// GetSetting 读取系统设置，不存在时返回空字符串
+func GetSetting(key string) (string, error) {
+	var setting models.Settings
+	result := DB.Where("`key` = ?", key).First(&setting)
+	if result.Error == gorm.ErrRecordNotFound {
+		return "", nil
+	} else if result.Error != nil {
+		return "", result.Error
+	}
+	return setting.Value, nil
+}
+
+// PutSetting 写入系统设置
+func PutSetting(key, value, updatedBy string) error {
+	return DB.Save(&models.Settings{
+		Key:       key,
+		Value:     value,
+		UpdatedBy: updatedBy,
+	}).Error
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"gorm.io/gorm/clause"
+	"server-env.com/server/models"
+)
+
+// recordDiagnosisMessage 记录诊断消息的发起者，同一消息只记录一次
+func recordDiagnosisMessage(messageID, conversationID, owner string) error {
+	return DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DiagnosisMessages{
+		ID:             messageID,
+		ConversationID: conversationID,
+		Username:       owner,
+	}).Error
+}
+
+// diagnosisConversationOwned 诊断会话共用诊断用户名，判断会话是否由caller发起
+func diagnosisConversationOwned(conversationID, caller string) (bool, error) {
+	var count int64
+	err := DB.Model(&models.DiagnosisMessages{}).
+		Where("conversation_id = ? AND username = ?", conversationID, caller).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// diagnosisMessageOwned 判断诊断消息是否由caller发起
+func diagnosisMessageOwned(messageID, caller string) (bool, error) {
+	var count int64
+	err := DB.Model(&models.DiagnosisMessages{}).
+		Where("id = ? AND username = ?", messageID, caller).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// diagnosisConversationIDs 返回用户发起的全部诊断会话ID
+func diagnosisConversationIDs(username string) ([]string, error) {
+	ids := []string{}
+	err := DB.Model(&models.DiagnosisMessages{}).
+		Where("username = ?", username).
+		Distinct().
+		Pluck("conversation_id", &ids).Error
+	return ids, err
+}
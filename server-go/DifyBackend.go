@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+var (
+	DIFY_API_KEY  = os.Getenv("DIFY_API_KEY")
+	DIFY_BASE_URL = getEnvOrDefault("DIFY_BASE_URL", "https://api.dify.ai/v1")
+	ALL_PROXY     = os.Getenv("ALL_PROXY")
+	USE_PROXY     = ALL_PROXY != ""
+	PAGE_LIMIT    = 20
+	difyClient    = resty.New()
+)
+
+func init() {
+	// 配置Dify客户端
+	difyClient.SetBaseURL(DIFY_BASE_URL)
+
+	// 配置代理
+	if USE_PROXY && ALL_PROXY != "" {
+		difyClient.SetProxy(ALL_PROXY)
+	}
+
+	// 设置超时时间
+	difyClient.SetTimeout(10 * time.Minute)
+}
+
+// ChatMessageRequest 是向Dify发送的聊天消息请求结构体
+type ChatMessageRequest struct {
+	Query          string                 `json:"query"`
+	User           string                 `json:"user"`
+	Inputs         map[string]interface{} `json:"inputs"`
+	Files          []map[string]string    `json:"files"`
+	ConversationID string                 `json:"conversation_id"`
+	Stream         string                 `json:"response_mode"`
+}
+
+// DifyBackend 通过Dify的应用API提供聊天，会话保存在Dify中
+type DifyBackend struct{}
+
+// difyRequest 创建带认证头的Dify请求
+func difyRequest(ctx context.Context) *resty.Request {
+	return difyClient.R().
+		SetContext(ctx).
+		SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
+		SetHeader("Content-Type", "application/json")
+}
+
+func (b *DifyBackend) StreamChat(ctx context.Context, req ChatBackendRequest) (<-chan ChatStreamEvent, error) {
+	files := make([]map[string]string, len(req.FileIDs))
+	for i, fileID := range req.FileIDs {
+		files[i] = map[string]string{
+			"type":            "image",
+			"transfer_method": "local_file",
+			"upload_file_id":  fileID,
+		}
+	}
+
+	// 构建Dify请求
+	chatReq := ChatMessageRequest{
+		Query:          req.Query,
+		User:           req.Username,
+		Inputs:         make(map[string]interface{}),
+		Files:          files,
+		ConversationID: req.ConversationID,
+		Stream:         "streaming",
+	}
+	resp, err := difyRequest(ctx).
+		SetBody(chatReq).
+		SetDoNotParseResponse(true).
+		Post("/chat-messages")
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		resp.RawResponse.Body.Close()
+		return nil, fmt.Errorf("AI服务异常: %s", resp.Status())
+	}
+
+	events := make(chan ChatStreamEvent)
+	go func() {
+		defer close(events)
+		defer resp.RawResponse.Body.Close()
+
+		difyEvents := make(chan difyStreamEvent)
+		readErr := make(chan error, 1)
+		go func() {
+			readErr <- readDifyStream(resp.RawResponse.Body, difyEvents, ctx.Done())
+			close(difyEvents)
+		}()
+
+		var ids difyStreamIDs
+		for event := range difyEvents {
+			if event.ConversationID != "" {
+				ids.ConversationID = string(event.ConversationID)
+			}
+			if event.MessageID != "" {
+				ids.MessageID = string(event.MessageID)
+			}
+			if event.TaskID != "" {
+				ids.TaskID = string(event.TaskID)
+			}
+			chatEvent, ok := chatEventFromDify(&event, ids)
+			if !ok {
+				continue
+			}
+			if !sendChatEvent(ctx, events, chatEvent) || chatEvent.terminal() {
+				return
+			}
+		}
+
+		// 上游在回答结束前关闭了响应，取消导致的中断由调用方处理
+		if err := <-readErr; err != nil && ctx.Err() == nil {
+			fmt.Println("读取AI服务响应出错:", err)
+			sendChatEvent(ctx, events, ChatStreamEvent{
+				Type: ChatEventError,
+				Data: ChatErrorEvent{Code: ChatErrorUpstreamRead, Message: "读取AI服务响应出错"},
+			})
+		}
+	}()
+	return events, nil
+}
+
+// StopChat 调用Dify的停止接口结束生成，Dify会校验任务属于该用户
+func (b *DifyBackend) StopChat(ctx context.Context, username, taskID string) error {
+	resp, err := difyRequest(ctx).
+		SetBody(map[string]string{"user": username}).
+		Post("/chat-messages/" + url.PathEscape(taskID) + "/stop")
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("Dify返回错误: %s", resp.Status())
+	}
+	return nil
+}
+
+func (b *DifyBackend) Suggestions(ctx context.Context, username, messageID string) ([]string, error) {
+	resp, err := difyRequest(ctx).
+		SetQueryParam("user", username).
+		Get(fmt.Sprintf("/messages/%s/suggested", url.PathEscape(messageID)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, errors.New(resp.Status())
+	}
+
+	var result struct {
+		Data difyStrings `json:"data"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, err
+	}
+	if result.Data == nil {
+		return []string{}, nil
+	}
+	return result.Data, nil
+}
+
+// difyConversation 是Dify会话列表中的一项
+type difyConversation struct {
+	ID        difyString `json:"id"`
+	Name      difyString `json:"name"`
+	CreatedAt difyNumber `json:"created_at"`
+	UpdatedAt difyNumber `json:"updated_at"`
+}
+
+// ListConversations 获取用户在Dify中的一页会话，按创建时间倒序
+func (b *DifyBackend) ListConversations(ctx context.Context, username, lastID string, limit int) ([]ChatConversation, bool, error) {
+	params := map[string]string{
+		"user":    username,
+		"limit":   fmt.Sprintf("%d", limit),
+		"sort_by": "-created_at",
+	}
+	if lastID != "" {
+		params["last_id"] = lastID
+	}
+
+	resp, err := difyRequest(ctx).
+		SetQueryParams(params).
+		Get("/conversations")
+	if err != nil {
+		return nil, false, err
+	}
+	// last_id对应的会话已被删除
+	if resp.StatusCode() == http.StatusNotFound {
+		return nil, false, ErrConversationNotFound
+	}
+	if resp.IsError() {
+		return nil, false, fmt.Errorf("AI服务异常: %s", resp.Status())
+	}
+
+	var result struct {
+		Data    []difyConversation `json:"data"`
+		HasMore bool               `json:"has_more"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, false, err
+	}
+
+	conversations := make([]ChatConversation, len(result.Data))
+	for i, conversation := range result.Data {
+		conversations[i] = ChatConversation{
+			ID:        string(conversation.ID),
+			Name:      string(conversation.Name),
+			CreatedAt: int64(conversation.CreatedAt),
+			UpdatedAt: int64(conversation.UpdatedAt),
+		}
+	}
+	return conversations, result.HasMore && len(conversations) > 0, nil
+}
+
+// ListAllConversationIDs 分页获取用户在Dify中的全部会话ID
+func (b *DifyBackend) ListAllConversationIDs(ctx context.Context, username string) ([]string, error) {
+	ids := []string{}
+	lastID := ""
+
+	for {
+		conversations, hasMore, err := b.ListConversations(ctx, username, lastID, 100)
+		if err != nil {
+			return nil, err
+		}
+		for _, conversation := range conversations {
+			ids = append(ids, conversation.ID)
+		}
+		if !hasMore {
+			break
+		}
+		lastID = conversations[len(conversations)-1].ID
+	}
+
+	return ids, nil
+}
+
+// difyMessage 是Dify消息列表中的一轮问答
+type difyMessage struct {
+	ID           difyString `json:"id"`
+	Query        difyString `json:"query"`
+	Answer       difyString `json:"answer"`
+	CreatedAt    difyNumber `json:"created_at"`
+	MessageFiles []struct {
+		ID        difyString `json:"id"`
+		Type      difyString `json:"type"`
+		URL       difyString `json:"url"`
+		BelongsTo difyString `json:"belongs_to"`
+	} `json:"message_files"`
+}
+
+// History 分页获取会话的全部消息，按时间正序返回
+func (b *DifyBackend) History(ctx context.Context, username, conversationID string) ([]ChatHistoryMessage, error) {
+	history := []ChatHistoryMessage{}
+	firstID := ""
+
+	for {
+		// 构建请求参数
+		params := map[string]string{
+			"conversation_id": conversationID,
+			"user":            username,
+			"limit":           fmt.Sprintf("%d", PAGE_LIMIT),
+		}
+		if firstID != "" {
+			params["first_id"] = firstID
+		}
+
+		resp, err := difyRequest(ctx).
+			SetQueryParams(params).
+			Get("/messages")
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() == http.StatusNotFound {
+			return nil, ErrConversationNotFound
+		}
+		if resp.IsError() {
+			return nil, errors.New(resp.Status())
+		}
+
+		var result struct {
+			Data    []difyMessage `json:"data"`
+			HasMore bool          `json:"has_more"`
+		}
+		if err := json.Unmarshal(resp.Body(), &result); err != nil {
+			return nil, err
+		}
+
+		for _, message := range result.Data {
+			files := make([]ChatMessageFile, len(message.MessageFiles))
+			for j, file := range message.MessageFiles {
+				files[j] = ChatMessageFile{
+					ID:        string(file.ID),
+					Type:      string(file.Type),
+					URL:       difyFileURL(string(file.URL)),
+					BelongsTo: string(file.BelongsTo),
+				}
+			}
+			history = append([]ChatHistoryMessage{{
+				ID:           string(message.ID),
+				Query:        string(message.Query),
+				Answer:       string(message.Answer),
+				MessageFiles: files,
+				CreatedAt:    int64(message.CreatedAt),
+			}}, history...)
+		}
+
+		// 检查是否还有更多消息
+		if !result.HasMore || len(result.Data) == 0 {
+			break
+		}
+		firstID = string(result.Data[0].ID)
+	}
+
+	return history, nil
+}
+
+// ConversationExists 判断会话是否存在且属于该用户
+func (b *DifyBackend) ConversationExists(ctx context.Context, username, conversationID string) (bool, error) {
+	resp, err := difyRequest(ctx).
+		SetQueryParams(map[string]string{
+			"conversation_id": conversationID,
+			"user":            username,
+			"limit":           "1",
+		}).
+		Get("/messages")
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.IsError() {
+		return false, fmt.Errorf("AI服务异常: %s", resp.Status())
+	}
+	return true, nil
+}
+
+// DeleteConversation 删除用户在Dify中的一个会话
+func (b *DifyBackend) DeleteConversation(ctx context.Context, username, conversationID string) error {
+	resp, err := difyRequest(ctx).
+		SetBody(map[string]string{"user": username}).
+		Delete(fmt.Sprintf("/conversations/%s", url.PathEscape(conversationID)))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode() == http.StatusNotFound {
+		return ErrConversationNotFound
+	}
+	if resp.IsError() {
+		return fmt.Errorf("AI服务异常: %s", resp.Status())
+	}
+	return nil
+}
+
+// UploadFile 上传文件到Dify，返回Dify的文件ID
+func (b *DifyBackend) UploadFile(ctx context.Context, username, filename string, data []byte) (string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	fileField, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return "", fmt.Errorf("创建表单文件字段失败: %w", err)
+	}
+	if _, err := fileField.Write(data); err != nil {
+		return "", fmt.Errorf("写入文件内容失败: %w", err)
+	}
+	if err := writer.WriteField("user", username); err != nil {
+		return "", fmt.Errorf("写入用户字段失败: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("关闭表单写入器失败: %w", err)
+	}
+
+	resp, err := difyClient.R().
+		SetContext(ctx).
+		SetHeader("Authorization", "Bearer "+DIFY_API_KEY).
+		SetHeader("Content-Type", writer.FormDataContentType()).
+		SetBody(buf.Bytes()).
+		Post("/files/upload")
+	if err != nil {
+		return "", err
+	}
+	if resp.IsError() {
+		return "", errors.New(resp.Status())
+	}
+
+	var result struct {
+		ID difyString `json:"id"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return "", fmt.Errorf("响应解析失败: %w", err)
+	}
+	return string(result.ID), nil
+}
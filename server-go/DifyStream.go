@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// difyString 容错的字符串字段，Dify不同版本可能返回数字、布尔或null，
+// 统一转换为字符串，对象和数组保留原始JSON，不会因类型不符导致整条事件解析失败
+type difyString string
+
+func (s *difyString) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0 || string(data) == "null":
+		*s = ""
+	case data[0] == '"':
+		var v string
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*s = difyString(v)
+	default:
+		*s = difyString(data)
+	}
+	return nil
+}
+
+// difyStrings 容错的字符串数组字段，单个值视为只有一个元素的数组
+type difyStrings []string
+
+func (s *difyStrings) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var items []difyString
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		*s = make([]string, 0, len(items))
+		for _, item := range items {
+			if item != "" {
+				*s = append(*s, string(item))
+			}
+		}
+		return nil
+	}
+	var item difyString
+	if err := item.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*s = nil
+	if item != "" {
+		*s = []string{string(item)}
+	}
+	return nil
+}
+
+// difyNumber 容错的数字字段，接受数字和数字字符串，无法解析时为0
+type difyNumber float64
+
+func (n *difyNumber) UnmarshalJSON(data []byte) error {
+	var s difyString
+	if err := s.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	v, err := strconv.ParseFloat(string(s), 64)
+	if err != nil {
+		v = 0
+	}
+	*n = difyNumber(v)
+	return nil
+}
+
+// difyStreamEvent 是Dify流式响应中的一条事件，不同事件使用其中不同的字段，
+// 未知字段直接忽略
+type difyStreamEvent struct {
+	Event          difyString      `json:"event"`
+	TaskID         difyString      `json:"task_id"`
+	MessageID      difyString      `json:"message_id"`
+	ConversationID difyString      `json:"conversation_id"`
+	Answer         difyString      `json:"answer"`
+	Metadata       json.RawMessage `json:"metadata"`
+
+	// error 事件
+	Code    difyString `json:"code"`
+	Message difyString `json:"message"`
+
+	// agent_thought 和 message_file 事件
+	ID           difyString  `json:"id"`
+	Position     difyNumber  `json:"position"`
+	Thought      difyString  `json:"thought"`
+	Observation  difyString  `json:"observation"`
+	Tool         difyString  `json:"tool"`
+	ToolInput    difyString  `json:"tool_input"`
+	MessageFiles difyStrings `json:"message_files"`
+	Type         difyString  `json:"type"`
+	BelongsTo    difyString  `json:"belongs_to"`
+	URL          difyString  `json:"url"`
+
+	// workflow_* 和 node_* 事件
+	WorkflowRunID difyString       `json:"workflow_run_id"`
+	Data          difyWorkflowData `json:"data"`
+
+	// tts_message 事件
+	Audio difyString `json:"audio"`
+}
+
+// difyWorkflowData 是工作流事件的 data 字段
+type difyWorkflowData struct {
+	NodeID      difyString `json:"node_id"`
+	NodeType    difyString `json:"node_type"`
+	Title       difyString `json:"title"`
+	Index       difyNumber `json:"index"`
+	Status      difyString `json:"status"`
+	Error       difyString `json:"error"`
+	ElapsedTime difyNumber `json:"elapsed_time"`
+	TotalTokens difyNumber `json:"total_tokens"`
+}
+
+// UnmarshalJSON data 不是对象时忽略，避免影响事件的其他字段
+func (d *difyWorkflowData) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '{' {
+		return nil
+	}
+	type plain difyWorkflowData
+	return json.Unmarshal(data, (*plain)(d))
+}
+
+// readDifyStream 逐行读取Dify的SSE响应并解析为事件，done关闭后停止发送
+// 正常读到结尾时返回nil
+func readDifyStream(body io.Reader, events chan<- difyStreamEvent, done <-chan struct{}) error {
+	reader := bufio.NewReader(body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		// 移除SSE Message的 "data:" 并解析对应的JSON
+		var event difyStreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			fmt.Println("JSON parse error:", err)
+			continue
+		}
+		select {
+		case events <- event:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// difyFileURL Dify返回的文件地址可能是相对路径，补全为Dify服务的地址
+func difyFileURL(raw string) string {
+	if !strings.HasPrefix(raw, "/") || strings.HasPrefix(raw, "//") {
+		return raw
+	}
+	base, err := url.Parse(DIFY_BASE_URL)
+	if err != nil {
+		return raw
+	}
+	return base.Scheme + "://" + base.Host + raw
+}
+
+// difyStreamIDs 是当前回答的对话ID、消息ID和任务ID
+type difyStreamIDs struct {
+	ConversationID string
+	MessageID      string
+	TaskID         string
+}
+
+// chatEventFromDify 将一条Dify事件转换为聊天协议的事件，不需要转发的事件返回false
+func chatEventFromDify(event *difyStreamEvent, ids difyStreamIDs) (ChatStreamEvent, bool) {
+	chatEvent := ChatStreamEvent{
+		ConversationID: ids.ConversationID,
+		MessageID:      ids.MessageID,
+		TaskID:         ids.TaskID,
+	}
+	switch event.Event {
+	case "message", "agent_message":
+		// 智能体模式下回答文本通过 agent_message 返回
+		if event.Answer == "" {
+			return chatEvent, false
+		}
+		chatEvent.Type = ChatEventDelta
+		chatEvent.Data = ChatDeltaEvent{
+			ConversationID: ids.ConversationID,
+			MessageID:      ids.MessageID,
+			TaskID:         ids.TaskID,
+			Text:           string(event.Answer),
+		}
+	case "message_replace":
+		// 内容审查命中时Dify用该事件替换已输出的全部回答
+		chatEvent.Type = ChatEventReplace
+		chatEvent.Data = ChatReplaceEvent{
+			ConversationID: ids.ConversationID,
+			MessageID:      ids.MessageID,
+			TaskID:         ids.TaskID,
+			Text:           string(event.Answer),
+		}
+	case "agent_thought":
+		chatEvent.Type = ChatEventAgentStep
+		chatEvent.Data = ChatAgentStepEvent{
+			ID:          string(event.ID),
+			MessageID:   ids.MessageID,
+			Position:    int(event.Position),
+			Thought:     string(event.Thought),
+			Tool:        string(event.Tool),
+			ToolInput:   string(event.ToolInput),
+			Observation: string(event.Observation),
+			FileIDs:     event.MessageFiles,
+		}
+	case "message_file":
+		chatEvent.Type = ChatEventFile
+		chatEvent.Data = ChatFileEvent{
+			ID:        string(event.ID),
+			MessageID: ids.MessageID,
+			Type:      string(event.Type),
+			BelongsTo: string(event.BelongsTo),
+			URL:       difyFileURL(string(event.URL)),
+		}
+	case "workflow_started", "node_started", "node_finished", "workflow_finished":
+		chatEvent.Type = ChatEventWorkflow
+		chatEvent.Data = ChatWorkflowEvent{
+			Phase:         strings.TrimPrefix(string(event.Event), "workflow_"),
+			WorkflowRunID: string(event.WorkflowRunID),
+			NodeID:        string(event.Data.NodeID),
+			NodeType:      string(event.Data.NodeType),
+			Title:         string(event.Data.Title),
+			Index:         int(event.Data.Index),
+			Status:        string(event.Data.Status),
+			Error:         string(event.Data.Error),
+			ElapsedTime:   float64(event.Data.ElapsedTime),
+			TotalTokens:   int(event.Data.TotalTokens),
+		}
+	case "tts_message", "tts_message_end":
+		chatEvent.Type = ChatEventAudio
+		chatEvent.Data = ChatAudioEvent{
+			MessageID: ids.MessageID,
+			Audio:     string(event.Audio),
+			End:       event.Event == "tts_message_end",
+		}
+	case "message_end":
+		chatEvent.Type = ChatEventMessageEnd
+		chatEvent.Data = ChatMessageEndEvent{
+			ConversationID: ids.ConversationID,
+			MessageID:      ids.MessageID,
+			TaskID:         ids.TaskID,
+			Metadata:       event.Metadata,
+		}
+	case "error":
+		message := string(event.Message)
+		if message == "" {
+			message = "AI服务异常"
+		}
+		chatEvent.Type = ChatEventError
+		chatEvent.Data = ChatErrorEvent{
+			Code:         ChatErrorUpstream,
+			Message:      message,
+			UpstreamCode: string(event.Code),
+		}
+	case "ping":
+		// Dify自身的心跳，由我们自己的心跳代替
+		return chatEvent, false
+	default:
+		// 迭代、并行分支等其他事件前端不需要，直接忽略
+		return chatEvent, false
+	}
+	return chatEvent, true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeDifyLine 按readDifyStream的方式解析一行SSE数据并转换为聊天事件
+func decodeDifyLine(t *testing.T, line string) (ChatStreamEvent, bool) {
+	t.Helper()
+	events := make(chan difyStreamEvent, 1)
+	if err := readDifyStream(strings.NewReader(line+"\n"), events, nil); err != nil {
+		t.Fatalf("读取事件失败: %v", err)
+	}
+	close(events)
+	event, ok := <-events
+	if !ok {
+		return ChatStreamEvent{}, false
+	}
+	return chatEventFromDify(&event, difyStreamIDs{ConversationID: "c1", MessageID: "m1", TaskID: "t1"})
+}
+
+func TestChatEventFromDify(t *testing.T) {
+	previous := DIFY_BASE_URL
+	DIFY_BASE_URL = "https://dify.example.com/v1"
+	t.Cleanup(func() { DIFY_BASE_URL = previous })
+
+	tests := []struct {
+		name string
+		line string
+		ok   bool
+		typ  string
+		data any
+	}{
+		{"正常增量", `data: {"event":"message","answer":"你好"}`, true, ChatEventDelta,
+			ChatDeltaEvent{ConversationID: "c1", MessageID: "m1", TaskID: "t1", Text: "你好"}},
+		{"智能体增量", `data:{"event":"agent_message","answer":"好"}`, true, ChatEventDelta,
+			ChatDeltaEvent{ConversationID: "c1", MessageID: "m1", TaskID: "t1", Text: "好"}},
+		{"回答为数字", `data: {"event":"message","answer":42}`, true, ChatEventDelta,
+			ChatDeltaEvent{ConversationID: "c1", MessageID: "m1", TaskID: "t1", Text: "42"}},
+		{"回答为null", `data: {"event":"message","answer":null}`, false, "", nil},
+		{"回答为空", `data: {"event":"message","answer":""}`, false, "", nil},
+		{"替换回答允许为空", `data: {"event":"message_replace","answer":""}`, true, ChatEventReplace,
+			ChatReplaceEvent{ConversationID: "c1", MessageID: "m1", TaskID: "t1"}},
+		{"智能体步骤字段类型不符", `data: {"event":"agent_thought","id":7,"position":"2","tool":null,"tool_input":{"q":"x"},"message_files":"f1"}`, true, ChatEventAgentStep,
+			ChatAgentStepEvent{ID: "7", MessageID: "m1", Position: 2, ToolInput: `{"q":"x"}`, FileIDs: []string{"f1"}}},
+		{"智能体步骤位置无法解析", `data: {"event":"agent_thought","id":"a","position":"first","message_files":[null,"f2",3]}`, true, ChatEventAgentStep,
+			ChatAgentStepEvent{ID: "a", MessageID: "m1", FileIDs: []string{"f2", "3"}}},
+		{"相对地址的文件", `data: {"event":"message_file","id":"f","type":"image","belongs_to":"assistant","url":"/files/a.png"}`, true, ChatEventFile,
+			ChatFileEvent{ID: "f", MessageID: "m1", Type: "image", BelongsTo: "assistant", URL: "https://dify.example.com/files/a.png"}},
+		{"协议相对地址不补全", `data: {"event":"message_file","id":"f","url":"//cdn.example.com/a.png"}`, true, ChatEventFile,
+			ChatFileEvent{ID: "f", MessageID: "m1", URL: "//cdn.example.com/a.png"}},
+		{"工作流data不是对象", `data: {"event":"workflow_started","workflow_run_id":"w1","data":"oops"}`, true, ChatEventWorkflow,
+			ChatWorkflowEvent{Phase: "started", WorkflowRunID: "w1"}},
+		{"节点数字字段为字符串", `data: {"event":"node_finished","workflow_run_id":"w1","data":{"node_id":1,"index":"3","elapsed_time":"0.5","total_tokens":"x"}}`, true, ChatEventWorkflow,
+			ChatWorkflowEvent{Phase: "node_finished", WorkflowRunID: "w1", NodeID: "1", Index: 3, ElapsedTime: 0.5}},
+		{"音频结束", `data: {"event":"tts_message_end","audio":""}`, true, ChatEventAudio,
+			ChatAudioEvent{MessageID: "m1", End: true}},
+		{"结束事件保留元数据", `data: {"event":"message_end","metadata":{"usage":{"total_tokens":3}}}`, true, ChatEventMessageEnd,
+			ChatMessageEndEvent{ConversationID: "c1", MessageID: "m1", TaskID: "t1", Metadata: json.RawMessage(`{"usage":{"total_tokens":3}}`)}},
+		{"错误缺少信息", `data: {"event":"error","code":400,"message":null}`, true, ChatEventError,
+			ChatErrorEvent{Code: ChatErrorUpstream, Message: "AI服务异常", UpstreamCode: "400"}},
+		{"心跳", `data: {"event":"ping"}`, false, "", nil},
+		{"未知事件", `data: {"event":"iteration_started"}`, false, "", nil},
+		{"缺少事件类型", `data: {"answer":"x"}`, false, "", nil},
+		{"JSON不完整", `data: {"event":"message","answer":`, false, "", nil},
+		{"不是JSON", `data: hello`, false, "", nil},
+		{"回答为数组", `data: {"event":"message","answer":[1,2]}`, true, ChatEventDelta,
+			ChatDeltaEvent{ConversationID: "c1", MessageID: "m1", TaskID: "t1", Text: "[1,2]"}},
+		{"答案字符串转义错误", `data: {"event":"message","answer":"\x"}`, false, "", nil},
+		{"不是data行", `event: message`, false, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event, ok := decodeDifyLine(t, tt.line)
+			if ok != tt.ok {
+				t.Fatalf("期望转发 %v，实际 %v %+v", tt.ok, ok, event)
+			}
+			if !ok {
+				return
+			}
+			if event.Type != tt.typ || !reflect.DeepEqual(event.Data, tt.data) {
+				t.Fatalf("期望 %s %+v，实际 %s %+v", tt.typ, tt.data, event.Type, event.Data)
+			}
+			if event.ConversationID != "c1" || event.MessageID != "m1" || event.TaskID != "t1" {
+				t.Fatalf("事件应带上当前回答的ID: %+v", event)
+			}
+		})
+	}
+}
+
+func TestReadDifyStreamSkipsMalformedLines(t *testing.T) {
+	body := strings.Join([]string{
+		`data: {"event":"message","answer":"一"}`,
+		`data: {"event":`,
+		``,
+		`: comment`,
+		`data: {"event":"message","answer":"二"}`,
+		`data: {"event":"message_end"}`,
+	}, "\n")
+	events := make(chan difyStreamEvent, 10)
+	if err := readDifyStream(strings.NewReader(body), events, nil); err != nil {
+		t.Fatalf("读取事件失败: %v", err)
+	}
+	close(events)
+	got := []string{}
+	for event := range events {
+		got = append(got, string(event.Event)+":"+string(event.Answer))
+	}
+	// 最后一行没有换行符，视为不完整而丢弃
+	if want := []string{"message:一", "message:二"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("期望 %v，实际 %v", want, got)
+	}
+}
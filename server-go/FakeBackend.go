@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fake后端每段回答之间的间隔(毫秒)，用于调试心跳和停止生成
+var FAKE_CHAT_DELAY = time.Duration(getEnvIntOrDefault("FAKE_CHAT_DELAY_MS", 0)) * time.Millisecond
+
+// 以该前缀开头的提问会让fake后端返回错误事件
+const fakeErrorPrefix = "[error]"
+
+// fake后端每个delta事件包含的字数
+const fakeChunkRunes = 4
+
+// FakeBackend 开发和测试用的聊天后端，不访问任何外部服务
+// 回答固定为对提问的复述，ID按调用顺序递增，同样的调用序列总是得到同样的结果
+type FakeBackend struct {
+	store *localConversationStore
+	seq   atomic.Int64
+	// 每段回答之间的间隔
+	delay time.Duration
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{store: newLocalConversationStore(), delay: FAKE_CHAT_DELAY}
+}
+
+func (b *FakeBackend) nextID(kind string) string {
+	return fmt.Sprintf("fake-%s-%d", kind, b.seq.Add(1))
+}
+
+// fakeAnswer 返回提问对应的固定回答
+func fakeAnswer(query string) string {
+	return "这是测试回答：" + query
+}
+
+func (b *FakeBackend) StreamChat(ctx context.Context, req ChatBackendRequest) (<-chan ChatStreamEvent, error) {
+	conversationID := req.ConversationID
+	if conversationID == "" {
+		conversationID = b.nextID("conversation")
+		b.store.create(req.Username, conversationID, req.Query)
+	} else if !b.store.exists(req.Username, conversationID) {
+		return nil, ErrConversationNotFound
+	}
+	messageID := b.nextID("message")
+	taskID := b.nextID("task")
+	ids := ChatStreamEvent{ConversationID: conversationID, MessageID: messageID, TaskID: taskID}
+
+	events := make(chan ChatStreamEvent)
+	go func() {
+		defer close(events)
+
+		if strings.HasPrefix(req.Query, fakeErrorPrefix) {
+			event := ids
+			event.Type = ChatEventError
+			event.Data = ChatErrorEvent{Code: ChatErrorUpstream, Message: "测试错误"}
+			sendChatEvent(ctx, events, event)
+			return
+		}
+
+		answer := []rune(fakeAnswer(req.Query))
+		for start := 0; start < len(answer); start += fakeChunkRunes {
+			if b.delay > 0 {
+				select {
+				case <-time.After(b.delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+			end := min(start+fakeChunkRunes, len(answer))
+			event := ids
+			event.Type = ChatEventDelta
+			event.Data = ChatDeltaEvent{
+				ConversationID: conversationID,
+				MessageID:      messageID,
+				TaskID:         taskID,
+				Text:           string(answer[start:end]),
+			}
+			if !sendChatEvent(ctx, events, event) {
+				return
+			}
+		}
+
+		// 回答完整结束后才记入历史
+		b.store.append(req.Username, conversationID, ChatHistoryMessage{
+			ID:           messageID,
+			Query:        req.Query,
+			Answer:       string(answer),
+			MessageFiles: []ChatMessageFile{},
+			CreatedAt:    time.Now().Unix(),
+		})
+		metadata, _ := json.Marshal(map[string]any{
+			"usage": map[string]int{
+				"prompt_tokens":     len([]rune(req.Query)),
+				"completion_tokens": len(answer),
+				"total_tokens":      len([]rune(req.Query)) + len(answer),
+			},
+		})
+		event := ids
+		event.Type = ChatEventMessageEnd
+		event.Data = ChatMessageEndEvent{
+			ConversationID: conversationID,
+			MessageID:      messageID,
+			TaskID:         taskID,
+			Metadata:       metadata,
+		}
+		sendChatEvent(ctx, events, event)
+	}()
+	return events, nil
+}
+
+// StopChat 回答只在本进程中生成，由调用方取消即可
+func (b *FakeBackend) StopChat(ctx context.Context, username, taskID string) error {
+	return nil
+}
+
+func (b *FakeBackend) Suggestions(ctx context.Context, username, messageID string) ([]string, error) {
+	if _, ok := b.store.conversationOf(username, messageID); !ok {
+		return []string{}, nil
+	}
+	return []string{"测试问题一", "测试问题二", "测试问题三"}, nil
+}
+
+func (b *FakeBackend) ListConversations(ctx context.Context, username, lastID string, limit int) ([]ChatConversation, bool, error) {
+	return b.store.page(username, lastID, limit)
+}
+
+func (b *FakeBackend) ListAllConversationIDs(ctx context.Context, username string) ([]string, error) {
+	return b.store.ids(username), nil
+}
+
+func (b *FakeBackend) History(ctx context.Context, username, conversationID string) ([]ChatHistoryMessage, error) {
+	return b.store.messagesOf(username, conversationID)
+}
+
+func (b *FakeBackend) ConversationExists(ctx context.Context, username, conversationID string) (bool, error) {
+	return b.store.exists(username, conversationID), nil
+}
+
+func (b *FakeBackend) DeleteConversation(ctx context.Context, username, conversationID string) error {
+	return b.store.delete(username, conversationID)
+}
+
+// UploadFile 不保存文件，文件ID由内容哈希得到
+func (b *FakeBackend) UploadFile(ctx context.Context, username, filename string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	return "fake-file-" + hex.EncodeToString(sum[:8]), nil
+}
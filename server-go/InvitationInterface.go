@@ -0,0 +1,794 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+// 注册方式
+const (
+	RegistrationOpen   = "open"   // 任何人都可以注册，邀请码可选
+	RegistrationInvite = "invite" // 必须使用邀请码注册
+)
+
+var (
+	REGISTRATION_MODE = getEnvOrDefault("REGISTRATION_MODE", RegistrationOpen)
+	// 邀请链接和激活链接的地址，可以是前端页面的完整地址
+	INVITE_LINK_BASE     = getEnvOrDefault("INVITE_LINK_BASE", "/auth/register")
+	ACTIVATION_LINK_BASE = getEnvOrDefault("ACTIVATION_LINK_BASE", "/auth/activate")
+)
+
+const (
+	// 邀请码字符集，去掉了容易混淆的 0 O 1 I
+	invitationCodeAlphabet  = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	invitationCodeLength    = 12
+	invitationCodePrefixLen = 4
+	// 单个邀请码最多可注册的账户数
+	maxInvitationCodeUses = 10000
+	// 批量导入单次最多的行数
+	maxImportRows = 1000
+	// 批量导入的初始密码长度
+	initialPasswordLength = 12
+	// 激活链接的有效期
+	activationTokenTTL       = 7 * 24 * time.Hour
+	accountActivationPurpose = "account_activation"
+)
+
+var ErrInvitationCodeInvalid = errors.New("邀请码无效、已用完或已过期")
+
+func init() {
+	if REGISTRATION_MODE != RegistrationOpen && REGISTRATION_MODE != RegistrationInvite {
+		panic(fmt.Sprintf("不支持的 REGISTRATION_MODE: %s", REGISTRATION_MODE))
+	}
+}
+
+// randomString 从字符集中随机生成字符串
+func randomString(alphabet string, length int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	buf := make([]byte, length)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		buf[i] = alphabet[n.Int64()]
+	}
+	return string(buf), nil
+}
+
+// generateInvitationCode 生成 XXXX-XXXX-XXXX 格式的邀请码
+func generateInvitationCode() (string, error) {
+	raw, err := randomString(invitationCodeAlphabet, invitationCodeLength)
+	if err != nil {
+		return "", err
+	}
+	return raw[:4] + "-" + raw[4:8] + "-" + raw[8:], nil
+}
+
+// normalizeInvitationCode 统一邀请码格式，忽略大小写、空格和连字符
+func normalizeInvitationCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashInvitationCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeInvitationCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// invitationLink 返回带邀请码的注册链接
+func invitationLink(code string) string {
+	return INVITE_LINK_BASE + "?" + url.Values{"invite_code": {code}}.Encode()
+}
+
+// usableInvitationCodes 未撤销、未过期且未用完的邀请码
+func usableInvitationCodes(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&models.InvitationCodes{}).
+		Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) AND used_count < max_uses", time.Now())
+}
+
+// findInvitationCode 查询可用的邀请码
+func findInvitationCode(code string) (*models.InvitationCodes, error) {
+	if code == "" {
+		return nil, ErrInvitationCodeInvalid
+	}
+	var invitation models.InvitationCodes
+	err := usableInvitationCodes(DB).Where("code_hash = ?", hashInvitationCode(code)).First(&invitation).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrInvitationCodeInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+// consumeInvitationCode 使用一次邀请码，通过条件更新防止并发注册超出次数
+func consumeInvitationCode(tx *gorm.DB, invitation *models.InvitationCodes) error {
+	result := usableInvitationCodes(tx).
+		Where("id = ?", invitation.ID).
+		Update("used_count", gorm.Expr("used_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvitationCodeInvalid
+	}
+	return nil
+}
+
+// joinPresetOrganization 将新用户加入邀请码或导入时指定的组织，组织已删除时跳过
+func joinPresetOrganization(tx *gorm.DB, username string, orgID uint, orgRole string) error {
+	if orgID == 0 {
+		return nil
+	}
+	var count int64
+	if err := tx.Model(&models.Organizations{}).Where("id = ?", orgID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	if orgRole == "" {
+		orgRole = models.OrgRoleMember
+	}
+	return tx.Create(&models.OrganizationMembers{
+		OrganizationID: orgID,
+		Username:       username,
+		Role:           orgRole,
+	}).Error
+}
+
+// invitationPreset 邀请码和批量导入预设的角色和组织
+type invitationPreset struct {
+	Role           string
+	OrganizationID uint
+	OrgRole        string
+}
+
+// authorizePreset 校验当前用户能否预设角色和组织，失败时直接写入响应
+// 系统管理员不受限制；其他用户只能为自己管理的组织邀请农户
+func authorizePreset(c *gin.Context, preset *invitationPreset) bool {
+	if preset.Role == "" {
+		preset.Role = models.RoleFarmer
+	}
+	if !IsValidRole(preset.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "角色不合法", "roles": models.Roles})
+		return false
+	}
+	if preset.OrgRole == "" {
+		preset.OrgRole = models.OrgRoleMember
+	}
+	if !slices.Contains(models.OrgRoles, preset.OrgRole) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "组织角色不合法", "roles": models.OrgRoles})
+		return false
+	}
+
+	identity := CurrentIdentity(c)
+	isAdmin := identity.HasRole(models.RoleAdmin)
+	if !isAdmin && preset.Role != models.RoleFarmer {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有系统管理员可以预设农户以外的角色"})
+		return false
+	}
+
+	if preset.OrganizationID == 0 {
+		if !isAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请指定要加入的组织"})
+			return false
+		}
+		return true
+	}
+
+	var org models.Organizations
+	if err := DB.First(&org, preset.OrganizationID).Error; err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "组织不存在"})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return false
+	}
+	if isAdmin {
+		return true
+	}
+
+	member, err := loadOrganizationMember(preset.OrganizationID, identity.Username)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "组织不存在"})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return false
+	}
+	if !requireOrgRole(c, member, orgManagerRoles...) {
+		return false
+	}
+	if !canAssignOrgRole(member, preset.OrgRole) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有所有者可以授予所有者或管理员角色"})
+		return false
+	}
+	return true
+}
+
+// invitationCodeView 邀请码信息，不包含邀请码本身
+func invitationCodeView(invitation *models.InvitationCodes) gin.H {
+	view := gin.H{
+		"id":              invitation.ID,
+		"prefix":          invitation.Prefix,
+		"max_uses":        invitation.MaxUses,
+		"used_count":      invitation.UsedCount,
+		"role":            invitation.Role,
+		"organization_id": invitation.OrganizationID,
+		"org_role":        invitation.OrgRole,
+		"note":            invitation.Note,
+		"created_by":      invitation.CreatedBy,
+		"created_at":      invitation.CreatedAt.Format(time.RFC3339),
+		"expires_at":      nil,
+		"revoked_at":      nil,
+	}
+	if invitation.ExpiresAt != nil {
+		view["expires_at"] = invitation.ExpiresAt.Format(time.RFC3339)
+	}
+	if invitation.RevokedAt != nil {
+		view["revoked_at"] = invitation.RevokedAt.Format(time.RFC3339)
+	}
+	return view
+}
+
+// CreateInvitationCode 生成注册邀请码，完整邀请码只在创建时返回一次
+func CreateInvitationCode(c *gin.Context) {
+	var requestData struct {
+		MaxUses        int    `json:"max_uses"`
+		ExpiresInDays  int    `json:"expires_in_days"`
+		Role           string `json:"role"`
+		OrganizationID uint   `json:"organization_id"`
+		OrgRole        string `json:"org_role"`
+		Note           string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	if requestData.MaxUses == 0 {
+		requestData.MaxUses = 1
+	}
+	if requestData.MaxUses < 1 || requestData.MaxUses > maxInvitationCodeUses {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("使用次数应在1到%d之间", maxInvitationCodeUses)})
+		return
+	}
+	if requestData.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "有效期不合法"})
+		return
+	}
+	note := strings.TrimSpace(requestData.Note)
+	if utf8.RuneCountInString(note) > 100 || hasControlCharacters(note) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "备注不超过100个字符"})
+		return
+	}
+
+	preset := invitationPreset{
+		Role:           requestData.Role,
+		OrganizationID: requestData.OrganizationID,
+		OrgRole:        requestData.OrgRole,
+	}
+	if !authorizePreset(c, &preset) {
+		return
+	}
+
+	code, err := generateInvitationCode()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "邀请码生成失败"})
+		return
+	}
+
+	invitation := models.InvitationCodes{
+		Prefix:         code[:invitationCodePrefixLen],
+		CodeHash:       hashInvitationCode(code),
+		MaxUses:        requestData.MaxUses,
+		Role:           preset.Role,
+		OrganizationID: preset.OrganizationID,
+		Note:           note,
+		CreatedBy:      CurrentIdentity(c).Username,
+	}
+	if preset.OrganizationID != 0 {
+		invitation.OrgRole = preset.OrgRole
+	}
+	if requestData.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, requestData.ExpiresInDays)
+		invitation.ExpiresAt = &expiresAt
+	}
+	if err := DB.Create(&invitation).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "邀请码保存失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditInviteCodeCreate,
+		Target:  invitation.Prefix,
+		Outcome: AuditSuccess,
+		Detail: gin.H{
+			"code_id":         invitation.ID,
+			"max_uses":        invitation.MaxUses,
+			"role":            invitation.Role,
+			"organization_id": invitation.OrganizationID,
+		},
+	})
+
+	view := invitationCodeView(&invitation)
+	view["code"] = code
+	view["link"] = invitationLink(code)
+	c.JSON(http.StatusOK, gin.H{
+		"message":         "邀请码已生成，请妥善保存，之后将无法再次查看",
+		"invitation_code": view,
+	})
+}
+
+// ListInvitationCodes 列出邀请码，系统管理员可以看到全部，其他用户只能看到自己生成的
+func ListInvitationCodes(c *gin.Context) {
+	page, pageSize := parsePagination(c)
+	identity := CurrentIdentity(c)
+
+	query := DB.Model(&models.InvitationCodes{})
+	if !identity.HasRole(models.RoleAdmin) {
+		query = query.Where("created_by = ?", identity.Username)
+	}
+	if orgID := c.Query("organization_id"); orgID != "" {
+		query = query.Where("organization_id = ?", orgID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var invitations []models.InvitationCodes
+	if err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(invitations))
+	for i := range invitations {
+		data[i] = invitationCodeView(&invitations[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"invitation_codes": data, "total": total, "page": page, "page_size": pageSize})
+}
+
+// RevokeInvitationCode 撤销邀请码，生成者和系统管理员可以操作
+func RevokeInvitationCode(c *gin.Context) {
+	id, ok := parseIDParam(c, "code_id", "邀请码")
+	if !ok {
+		return
+	}
+	identity := CurrentIdentity(c)
+
+	query := DB.Model(&models.InvitationCodes{}).Where("id = ? AND revoked_at IS NULL", id)
+	if !identity.HasRole(models.RoleAdmin) {
+		query = query.Where("created_by = ?", identity.Username)
+	}
+	result := query.Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "邀请码撤销失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "邀请码不存在"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditInviteCodeRevoke,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"code_id": id},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "邀请码已撤销", "id": id})
+}
+
+// CheckInvitationCode 注册页面校验邀请码，返回将要加入的组织
+func CheckInvitationCode(c *gin.Context) {
+	invitation, err := findInvitationCode(c.Query("code"))
+	if err == ErrInvitationCodeInvalid {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "registration_mode": REGISTRATION_MODE})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	response := gin.H{"valid": true, "role": invitation.Role, "organization": nil}
+	if invitation.OrganizationID != 0 {
+		var org models.Organizations
+		if err := DB.Select("id", "name").First(&org, invitation.OrganizationID).Error; err == nil {
+			response["organization"] = gin.H{"id": org.ID, "name": org.Name}
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// generateInitialPassword 生成符合账户策略的初始密码
+func generateInitialPassword(username string) (string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	for i := 0; i < 20; i++ {
+		password, err := randomString(alphabet, initialPasswordLength)
+		if err != nil {
+			return "", err
+		}
+		if accountPolicy.ValidatePassword(username, password) == nil {
+			return password, nil
+		}
+	}
+	return "", errors.New("无法生成符合账户策略的初始密码")
+}
+
+// accountActivation 激活链接中携带的数据
+type accountActivation struct {
+	Username  string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// activationLink 生成账户激活链接，用户通过该链接设置密码
+func activationLink(username string) (string, error) {
+	token, err := encodeSignedValue(accountActivationPurpose, &accountActivation{
+		Username:  username,
+		ExpiresAt: time.Now().Add(activationTokenTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return ACTIVATION_LINK_BASE + "?" + url.Values{"token": {token}}.Encode(), nil
+}
+
+// importRow 批量导入的一行数据
+type importRow struct {
+	Line         int
+	Username     string
+	DisplayName  string
+	Phone        string
+	Email        string
+	RegionAdcode string
+}
+
+// importRowError 批量导入中某一行的错误
+type importRowError struct {
+	Line     int    `json:"line"`
+	Username string `json:"username"`
+	Error    string `json:"error"`
+}
+
+// 批量导入支持的列，username为必填列
+var importColumns = []string{"username", "display_name", "phone", "email", "region_adcode"}
+
+// parseImportCSV 解析批量导入的CSV，第一行为列名
+func parseImportCSV(r io.Reader) ([]importRow, []importRowError, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, errors.New("CSV文件为空或格式错误")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if slices.Contains(importColumns, name) {
+			columns[name] = i
+		}
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, nil, fmt.Errorf("CSV缺少username列，支持的列: %s", strings.Join(importColumns, ","))
+	}
+
+	rows := []importRow{}
+	rowErrors := []importRowError{}
+	seen := map[string]bool{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("第%d行格式错误", line)
+		}
+		if len(rows)+len(rowErrors) >= maxImportRows {
+			return nil, nil, fmt.Errorf("单次最多导入%d个账户", maxImportRows)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := importRow{
+			Line:         line,
+			Username:     field("username"),
+			DisplayName:  field("display_name"),
+			Phone:        normalizePhone(field("phone")),
+			Email:        field("email"),
+			RegionAdcode: field("region_adcode"),
+		}
+		if row.Username == "" && row.DisplayName == "" && row.Phone == "" && row.Email == "" {
+			continue
+		}
+
+		fail := func(message string) {
+			rowErrors = append(rowErrors, importRowError{Line: line, Username: row.Username, Error: message})
+		}
+		if violation := accountPolicy.ValidateUsername(row.Username); violation != nil {
+			fail(violation.Message)
+			continue
+		}
+		if seen[strings.ToLower(row.Username)] {
+			fail("用户名在文件中重复")
+			continue
+		}
+		seen[strings.ToLower(row.Username)] = true
+		if utf8.RuneCountInString(row.DisplayName) > maxDisplayNameLength || hasControlCharacters(row.DisplayName) {
+			fail("昵称不合法")
+			continue
+		}
+		if row.Phone != "" && !phonePattern.MatchString(row.Phone) {
+			fail("手机号格式不正确")
+			continue
+		}
+		if row.Email != "" && !validEmail(row.Email) {
+			fail("邮箱格式不正确")
+			continue
+		}
+		if row.RegionAdcode != "" && !adcodePattern.MatchString(row.RegionAdcode) {
+			fail("地区编码应为6位行政区划代码")
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, rowErrors, nil
+}
+
+// 批量导入方式
+const (
+	importModePassword = "password" // 生成初始密码，首次登录后必须修改
+	importModeInvite   = "invite"   // 生成激活链接，用户通过链接设置密码
+)
+
+// ImportUsers 通过CSV批量创建账户，返回初始密码或激活链接
+// 任意一行有误时不创建任何账户，返回全部错误便于修改后重新导入
+func ImportUsers(c *gin.Context) {
+	mode := c.DefaultPostForm("mode", importModePassword)
+	if mode != importModePassword && mode != importModeInvite {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "导入方式只支持password或invite"})
+		return
+	}
+	format := c.DefaultPostForm("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "结果格式只支持json或csv"})
+		return
+	}
+
+	orgID, err := strconv.ParseUint(c.DefaultPostForm("organization_id", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "组织ID不合法"})
+		return
+	}
+	preset := invitationPreset{
+		Role:           c.PostForm("role"),
+		OrganizationID: uint(orgID),
+		OrgRole:        c.PostForm("org_role"),
+	}
+	if !authorizePreset(c, &preset) {
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请上传CSV文件"})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV文件读取失败"})
+		return
+	}
+	defer file.Close()
+
+	rows, rowErrors, err := parseImportCSV(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// 检查用户名是否已被注册
+	usernames := make([]string, len(rows))
+	for i, row := range rows {
+		usernames[i] = row.Username
+	}
+	var existing []string
+	if len(usernames) > 0 {
+		if err := DB.Model(&models.Users{}).Where("username IN ?", usernames).Pluck("username", &existing).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+			return
+		}
+	}
+	for _, row := range rows {
+		if slices.Contains(existing, row.Username) {
+			rowErrors = append(rowErrors, importRowError{Line: row.Line, Username: row.Username, Error: "用户已存在"})
+		}
+	}
+	if len(rowErrors) > 0 {
+		slices.SortFunc(rowErrors, func(a, b importRowError) int { return a.Line - b.Line })
+		c.JSON(http.StatusBadRequest, gin.H{"error": "导入数据有误，未创建任何账户", "errors": rowErrors})
+		return
+	}
+	if len(rows) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV中没有要导入的账户"})
+		return
+	}
+
+	// 生成初始密码或激活链接，密码哈希较慢，放在事务之外计算
+	users := make([]models.Users, len(rows))
+	credentials := make([]string, len(rows))
+	for i, row := range rows {
+		users[i] = models.Users{
+			Username:     row.Username,
+			Role:         preset.Role,
+			DisplayName:  row.DisplayName,
+			Phone:        row.Phone,
+			Email:        row.Email,
+			RegionAdcode: row.RegionAdcode,
+		}
+		if mode == importModePassword {
+			password, err := generateInitialPassword(row.Username)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			hashedPassword, err := passwordHasher.Hash(password)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "密码加密失败"})
+				return
+			}
+			users[i].Password = hashedPassword
+			users[i].PasswordChangeRequired = true
+			credentials[i] = password
+		} else {
+			link, err := activationLink(row.Username)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "激活链接生成失败"})
+				return
+			}
+			credentials[i] = link
+		}
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&users).Error; err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := joinPresetOrganization(tx, user.Username, preset.OrganizationID, preset.OrgRole); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	RecordAudit(c, AuditEvent{
+		Action:  AuditUserImport,
+		Outcome: auditResult(err),
+		Detail: gin.H{
+			"mode":            mode,
+			"count":           len(users),
+			"role":            preset.Role,
+			"organization_id": preset.OrganizationID,
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "账户创建失败，未创建任何账户"})
+		return
+	}
+
+	credentialColumn := "initial_password"
+	if mode == importModeInvite {
+		credentialColumn = "activation_link"
+	}
+
+	if format == "csv" {
+		filename := "imported-users-" + time.Now().Format("20060102-150405") + ".csv"
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		c.Writer.WriteString("\ufeff")
+		writer := csv.NewWriter(c.Writer)
+		writer.Write([]string{"username", "display_name", credentialColumn})
+		for i, user := range users {
+			writer.Write([]string{csvSafe(user.Username), csvSafe(user.DisplayName), csvSafe(credentials[i])})
+		}
+		writer.Flush()
+		return
+	}
+
+	data := make([]gin.H, len(users))
+	for i, user := range users {
+		data[i] = gin.H{
+			"username":       user.Username,
+			"display_name":   user.DisplayName,
+			credentialColumn: credentials[i],
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("已创建%d个账户，初始密码和激活链接只显示这一次", len(users)),
+		"mode":    mode,
+		"users":   data,
+	})
+}
+
+// ActivateAccount 通过激活链接为批量导入的账户设置密码
+func ActivateAccount(c *gin.Context) {
+	var requestData struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	var activation accountActivation
+	if err := decodeSignedValue(accountActivationPurpose, requestData.Token, &activation); err != nil || activation.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "激活链接无效"})
+		return
+	}
+	if time.Now().Unix() >= activation.ExpiresAt {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "激活链接已过期，请联系管理员重新导入"})
+		return
+	}
+
+	if violation := accountPolicy.ValidatePassword(activation.Username, requestData.Password); violation != nil {
+		c.JSON(http.StatusBadRequest, violation.Response())
+		return
+	}
+	hashedPassword, err := passwordHasher.Hash(requestData.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密码加密失败"})
+		return
+	}
+
+	// 只有尚未设置密码的账户可以激活，同一链接不能重复使用
+	result := DB.Model(&models.Users{}).
+		Where("username = ? AND password = ''", activation.Username).
+		Updates(map[string]interface{}{
+			"password":                 hashedPassword,
+			"password_change_required": false,
+		})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "账户激活失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "激活链接已使用或账户不存在"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditAccountActivate,
+		Actor:   activation.Username,
+		Target:  activation.Username,
+		Outcome: AuditSuccess,
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "账户已激活，请使用新密码登录", "username": activation.Username})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+func TestInvitationEndpointsRequireManagerOrAdmin(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+
+	tests := []struct {
+		role string
+		code int
+	}{
+		{models.RoleFarmer, http.StatusForbidden},
+		{models.RoleExpert, http.StatusForbidden},
+		{models.RoleManager, http.StatusOK},
+		{models.RoleAdmin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		createTestUser(t, models.Users{Username: tt.role + "_user", Role: tt.role}, "Test-Passw0rd")
+		token := testAccessToken(t, tt.role+"_user")
+		for _, target := range []string{"/api/invitation-codes", "/api/users/import"} {
+			method := http.MethodGet
+			if target == "/api/users/import" {
+				method = http.MethodPost
+			}
+			w := performRequest(router, method, target, "", bearer(token))
+			if tt.code == http.StatusForbidden && w.Code != http.StatusForbidden {
+				t.Errorf("%s 访问 %s 应返回403，实际 %d", tt.role, target, w.Code)
+			}
+			if tt.code == http.StatusOK && w.Code == http.StatusForbidden {
+				t.Errorf("%s 应能访问 %s，实际 %d %s", tt.role, target, w.Code, w.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"server-env.com/server/models"
+)
+
+// 登录失败计数存储方式: memory(单实例) 或 db(多实例共享)
+var LOGIN_ATTEMPT_STORE = getEnvOrDefault("LOGIN_ATTEMPT_STORE", "memory")
+
+var loginGuard = NewLoginGuard(NewLoginAttemptStore(LOGIN_ATTEMPT_STORE))
+
+// LoginAttempt 是某个计数键(用户名或IP)的登录失败记录
+type LoginAttempt struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// LoginAttemptStore 登录失败计数的存储接口
+type LoginAttemptStore interface {
+	// Get 返回计数键当前的记录，不存在时返回零值
+	Get(key string) (LoginAttempt, error)
+	// RecordFailure 原子地累加一次失败，距上次失败超过window时从1重新计数
+	RecordFailure(key string, now time.Time, window time.Duration) (LoginAttempt, error)
+	// Lock 将计数键锁定到指定时间
+	Lock(key string, until time.Time) error
+	// Reset 清除计数键的记录
+	Reset(key string) error
+}
+
+// NewLoginAttemptStore 按名称创建登录失败计数存储
+func NewLoginAttemptStore(kind string) LoginAttemptStore {
+	switch kind {
+	case "db":
+		return &DBLoginAttemptStore{}
+	case "memory":
+		return NewMemoryLoginAttemptStore()
+	default:
+		fmt.Printf("未知的 LOGIN_ATTEMPT_STORE=%s，使用内存存储\n", kind)
+		return NewMemoryLoginAttemptStore()
+	}
+}
+
+// MemoryLoginAttemptStore 进程内的登录失败计数存储，仅适用于单实例部署
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+// 内存存储超过该数量时清理过期记录
+const memoryLoginAttemptSweepSize = 10000
+
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: make(map[string]LoginAttempt)}
+}
+
+func (s *MemoryLoginAttemptStore) Get(key string) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key], nil
+}
+
+func (s *MemoryLoginAttemptStore) RecordFailure(key string, now time.Time, window time.Duration) (LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.attempts) >= memoryLoginAttemptSweepSize {
+		for k, attempt := range s.attempts {
+			if now.Sub(attempt.LastFailureAt) > window && now.After(attempt.LockedUntil) {
+				delete(s.attempts, k)
+			}
+		}
+	}
+
+	attempt := s.attempts[key]
+	if now.Sub(attempt.LastFailureAt) > window {
+		attempt.Failures = 0
+	}
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	s.attempts[key] = attempt
+	return attempt, nil
+}
+
+func (s *MemoryLoginAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt := s.attempts[key]
+	attempt.LockedUntil = until
+	s.attempts[key] = attempt
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// DBLoginAttemptStore 基于数据库的登录失败计数存储，多实例共享
+type DBLoginAttemptStore struct{}
+
+func loginAttemptFromRecord(record models.LoginAttempts) LoginAttempt {
+	return LoginAttempt{
+		Failures:      record.Failures,
+		LastFailureAt: record.LastFailureAt,
+		LockedUntil:   record.LockedUntil,
+	}
+}
+
+func (s *DBLoginAttemptStore) Get(key string) (LoginAttempt, error) {
+	var record models.LoginAttempts
+	result := DB.Where("`key` = ?", key).First(&record)
+	if result.Error == gorm.ErrRecordNotFound {
+		return LoginAttempt{}, nil
+	} else if result.Error != nil {
+		return LoginAttempt{}, result.Error
+	}
+	return loginAttemptFromRecord(record), nil
+}
+
+func (s *DBLoginAttemptStore) RecordFailure(key string, now time.Time, window time.Duration) (LoginAttempt, error) {
+	var record models.LoginAttempts
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("`key` = ?", key).First(&record)
+		if result.Error == gorm.ErrRecordNotFound {
+			record = models.LoginAttempts{Key: key}
+		} else if result.Error != nil {
+			return result.Error
+		}
+
+		if now.Sub(record.LastFailureAt) > window {
+			record.Failures = 0
+		}
+		record.Failures++
+		record.LastFailureAt = now
+		return tx.Save(&record).Error
+	})
+	if err != nil {
+		return LoginAttempt{}, err
+	}
+	return loginAttemptFromRecord(record), nil
+}
+
+func (s *DBLoginAttemptStore) Lock(key string, until time.Time) error {
+	return DB.Model(&models.LoginAttempts{}).Where("`key` = ?", key).Update("locked_until", until).Error
+}
+
+func (s *DBLoginAttemptStore) Reset(key string) error {
+	return DB.Where("`key` = ?", key).Delete(&models.LoginAttempts{}).Error
+}
+
+// LoginGuard 按用户名和客户端IP统计登录失败，实施递增延迟和临时锁定
+type LoginGuard struct {
+	Store LoginAttemptStore
+	// 失败计数的统计窗口，距上次失败超过该时长后重新计数
+	Window time.Duration
+	// 连续失败达到该次数后开始要求等待，之后每次失败等待时间翻倍
+	DelayAfter int
+	MaxDelay   time.Duration
+	// 用户名和IP各自的锁定阈值
+	MaxUserFailures int
+	MaxIPFailures   int
+	LockDuration    time.Duration
+}
+
+func NewLoginGuard(store LoginAttemptStore) *LoginGuard {
+	return &LoginGuard{
+		Store:           store,
+		Window:          15 * time.Minute,
+		DelayAfter:      3,
+		MaxDelay:        30 * time.Second,
+		MaxUserFailures: 5,
+		MaxIPFailures:   20,
+		LockDuration:    15 * time.Minute,
+	}
+}
+
+func loginUserKey(username string) string {
+	return "user:" + username
+}
+
+func loginIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// delayFor 计算失败次数对应的等待时间
+func (g *LoginGuard) delayFor(failures int) time.Duration {
+	if failures < g.DelayAfter {
+		return 0
+	}
+	shift := failures - g.DelayAfter
+	if shift > 16 {
+		return g.MaxDelay
+	}
+	delay := time.Second << shift
+	if delay > g.MaxDelay {
+		return g.MaxDelay
+	}
+	return delay
+}
+
+// retryAfter 计算单个计数键还需等待多久才能再次尝试
+func (g *LoginGuard) retryAfter(attempt LoginAttempt, now time.Time) time.Duration {
+	wait := attempt.LockedUntil.Sub(now)
+	if now.Sub(attempt.LastFailureAt) <= g.Window {
+		if delayWait := attempt.LastFailureAt.Add(g.delayFor(attempt.Failures)).Sub(now); delayWait > wait {
+			wait = delayWait
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Check 检查本次登录是否允许进行，不允许时返回需要等待的时长
+func (g *LoginGuard) Check(username, ip string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range []string{loginUserKey(username), loginIPKey(ip)} {
+		attempt, err := g.Store.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if w := g.retryAfter(attempt, now); w > wait {
+			wait = w
+		}
+	}
+	return wait, nil
+}
+
+// Failures 返回用户名和IP在统计窗口内失败次数的较大值
+func (g *LoginGuard) Failures(username, ip string) (int, error) {
+	now := time.Now()
+	failures := 0
+	for _, key := range []string{loginUserKey(username), loginIPKey(ip)} {
+		attempt, err := g.Store.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if now.Sub(attempt.LastFailureAt) <= g.Window && attempt.Failures > failures {
+			failures = attempt.Failures
+		}
+	}
+	return failures, nil
+}
+
+// RecordFailure 记录一次登录失败，达到阈值时锁定对应的用户名或IP
+func (g *LoginGuard) RecordFailure(username, ip string) error {
+	now := time.Now()
+	limits := map[string]int{
+		loginUserKey(username): g.MaxUserFailures,
+		loginIPKey(ip):         g.MaxIPFailures,
+	}
+	for key, limit := range limits {
+		attempt, err := g.Store.RecordFailure(key, now, g.Window)
+		if err != nil {
+			return err
+		}
+		if attempt.Failures >= limit {
+			if err := g.Store.Lock(key, now.Add(g.LockDuration)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RecordSuccess 登录成功后清除该用户名的失败计数，IP计数保留直到窗口过期
+func (g *LoginGuard) RecordSuccess(username string) error {
+	return g.Store.Reset(loginUserKey(username))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginGuardDelayFor(t *testing.T) {
+	guard := NewLoginGuard(NewMemoryLoginAttemptStore())
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{6, 8 * time.Second},
+		{8, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := guard.delayFor(tt.failures); got != tt.delay {
+			t.Errorf("失败 %d 次应等待 %v，实际 %v", tt.failures, tt.delay, got)
+		}
+	}
+}
+
+func TestLoginGuardLockout(t *testing.T) {
+	stores := map[string]func(t *testing.T) LoginAttemptStore{
+		"memory": func(t *testing.T) LoginAttemptStore { return NewMemoryLoginAttemptStore() },
+		"db": func(t *testing.T) LoginAttemptStore {
+			setupTestDB(t)
+			return &DBLoginAttemptStore{}
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			guard := NewLoginGuard(newStore(t))
+			// 去掉递增延迟，只观察锁定
+			guard.DelayAfter = 1000
+
+			tests := []struct {
+				name     string
+				username string
+				ip       string
+				failures int
+				locked   bool
+			}{
+				{"未达到用户名阈值", "quinn", "10.0.0.1", guard.MaxUserFailures - 1, false},
+				{"达到用户名阈值", "rose", "10.0.0.2", guard.MaxUserFailures, true},
+				{"不同用户名累计到IP阈值", "", "10.0.0.3", guard.MaxIPFailures, true},
+			}
+			for _, tt := range tests {
+				for i := 0; i < tt.failures; i++ {
+					username := tt.username
+					if username == "" {
+						username = fmt.Sprintf("user%d", i)
+					}
+					if err := guard.RecordFailure(username, tt.ip); err != nil {
+						t.Fatalf("%s: 记录失败出错: %v", tt.name, err)
+					}
+				}
+				username := tt.username
+				if username == "" {
+					username = "another"
+				}
+				wait, err := guard.Check(username, tt.ip)
+				if err != nil {
+					t.Fatalf("%s: 检查出错: %v", tt.name, err)
+				}
+				if locked := wait > guard.LockDuration-time.Minute; locked != tt.locked {
+					t.Errorf("%s: 期望锁定 %v，实际等待 %v", tt.name, tt.locked, wait)
+				}
+			}
+
+			// 锁定的用户名换一个IP也不能登录，登录成功只清除用户名的计数
+			if wait, _ := guard.Check("rose", "10.0.0.9"); wait == 0 {
+				t.Error("用户名锁定后换IP仍应等待")
+			}
+			guard.RecordSuccess("rose")
+			if wait, _ := guard.Check("rose", "10.0.0.9"); wait != 0 {
+				t.Errorf("登录成功后应清除用户名的锁定，实际等待 %v", wait)
+			}
+			if wait, _ := guard.Check("rose", "10.0.0.2"); wait != 0 {
+				t.Errorf("IP未达到阈值时不应等待，实际 %v", wait)
+			}
+			if wait, _ := guard.Check("another", "10.0.0.3"); wait == 0 {
+				t.Error("IP锁定不应被其他用户的登录成功清除")
+			}
+		})
+	}
+}
+
+func TestLoginGuardWindow(t *testing.T) {
+	store := NewMemoryLoginAttemptStore()
+	guard := NewLoginGuard(store)
+	now := time.Now()
+
+	// 超出统计窗口的失败不再累计
+	store.RecordFailure(loginUserKey("sam"), now.Add(-2*guard.Window), guard.Window)
+	store.RecordFailure(loginUserKey("sam"), now.Add(-2*guard.Window), guard.Window)
+	attempt, _ := store.RecordFailure(loginUserKey("sam"), now, guard.Window)
+	if attempt.Failures != 1 {
+		t.Fatalf("窗口外的失败应重新计数，实际 %d", attempt.Failures)
+	}
+
+	// 延迟从最近一次失败开始计算
+	for i := 0; i < guard.DelayAfter; i++ {
+		guard.RecordFailure("tom", "10.0.1.1")
+	}
+	wait, _ := guard.Check("tom", "10.0.1.2")
+	if wait <= 0 || wait > guard.delayFor(guard.DelayAfter) {
+		t.Fatalf("达到延迟阈值后应等待不超过 %v，实际 %v", guard.delayFor(guard.DelayAfter), wait)
+	}
+	failures, _ := guard.Failures("tom", "10.0.1.2")
+	if failures != guard.DelayAfter {
+		t.Fatalf("失败次数应为 %d，实际 %d", guard.DelayAfter, failures)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+var (
+	// 短信网关配置，未配置时不能通过短信发送验证码，NOTIFY_MODE=dev时改为输出到开发通知器
+	SMS_GATEWAY_URL   = os.Getenv("SMS_GATEWAY_URL")
+	SMS_GATEWAY_TOKEN = os.Getenv("SMS_GATEWAY_TOKEN")
+	// SMTP配置，未配置时不能通过邮件发送验证码，NOTIFY_MODE=dev时改为输出到开发通知器
+	SMTP_ADDR     = os.Getenv("SMTP_ADDR")
+	SMTP_USERNAME = os.Getenv("SMTP_USERNAME")
+	SMTP_PASSWORD = os.Getenv("SMTP_PASSWORD")
+	SMTP_FROM     = os.Getenv("SMTP_FROM")
+	// 开发通知器写入的文件，为空时输出到标准输出
+	NOTIFY_DEV_FILE = os.Getenv("NOTIFY_DEV_FILE")
+	// 设为dev时未配置的渠道使用开发通知器，否则未配置的渠道视为停用
+	NOTIFY_MODE = os.Getenv("NOTIFY_MODE")
+)
+
+const NotifyModeDev = "dev"
+
+// 通知渠道
+const (
+	NotifyChannelSMS   = "sms"
+	NotifyChannelEmail = "email"
+)
+
+// notifyChannelNames 通知渠道的中文名称
+var notifyChannelNames = map[string]string{
+	NotifyChannelSMS:   "短信",
+	NotifyChannelEmail: "邮件",
+}
+
+// Notification 是一条待发送的通知
+type Notification struct {
+	Channel string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier 通知发送接口
+type Notifier interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// 各渠道使用的通知器，启动时由NewNotifiersFromEnv创建，停用的渠道不在其中
+var notifiers map[string]Notifier
+
+// NewNotifiersFromEnv 按环境变量创建各渠道的通知器
+// 渠道未配置且不是开发模式时停用该渠道，避免验证码被静默输出到日志
+func NewNotifiersFromEnv() map[string]Notifier {
+	result := map[string]Notifier{}
+	add := func(channel string, notifier Notifier) {
+		if notifier == nil {
+			fmt.Printf("通知渠道 %s 未配置，已停用\n", channel)
+			return
+		}
+		result[channel] = notifier
+	}
+	add(NotifyChannelSMS, newSMSNotifier())
+	add(NotifyChannelEmail, newEmailNotifier())
+	return result
+}
+
+// NotifyChannelEnabled 判断通知渠道是否可用
+func NotifyChannelEnabled(channel string) bool {
+	_, ok := notifiers[channel]
+	return ok
+}
+
+// newDevNotifier 创建开发环境使用的通知器
+func newDevNotifier() Notifier {
+	if NOTIFY_DEV_FILE != "" {
+		return &FileNotifier{Path: NOTIFY_DEV_FILE}
+	}
+	return &LogNotifier{}
+}
+
+// newSMSNotifier 创建短信通知器，未配置且不是开发模式时返回nil
+func newSMSNotifier() Notifier {
+	if SMS_GATEWAY_URL == "" {
+		if NOTIFY_MODE != NotifyModeDev {
+			return nil
+		}
+		return newDevNotifier()
+	}
+	return &SMSNotifier{
+		client: resty.New().SetBaseURL(SMS_GATEWAY_URL).SetTimeout(10 * time.Second),
+		token:  SMS_GATEWAY_TOKEN,
+	}
+}
+
+// newEmailNotifier 创建邮件通知器，未配置且不是开发模式时返回nil
+func newEmailNotifier() Notifier {
+	if SMTP_ADDR == "" {
+		if NOTIFY_MODE != NotifyModeDev {
+			return nil
+		}
+		return newDevNotifier()
+	}
+	return &EmailNotifier{
+		Addr:     SMTP_ADDR,
+		Username: SMTP_USERNAME,
+		Password: SMTP_PASSWORD,
+		From:     SMTP_FROM,
+	}
+}
+
+// SendNotification 通过对应渠道的通知器发送通知
+func SendNotification(ctx context.Context, n Notification) error {
+	notifier, ok := notifiers[n.Channel]
+	if !ok {
+		return fmt.Errorf("通知渠道未启用: %s", n.Channel)
+	}
+	return notifier.Send(ctx, n)
+}
+
+// SMSNotifier 通过HTTP短信网关发送短信
+type SMSNotifier struct {
+	client *resty.Client
+	token  string
+}
+
+func (s *SMSNotifier) Send(ctx context.Context, n Notification) error {
+	req := s.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(map[string]string{
+			"phone":   n.To,
+			"message": n.Body,
+		})
+	if s.token != "" {
+		req.SetHeader("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := req.Post("")
+	if err != nil {
+		return fmt.Errorf("短信发送失败: %w", err)
+	}
+	if resp.IsError() {
+		return fmt.Errorf("短信发送失败: %s", resp.Status())
+	}
+	return nil
+}
+
+// EmailNotifier 通过SMTP发送邮件
+type EmailNotifier struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (e *EmailNotifier) Send(ctx context.Context, n Notification) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		host := e.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+
+	msg := strings.Join([]string{
+		"From: " + e.From,
+		"To: " + n.To,
+		"Subject: " + n.Subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		n.Body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(e.Addr, auth, e.From, []string{n.To}, []byte(msg)); err != nil {
+		return fmt.Errorf("邮件发送失败: %w", err)
+	}
+	return nil
+}
+
+// LogNotifier 将通知输出到标准输出，用于开发环境
+type LogNotifier struct{}
+
+func (LogNotifier) Send(ctx context.Context, n Notification) error {
+	fmt.Printf("[通知][%s] to=%s subject=%s body=%s\n", n.Channel, n.To, n.Subject, n.Body)
+	return nil
+}
+
+// FileNotifier 将通知追加写入文件，用于开发和测试环境
+type FileNotifier struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (f *FileNotifier) Send(ctx context.Context, n Notification) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\t%s\t%s\n",
+		time.Now().Format(time.RFC3339), n.Channel, n.To, n.Subject, n.Body)
+	return err
+}
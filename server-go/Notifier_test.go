@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestNewNotifiersFromEnv(t *testing.T) {
+	previous := []string{SMS_GATEWAY_URL, SMTP_ADDR, NOTIFY_MODE}
+	t.Cleanup(func() {
+		SMS_GATEWAY_URL, SMTP_ADDR, NOTIFY_MODE = previous[0], previous[1], previous[2]
+	})
+
+	tests := []struct {
+		name     string
+		sms      string
+		smtp     string
+		mode     string
+		channels []string
+	}{
+		{"都未配置", "", "", "", nil},
+		{"只配置邮件", "", "smtp.example.com:587", "", []string{NotifyChannelEmail}},
+		{"只配置短信", "https://sms.example.com/send", "", "", []string{NotifyChannelSMS}},
+		{"开发模式", "", "", NotifyModeDev, []string{NotifyChannelSMS, NotifyChannelEmail}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SMS_GATEWAY_URL, SMTP_ADDR, NOTIFY_MODE = tt.sms, tt.smtp, tt.mode
+			result := NewNotifiersFromEnv()
+			if len(result) != len(tt.channels) {
+				t.Fatalf("期望启用 %v，实际 %v", tt.channels, result)
+			}
+			for _, channel := range tt.channels {
+				if result[channel] == nil {
+					t.Fatalf("渠道 %s 应启用", channel)
+				}
+			}
+		})
+	}
+}
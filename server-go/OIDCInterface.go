@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+var (
+	// 第三方登录(OIDC)配置，OIDC_ISSUER和OIDC_CLIENT_ID为空时不启用
+	OIDC_PROVIDER      = getEnvOrDefault("OIDC_PROVIDER", "oidc")
+	OIDC_ISSUER        = strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	OIDC_CLIENT_ID     = os.Getenv("OIDC_CLIENT_ID")
+	OIDC_CLIENT_SECRET = os.Getenv("OIDC_CLIENT_SECRET")
+	OIDC_REDIRECT_URL  = os.Getenv("OIDC_REDIRECT_URL")
+	OIDC_SCOPES        = getEnvOrDefault("OIDC_SCOPES", "openid profile email")
+	// 登录成功后跳转的前端页面，访问令牌放在URL片段中
+	OIDC_FRONTEND_REDIRECT = getEnvOrDefault("OIDC_FRONTEND_REDIRECT", "/auth/login")
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateTTL    = 10 * time.Minute
+	// JWKS的最短刷新间隔，遇到未知kid时也不会比这更频繁地拉取
+	oidcJWKSRefreshInterval = 5 * time.Minute
+	oidcClockSkew           = time.Minute
+	// 重新验证时要求身份提供方的登录时间在此范围内，签发的凭证有效期相同
+	oidcReauthMaxAge  = 5 * time.Minute
+	oidcReauthPurpose = "oidc_reauth"
+	oidcLinkPurpose   = "oidc_link"
+	// 发起登录的用途，reauth用于注销账户等敏感操作前重新验证身份
+	oidcIntentReauth = "reauth"
+)
+
+var oidcProvider = NewOIDCProvider()
+
+var (
+	ErrOIDCDisabled     = errors.New("未配置第三方登录")
+	ErrIDTokenInvalid   = errors.New("身份令牌无效")
+	ErrIDTokenKeyLookup = errors.New("找不到身份令牌的签名密钥")
+	// 邮箱已属于本地账户时不自动关联，需要输入本地密码确认
+	ErrOIDCLinkRequired  = errors.New("该邮箱已注册本地账户，请输入本地账户密码完成关联")
+	ErrOIDCEmailConflict = errors.New("该邮箱已被本地账户使用，且第三方账号的邮箱未经验证，无法关联")
+)
+
+// oidcDiscovery 是提供方 .well-known/openid-configuration 中用到的字段
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims 是身份令牌中用到的声明
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	ExpiresAt         int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	Nonce             string          `json:"nonce"`
+	AuthTime          int64           `json:"auth_time"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	PreferredUsername string          `json:"preferred_username"`
+	Name              string          `json:"name"`
+}
+
+// hasAudience 判断aud声明(字符串或数组)是否包含clientID
+func (c *oidcClaims) hasAudience(clientID string) bool {
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		return single == clientID
+	}
+	var multiple []string
+	if err := json.Unmarshal(c.Audience, &multiple); err == nil {
+		for _, aud := range multiple {
+			if aud == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// OIDCProvider 外部OIDC身份提供方，发现文档和签名密钥按需拉取并缓存
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+
+	client *resty.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+func NewOIDCProvider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:         OIDC_PROVIDER,
+		Issuer:       OIDC_ISSUER,
+		ClientID:     OIDC_CLIENT_ID,
+		ClientSecret: OIDC_CLIENT_SECRET,
+		RedirectURL:  OIDC_REDIRECT_URL,
+		Scopes:       OIDC_SCOPES,
+		client:       resty.New().SetTimeout(15 * time.Second),
+	}
+}
+
+// Enabled 判断是否已配置第三方登录
+func (p *OIDCProvider) Enabled() bool {
+	return p.Issuer != "" && p.ClientID != ""
+}
+
+// Discover 获取并缓存提供方的发现文档
+func (p *OIDCProvider) Discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	resp, err := p.client.R().Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("获取OIDC发现文档失败: %w", err)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("获取OIDC发现文档失败: %s", resp.Status())
+	}
+
+	var discovery oidcDiscovery
+	if err := json.Unmarshal(resp.Body(), &discovery); err != nil {
+		return nil, fmt.Errorf("解析OIDC发现文档失败: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("OIDC发现文档的issuer不匹配: %s", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("OIDC发现文档缺少必要的端点")
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// AuthCodeURL 构造授权码模式的跳转地址，使用PKCE(S256)，extra为附加的请求参数
+func (p *OIDCProvider) AuthCodeURL(state, nonce, codeVerifier string, extra url.Values) (string, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {p.Scopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	for key, values := range extra {
+		query[key] = values
+	}
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange 用授权码换取身份令牌
+func (p *OIDCProvider) Exchange(code, codeVerifier string) (string, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.client.R().
+		SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret)).
+		SetFormData(map[string]string{
+			"grant_type":    "authorization_code",
+			"code":          code,
+			"redirect_uri":  p.RedirectURL,
+			"code_verifier": codeVerifier,
+		}).
+		Post(discovery.TokenEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("授权码换取令牌失败: %w", err)
+	}
+	if resp.IsError() {
+		return "", fmt.Errorf("授权码换取令牌失败: %s", resp.Status())
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(resp.Body(), &tokenResp); err != nil {
+		return "", fmt.Errorf("解析令牌响应失败: %w", err)
+	}
+	if tokenResp.IDToken == "" {
+		return "", errors.New("令牌响应中缺少id_token")
+	}
+	return tokenResp.IDToken, nil
+}
+
+// jsonWebKey 是JWKS中的单个公钥
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey 将JWK转换为RSA或P-256公钥，其他类型返回nil
+func (k *jsonWebKey) publicKey() crypto.PublicKey {
+	switch k.Kty {
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	}
+	return nil
+}
+
+// keyFor 按kid查找签名公钥，找不到时刷新一次JWKS
+func (p *OIDCProvider) keyFor(kid string) (crypto.PublicKey, error) {
+	discovery, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < oidcJWKSRefreshInterval {
+		return nil, ErrIDTokenKeyLookup
+	}
+
+	resp, err := p.client.R().Get(discovery.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("获取JWKS失败: %w", err)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("获取JWKS失败: %s", resp.Status())
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(resp.Body(), &jwks); err != nil {
+		return nil, fmt.Errorf("解析JWKS失败: %w", err)
+	}
+
+	p.keys = map[string]crypto.PublicKey{}
+	p.keysFetchedAt = time.Now()
+	for i := range jwks.Keys {
+		if jwks.Keys[i].Use != "" && jwks.Keys[i].Use != "sig" {
+			continue
+		}
+		if key := jwks.Keys[i].publicKey(); key != nil {
+			p.keys[jwks.Keys[i].Kid] = key
+		}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrIDTokenKeyLookup
+}
+
+// VerifyIDToken 校验身份令牌的签名、签发方、受众、有效期和nonce
+func (p *OIDCProvider) VerifyIDToken(rawToken, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrIDTokenInvalid
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+
+	key, err := p.keyFor(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return nil, ErrIDTokenInvalid
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, ErrIDTokenInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return nil, ErrIDTokenInvalid
+		}
+	default:
+		return nil, ErrIDTokenInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrIDTokenInvalid
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.Issuer,
+		claims.Subject == "",
+		!claims.hasAudience(p.ClientID),
+		now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)),
+		claims.Nonce != nonce:
+		return nil, ErrIDTokenInvalid
+	}
+
+	return &claims, nil
+}
+
+// oidcState 是发起登录时保存在签名Cookie中的状态
+type oidcState struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	Intent       string `json:"intent,omitempty"`
+	// 发起登录时提交的邀请码和图形验证码结果，首次登录创建账户时使用
+	InviteCode      string `json:"invite_code,omitempty"`
+	CaptchaVerified bool   `json:"captcha_verified,omitempty"`
+	ExpiresAt       int64  `json:"exp"`
+}
+
+// oidcReauthToken 是重新登录第三方账号后签发的验证凭证
+type oidcReauthToken struct {
+	Username  string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// issueOIDCReauthToken 为重新验证过身份的用户签发短期凭证
+func issueOIDCReauthToken(username string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(oidcReauthMaxAge)
+	token, err := encodeSignedValue(oidcReauthPurpose, &oidcReauthToken{Username: username, ExpiresAt: expiresAt.Unix()})
+	return token, expiresAt, err
+}
+
+// oidcLinkToken 是邮箱匹配到本地账户时签发的关联凭证
+type oidcLinkToken struct {
+	Provider  string `json:"provider"`
+	Subject   string `json:"subject"`
+	Email     string `json:"email"`
+	Username  string `json:"username"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// issueOIDCLinkToken 为待关联的外部身份签发凭证，用户输入本地密码后完成关联
+func issueOIDCLinkToken(provider string, claims *oidcClaims, username string) (string, error) {
+	return encodeSignedValue(oidcLinkPurpose, &oidcLinkToken{
+		Provider:  provider,
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		Username:  username,
+		ExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+	})
+}
+
+// parseOIDCLinkToken 校验关联凭证的签名和有效期
+func parseOIDCLinkToken(value string) (*oidcLinkToken, error) {
+	var token oidcLinkToken
+	if err := decodeSignedValue(oidcLinkPurpose, value, &token); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= token.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return &token, nil
+}
+
+// parseOIDCReauthToken 校验重新验证凭证，返回对应的用户名
+func parseOIDCReauthToken(value string) (string, error) {
+	var token oidcReauthToken
+	if err := decodeSignedValue(oidcReauthPurpose, value, &token); err != nil {
+		return "", err
+	}
+	if time.Now().Unix() >= token.ExpiresAt {
+		return "", ErrTokenExpired
+	}
+	return token.Username, nil
+}
+
+// randomURLToken 生成URL安全的随机字符串
+func randomURLToken(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// encodeOIDCState 将状态编码为带签名的Cookie值
+func encodeOIDCState(state *oidcState) (string, error) {
+	return encodeSignedValue(oidcStateCookie, state)
+}
+
+// decodeOIDCState 校验Cookie签名和有效期并解析状态
+func decodeOIDCState(value string) (*oidcState, error) {
+	var state oidcState
+	if err := decodeSignedValue(oidcStateCookie, value, &state); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= state.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return &state, nil
+}
+
+// deriveOIDCUsername 根据外部身份生成符合账户策略且未被占用的用户名
+func deriveOIDCUsername(tx *gorm.DB, claims *oidcClaims) (string, error) {
+	candidates := []string{claims.PreferredUsername}
+	if local, _, ok := strings.Cut(claims.Email, "@"); ok {
+		candidates = append(candidates, local)
+	}
+	subjectHash := sha256.Sum256([]byte(claims.Subject))
+	candidates = append(candidates, "oidc_"+hex.EncodeToString(subjectHash[:])[:10])
+
+	for _, candidate := range candidates {
+		// 去掉账户策略不允许的字符
+		var sanitized strings.Builder
+		for _, r := range candidate {
+			if accountPolicy.UsernamePattern.MatchString(string(r)) {
+				sanitized.WriteRune(r)
+			}
+		}
+		base := sanitized.String()
+		if accountPolicy.ValidateUsername(base) != nil {
+			continue
+		}
+
+		for i := 1; i <= 20; i++ {
+			username := base
+			if i > 1 {
+				username = fmt.Sprintf("%s_%d", base, i)
+			}
+			if accountPolicy.ValidateUsername(username) != nil {
+				break
+			}
+			var count int64
+			if err := tx.Model(&models.Users{}).Where("username = ?", username).Count(&count).Error; err != nil {
+				return "", err
+			}
+			if count == 0 {
+				return username, nil
+			}
+		}
+	}
+
+	return "", errors.New("无法为第三方账号生成可用的用户名")
+}
+
+// findOrCreateOIDCUser 查找外部身份关联的用户，首次登录时按注册规则创建账户
+// 邮箱已属于本地账户时返回该账户和ErrOIDCLinkRequired，不会自动关联
+func findOrCreateOIDCUser(provider string, claims *oidcClaims, state *oidcState) (*models.Users, bool, error) {
+	var user models.Users
+	created := false
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var link models.ExternalIdentities
+		result := tx.Where("provider = ? AND subject = ?", provider, claims.Subject).First(&link)
+		if result.Error == nil {
+			return tx.Where("username = ?", link.Username).First(&user).Error
+		} else if result.Error != gorm.ErrRecordNotFound {
+			return result.Error
+		}
+
+		// 只有提供方确认过的邮箱才能关联到有密码的本地账户，且需要输入本地密码确认
+		if claims.Email != "" {
+			result := tx.Where("email = ?", claims.Email).Order("created_at").First(&user)
+			if result.Error == nil {
+				if claims.EmailVerified && user.Password != "" {
+					return ErrOIDCLinkRequired
+				}
+				return ErrOIDCEmailConflict
+			} else if result.Error != gorm.ErrRecordNotFound {
+				return result.Error
+			}
+		}
+
+		// 创建账户与普通注册一样需要图形验证码，仅限邀请注册时还需要邀请码
+		if !state.CaptchaVerified {
+			return ErrCaptchaRequired
+		}
+		var invitation *models.InvitationCodes
+		if state.InviteCode != "" || REGISTRATION_MODE == RegistrationInvite {
+			var err error
+			if invitation, err = findInvitationCode(state.InviteCode); err != nil {
+				return err
+			}
+		}
+
+		username, err := deriveOIDCUsername(tx, claims)
+		if err != nil {
+			return err
+		}
+
+		// 第三方账号没有本地密码，密码哈希为空时无法通过密码登录
+		user = models.Users{Username: username}
+		if claims.EmailVerified {
+			user.Email = claims.Email
+		}
+		if invitation != nil {
+			user.Role = invitation.Role
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		created = true
+
+		if err := tx.Create(&models.ExternalIdentities{
+			Provider: provider,
+			Subject:  claims.Subject,
+			Username: username,
+			Email:    claims.Email,
+		}).Error; err != nil {
+			return err
+		}
+
+		if invitation == nil {
+			return nil
+		}
+		if err := consumeInvitationCode(tx, invitation); err != nil {
+			return err
+		}
+		return joinPresetOrganization(tx, username, invitation.OrganizationID, invitation.OrgRole)
+	})
+	if err == ErrOIDCLinkRequired {
+		return &user, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &user, created, nil
+}
+
+// oidcRespond 接口调用方直接返回JSON，浏览器跳转回前端并把响应字段放在URL片段中
+func oidcRespond(c *gin.Context, status int, body gin.H) {
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(status, body)
+		return
+	}
+	fragment := url.Values{}
+	for key, value := range body {
+		fragment.Set(key, fmt.Sprint(value))
+	}
+	c.Redirect(http.StatusFound, OIDC_FRONTEND_REDIRECT+"#"+fragment.Encode())
+}
+
+// OIDCLogin 发起第三方登录，跳转到身份提供方的授权页面
+// 首次登录需要创建账户时必须携带图形验证码，仅限邀请注册时还需要携带邀请码
+// intent=reauth时要求提供方重新输入凭证，回调只签发重新验证凭证而不创建会话
+func OIDCLogin(c *gin.Context) {
+	if !oidcProvider.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrOIDCDisabled.Error()})
+		return
+	}
+
+	intent := c.Query("intent")
+	if intent != "" && intent != oidcIntentReauth {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "intent 参数无效"})
+		return
+	}
+
+	state := &oidcState{
+		Intent:     intent,
+		InviteCode: c.Query("invite_code"),
+		ExpiresAt:  time.Now().Add(oidcStateTTL).Unix(),
+	}
+
+	// 首次使用第三方登录会创建账户，图形验证码在发起登录时校验，结果保存在签名状态中
+	if captchaID := c.Query("captcha_id"); captchaID != "" {
+		if !captchaErrorResponse(c, VerifyCaptcha(captchaID, c.Query("captcha_answer"))) {
+			return
+		}
+		state.CaptchaVerified = true
+	}
+
+	var err error
+	if state.State, err = randomURLToken(24); err == nil {
+		if state.Nonce, err = randomURLToken(24); err == nil {
+			state.CodeVerifier, err = randomURLToken(48)
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成登录状态失败"})
+		return
+	}
+
+	var extra url.Values
+	if intent == oidcIntentReauth {
+		extra = url.Values{"prompt": {"login"}, "max_age": {"0"}}
+	}
+	authURL, err := oidcProvider.AuthCodeURL(state.State, state.Nonce, state.CodeVerifier, extra)
+	if err != nil {
+		fmt.Println("OIDC发现失败:", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "第三方登录服务不可用"})
+		return
+	}
+
+	cookieValue, err := encodeOIDCState(state)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成登录状态失败"})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, cookieValue, int(oidcStateTTL.Seconds()), "/api/user/oidc", "", c.Request.TLS != nil, true)
+
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback 处理身份提供方的回调，校验身份令牌后登录或创建账户
+func OIDCCallback(c *gin.Context) {
+	if !oidcProvider.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrOIDCDisabled.Error()})
+		return
+	}
+
+	if errCode := c.Query("error"); errCode != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "第三方登录被拒绝: " + errCode})
+		return
+	}
+
+	cookieValue, err := c.Cookie(oidcStateCookie)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "登录状态已失效，请重新登录"})
+		return
+	}
+	// 状态只能使用一次
+	c.SetCookie(oidcStateCookie, "", -1, "/api/user/oidc", "", c.Request.TLS != nil, true)
+
+	state, err := decodeOIDCState(cookieValue)
+	if err != nil || c.Query("state") != state.State {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "登录状态已失效，请重新登录"})
+		return
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "缺少授权码"})
+		return
+	}
+
+	rawIDToken, err := oidcProvider.Exchange(code, state.CodeVerifier)
+	if err != nil {
+		fmt.Println("OIDC授权码换取失败:", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "第三方登录失败"})
+		return
+	}
+
+	claims, err := oidcProvider.VerifyIDToken(rawIDToken, state.Nonce)
+	if err != nil {
+		fmt.Println("OIDC身份令牌校验失败:", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "第三方登录失败"})
+		return
+	}
+
+	if state.Intent == oidcIntentReauth {
+		oidcReauthCallback(c, claims)
+		return
+	}
+
+	user, created, err := findOrCreateOIDCUser(oidcProvider.Name, claims, state)
+	switch err {
+	case nil:
+	case ErrOIDCLinkRequired:
+		linkToken, err := issueOIDCLinkToken(oidcProvider.Name, claims, user.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+			return
+		}
+		oidcRespond(c, http.StatusConflict, gin.H{
+			"error":         ErrOIDCLinkRequired.Error(),
+			"link_required": true,
+			"link_token":    linkToken,
+			"username":      user.Username,
+		})
+		return
+	case ErrOIDCEmailConflict:
+		oidcRespond(c, http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case ErrCaptchaRequired:
+		oidcRespond(c, http.StatusForbidden, gin.H{"error": "首次使用第三方登录需要先完成图形验证码", "captcha_required": true})
+		return
+	case ErrInvitationCodeInvalid:
+		oidcRespond(c, http.StatusForbidden, gin.H{"error": err.Error(), "invite_code_required": REGISTRATION_MODE == RegistrationInvite})
+		return
+	default:
+		fmt.Println("OIDC账户关联失败:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "账户关联失败"})
+		return
+	}
+
+	if !loginAllowed(c, AuditLoginOIDC, user) {
+		return
+	}
+
+	// 启用了两步验证的账户同样需要完成第二步
+	if user.TOTPEnabled {
+		if strings.Contains(c.GetHeader("Accept"), "application/json") {
+			response, err := twoFactorChallengeResponse(user.Username)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+				return
+			}
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		challenge, err := issueTwoFactorChallenge(user.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+			return
+		}
+		fragment := url.Values{
+			"two_factor_required": {"true"},
+			"challenge_token":     {challenge},
+		}
+		c.Redirect(http.StatusFound, OIDC_FRONTEND_REDIRECT+"#"+fragment.Encode())
+		return
+	}
+
+	token, session, err := CreateSession(c, user.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditLoginOIDC,
+		Actor:   user.Username,
+		Target:  user.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"provider": oidcProvider.Name, "created": created, "session_id": session.ID},
+	})
+
+	result := gin.H{
+		"message":      "登录成功",
+		"access_token": token,
+		"token_type":   "Bearer",
+		"session_id":   session.ID,
+		"role":         user.Role,
+		"username":     user.Username,
+		"created":      created,
+		"expires_at":   session.ExpiresAt.Format(time.RFC3339),
+	}
+
+	// 接口调用方直接返回JSON，浏览器跳转回前端并在URL片段中携带令牌
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	fragment := url.Values{
+		"access_token": {token},
+		"token_type":   {"Bearer"},
+		"username":     {user.Username},
+		"expires_at":   {session.ExpiresAt.Format(time.RFC3339)},
+	}
+	c.Redirect(http.StatusFound, OIDC_FRONTEND_REDIRECT+"#"+fragment.Encode())
+}
+
+// oidcReauthCallback 处理重新验证的回调，只接受已关联的外部身份和最近的登录时间
+func oidcReauthCallback(c *gin.Context, claims *oidcClaims) {
+	var link models.ExternalIdentities
+	result := DB.Where("provider = ? AND subject = ?", oidcProvider.Name, claims.Subject).First(&link)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "该第三方账号未关联本地账户"})
+		return
+	} else if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	authTime := time.Unix(claims.AuthTime, 0)
+	if claims.AuthTime == 0 || time.Since(authTime) > oidcReauthMaxAge+oidcClockSkew {
+		RecordAudit(c, AuditEvent{
+			Action:  AuditLoginOIDC,
+			Actor:   link.Username,
+			Target:  link.Username,
+			Outcome: AuditFailure,
+			Detail:  gin.H{"provider": oidcProvider.Name, "reason": "stale_auth_time"},
+		})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "请在第三方登录页面重新输入凭证"})
+		return
+	}
+
+	token, expiresAt, err := issueOIDCReauthToken(link.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+		return
+	}
+	RecordAudit(c, AuditEvent{
+		Action:  AuditLoginOIDC,
+		Actor:   link.Username,
+		Target:  link.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"provider": oidcProvider.Name, "stage": "reauth"},
+	})
+
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.JSON(http.StatusOK, gin.H{
+			"reauth_token": token,
+			"username":     link.Username,
+			"expires_at":   expiresAt.Format(time.RFC3339),
+		})
+		return
+	}
+	fragment := url.Values{
+		"reauth_token": {token},
+		"username":     {link.Username},
+		"expires_at":   {expiresAt.Format(time.RFC3339)},
+	}
+	c.Redirect(http.StatusFound, OIDC_FRONTEND_REDIRECT+"#"+fragment.Encode())
+}
+
+// OIDCLink 输入本地账户密码，将邮箱匹配的第三方账号关联到本地账户并登录
+func OIDCLink(c *gin.Context) {
+	if !oidcProvider.Enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrOIDCDisabled.Error()})
+		return
+	}
+
+	var requestData struct {
+		LinkToken string `json:"link_token"`
+		Password  string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	if requestData.LinkToken == "" || requestData.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "关联凭证和密码为必填项"})
+		return
+	}
+
+	token, err := parseOIDCLinkToken(requestData.LinkToken)
+	if err != nil || token.Provider != oidcProvider.Name {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "关联凭证已失效，请重新登录"})
+		return
+	}
+
+	// 与密码登录共用失败计数，防止借关联接口猜测密码
+	clientIP := c.ClientIP()
+	wait, err := loginGuard.Check(token.Username, clientIP)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if wait > 0 {
+		auditLoginFailure(c, AuditLoginOIDC, token.Username, "throttled")
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "登录尝试过于频繁，请稍后再试",
+			"retry_after": retryAfter,
+		})
+		return
+	}
+
+	var user models.Users
+	result := DB.Where("username = ? AND email = ?", token.Username, token.Email).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "关联凭证已失效，请重新登录"})
+		return
+	} else if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	if user.Password == "" || !passwordHasher.Verify(user.Password, requestData.Password) {
+		if err := loginGuard.RecordFailure(user.Username, clientIP); err != nil {
+			fmt.Println("记录登录失败出错:", err)
+		}
+		auditLoginFailure(c, AuditLoginOIDC, user.Username, "bad_password")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "密码错误"})
+		return
+	}
+
+	if !loginAllowed(c, AuditLoginOIDC, &user) {
+		return
+	}
+
+	err = DB.Create(&models.ExternalIdentities{
+		Provider: token.Provider,
+		Subject:  token.Subject,
+		Username: user.Username,
+		Email:    token.Email,
+	}).Error
+	if err != nil {
+		// 唯一索引冲突说明该外部身份已被关联
+		var count int64
+		if DB.Model(&models.ExternalIdentities{}).Where("provider = ? AND subject = ?", token.Provider, token.Subject).Count(&count); count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "该第三方账号已关联其他账户"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "账户关联失败"})
+		return
+	}
+	RecordAudit(c, AuditEvent{
+		Action:  AuditLoginOIDC,
+		Actor:   user.Username,
+		Target:  user.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"provider": token.Provider, "stage": "linked"},
+	})
+
+	if user.TOTPEnabled {
+		response, err := twoFactorChallengeResponse(user.Username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+			return
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if err := loginGuard.RecordSuccess(user.Username); err != nil {
+		fmt.Println("清除登录失败计数出错:", err)
+	}
+	response, err := loginSuccessResponse(c, &user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+		return
+	}
+	response["username"] = user.Username
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"server-env.com/server/models"
+)
+
+// mockIdP 是测试用的OIDC身份提供方，令牌端点返回用当前声明签发的身份令牌
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	// JWKS中同时提供的P-256密钥，kid为ec-key
+	ecKey *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]any
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+	idp := &mockIdP{key: key, kid: "test-key", ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		claims := idp.claims
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.key, claims)})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": idp.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, {
+			"kty": "EC",
+			"kid": "ec-key",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		}, {
+			// 用于加密的密钥不能用来校验签名
+			"kty": "RSA",
+			"kid": "enc-key",
+			"use": "enc",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	previous := oidcProvider
+	oidcProvider = &OIDCProvider{
+		Name:        "mock",
+		Issuer:      idp.server.URL,
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost/api/user/oidc/callback",
+		Scopes:      "openid email",
+		client:      resty.New().SetDisableWarn(true),
+	}
+	t.Cleanup(func() { oidcProvider = previous })
+	return idp
+}
+
+// sign 用RS256签发身份令牌
+func (idp *mockIdP) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": idp.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("签名失败: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims 返回一组可以通过校验的声明，nonce由登录流程填入
+func (idp *mockIdP) validClaims(subject string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":                idp.server.URL,
+		"sub":                subject,
+		"aud":                oidcProvider.ClientID,
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"auth_time":          now.Unix(),
+		"email":              subject + "@example.com",
+		"email_verified":     true,
+		"preferred_username": subject,
+	}
+}
+
+// login 走一遍登录发起和回调，claims为令牌端点返回的声明
+func (idp *mockIdP) login(t *testing.T, router http.Handler, query string, claims map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	w := performRequest(router, http.MethodGet, "/api/user/oidc/login?"+query, "", nil)
+	if w.Code != http.StatusFound {
+		return w
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("跳转地址无效: %v", err)
+	}
+	var cookie string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oidcStateCookie {
+			cookie = c.Name + "=" + c.Value
+		}
+	}
+
+	claims["nonce"] = location.Query().Get("nonce")
+	idp.mu.Lock()
+	idp.claims = claims
+	idp.mu.Unlock()
+
+	target := "/api/user/oidc/callback?code=test-code&state=" + url.QueryEscape(location.Query().Get("state"))
+	return performRequest(router, http.MethodGet, target, "", map[string]string{
+		"Cookie": cookie,
+		"Accept": "application/json",
+	})
+}
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) map[string]any {
+	t.Helper()
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("响应不是JSON: %s", w.Body.String())
+	}
+	return body
+}
+
+func TestOIDCCallbackCreatesAccount(t *testing.T) {
+	setupTestDB(t)
+	idp := newMockIdP(t)
+	router := newTestRouter()
+
+	// 未完成图形验证码时不创建账户
+	w := idp.login(t, router, "", idp.validClaims("alice"))
+	if w.Code != http.StatusForbidden || decodeBody(t, w)["captcha_required"] != true {
+		t.Fatalf("缺少验证码时应返回403 captcha_required，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	createTestCaptcha(t, "captcha-1", "ABCD")
+	w = idp.login(t, router, "captcha_id=captcha-1&captcha_answer=abcd", idp.validClaims("alice"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("首次登录应创建账户，实际 %d %s", w.Code, w.Body.String())
+	}
+	body := decodeBody(t, w)
+	if body["created"] != true || body["access_token"] == "" {
+		t.Fatalf("响应缺少账户信息: %v", body)
+	}
+
+	var link models.ExternalIdentities
+	if err := DB.Where("provider = ? AND subject = ?", "mock", "alice").First(&link).Error; err != nil {
+		t.Fatalf("未保存外部身份: %v", err)
+	}
+
+	// 再次登录使用已关联的账户，不再需要验证码
+	w = idp.login(t, router, "", idp.validClaims("alice"))
+	if w.Code != http.StatusOK || decodeBody(t, w)["created"] != false {
+		t.Fatalf("再次登录应使用已有账户，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	// 用户名已被占用时生成新的用户名
+	createTestUser(t, models.Users{Username: "bob"}, "Local-Passw0rd")
+	createTestCaptcha(t, "captcha-2", "ABCD")
+	w = idp.login(t, router, "captcha_id=captcha-2&captcha_answer=ABCD", idp.validClaims("bob"))
+	if body := decodeBody(t, w); w.Code != http.StatusOK || body["username"] == "bob" || body["created"] != true {
+		t.Fatalf("不应登录已有的同名本地账户，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCCallbackInviteOnly(t *testing.T) {
+	setupTestDB(t)
+	idp := newMockIdP(t)
+	router := newTestRouter()
+
+	previous := REGISTRATION_MODE
+	REGISTRATION_MODE = RegistrationInvite
+	t.Cleanup(func() { REGISTRATION_MODE = previous })
+
+	createTestCaptcha(t, "captcha-1", "ABCD")
+	w := idp.login(t, router, "captcha_id=captcha-1&captcha_answer=ABCD", idp.validClaims("bob"))
+	if w.Code != http.StatusForbidden || decodeBody(t, w)["invite_code_required"] != true {
+		t.Fatalf("仅限邀请注册时应要求邀请码，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	err := DB.Create(&models.InvitationCodes{
+		CodeHash:  hashInvitationCode("INVITE-1"),
+		Role:      models.RoleFarmer,
+		MaxUses:   1,
+		CreatedBy: "admin",
+	}).Error
+	if err != nil {
+		t.Fatalf("创建邀请码失败: %v", err)
+	}
+	createTestCaptcha(t, "captcha-2", "ABCD")
+	w = idp.login(t, router, "captcha_id=captcha-2&captcha_answer=ABCD&invite_code=INVITE-1", idp.validClaims("bob"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("使用邀请码应能创建账户，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	var invitation models.InvitationCodes
+	DB.First(&invitation)
+	if invitation.UsedCount != 1 {
+		t.Fatalf("邀请码使用次数应为1，实际 %d", invitation.UsedCount)
+	}
+}
+
+func TestOIDCCallbackLinksVerifiedEmail(t *testing.T) {
+	setupTestDB(t)
+	idp := newMockIdP(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "carol", Email: "carol@example.com"}, "Local-Passw0rd")
+
+	// 未验证的邮箱不能关联到本地账户
+	claims := idp.validClaims("carol")
+	claims["email_verified"] = false
+	w := idp.login(t, router, "", claims)
+	if w.Code != http.StatusConflict || decodeBody(t, w)["link_required"] != nil {
+		t.Fatalf("未验证的邮箱应拒绝关联，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	// 已验证的邮箱需要输入本地密码确认
+	w = idp.login(t, router, "", idp.validClaims("carol"))
+	body := decodeBody(t, w)
+	if w.Code != http.StatusConflict || body["link_required"] != true {
+		t.Fatalf("已验证的邮箱应要求确认关联，实际 %d %s", w.Code, w.Body.String())
+	}
+	linkToken, _ := body["link_token"].(string)
+
+	var count int64
+	DB.Model(&models.ExternalIdentities{}).Count(&count)
+	if count != 0 {
+		t.Fatal("确认之前不应创建关联")
+	}
+
+	w = performRequest(router, http.MethodPost, "/api/user/oidc/link", `{"link_token":"`+linkToken+`","password":"wrong"}`, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("密码错误应返回401，实际 %d %s", w.Code, w.Body.String())
+	}
+	w = performRequest(router, http.MethodPost, "/api/user/oidc/link", `{"link_token":"`+linkToken+`","password":"Local-Passw0rd"}`, nil)
+	if w.Code != http.StatusOK || decodeBody(t, w)["username"] != "carol" {
+		t.Fatalf("密码正确应完成关联并登录，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	w = idp.login(t, router, "", idp.validClaims("carol"))
+	body = decodeBody(t, w)
+	if w.Code != http.StatusOK || body["username"] != "carol" || body["created"] != false {
+		t.Fatalf("关联后应直接登录本地账户，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOIDCCallbackAccountStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   models.Users
+		status int
+	}{
+		{"禁用", models.Users{Username: "dave", Disabled: true}, http.StatusForbidden},
+		{"需要重置密码", models.Users{Username: "dave", PasswordResetRequired: true}, http.StatusForbidden},
+		{"正常", models.Users{Username: "dave"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			idp := newMockIdP(t)
+			router := newTestRouter()
+			createTestUser(t, tt.user, "")
+			DB.Create(&models.ExternalIdentities{Provider: "mock", Subject: "dave", Username: "dave"})
+
+			w := idp.login(t, router, "", idp.validClaims("dave"))
+			if w.Code != tt.status {
+				t.Fatalf("期望 %d，实际 %d %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestOIDCLoginDisabled(t *testing.T) {
+	previous := oidcProvider
+	oidcProvider = &OIDCProvider{}
+	t.Cleanup(func() { oidcProvider = previous })
+
+	router := newTestRouter()
+	for _, target := range []string{"/api/user/oidc/login", "/api/user/oidc/callback"} {
+		if w := performRequest(router, http.MethodGet, target, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s 未配置第三方登录时应返回404，实际 %d", target, w.Code)
+		}
+	}
+}
+
+func TestOIDCCallbackRejectsInvalidIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("生成密钥失败: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(idp *mockIdP, claims map[string]any)
+	}{
+		{"签发方不匹配", func(idp *mockIdP, claims map[string]any) { claims["iss"] = "https://evil.example.com" }},
+		{"受众不匹配", func(idp *mockIdP, claims map[string]any) { claims["aud"] = "other-client" }},
+		{"已过期", func(idp *mockIdP, claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"签名密钥不匹配", func(idp *mockIdP, claims map[string]any) { idp.key = otherKey }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			idp := newMockIdP(t)
+			router := newTestRouter()
+			claims := idp.validClaims("erin")
+			tt.mutate(idp, claims)
+
+			w := idp.login(t, router, "", claims)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("期望401，实际 %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestOIDCReauth(t *testing.T) {
+	setupTestDB(t)
+	idp := newMockIdP(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "frank"}, "")
+	DB.Create(&models.ExternalIdentities{Provider: "mock", Subject: "frank", Username: "frank"})
+
+	claims := idp.validClaims("frank")
+	claims["auth_time"] = time.Now().Add(-time.Hour).Unix()
+	w := idp.login(t, router, "intent=reauth", claims)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("登录时间过早应拒绝，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	w = idp.login(t, router, "intent=reauth", idp.validClaims("frank"))
+	body := decodeBody(t, w)
+	if w.Code != http.StatusOK || body["access_token"] != nil {
+		t.Fatalf("重新验证应只返回凭证，实际 %d %s", w.Code, w.Body.String())
+	}
+	username, err := parseOIDCReauthToken(body["reauth_token"].(string))
+	if err != nil || username != "frank" {
+		t.Fatalf("重新验证凭证无效: %v %s", err, username)
+	}
+}
+
+// signIDToken 按给定的头部签发身份令牌，RS256使用RSA密钥，ES256使用P-256密钥
+func (idp *mockIdP) signIDToken(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	var signature []byte
+	switch alg {
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, idp.ecKey, digest[:])
+		if err != nil {
+			t.Fatalf("签名失败: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("签名失败: %v", err)
+		}
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	with := func(changes map[string]any) map[string]any {
+		claims := idp.validClaims("gina")
+		claims["nonce"] = "n-1"
+		for key, value := range changes {
+			if value == nil {
+				delete(claims, key)
+			} else {
+				claims[key] = value
+			}
+		}
+		return claims
+	}
+	valid := idp.signIDToken(t, "RS256", idp.kid, with(nil))
+	parts := strings.Split(valid, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + idp.server.URL + `","sub":"admin","aud":"test-client","exp":9999999999,"nonce":"n-1"}`))
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"RS256", valid, nil},
+		{"ES256", idp.signIDToken(t, "ES256", "ec-key", with(nil)), nil},
+		{"受众为数组", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"aud": []string{"other", "test-client"}})), nil},
+		{"签发方带斜杠", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"iss": idp.server.URL + "/"})), nil},
+		{"时钟偏差内过期", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"exp": time.Now().Add(-oidcClockSkew / 2).Unix()})), nil},
+		{"超出时钟偏差", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"exp": time.Now().Add(-2 * oidcClockSkew).Unix()})), ErrIDTokenInvalid},
+		{"nonce不匹配", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"nonce": "n-2"})), ErrIDTokenInvalid},
+		{"缺少nonce", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"nonce": nil})), ErrIDTokenInvalid},
+		{"缺少sub", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"sub": nil})), ErrIDTokenInvalid},
+		{"受众数组中没有本应用", idp.signIDToken(t, "RS256", idp.kid, with(map[string]any{"aud": []string{"other"}})), ErrIDTokenInvalid},
+		{"RSA密钥声明为ES256", idp.signIDToken(t, "ES256", idp.kid, with(nil)), ErrIDTokenInvalid},
+		{"EC密钥声明为RS256", idp.signIDToken(t, "RS256", "ec-key", with(nil)), ErrIDTokenInvalid},
+		{"alg为none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test-key"}`)) + "." + parts[1] + ".", ErrIDTokenInvalid},
+		{"加密用途的密钥", idp.signIDToken(t, "RS256", "enc-key", with(nil)), ErrIDTokenKeyLookup},
+		{"未知的kid", idp.signIDToken(t, "RS256", "unknown", with(nil)), ErrIDTokenKeyLookup},
+		{"篡改载荷", parts[0] + "." + forged + "." + parts[2], ErrIDTokenInvalid},
+		{"签名不是base64", parts[0] + "." + parts[1] + ".!!!", ErrIDTokenInvalid},
+		{"头部不是JSON", base64.RawURLEncoding.EncodeToString([]byte("x")) + "." + parts[1] + "." + parts[2], ErrIDTokenInvalid},
+		{"段数不对", parts[0] + "." + parts[1], ErrIDTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := oidcProvider.VerifyIDToken(tt.token, "n-1")
+			if err != tt.err {
+				t.Fatalf("期望错误 %v，实际 %v", tt.err, err)
+			}
+			if tt.err == nil && claims.Subject != "gina" {
+				t.Fatalf("声明解析错误: %+v", claims)
+			}
+		})
+	}
+}
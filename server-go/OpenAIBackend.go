@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+var (
+	// 兼容OpenAI chat completions接口的服务地址，本地模型服务如 http://localhost:11434/v1
+	OPENAI_BASE_URL = getEnvOrDefault("OPENAI_BASE_URL", "https://api.openai.com/v1")
+	OPENAI_API_KEY  = os.Getenv("OPENAI_API_KEY")
+	OPENAI_MODEL    = os.Getenv("OPENAI_MODEL")
+	// 可选的系统提示词
+	OPENAI_SYSTEM_PROMPT = os.Getenv("OPENAI_SYSTEM_PROMPT")
+	// 每次提问带上的历史问答轮数
+	OPENAI_HISTORY_TURNS = getEnvIntOrDefault("OPENAI_HISTORY_TURNS", 10)
+)
+
+// 生成推荐问题时使用的提示词
+const openAISuggestionPrompt = "根据以上对话，列出用户接下来最可能提出的3个简短问题，每行一个，不要编号，不要输出其他内容。"
+
+// OpenAIBackend 通过兼容OpenAI chat completions的接口提供聊天
+// 这类接口不保存会话，会话和历史直接读取数据库中的聊天记录
+type OpenAIBackend struct {
+	client *resty.Client
+	model  string
+}
+
+// NewOpenAIBackendFromEnv 根据环境变量创建OpenAI兼容后端
+func NewOpenAIBackendFromEnv() (*OpenAIBackend, error) {
+	if OPENAI_MODEL == "" {
+		return nil, errors.New("使用 openai 聊天后端时必须设置 OPENAI_MODEL")
+	}
+	client := resty.New().
+		SetBaseURL(strings.TrimRight(OPENAI_BASE_URL, "/")).
+		SetTimeout(10*time.Minute).
+		SetHeader("Content-Type", "application/json")
+	if OPENAI_API_KEY != "" {
+		client.SetHeader("Authorization", "Bearer "+OPENAI_API_KEY)
+	}
+	if USE_PROXY {
+		client.SetProxy(ALL_PROXY)
+	}
+	return &OpenAIBackend{client: client, model: OPENAI_MODEL}, nil
+}
+
+// openAIMessage 是chat completions请求中的一条消息，Content为字符串或多段内容
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+// openAIStreamChunk 是流式响应中的一段
+type openAIStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage json.RawMessage `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// randomHexID 生成随机的十六进制ID
+func randomHexID(prefix string) (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(buf), nil
+}
+
+// historyMessages 把会话最近的问答转换为请求消息
+func (b *OpenAIBackend) historyMessages(ctx context.Context, username, conversationID string) ([]openAIMessage, error) {
+	messages := []openAIMessage{}
+	if OPENAI_SYSTEM_PROMPT != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: OPENAI_SYSTEM_PROMPT})
+	}
+	if conversationID == "" {
+		return messages, nil
+	}
+	history, err := b.History(ctx, username, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) > OPENAI_HISTORY_TURNS {
+		history = history[len(history)-OPENAI_HISTORY_TURNS:]
+	}
+	for _, turn := range history {
+		messages = append(messages,
+			openAIMessage{Role: "user", Content: turn.Query},
+			openAIMessage{Role: "assistant", Content: turn.Answer},
+		)
+	}
+	return messages, nil
+}
+
+// userMessage 构造本次提问，图片以data URL内联
+func (b *OpenAIBackend) userMessage(ctx context.Context, query string, fileIDs []string) (openAIMessage, error) {
+	if len(fileIDs) == 0 {
+		return openAIMessage{Role: "user", Content: query}, nil
+	}
+	parts := []map[string]any{{"type": "text", "text": query}}
+	for _, fileID := range fileIDs {
+		// 文件ID即上传图片在文件存储中的键
+		if !strings.HasPrefix(fileID, uploadKeyPrefix) {
+			return openAIMessage{}, fmt.Errorf("无效的文件ID: %s", fileID)
+		}
+		reader, info, err := blobStore.Get(ctx, fileID)
+		if err != nil {
+			return openAIMessage{}, err
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return openAIMessage{}, err
+		}
+		parts = append(parts, map[string]any{
+			"type": "image_url",
+			"image_url": map[string]string{
+				"url": "data:" + info.ContentType + ";base64," + base64.StdEncoding.EncodeToString(data),
+			},
+		})
+	}
+	return openAIMessage{Role: "user", Content: parts}, nil
+}
+
+func (b *OpenAIBackend) StreamChat(ctx context.Context, req ChatBackendRequest) (<-chan ChatStreamEvent, error) {
+	messages, err := b.historyMessages(ctx, req.Username, req.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	question, err := b.userMessage(ctx, req.Query, req.FileIDs)
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, question)
+
+	resp, err := b.client.R().
+		SetContext(ctx).
+		SetBody(map[string]any{
+			"model":    b.model,
+			"messages": messages,
+			"stream":   true,
+		}).
+		SetDoNotParseResponse(true).
+		Post("/chat/completions")
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		resp.RawResponse.Body.Close()
+		return nil, fmt.Errorf("AI服务异常: %s", resp.Status())
+	}
+
+	conversationID := req.ConversationID
+	if conversationID == "" {
+		if conversationID, err = randomHexID("conv-"); err != nil {
+			resp.RawResponse.Body.Close()
+			return nil, err
+		}
+	}
+	messageID, err := randomHexID("msg-")
+	if err != nil {
+		resp.RawResponse.Body.Close()
+		return nil, err
+	}
+	// 这类接口没有任务的概念，task_id仅用于停止接口找到本地的回答流
+	taskID, err := randomHexID("task-")
+	if err != nil {
+		resp.RawResponse.Body.Close()
+		return nil, err
+	}
+	ids := ChatStreamEvent{ConversationID: conversationID, MessageID: messageID, TaskID: taskID}
+
+	events := make(chan ChatStreamEvent)
+	go func() {
+		defer close(events)
+		defer resp.RawResponse.Body.Close()
+
+		var usage json.RawMessage
+		finishReason := ""
+		completed := false
+
+		reader := bufio.NewReader(resp.RawResponse.Body)
+		for !completed {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					fmt.Println("读取AI服务响应出错:", err)
+					event := ids
+					event.Type = ChatEventError
+					event.Data = ChatErrorEvent{Code: ChatErrorUpstreamRead, Message: "读取AI服务响应出错"}
+					sendChatEvent(ctx, events, event)
+					return
+				}
+				break
+			}
+
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			if data == "[DONE]" {
+				completed = true
+				break
+			}
+			var chunk openAIStreamChunk
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				fmt.Println("JSON parse error:", err)
+				continue
+			}
+			if chunk.Error != nil {
+				event := ids
+				event.Type = ChatEventError
+				event.Data = ChatErrorEvent{Code: ChatErrorUpstream, Message: chunk.Error.Message}
+				sendChatEvent(ctx, events, event)
+				return
+			}
+			if len(chunk.Usage) > 0 && string(chunk.Usage) != "null" {
+				usage = chunk.Usage
+			}
+			for _, choice := range chunk.Choices {
+				if choice.FinishReason != "" {
+					finishReason = choice.FinishReason
+				}
+				if choice.Delta.Content == "" {
+					continue
+				}
+				event := ids
+				event.Type = ChatEventDelta
+				event.Data = ChatDeltaEvent{
+					ConversationID: conversationID,
+					MessageID:      messageID,
+					TaskID:         taskID,
+					Text:           choice.Delta.Content,
+				}
+				if !sendChatEvent(ctx, events, event) {
+					return
+				}
+			}
+		}
+
+		// 没有收到结束标记的响应视为中断，由调用方发送错误事件
+		if !completed && finishReason == "" {
+			return
+		}
+		metadata, _ := json.Marshal(map[string]any{
+			"model":         b.model,
+			"finish_reason": finishReason,
+			"usage":         usage,
+		})
+		event := ids
+		event.Type = ChatEventMessageEnd
+		event.Data = ChatMessageEndEvent{
+			ConversationID: conversationID,
+			MessageID:      messageID,
+			TaskID:         taskID,
+			Metadata:       metadata,
+		}
+		sendChatEvent(ctx, events, event)
+	}()
+	return events, nil
+}
+
+// StopChat 回答流在本进程中读取，由调用方取消请求即可
+func (b *OpenAIBackend) StopChat(ctx context.Context, username, taskID string) error {
+	return nil
+}
+
+// Suggestions 让模型根据会话内容生成推荐问题
+func (b *OpenAIBackend) Suggestions(ctx context.Context, username, messageID string) ([]string, error) {
+	conversationID, err := storedMessageConversation(username, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if conversationID == "" {
+		return []string{}, nil
+	}
+	messages, err := b.historyMessages(ctx, username, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, openAIMessage{Role: "user", Content: openAISuggestionPrompt})
+
+	resp, err := b.client.R().
+		SetContext(ctx).
+		SetBody(map[string]any{"model": b.model, "messages": messages}).
+		Post("/chat/completions")
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, errors.New(resp.Status())
+	}
+
+	var result struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, err
+	}
+	suggestions := []string{}
+	if len(result.Choices) == 0 {
+		return suggestions, nil
+	}
+	for _, line := range strings.Split(result.Choices[0].Message.Content, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "-*•0123456789.、) "))
+		if line != "" && len(suggestions) < 3 {
+			suggestions = append(suggestions, line)
+		}
+	}
+	return suggestions, nil
+}
+
+// ListConversations 会话只保存在数据库中，没有需要导入的会话
+func (b *OpenAIBackend) ListConversations(ctx context.Context, username, lastID string, limit int) ([]ChatConversation, bool, error) {
+	return []ChatConversation{}, false, nil
+}
+
+func (b *OpenAIBackend) ListAllConversationIDs(ctx context.Context, username string) ([]string, error) {
+	return []string{}, nil
+}
+
+// History 返回数据库中保存的本后端的会话
+func (b *OpenAIBackend) History(ctx context.Context, username, conversationID string) ([]ChatHistoryMessage, error) {
+	exists, err := b.ConversationExists(ctx, username, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrConversationNotFound
+	}
+	return storedHistory(username, conversationID)
+}
+
+func (b *OpenAIBackend) ConversationExists(ctx context.Context, username, conversationID string) (bool, error) {
+	conversation, err := findStoredConversation(username, conversationID)
+	if err != nil {
+		return false, err
+	}
+	return conversation != nil && conversation.Backend == CHAT_BACKEND, nil
+}
+
+// DeleteConversation 后端中没有会话，数据库中的记录由调用方删除
+func (b *OpenAIBackend) DeleteConversation(ctx context.Context, username, conversationID string) error {
+	return ErrConversationNotFound
+}
+
+// UploadFile 图片保存到文件存储，文件ID即存储的键，提问时内联到请求中
+func (b *OpenAIBackend) UploadFile(ctx context.Context, username, filename string, data []byte) (string, error) {
+	key, err := storeUploadedImage(ctx, data)
+	if err != nil {
+		return "", err
+	}
+	if key == "" {
+		return "", errors.New("只支持上传图片")
+	}
+	return key, nil
+}
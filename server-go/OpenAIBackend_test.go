@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"server-env.com/server/models"
+)
+
+// fakeOpenAIServer 模拟chat completions接口，记录每次请求的消息
+type fakeOpenAIServer struct {
+	mu       sync.Mutex
+	requests [][]openAIMessage
+}
+
+func (s *fakeOpenAIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Messages []openAIMessage `json:"messages"`
+		Stream   bool            `json:"stream"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	s.requests = append(s.requests, body.Messages)
+	s.mu.Unlock()
+
+	if !body.Stream {
+		fmt.Fprint(w, `{"choices":[{"message":{"content":"1. 问题一\n2. 问题二"}}]}`)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"回答\"}}]}\n\n")
+	fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func (s *fakeOpenAIServer) lastRequest() []openAIMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+// setupOpenAIBackend 使用指向upstream的openai后端，每次调用都创建新实例，模拟重启或多实例
+func setupOpenAIBackend(t *testing.T, upstream *httptest.Server) {
+	t.Helper()
+	previous := chatBackend
+	chatBackend = &OpenAIBackend{client: resty.New().SetBaseURL(upstream.URL), model: "test-model"}
+	t.Cleanup(func() { chatBackend = previous })
+}
+
+func TestOpenAIBackendReadsHistoryFromDatabase(t *testing.T) {
+	setupTestDB(t)
+	upstream := &fakeOpenAIServer{}
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	setupOpenAIBackend(t, server)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "kate"}, "Kate-Passw0rd")
+	token := testAccessToken(t, "kate")
+
+	w := performRequest(router, http.MethodPost, "/api/chat", chatBody("kate", "第一个问题", ""), bearer(token))
+	events := readSSEEvents(t, w.Body.String())
+	end := events[len(events)-1]
+	if end.Event != ChatEventMessageEnd {
+		t.Fatalf("回答应以message_end结束，实际 %v", events)
+	}
+	conversationID := end.Data["conversation_id"].(string)
+	messageID := end.Data["message_id"].(string)
+
+	// 新的后端实例没有任何内存状态，上下文只能来自数据库
+	setupOpenAIBackend(t, server)
+	w = performRequest(router, http.MethodPost, "/api/chat", chatBody("kate", "第二个问题", conversationID), bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("继续会话失败 %d %s", w.Code, w.Body.String())
+	}
+	messages := upstream.lastRequest()
+	if len(messages) != 3 || messages[0].Content != "第一个问题" || messages[1].Content != "回答" || messages[2].Content != "第二个问题" {
+		t.Fatalf("请求应带上数据库中的历史，实际 %v", messages)
+	}
+
+	w = performRequest(router, http.MethodGet, "/api/chat/next_suggest/"+messageID+"?username=kate", "", bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("获取问题建议失败 %d %s", w.Code, w.Body.String())
+	}
+	var suggestions struct {
+		Data []string `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &suggestions)
+	if len(suggestions.Data) != 2 || suggestions.Data[0] != "问题一" {
+		t.Fatalf("问题建议解析错误: %v", suggestions.Data)
+	}
+
+	// 其他用户的会话和不存在的会话都不能继续
+	createTestUser(t, models.Users{Username: "leo"}, "Leo-Passw0rd")
+	w = performRequest(router, http.MethodPost, "/api/chat", chatBody("leo", "问题", conversationID), bearer(testAccessToken(t, "leo")))
+	if w.Code == http.StatusOK {
+		t.Fatalf("其他用户不应能继续会话: %s", w.Body.String())
+	}
+}
+
+func TestLocalConversationStoreBounded(t *testing.T) {
+	store := newLocalConversationStore()
+	for i := 0; i < localConversationLimit+10; i++ {
+		id := fmt.Sprintf("conv-%d", i)
+		store.create("mia", id, "问题")
+		store.append("mia", id, ChatHistoryMessage{ID: fmt.Sprintf("msg-%d", i), CreatedAt: int64(i)})
+	}
+	if len(store.conversations) != localConversationLimit || len(store.messages) != localConversationLimit {
+		t.Fatalf("会话数应不超过 %d，实际 %d 个会话 %d 条消息", localConversationLimit, len(store.conversations), len(store.messages))
+	}
+	if store.exists("mia", "conv-0") || !store.exists("mia", fmt.Sprintf("conv-%d", localConversationLimit+9)) {
+		t.Fatal("应丢弃最久未更新的会话")
+	}
+}
@@ -0,0 +1,1140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+const (
+	// 邀请的有效期
+	orgInvitationTTL = 7 * 24 * time.Hour
+	// 组织名称和简介的长度限制
+	maxOrgNameLength        = 100
+	maxOrgDescriptionLength = 500
+)
+
+var (
+	// 可以管理成员和邀请的组织角色
+	orgManagerRoles = []string{models.OrgRoleOwner, models.OrgRoleAdmin}
+	// 可以查看开启全部共享的成员记录的组织角色
+	orgStaffRoles = []string{models.OrgRoleOwner, models.OrgRoleAdmin, models.OrgRoleAgent}
+)
+
+var (
+	ErrResourceNotFound = errors.New("资源不存在")
+	ErrLastOrgOwner     = errors.New("组织至少需要一个所有者，请先将其他成员设为所有者")
+)
+
+// orgTarget 审计日志中组织的目标名称
+func orgTarget(orgID uint) string {
+	return "org:" + strconv.FormatUint(uint64(orgID), 10)
+}
+
+// organizationView 组织信息，附带当前用户在组织内的角色
+func organizationView(org *models.Organizations, member *models.OrganizationMembers) gin.H {
+	return gin.H{
+		"id":          org.ID,
+		"name":        org.Name,
+		"description": org.Description,
+		"created_by":  org.CreatedBy,
+		"created_at":  org.CreatedAt.Format(time.RFC3339),
+		"role":        member.Role,
+		"share_all":   member.ShareAll,
+	}
+}
+
+// memberView 组织成员信息，只包含其他成员可见的资料
+func memberView(member *models.OrganizationMembers, user *models.Users) gin.H {
+	view := gin.H{
+		"username":  member.Username,
+		"role":      member.Role,
+		"share_all": member.ShareAll,
+		"joined_at": member.CreatedAt.Format(time.RFC3339),
+	}
+	if user != nil {
+		view["display_name"] = user.DisplayName
+		view["avatar"] = avatarURL(user.Avatar)
+		view["region_adcode"] = user.RegionAdcode
+	}
+	return view
+}
+
+// invitationView 邀请信息
+func invitationView(invitation *models.OrganizationInvitations, org *models.Organizations) gin.H {
+	view := gin.H{
+		"id":              invitation.ID,
+		"organization_id": invitation.OrganizationID,
+		"username":        invitation.Username,
+		"role":            invitation.Role,
+		"invited_by":      invitation.InvitedBy,
+		"created_at":      invitation.CreatedAt.Format(time.RFC3339),
+		"expires_at":      invitation.ExpiresAt.Format(time.RFC3339),
+	}
+	if org != nil {
+		view["organization_name"] = org.Name
+	}
+	return view
+}
+
+// sharedResourceView 共享资源信息
+func sharedResourceView(share *models.SharedResources) gin.H {
+	return gin.H{
+		"id":            share.ID,
+		"resource_type": share.ResourceType,
+		"resource_id":   share.ResourceID,
+		"owner":         share.Owner,
+		"title":         share.Title,
+		"created_at":    share.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// pendingInvitations 未处理且未过期的邀请
+func pendingInvitations(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&models.OrganizationInvitations{}).
+		Where("accepted_at IS NULL AND declined_at IS NULL AND revoked_at IS NULL AND expires_at > ?", time.Now())
+}
+
+// loadMembership 查询当前用户在路径中组织的成员身份，失败时直接写入响应
+// 不是成员时与组织不存在返回相同的错误
+func loadMembership(c *gin.Context) (*models.OrganizationMembers, bool) {
+	orgID, ok := parseIDParam(c, "org_id", "组织")
+	if !ok {
+		return nil, false
+	}
+
+	var member models.OrganizationMembers
+	result := DB.Where("organization_id = ? AND username = ?", orgID, CurrentIdentity(c).Username).First(&member)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "组织不存在"})
+		return nil, false
+	} else if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return nil, false
+	}
+	return &member, true
+}
+
+// requireOrgRole 检查成员在组织内的角色，不满足时直接写入响应
+func requireOrgRole(c *gin.Context, member *models.OrganizationMembers, roles ...string) bool {
+	if !slices.Contains(roles, member.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "组织内权限不足"})
+		return false
+	}
+	return true
+}
+
+// loadOrganizationMember 查询组织的某个成员
+func loadOrganizationMember(orgID uint, username string) (*models.OrganizationMembers, error) {
+	var member models.OrganizationMembers
+	if err := DB.Where("organization_id = ? AND username = ?", orgID, username).First(&member).Error; err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// canAssignOrgRole 判断成员能否授予或变更为给定角色，所有者和管理员只能由所有者授予
+func canAssignOrgRole(actor *models.OrganizationMembers, role string) bool {
+	if actor.Role == models.OrgRoleOwner {
+		return true
+	}
+	return actor.Role == models.OrgRoleAdmin && (role == models.OrgRoleAgent || role == models.OrgRoleMember)
+}
+
+// parseOrgFields 校验组织名称和简介
+func parseOrgFields(name, description *string) (map[string]interface{}, error) {
+	updates := map[string]interface{}{}
+	if name != nil {
+		value := strings.TrimSpace(*name)
+		if value == "" || utf8.RuneCountInString(value) > maxOrgNameLength || hasControlCharacters(value) {
+			return nil, fmt.Errorf("组织名称为必填项且不超过%d个字符", maxOrgNameLength)
+		}
+		updates["name"] = value
+	}
+	if description != nil {
+		value := strings.TrimSpace(*description)
+		if utf8.RuneCountInString(value) > maxOrgDescriptionLength {
+			return nil, fmt.Errorf("组织简介不超过%d个字符", maxOrgDescriptionLength)
+		}
+		updates["description"] = value
+	}
+	return updates, nil
+}
+
+// CreateOrganization 创建组织，创建者成为所有者
+func CreateOrganization(c *gin.Context) {
+	var requestData struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	if requestData.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "组织名称为必填项"})
+		return
+	}
+	fields, err := parseOrgFields(requestData.Name, requestData.Description)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	username := CurrentIdentity(c).Username
+	org := models.Organizations{CreatedBy: username}
+	org.Name, _ = fields["name"].(string)
+	org.Description, _ = fields["description"].(string)
+	member := models.OrganizationMembers{Username: username, Role: models.OrgRoleOwner}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&org).Error; err != nil {
+			return err
+		}
+		member.OrganizationID = org.ID
+		return tx.Create(&member).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "组织创建失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgCreate,
+		Target:  orgTarget(org.ID),
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"name": org.Name},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "组织已创建", "data": organizationView(&org, &member)})
+}
+
+// ListOrganizations 列出当前用户加入的组织
+func ListOrganizations(c *gin.Context) {
+	var members []models.OrganizationMembers
+	if err := DB.Where("username = ?", CurrentIdentity(c).Username).Order("id ASC").Find(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	orgIDs := make([]uint, len(members))
+	for i, member := range members {
+		orgIDs[i] = member.OrganizationID
+	}
+	var orgs []models.Organizations
+	if err := DB.Where("id IN ?", orgIDs).Find(&orgs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	orgByID := map[uint]*models.Organizations{}
+	for i := range orgs {
+		orgByID[orgs[i].ID] = &orgs[i]
+	}
+
+	data := []gin.H{}
+	for i := range members {
+		if org, ok := orgByID[members[i].OrganizationID]; ok {
+			data = append(data, organizationView(org, &members[i]))
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"organizations": data})
+}
+
+// GetOrganization 查看组织信息和成员列表
+func GetOrganization(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	var org models.Organizations
+	if err := DB.First(&org, member.OrganizationID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var members []models.OrganizationMembers
+	if err := DB.Where("organization_id = ?", org.ID).Order("id ASC").Find(&members).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	usernames := make([]string, len(members))
+	for i, m := range members {
+		usernames[i] = m.Username
+	}
+	var users []models.Users
+	if err := DB.Select("username", "display_name", "avatar", "region_adcode").Where("username IN ?", usernames).Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	userByName := map[string]*models.Users{}
+	for i := range users {
+		userByName[users[i].Username] = &users[i]
+	}
+
+	memberData := make([]gin.H, len(members))
+	for i := range members {
+		memberData[i] = memberView(&members[i], userByName[members[i].Username])
+	}
+
+	view := organizationView(&org, member)
+	view["members"] = memberData
+	c.JSON(http.StatusOK, gin.H{"data": view})
+}
+
+// UpdateOrganization 修改组织名称和简介
+func UpdateOrganization(c *gin.Context) {
+	var requestData struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	updates, err := parseOrgFields(requestData.Name, requestData.Description)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, ok := loadMembership(c)
+	if !ok || !requireOrgRole(c, member, orgManagerRoles...) {
+		return
+	}
+
+	var org models.Organizations
+	if err := DB.First(&org, member.OrganizationID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if len(updates) > 0 {
+		if err := DB.Model(&org).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "组织信息保存失败"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "组织信息已更新", "data": organizationView(&org, member)})
+}
+
+// deleteOrganization 删除组织及其成员、邀请和共享记录，被共享的资源本身不受影响
+func deleteOrganization(tx *gorm.DB, orgID uint) error {
+	for _, model := range []interface{}{
+		&models.SharedResources{},
+		&models.OrganizationInvitations{},
+		&models.OrganizationMembers{},
+	} {
+		if err := tx.Where("organization_id = ?", orgID).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Delete(&models.Organizations{}, orgID).Error
+}
+
+// DeleteOrganization 所有者删除组织
+func DeleteOrganization(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok || !requireOrgRole(c, member, models.OrgRoleOwner) {
+		return
+	}
+
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		return deleteOrganization(tx, member.OrganizationID)
+	})
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgDelete,
+		Target:  orgTarget(member.OrganizationID),
+		Outcome: auditResult(err),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "组织删除失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "组织已删除", "id": member.OrganizationID})
+}
+
+// InviteMember 邀请用户加入组织
+func InviteMember(c *gin.Context) {
+	var requestData struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	if requestData.Role == "" {
+		requestData.Role = models.OrgRoleMember
+	}
+	if !slices.Contains(models.OrgRoles, requestData.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "组织角色不合法", "roles": models.OrgRoles})
+		return
+	}
+
+	member, ok := loadMembership(c)
+	if !ok || !requireOrgRole(c, member, orgManagerRoles...) {
+		return
+	}
+	if !canAssignOrgRole(member, requestData.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有所有者可以授予所有者或管理员角色"})
+		return
+	}
+
+	var count int64
+	if err := DB.Model(&models.Users{}).Where("username = ?", requestData.Username).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	}
+
+	if _, err := loadOrganizationMember(member.OrganizationID, requestData.Username); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "该用户已是组织成员"})
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	err := pendingInvitations(DB).
+		Where("organization_id = ? AND username = ?", member.OrganizationID, requestData.Username).
+		Count(&count).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "已向该用户发出邀请，请等待对方处理"})
+		return
+	}
+
+	invitation := models.OrganizationInvitations{
+		OrganizationID: member.OrganizationID,
+		Username:       requestData.Username,
+		Role:           requestData.Role,
+		InvitedBy:      member.Username,
+		ExpiresAt:      time.Now().Add(orgInvitationTTL),
+	}
+	if err := DB.Create(&invitation).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "邀请创建失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgInvite,
+		Target:  orgTarget(member.OrganizationID),
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"username": invitation.Username, "role": invitation.Role},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "邀请已发送", "data": invitationView(&invitation, nil)})
+}
+
+// ListOrganizationInvitations 列出组织尚未处理的邀请
+func ListOrganizationInvitations(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok || !requireOrgRole(c, member, orgManagerRoles...) {
+		return
+	}
+
+	var invitations []models.OrganizationInvitations
+	if err := pendingInvitations(DB).Where("organization_id = ?", member.OrganizationID).Order("id DESC").Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(invitations))
+	for i := range invitations {
+		data[i] = invitationView(&invitations[i], nil)
+	}
+	c.JSON(http.StatusOK, gin.H{"invitations": data})
+}
+
+// RevokeInvitation 撤销尚未处理的邀请
+func RevokeInvitation(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok || !requireOrgRole(c, member, orgManagerRoles...) {
+		return
+	}
+	id, ok := parseIDParam(c, "invitation_id", "邀请")
+	if !ok {
+		return
+	}
+
+	result := pendingInvitations(DB).
+		Where("id = ? AND organization_id = ?", id, member.OrganizationID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "邀请撤销失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "邀请不存在或已处理"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "邀请已撤销", "id": id})
+}
+
+// ListMyInvitations 列出当前用户收到的邀请
+func ListMyInvitations(c *gin.Context) {
+	var invitations []models.OrganizationInvitations
+	if err := pendingInvitations(DB).Where("username = ?", CurrentIdentity(c).Username).Order("id DESC").Find(&invitations).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	orgIDs := make([]uint, len(invitations))
+	for i, invitation := range invitations {
+		orgIDs[i] = invitation.OrganizationID
+	}
+	var orgs []models.Organizations
+	if err := DB.Where("id IN ?", orgIDs).Find(&orgs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	orgByID := map[uint]*models.Organizations{}
+	for i := range orgs {
+		orgByID[orgs[i].ID] = &orgs[i]
+	}
+
+	data := make([]gin.H, len(invitations))
+	for i := range invitations {
+		data[i] = invitationView(&invitations[i], orgByID[invitations[i].OrganizationID])
+	}
+	c.JSON(http.StatusOK, gin.H{"invitations": data})
+}
+
+// AcceptInvitation 接受邀请加入组织
+func AcceptInvitation(c *gin.Context) {
+	respondInvitation(c, true)
+}
+
+// DeclineInvitation 拒绝邀请
+func DeclineInvitation(c *gin.Context) {
+	respondInvitation(c, false)
+}
+
+// respondInvitation 处理当前用户收到的邀请，接受时在同一事务中加入组织
+func respondInvitation(c *gin.Context, accept bool) {
+	id, ok := parseIDParam(c, "invitation_id", "邀请")
+	if !ok {
+		return
+	}
+	username := CurrentIdentity(c).Username
+
+	var invitation models.OrganizationInvitations
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := pendingInvitations(tx).Where("id = ? AND username = ?", id, username).First(&invitation).Error; err != nil {
+			return err
+		}
+
+		column := "declined_at"
+		if accept {
+			column = "accepted_at"
+		}
+		// 条件更新，防止同一邀请被重复处理
+		result := pendingInvitations(tx).Where("id = ?", invitation.ID).Update(column, time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if !accept {
+			return nil
+		}
+
+		var count int64
+		if err := tx.Model(&models.OrganizationMembers{}).Where("organization_id = ? AND username = ?", invitation.OrganizationID, username).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		return tx.Create(&models.OrganizationMembers{
+			OrganizationID: invitation.OrganizationID,
+			Username:       username,
+			Role:           invitation.Role,
+		}).Error
+	})
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "邀请不存在、已处理或已过期"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "邀请处理失败"})
+		return
+	}
+
+	if !accept {
+		c.JSON(http.StatusOK, gin.H{"message": "已拒绝邀请", "id": id})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgJoin,
+		Target:  orgTarget(invitation.OrganizationID),
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"role": invitation.Role, "invited_by": invitation.InvitedBy},
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "已加入组织", "organization_id": invitation.OrganizationID})
+}
+
+// countOrgOwners 统计组织的所有者人数
+func countOrgOwners(tx *gorm.DB, orgID uint) (int64, error) {
+	var count int64
+	err := tx.Model(&models.OrganizationMembers{}).
+		Where("organization_id = ? AND role = ?", orgID, models.OrgRoleOwner).
+		Count(&count).Error
+	return count, err
+}
+
+// SetMemberRole 修改成员在组织内的角色
+func SetMemberRole(c *gin.Context) {
+	var requestData struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	if !slices.Contains(models.OrgRoles, requestData.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "组织角色不合法", "roles": models.OrgRoles})
+		return
+	}
+
+	member, ok := loadMembership(c)
+	if !ok || !requireOrgRole(c, member, orgManagerRoles...) {
+		return
+	}
+
+	target, err := loadOrganizationMember(member.OrganizationID, c.Param("username"))
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "该用户不是组织成员"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if !canAssignOrgRole(member, target.Role) || !canAssignOrgRole(member, requestData.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有所有者可以变更所有者或管理员角色"})
+		return
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if target.Role == models.OrgRoleOwner && requestData.Role != models.OrgRoleOwner {
+			owners, err := countOrgOwners(tx, target.OrganizationID)
+			if err != nil {
+				return err
+			}
+			if owners <= 1 {
+				return ErrLastOrgOwner
+			}
+		}
+		return tx.Model(target).Update("role", requestData.Role).Error
+	})
+	if err == ErrLastOrgOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "角色修改失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgMemberRole,
+		Target:  orgTarget(target.OrganizationID),
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"username": target.Username, "role": requestData.Role},
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "角色修改成功",
+		"username": target.Username,
+		"role":     requestData.Role,
+	})
+}
+
+// removeOrganizationMember 将成员移出组织，同时取消其在该组织内的共享
+func removeOrganizationMember(tx *gorm.DB, orgID uint, username string) error {
+	err := tx.Where("organization_id = ? AND owner = ?", orgID, username).Delete(&models.SharedResources{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("organization_id = ? AND username = ?", orgID, username).Delete(&models.OrganizationMembers{}).Error
+}
+
+// RemoveMember 将成员移出组织，成员也可以通过该接口退出组织
+// 最后一名成员退出时组织随之删除
+func RemoveMember(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+	username := c.Param("username")
+	leaving := username == member.Username
+
+	target := member
+	if !leaving {
+		if !requireOrgRole(c, member, orgManagerRoles...) {
+			return
+		}
+		var err error
+		target, err = loadOrganizationMember(member.OrganizationID, username)
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "该用户不是组织成员"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+			return
+		}
+		if !canAssignOrgRole(member, target.Role) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "只有所有者可以移除所有者或管理员"})
+			return
+		}
+	}
+
+	orgDeleted := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var remaining int64
+		if err := tx.Model(&models.OrganizationMembers{}).Where("organization_id = ?", target.OrganizationID).Count(&remaining).Error; err != nil {
+			return err
+		}
+		if remaining <= 1 {
+			orgDeleted = true
+			return deleteOrganization(tx, target.OrganizationID)
+		}
+
+		if target.Role == models.OrgRoleOwner {
+			owners, err := countOrgOwners(tx, target.OrganizationID)
+			if err != nil {
+				return err
+			}
+			if owners <= 1 {
+				return ErrLastOrgOwner
+			}
+		}
+		return removeOrganizationMember(tx, target.OrganizationID, target.Username)
+	})
+	if err == ErrLastOrgOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "成员移除失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgMemberRemove,
+		Target:  orgTarget(target.OrganizationID),
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"username": target.Username, "left": leaving, "organization_deleted": orgDeleted},
+	})
+
+	message := "成员已移除"
+	if leaving {
+		message = "已退出组织"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":              message,
+		"username":             target.Username,
+		"organization_deleted": orgDeleted,
+	})
+}
+
+// UpdateMySharing 设置是否向组织的管理员和农技员共享自己的全部对话和记录
+func UpdateMySharing(c *gin.Context) {
+	var requestData struct {
+		ShareAll *bool `json:"share_all"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil || requestData.ShareAll == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	member, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+	if err := DB.Model(member).Update("share_all", *requestData.ShareAll).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "共享设置保存失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "共享设置已更新", "share_all": *requestData.ShareAll})
+}
+
+// resourceExists 判断资源是否存在且属于owner
+func resourceExists(ctx context.Context, resourceType, owner, resourceID string) (bool, error) {
+	switch resourceType {
+	case models.ResourceConversation:
+		return conversationExists(ctx, owner, resourceID)
+	case models.ResourceDiagnosis, models.ResourceField:
+		_, err := resourceContent(ctx, resourceType, owner, resourceID)
+		if err == ErrResourceNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// resourceContent 读取owner的一项资源，不存在时返回ErrResourceNotFound
+func resourceContent(ctx context.Context, resourceType, owner, resourceID string) (any, error) {
+	if resourceType == models.ResourceConversation {
+		history, err := conversationHistory(ctx, owner, resourceID)
+		if err == ErrConversationNotFound {
+			return nil, ErrResourceNotFound
+		}
+		return history, err
+	}
+
+	id, err := strconv.ParseUint(resourceID, 10, 64)
+	if err != nil {
+		return nil, ErrResourceNotFound
+	}
+	switch resourceType {
+	case models.ResourceDiagnosis:
+		record, err := findDiagnosisRecord(owner, uint(id))
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrResourceNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		return diagnosisRecordView(record), nil
+	case models.ResourceField:
+		record, err := findFieldRecord(owner, uint(id))
+		if err == gorm.ErrRecordNotFound {
+			return nil, ErrResourceNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		return fieldRecordView(record), nil
+	}
+	return nil, ErrResourceNotFound
+}
+
+// listResources 列出owner的某类全部资源，对话只返回最近的会话
+func listResources(ctx context.Context, resourceType, owner string) (any, error) {
+	switch resourceType {
+	case models.ResourceConversation:
+		return recentConversations(ctx, owner, recentConversationLimit)
+	case models.ResourceDiagnosis:
+		var records []models.DiagnosisRecords
+		if err := DB.Where("username = ?", owner).Order("id DESC").Limit(maxPageSize).Find(&records).Error; err != nil {
+			return nil, err
+		}
+		data := make([]gin.H, len(records))
+		for i := range records {
+			data[i] = diagnosisRecordView(&records[i])
+		}
+		return data, nil
+	case models.ResourceField:
+		var records []models.FieldRecords
+		if err := DB.Where("username = ?", owner).Order("id ASC").Find(&records).Error; err != nil {
+			return nil, err
+		}
+		data := make([]gin.H, len(records))
+		for i := range records {
+			data[i] = fieldRecordView(&records[i])
+		}
+		return data, nil
+	}
+	return nil, ErrResourceNotFound
+}
+
+// unshareResource 资源删除后取消其在所有组织内的共享
+func unshareResource(resourceType, resourceID, owner string) {
+	err := DB.Where("resource_type = ? AND resource_id = ? AND owner = ?", resourceType, resourceID, owner).
+		Delete(&models.SharedResources{}).Error
+	if err != nil {
+		fmt.Println("取消共享失败:", err, resourceType, resourceID)
+	}
+}
+
+// ShareResource 将自己的对话、诊断记录或地块数据共享到组织
+func ShareResource(c *gin.Context) {
+	var requestData struct {
+		ResourceType string `json:"resource_type"`
+		ResourceID   string `json:"resource_id"`
+		Title        string `json:"title"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	if !slices.Contains(models.ResourceTypes, requestData.ResourceType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "资源类型不合法", "resource_types": models.ResourceTypes})
+		return
+	}
+	title := strings.TrimSpace(requestData.Title)
+	if requestData.ResourceID == "" || len(requestData.ResourceID) > 64 || utf8.RuneCountInString(title) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "资源ID或标题不合法"})
+		return
+	}
+
+	member, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+
+	exists, err := resourceExists(c.Request.Context(), requestData.ResourceType, member.Username, requestData.ResourceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "资源查询失败"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "资源不存在"})
+		return
+	}
+
+	share := models.SharedResources{
+		OrganizationID: member.OrganizationID,
+		ResourceType:   requestData.ResourceType,
+		ResourceID:     requestData.ResourceID,
+		Owner:          member.Username,
+		Title:          title,
+	}
+	var count int64
+	err = DB.Model(&models.SharedResources{}).
+		Where("organization_id = ? AND resource_type = ? AND resource_id = ?", share.OrganizationID, share.ResourceType, share.ResourceID).
+		Count(&count).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "该资源已共享到组织"})
+		return
+	}
+	if err := DB.Create(&share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "共享失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgShare,
+		Target:  orgTarget(share.OrganizationID),
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"resource_type": share.ResourceType, "resource_id": share.ResourceID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "已共享到组织", "data": sharedResourceView(&share)})
+}
+
+// ListSharedResources 分页列出组织内共享的资源，可按类型和所有者筛选
+func ListSharedResources(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+	page, pageSize := parsePagination(c)
+
+	query := DB.Model(&models.SharedResources{}).Where("organization_id = ?", member.OrganizationID)
+	if resourceType := c.Query("resource_type"); resourceType != "" {
+		query = query.Where("resource_type = ?", resourceType)
+	}
+	if owner := c.Query("owner"); owner != "" {
+		query = query.Where("owner = ?", owner)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var shares []models.SharedResources
+	if err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&shares).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(shares))
+	for i := range shares {
+		data[i] = sharedResourceView(&shares[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"shared": data, "total": total, "page": page, "page_size": pageSize})
+}
+
+// loadShare 查询组织内的一条共享记录，失败时直接写入响应
+func loadShare(c *gin.Context, member *models.OrganizationMembers) (*models.SharedResources, bool) {
+	id, ok := parseIDParam(c, "share_id", "共享")
+	if !ok {
+		return nil, false
+	}
+
+	var share models.SharedResources
+	result := DB.Where("id = ? AND organization_id = ?", id, member.OrganizationID).First(&share)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "共享记录不存在"})
+		return nil, false
+	} else if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return nil, false
+	}
+	return &share, true
+}
+
+// GetSharedResource 查看组织内共享资源的内容
+func GetSharedResource(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+	share, ok := loadShare(c, member)
+	if !ok {
+		return
+	}
+
+	content, err := resourceContent(c.Request.Context(), share.ResourceType, share.Owner, share.ResourceID)
+	if err == ErrResourceNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "资源已被删除"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "资源读取失败"})
+		return
+	}
+
+	view := sharedResourceView(share)
+	view["content"] = content
+	c.JSON(http.StatusOK, gin.H{"data": view})
+}
+
+// UnshareResource 取消共享，资源所有者和组织管理员可以操作
+func UnshareResource(c *gin.Context) {
+	member, ok := loadMembership(c)
+	if !ok {
+		return
+	}
+	share, ok := loadShare(c, member)
+	if !ok {
+		return
+	}
+	if share.Owner != member.Username && !requireOrgRole(c, member, orgManagerRoles...) {
+		return
+	}
+
+	if err := DB.Delete(share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "取消共享失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditOrgUnshare,
+		Target:  orgTarget(share.OrganizationID),
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"resource_type": share.ResourceType, "resource_id": share.ResourceID, "owner": share.Owner},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "已取消共享", "id": share.ID})
+}
+
+// loadSharingMember 查询开启了全部共享的组织成员，只有组织的管理员和农技员可以查看
+func loadSharingMember(c *gin.Context) (*models.OrganizationMembers, bool) {
+	member, ok := loadMembership(c)
+	if !ok || !requireOrgRole(c, member, orgStaffRoles...) {
+		return nil, false
+	}
+	if !slices.Contains(models.ResourceTypes, c.Param("resource_type")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "资源类型不合法", "resource_types": models.ResourceTypes})
+		return nil, false
+	}
+
+	target, err := loadOrganizationMember(member.OrganizationID, c.Param("username"))
+	if err != nil && err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return nil, false
+	}
+	if err == gorm.ErrRecordNotFound || !target.ShareAll {
+		c.JSON(http.StatusForbidden, gin.H{"error": "该成员未开启全部共享"})
+		return nil, false
+	}
+	return target, true
+}
+
+// ListMemberResources 组织的管理员和农技员查看成员的某类全部资源
+func ListMemberResources(c *gin.Context) {
+	target, ok := loadSharingMember(c)
+	if !ok {
+		return
+	}
+
+	data, err := listResources(c.Request.Context(), c.Param("resource_type"), target.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "资源读取失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": target.Username, "data": data})
+}
+
+// GetMemberResource 组织的管理员和农技员查看成员的一项资源
+func GetMemberResource(c *gin.Context) {
+	target, ok := loadSharingMember(c)
+	if !ok {
+		return
+	}
+
+	content, err := resourceContent(c.Request.Context(), c.Param("resource_type"), target.Username, c.Param("resource_id"))
+	if err == ErrResourceNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "资源不存在"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "资源读取失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"username": target.Username, "data": content})
+}
+
+// leaveAllOrganizations 注销账户时退出全部组织
+// 用户是唯一所有者时将最早加入的管理员或成员提升为所有者，用户是最后一名成员时删除组织
+func leaveAllOrganizations(tx *gorm.DB, username string) (int64, error) {
+	var memberships []models.OrganizationMembers
+	if err := tx.Where("username = ?", username).Find(&memberships).Error; err != nil {
+		return 0, err
+	}
+
+	for _, membership := range memberships {
+		var successor models.OrganizationMembers
+		err := tx.Where("organization_id = ? AND username <> ?", membership.OrganizationID, username).
+			Order(gorm.Expr("FIELD(role, ?, ?, ?, ?), id", models.OrgRoleOwner, models.OrgRoleAdmin, models.OrgRoleAgent, models.OrgRoleMember)).
+			First(&successor).Error
+		if err == gorm.ErrRecordNotFound {
+			if err := deleteOrganization(tx, membership.OrganizationID); err != nil {
+				return 0, err
+			}
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		if membership.Role == models.OrgRoleOwner && successor.Role != models.OrgRoleOwner {
+			if err := tx.Model(&successor).Update("role", models.OrgRoleOwner).Error; err != nil {
+				return 0, err
+			}
+		}
+		if err := removeOrganizationMember(tx, membership.OrganizationID, username); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Where("username = ?", username).Delete(&models.OrganizationInvitations{}).Error; err != nil {
+		return 0, err
+	}
+	return int64(len(memberships)), nil
+}
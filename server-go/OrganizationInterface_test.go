@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+// createTestOrg 通过接口创建组织并返回组织ID
+func createTestOrg(t *testing.T, router http.Handler, token, name string) uint {
+	t.Helper()
+	w := performRequest(router, http.MethodPost, "/api/orgs", fmt.Sprintf(`{"name":%q}`, name), bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("创建组织失败: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data struct {
+			ID uint `json:"id"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Data.ID
+}
+
+// joinTestOrg 由owner邀请username并接受邀请
+func joinTestOrg(t *testing.T, router http.Handler, orgID uint, ownerToken, username, userToken, role string) {
+	t.Helper()
+	target := fmt.Sprintf("/api/orgs/%d/invitations", orgID)
+	w := performRequest(router, http.MethodPost, target, fmt.Sprintf(`{"username":%q,"role":%q}`, username, role), bearer(ownerToken))
+	if w.Code != http.StatusOK {
+		t.Fatalf("邀请 %s 失败: %d %s", username, w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data struct {
+			ID uint `json:"id"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	w = performRequest(router, http.MethodPost, fmt.Sprintf("/api/user/invitations/%d/accept", resp.Data.ID), "", bearer(userToken))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s 接受邀请失败: %d %s", username, w.Code, w.Body.String())
+	}
+}
+
+func TestCreateOrganizationRequiresRole(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "fred"}, "")
+	createTestUser(t, models.Users{Username: "mia", Role: models.RoleManager}, "")
+
+	w := performRequest(router, http.MethodPost, "/api/orgs", `{"name":"玉米合作社"}`, bearer(testAccessToken(t, "fred")))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("普通农户不能创建组织，实际 %d", w.Code)
+	}
+
+	mia := testAccessToken(t, "mia")
+	if w := performRequest(router, http.MethodPost, "/api/orgs", `{"name":"  "}`, bearer(mia)); w.Code != http.StatusBadRequest {
+		t.Fatalf("组织名称为空应返回400，实际 %d", w.Code)
+	}
+	orgID := createTestOrg(t, router, mia, "玉米合作社")
+
+	var member models.OrganizationMembers
+	DB.Where("organization_id = ? AND username = ?", orgID, "mia").First(&member)
+	if member.Role != models.OrgRoleOwner {
+		t.Fatalf("创建者应为所有者，实际 %q", member.Role)
+	}
+}
+
+func TestOrganizationInvitations(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "mia", Role: models.RoleManager}, "")
+	createTestUser(t, models.Users{Username: "fred"}, "")
+	createTestUser(t, models.Users{Username: "gina"}, "")
+	mia, fred, gina := testAccessToken(t, "mia"), testAccessToken(t, "fred"), testAccessToken(t, "gina")
+	orgID := createTestOrg(t, router, mia, "玉米合作社")
+	orgPath := fmt.Sprintf("/api/orgs/%d", orgID)
+
+	// 不是成员时与组织不存在返回相同的错误
+	if w := performRequest(router, http.MethodGet, orgPath, "", bearer(fred)); w.Code != http.StatusNotFound {
+		t.Fatalf("非成员查看组织应返回404，实际 %d", w.Code)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"角色不合法", `{"username":"fred","role":"boss"}`, http.StatusBadRequest},
+		{"用户不存在", `{"username":"nobody"}`, http.StatusNotFound},
+		{"已是成员", `{"username":"mia"}`, http.StatusConflict},
+		{"邀请成功", `{"username":"fred"}`, http.StatusOK},
+		{"重复邀请", `{"username":"fred"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		w := performRequest(router, http.MethodPost, orgPath+"/invitations", tt.body, bearer(mia))
+		if w.Code != tt.code {
+			t.Errorf("%s: 期望 %d，实际 %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	var invitation models.OrganizationInvitations
+	DB.Where("username = ?", "fred").First(&invitation)
+	acceptPath := fmt.Sprintf("/api/user/invitations/%d/accept", invitation.ID)
+
+	// 只有被邀请人可以处理邀请，且同一邀请只能处理一次
+	if w := performRequest(router, http.MethodPost, acceptPath, "", bearer(gina)); w.Code != http.StatusNotFound {
+		t.Fatalf("他人不能接受邀请，实际 %d", w.Code)
+	}
+	if w := performRequest(router, http.MethodPost, acceptPath, "", bearer(fred)); w.Code != http.StatusOK {
+		t.Fatalf("接受邀请失败: %d %s", w.Code, w.Body.String())
+	}
+	if w := performRequest(router, http.MethodPost, acceptPath, "", bearer(fred)); w.Code != http.StatusNotFound {
+		t.Fatalf("重复接受邀请应返回404，实际 %d", w.Code)
+	}
+
+	if w := performRequest(router, http.MethodGet, orgPath, "", bearer(fred)); w.Code != http.StatusOK {
+		t.Fatalf("成员应能查看组织，实际 %d", w.Code)
+	}
+	// 普通成员不能邀请他人
+	if w := performRequest(router, http.MethodPost, orgPath+"/invitations", `{"username":"gina"}`, bearer(fred)); w.Code != http.StatusForbidden {
+		t.Fatalf("普通成员邀请他人应返回403，实际 %d", w.Code)
+	}
+}
+
+func TestOrganizationMemberRoles(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "mia", Role: models.RoleManager}, "")
+	createTestUser(t, models.Users{Username: "alan"}, "")
+	createTestUser(t, models.Users{Username: "fred"}, "")
+	mia, alan, fred := testAccessToken(t, "mia"), testAccessToken(t, "alan"), testAccessToken(t, "fred")
+	orgID := createTestOrg(t, router, mia, "玉米合作社")
+	orgPath := fmt.Sprintf("/api/orgs/%d", orgID)
+	joinTestOrg(t, router, orgID, mia, "alan", alan, models.OrgRoleAdmin)
+	joinTestOrg(t, router, orgID, mia, "fred", fred, models.OrgRoleMember)
+
+	tests := []struct {
+		name   string
+		token  string
+		target string
+		role   string
+		code   int
+	}{
+		{"管理员不能授予所有者", alan, "fred", models.OrgRoleOwner, http.StatusForbidden},
+		{"管理员不能变更所有者", alan, "mia", models.OrgRoleMember, http.StatusForbidden},
+		{"普通成员不能修改角色", fred, "fred", models.OrgRoleAdmin, http.StatusForbidden},
+		{"唯一所有者不能降级", mia, "mia", models.OrgRoleAdmin, http.StatusBadRequest},
+		{"管理员可以设置农技员", alan, "fred", models.OrgRoleAgent, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := performRequest(router, http.MethodPut, orgPath+"/members/"+tt.target+"/role", fmt.Sprintf(`{"role":%q}`, tt.role), bearer(tt.token))
+		if w.Code != tt.code {
+			t.Errorf("%s: 期望 %d，实际 %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	// 唯一所有者不能退出，成员可以自行退出
+	if w := performRequest(router, http.MethodDelete, orgPath+"/members/mia", "", bearer(mia)); w.Code != http.StatusBadRequest {
+		t.Fatalf("唯一所有者退出应返回400，实际 %d", w.Code)
+	}
+	if w := performRequest(router, http.MethodDelete, orgPath+"/members/fred", "", bearer(fred)); w.Code != http.StatusOK {
+		t.Fatalf("成员退出失败: %d %s", w.Code, w.Body.String())
+	}
+	if w := performRequest(router, http.MethodGet, orgPath, "", bearer(fred)); w.Code != http.StatusNotFound {
+		t.Fatalf("退出后不应能查看组织，实际 %d", w.Code)
+	}
+}
+
+func TestOrganizationSharing(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "mia", Role: models.RoleManager}, "")
+	createTestUser(t, models.Users{Username: "ada"}, "")
+	createTestUser(t, models.Users{Username: "fred"}, "")
+	createTestUser(t, models.Users{Username: "gina"}, "")
+	mia, ada, fred, gina := testAccessToken(t, "mia"), testAccessToken(t, "ada"), testAccessToken(t, "fred"), testAccessToken(t, "gina")
+	orgID := createTestOrg(t, router, mia, "玉米合作社")
+	orgPath := fmt.Sprintf("/api/orgs/%d", orgID)
+	joinTestOrg(t, router, orgID, mia, "ada", ada, models.OrgRoleAgent)
+	joinTestOrg(t, router, orgID, mia, "fred", fred, models.OrgRoleMember)
+
+	field := models.FieldRecords{Username: "fred", Name: "东地"}
+	other := models.FieldRecords{Username: "gina", Name: "西地"}
+	DB.Create(&field)
+	DB.Create(&other)
+	fieldID := fmt.Sprint(field.ID)
+
+	// 只能共享自己的资源
+	body := fmt.Sprintf(`{"resource_type":"field","resource_id":"%d"}`, other.ID)
+	if w := performRequest(router, http.MethodPost, orgPath+"/shared", body, bearer(fred)); w.Code != http.StatusNotFound {
+		t.Fatalf("共享他人的资源应返回404，实际 %d", w.Code)
+	}
+	body = `{"resource_type":"field","resource_id":"` + fieldID + `","title":"东地"}`
+	w := performRequest(router, http.MethodPost, orgPath+"/shared", body, bearer(fred))
+	if w.Code != http.StatusOK {
+		t.Fatalf("共享失败: %d %s", w.Code, w.Body.String())
+	}
+	var share models.SharedResources
+	DB.First(&share)
+	sharePath := fmt.Sprintf("%s/shared/%d", orgPath, share.ID)
+
+	// 组织成员可以查看共享的资源，非成员不能
+	if w := performRequest(router, http.MethodGet, sharePath, "", bearer(mia)); w.Code != http.StatusOK {
+		t.Fatalf("成员查看共享资源失败: %d %s", w.Code, w.Body.String())
+	}
+	if w := performRequest(router, http.MethodGet, sharePath, "", bearer(gina)); w.Code != http.StatusNotFound {
+		t.Fatalf("非成员查看共享资源应返回404，实际 %d", w.Code)
+	}
+
+	// 未开启全部共享时，农技员不能查看成员的全部记录
+	memberPath := orgPath + "/members/fred/records/field"
+	if w := performRequest(router, http.MethodGet, memberPath, "", bearer(ada)); w.Code != http.StatusForbidden {
+		t.Fatalf("未开启全部共享时应返回403，实际 %d", w.Code)
+	}
+	if w := performRequest(router, http.MethodPut, orgPath+"/sharing", `{"share_all":true}`, bearer(fred)); w.Code != http.StatusOK {
+		t.Fatalf("开启全部共享失败: %d", w.Code)
+	}
+	if w := performRequest(router, http.MethodGet, memberPath, "", bearer(ada)); w.Code != http.StatusOK {
+		t.Fatalf("农技员查看成员记录失败: %d %s", w.Code, w.Body.String())
+	}
+	// 普通成员不能查看其他成员的全部记录
+	joinTestOrg(t, router, orgID, mia, "gina", gina, models.OrgRoleMember)
+	if w := performRequest(router, http.MethodGet, memberPath, "", bearer(gina)); w.Code != http.StatusForbidden {
+		t.Fatalf("普通成员查看他人记录应返回403，实际 %d", w.Code)
+	}
+
+	// 删除资源后共享随之取消
+	if w := performRequest(router, http.MethodDelete, "/api/records/fields/"+fieldID, "", bearer(fred)); w.Code != http.StatusOK {
+		t.Fatalf("删除地块失败: %d", w.Code)
+	}
+	if w := performRequest(router, http.MethodGet, sharePath, "", bearer(mia)); w.Code != http.StatusNotFound {
+		t.Fatalf("资源删除后共享应被取消，实际 %d", w.Code)
+	}
+}
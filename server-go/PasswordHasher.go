@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"server-env.com/server/models"
+)
+
+// 支持的密码哈希算法
+const (
+	PasswordAlgorithmBcrypt   = "bcrypt"
+	PasswordAlgorithmArgon2id = "argon2id"
+)
+
+var ErrPasswordHashMalformed = errors.New("密码哈希格式错误")
+
+// Argon2Params argon2id的参数，MemoryKiB单位为KiB
+type Argon2Params struct {
+	MemoryKiB uint32
+	Time      uint32
+	Threads   uint8
+	SaltLen   int
+	KeyLen    uint32
+}
+
+// PasswordHasher 计算和校验密码哈希
+// 哈希字符串自带算法和参数：bcrypt为 $2a$cost$...，argon2id为PHC格式
+// $argon2id$v=19$m=65536,t=3,p=4$salt$hash，因此切换算法后旧哈希仍可校验
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// 密码哈希配置，可通过环境变量调整
+var passwordHasher = NewPasswordHasherFromEnv()
+
+// NewPasswordHasherFromEnv 从环境变量读取密码哈希配置
+func NewPasswordHasherFromEnv() *PasswordHasher {
+	algorithm := getEnvOrDefault("PASSWORD_HASH_ALGORITHM", PasswordAlgorithmBcrypt)
+	if algorithm != PasswordAlgorithmBcrypt && algorithm != PasswordAlgorithmArgon2id {
+		panic(fmt.Sprintf("不支持的 PASSWORD_HASH_ALGORITHM: %s", algorithm))
+	}
+
+	cost := getEnvIntOrDefault("BCRYPT_COST", bcrypt.DefaultCost)
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		panic(fmt.Sprintf("BCRYPT_COST 须在%d到%d之间", bcrypt.MinCost, bcrypt.MaxCost))
+	}
+
+	threads := getEnvIntOrDefault("ARGON2_THREADS", 4)
+	if threads < 1 || threads > 255 {
+		panic("ARGON2_THREADS 须在1到255之间")
+	}
+
+	return &PasswordHasher{
+		Algorithm:  algorithm,
+		BcryptCost: cost,
+		Argon2: Argon2Params{
+			MemoryKiB: uint32(getEnvIntOrDefault("ARGON2_MEMORY_KIB", 64*1024)),
+			Time:      uint32(getEnvIntOrDefault("ARGON2_TIME", 3)),
+			Threads:   uint8(threads),
+			SaltLen:   16,
+			KeyLen:    32,
+		},
+	}
+}
+
+// Hash 使用当前配置的算法计算密码哈希
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == PasswordAlgorithmArgon2id {
+		return h.hashArgon2id(password)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *PasswordHasher) hashArgon2id(password string) (string, error) {
+	salt := make([]byte, h.Argon2.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := h.Argon2
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.MemoryKiB, p.Threads, p.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.MemoryKiB, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify 校验密码，根据哈希前缀自动识别算法
+// 哈希为空（如第三方登录创建的账户）时始终校验失败
+func (h *PasswordHasher) Verify(hash, password string) bool {
+	switch {
+	case hash == "":
+		return false
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		actual := argon2.IDKey([]byte(password), salt, params.Time, params.MemoryKiB, params.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(actual, key) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+// NeedsRehash 判断哈希是否与当前配置的算法或参数不一致
+func (h *PasswordHasher) NeedsRehash(hash string) bool {
+	if hash == "" {
+		return false
+	}
+
+	if h.Algorithm == PasswordAlgorithmArgon2id {
+		params, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return true
+		}
+		return params.MemoryKiB != h.Argon2.MemoryKiB ||
+			params.Time != h.Argon2.Time ||
+			params.Threads != h.Argon2.Threads ||
+			len(salt) != h.Argon2.SaltLen ||
+			uint32(len(key)) != h.Argon2.KeyLen
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost != h.BcryptCost
+}
+
+// parseArgon2id 解析PHC格式的argon2id哈希
+func parseArgon2id(hash string) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != PasswordAlgorithmArgon2id {
+		return nil, nil, nil, ErrPasswordHashMalformed
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrPasswordHashMalformed
+	}
+
+	params := &Argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.MemoryKiB, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, ErrPasswordHashMalformed
+	}
+	if params.Time == 0 || params.Threads == 0 {
+		return nil, nil, nil, ErrPasswordHashMalformed
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrPasswordHashMalformed
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return nil, nil, nil, ErrPasswordHashMalformed
+	}
+	params.SaltLen = len(salt)
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// rehashPasswordIfNeeded 登录成功后将旧算法或旧参数的哈希升级为当前配置
+// 只在数据库中的哈希未被并发修改时更新，失败不影响登录
+func rehashPasswordIfNeeded(username, currentHash, password string) {
+	if !passwordHasher.NeedsRehash(currentHash) {
+		return
+	}
+
+	newHash, err := passwordHasher.Hash(password)
+	if err != nil {
+		fmt.Println("密码哈希升级失败:", err)
+		return
+	}
+
+	err = DB.Model(&models.Users{}).
+		Where("username = ? AND password = ?", username, currentHash).
+		Update("password", newHash).Error
+	if err != nil {
+		fmt.Println("密码哈希升级失败:", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	"server-env.com/server/models"
+)
+
+// 测试使用的低强度参数
+func testBcryptHasher(cost int) *PasswordHasher {
+	return &PasswordHasher{Algorithm: PasswordAlgorithmBcrypt, BcryptCost: cost}
+}
+
+func testArgon2Hasher(memoryKiB, time uint32) *PasswordHasher {
+	return &PasswordHasher{
+		Algorithm: PasswordAlgorithmArgon2id,
+		Argon2:    Argon2Params{MemoryKiB: memoryKiB, Time: time, Threads: 1, SaltLen: 16, KeyLen: 32},
+	}
+}
+
+func mustHash(t *testing.T, h *PasswordHasher, password string) string {
+	t.Helper()
+	hash, err := h.Hash(password)
+	if err != nil {
+		t.Fatalf("计算哈希失败: %v", err)
+	}
+	return hash
+}
+
+func TestPasswordHasherVerify(t *testing.T) {
+	bcryptHash := mustHash(t, testBcryptHasher(bcrypt.MinCost), "Corn-Passw0rd")
+	argon2Hash := mustHash(t, testArgon2Hasher(64, 1), "Corn-Passw0rd")
+	// 校验只依赖哈希中记录的算法和参数，与当前配置无关
+	hasher := testArgon2Hasher(128, 2)
+
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"bcrypt", bcryptHash, "Corn-Passw0rd", true},
+		{"bcrypt密码错误", bcryptHash, "corn-passw0rd", false},
+		{"argon2id", argon2Hash, "Corn-Passw0rd", true},
+		{"argon2id密码错误", argon2Hash, "Corn-Passw0rd ", false},
+		{"空哈希", "", "", false},
+		{"argon2id格式错误", "$argon2id$v=19$m=64,t=1,p=1$salt", "Corn-Passw0rd", false},
+		{"argon2id版本不对", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5", "Corn-Passw0rd", false},
+		{"argon2id参数为0", "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$a2V5", "Corn-Passw0rd", false},
+		{"明文", "Corn-Passw0rd", "Corn-Passw0rd", false},
+	}
+	for _, tt := range tests {
+		if got := hasher.Verify(tt.hash, tt.password); got != tt.ok {
+			t.Errorf("%s: 期望 %v，实际 %v", tt.name, tt.ok, got)
+		}
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	bcrypt4 := mustHash(t, testBcryptHasher(bcrypt.MinCost), "p")
+	bcrypt5 := mustHash(t, testBcryptHasher(bcrypt.MinCost+1), "p")
+	argon64 := mustHash(t, testArgon2Hasher(64, 1), "p")
+	argon128 := mustHash(t, testArgon2Hasher(128, 1), "p")
+	argonTime2 := mustHash(t, testArgon2Hasher(64, 2), "p")
+
+	tests := []struct {
+		name   string
+		hasher *PasswordHasher
+		hash   string
+		rehash bool
+	}{
+		{"bcrypt参数一致", testBcryptHasher(bcrypt.MinCost), bcrypt4, false},
+		{"bcrypt强度变化", testBcryptHasher(bcrypt.MinCost), bcrypt5, true},
+		{"argon2id切换为bcrypt", testBcryptHasher(bcrypt.MinCost), argon64, true},
+		{"bcrypt切换为argon2id", testArgon2Hasher(64, 1), bcrypt4, true},
+		{"argon2id参数一致", testArgon2Hasher(64, 1), argon64, false},
+		{"argon2id内存变化", testArgon2Hasher(64, 1), argon128, true},
+		{"argon2id迭代次数变化", testArgon2Hasher(64, 1), argonTime2, true},
+		{"哈希格式错误", testArgon2Hasher(64, 1), "$argon2id$broken", true},
+		{"没有密码", testBcryptHasher(bcrypt.MinCost), "", false},
+	}
+	for _, tt := range tests {
+		if got := tt.hasher.NeedsRehash(tt.hash); got != tt.rehash {
+			t.Errorf("%s: 期望 %v，实际 %v", tt.name, tt.rehash, got)
+		}
+	}
+}
+
+func TestRehashPasswordIfNeeded(t *testing.T) {
+	setupTestDB(t)
+	previous := passwordHasher
+	t.Cleanup(func() { passwordHasher = previous })
+
+	oldHash := mustHash(t, testBcryptHasher(bcrypt.MinCost), "Olga-Passw0rd")
+	DB.Create(&models.Users{Username: "olga", Password: oldHash})
+	DB.Create(&models.Users{Username: "paul", Password: oldHash})
+
+	passwordHasher = testArgon2Hasher(64, 1)
+	rehashPasswordIfNeeded("olga", oldHash, "Olga-Passw0rd")
+	var user models.Users
+	DB.First(&user, "username = ?", "olga")
+	if user.Password == oldHash || passwordHasher.NeedsRehash(user.Password) || !passwordHasher.Verify(user.Password, "Olga-Passw0rd") {
+		t.Fatalf("登录后应升级为当前配置的哈希: %s", user.Password)
+	}
+
+	// 参数一致时不再更新
+	upgraded := user.Password
+	rehashPasswordIfNeeded("olga", upgraded, "Olga-Passw0rd")
+	DB.First(&user, "username = ?", "olga")
+	if user.Password != upgraded {
+		t.Fatal("参数一致时不应重新计算哈希")
+	}
+
+	// 数据库中的哈希已被并发修改（如重置密码）时不覆盖
+	changed := mustHash(t, testBcryptHasher(bcrypt.MinCost), "Paul-New-Passw0rd")
+	DB.Model(&models.Users{}).Where("username = ?", "paul").Update("password", changed)
+	rehashPasswordIfNeeded("paul", oldHash, "Olga-Passw0rd")
+	var paul models.Users
+	DB.First(&paul, "username = ?", "paul")
+	if paul.Password != changed {
+		t.Fatal("哈希已被修改时不应覆盖")
+	}
+}
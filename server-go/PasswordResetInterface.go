@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+const (
+	// 验证码有效期
+	passwordResetCodeTTL = 15 * time.Minute
+	// 同一用户两次申请验证码的最小间隔
+	passwordResetRequestInterval = time.Minute
+	// 单个验证码允许的最大校验次数
+	passwordResetMaxAttempts = 5
+	passwordResetCodeDigits  = 6
+)
+
+// generateResetCode 生成数字验证码
+func generateResetCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < passwordResetCodeDigits; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", passwordResetCodeDigits, n), nil
+}
+
+// hashResetCode 计算加盐的验证码哈希
+func hashResetCode(salt, code string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// resetDestination 选择验证码的发送渠道和目标地址，未指定渠道时优先短信
+// 渠道已停用或用户没有对应的联系方式时目标地址为空
+func resetDestination(user *models.Users, channel string) (string, string) {
+	switch channel {
+	case NotifyChannelSMS, NotifyChannelEmail:
+		if !NotifyChannelEnabled(channel) {
+			return channel, ""
+		}
+		if channel == NotifyChannelSMS {
+			return channel, user.Phone
+		}
+		return channel, user.Email
+	case "":
+		if user.Phone != "" && NotifyChannelEnabled(NotifyChannelSMS) {
+			return NotifyChannelSMS, user.Phone
+		}
+		if user.Email != "" && NotifyChannelEnabled(NotifyChannelEmail) {
+			return NotifyChannelEmail, user.Email
+		}
+	}
+	return "", ""
+}
+
+// IssuePasswordReset 为用户生成新的重置验证码，旧的未使用验证码同时作废
+func IssuePasswordReset(user *models.Users, channel string) (string, error) {
+	code, err := generateResetCode()
+	if err != nil {
+		return "", err
+	}
+
+	saltBytes := make([]byte, 16)
+	if _, err := rand.Read(saltBytes); err != nil {
+		return "", err
+	}
+	salt := hex.EncodeToString(saltBytes)
+
+	now := time.Now()
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.PasswordResets{}).
+			Where("username = ? AND used_at IS NULL", user.Username).
+			Update("used_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResets{
+			Username:  user.Username,
+			Channel:   channel,
+			CodeSalt:  salt,
+			CodeHash:  hashResetCode(salt, code),
+			CreatedAt: now,
+			ExpiresAt: now.Add(passwordResetCodeTTL),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// SendPasswordResetCode 生成重置验证码并发送给用户
+// 用户没有绑定对应渠道的联系方式时不发送，返回false
+func SendPasswordResetCode(ctx context.Context, user *models.Users, channel string) (bool, error) {
+	channel, destination := resetDestination(user, channel)
+	if destination == "" {
+		return false, nil
+	}
+
+	code, err := IssuePasswordReset(user, channel)
+	if err != nil {
+		return false, err
+	}
+
+	err = SendNotification(ctx, Notification{
+		Channel: channel,
+		To:      destination,
+		Subject: "密码重置验证码",
+		Body:    fmt.Sprintf("您的密码重置验证码为 %s，%d分钟内有效。如非本人操作请忽略。", code, int(passwordResetCodeTTL.Minutes())),
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RequestPasswordReset 申请密码重置验证码
+// 无论用户是否存在都返回相同的响应，避免泄露用户名
+func RequestPasswordReset(ctx *gin.Context) {
+	var requestData struct {
+		Username string `json:"username"`
+		Channel  string `json:"channel"`
+	}
+
+	if err := ctx.ShouldBindJSON(&requestData); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	if requestData.Username == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "用户名为必填项"})
+		return
+	}
+
+	if requestData.Channel != "" && requestData.Channel != NotifyChannelSMS && requestData.Channel != NotifyChannelEmail {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "不支持的验证码发送方式"})
+		return
+	}
+
+	// 渠道停用与用户无关，直接告知，不会泄露用户名
+	if requestData.Channel != "" && !NotifyChannelEnabled(requestData.Channel) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":               "暂不支持通过" + notifyChannelNames[requestData.Channel] + "重置密码",
+			"channel_unavailable": true,
+		})
+		return
+	}
+	if requestData.Channel == "" && len(notifiers) == 0 {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":               "密码重置暂不可用，请联系管理员",
+			"channel_unavailable": true,
+		})
+		return
+	}
+
+	accepted := gin.H{"message": "如果账户存在且已绑定联系方式，验证码已发送"}
+
+	var user models.Users
+	result := DB.Where("username = ?", requestData.Username).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		ctx.JSON(http.StatusOK, accepted)
+		return
+	} else if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	// 限制申请频率
+	var latest models.PasswordResets
+	result = DB.Where("username = ?", user.Username).Order("created_at DESC").First(&latest)
+	if result.Error == nil && time.Since(latest.CreatedAt) < passwordResetRequestInterval {
+		ctx.JSON(http.StatusOK, accepted)
+		return
+	}
+
+	// 发送失败时同样返回成功的响应，否则可据此判断用户是否存在
+	if _, err := SendPasswordResetCode(ctx.Request.Context(), &user, requestData.Channel); err != nil {
+		fmt.Println("密码重置验证码发送失败:", err, user.Username)
+	}
+
+	ctx.JSON(http.StatusOK, accepted)
+}
+
+// ConfirmPasswordReset 校验验证码并设置新密码
+func ConfirmPasswordReset(ctx *gin.Context) {
+	var requestData struct {
+		Username    string `json:"username"`
+		Code        string `json:"code"`
+		NewPassword string `json:"newPassword"`
+	}
+
+	if err := ctx.ShouldBindJSON(&requestData); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	if requestData.Username == "" || requestData.Code == "" || requestData.NewPassword == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "用户名、验证码和新密码都为必填项"})
+		return
+	}
+
+	// 校验新密码是否符合账户策略
+	if violation := accountPolicy.ValidatePassword(requestData.Username, requestData.NewPassword); violation != nil {
+		ctx.JSON(http.StatusBadRequest, violation.Response())
+		return
+	}
+
+	// 与登录共用失败计数，限制同一用户名或IP猜测验证码
+	clientIP := ctx.ClientIP()
+	wait, err := loginGuard.Check(requestData.Username, clientIP)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if wait > 0 {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "尝试过于频繁，请稍后再试",
+			"retry_after": retryAfter,
+		})
+		return
+	}
+	invalidCode := func() {
+		if err := loginGuard.RecordFailure(requestData.Username, clientIP); err != nil {
+			fmt.Println("记录验证码校验失败出错:", err)
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "验证码无效或已过期"})
+	}
+
+	// 查询最近一条未使用的验证码
+	var reset models.PasswordResets
+	result := DB.Where("username = ? AND used_at IS NULL AND expires_at > ?", requestData.Username, time.Now()).
+		Order("created_at DESC").
+		First(&reset)
+	if result.Error == gorm.ErrRecordNotFound {
+		invalidCode()
+		return
+	} else if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	// 先累加校验次数再比较验证码，条件更新保证并发请求也不会超过次数上限
+	result = DB.Model(&models.PasswordResets{}).
+		Where("id = ? AND attempts < ? AND used_at IS NULL", reset.ID, passwordResetMaxAttempts).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库更新出错"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		invalidCode()
+		return
+	}
+	reset.Attempts++
+
+	expected := hashResetCode(reset.CodeSalt, requestData.Code)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(reset.CodeHash)) != 1 {
+		RecordAudit(ctx, AuditEvent{
+			Action:  AuditPasswordReset,
+			Actor:   reset.Username,
+			Target:  reset.Username,
+			Outcome: AuditFailure,
+			Detail:  gin.H{"reason": "bad_code", "attempts": reset.Attempts},
+		})
+		invalidCode()
+		return
+	}
+
+	// 加密新密码
+	hashedPassword, err := passwordHasher.Hash(requestData.NewPassword)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "密码加密失败"})
+		return
+	}
+
+	// 作废验证码并更新密码，验证码只能使用一次
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PasswordResets{}).
+			Where("id = ? AND used_at IS NULL", reset.ID).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Model(&models.Users{}).
+			Where("username = ?", reset.Username).
+			Updates(map[string]interface{}{
+				"password":                hashedPassword,
+				"password_reset_required": false,
+			}).Error
+	})
+	if err == gorm.ErrRecordNotFound {
+		invalidCode()
+		return
+	} else if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "密码重置失败"})
+		return
+	}
+
+	// 重置成功后注销全部会话并清除登录失败计数
+	if _, err := RevokeUserSessions(reset.Username, ""); err != nil {
+		fmt.Println("密码重置后注销会话失败:", err)
+	}
+	if err := loginGuard.RecordSuccess(reset.Username); err != nil {
+		fmt.Println("清除登录失败计数出错:", err)
+	}
+
+	RecordAudit(ctx, AuditEvent{Action: AuditPasswordReset, Actor: reset.Username, Target: reset.Username, Outcome: AuditSuccess})
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "密码重置成功，请重新登录"})
+}
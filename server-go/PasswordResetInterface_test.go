@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"server-env.com/server/models"
+)
+
+func TestConfirmPasswordResetAttemptLimit(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "grace"}, "Old-Passw0rd")
+	reset := models.PasswordResets{
+		Username:  "grace",
+		CodeSalt:  "salt",
+		CodeHash:  hashResetCode("salt", "123456"),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	DB.Create(&reset)
+	// 放宽登录保护，单独验证验证码自身的次数上限
+	loginGuard.DelayAfter = passwordResetMaxAttempts * 4
+	loginGuard.MaxUserFailures = passwordResetMaxAttempts * 4
+
+	// 并发提交错误验证码，累计次数不能超过上限
+	var wg sync.WaitGroup
+	for i := 0; i < passwordResetMaxAttempts*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			performRequest(router, http.MethodPost, "/api/user/password-reset/confirm",
+				`{"username":"grace","code":"000000","newPassword":"New-Passw0rd!"}`, nil)
+		}()
+	}
+	wg.Wait()
+
+	DB.First(&reset, reset.ID)
+	if reset.Attempts != passwordResetMaxAttempts {
+		t.Fatalf("校验次数应为 %d，实际 %d", passwordResetMaxAttempts, reset.Attempts)
+	}
+
+	// 次数用完后正确的验证码也不能使用
+	w := performRequest(router, http.MethodPost, "/api/user/password-reset/confirm",
+		`{"username":"grace","code":"123456","newPassword":"New-Passw0rd!"}`, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("次数用完后应拒绝，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+// recordingNotifier 记录发送的通知，err非空时发送失败
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+	err  error
+}
+
+func (r *recordingNotifier) Send(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+// setupNotifiers 只启用给定的渠道，通知由返回的notifier记录，测试结束后恢复
+func setupNotifiers(t *testing.T, channels ...string) *recordingNotifier {
+	t.Helper()
+	notifier := &recordingNotifier{}
+	previous := notifiers
+	notifiers = map[string]Notifier{}
+	for _, channel := range channels {
+		notifiers[channel] = notifier
+	}
+	t.Cleanup(func() { notifiers = previous })
+	return notifier
+}
+
+func TestRequestPasswordResetChannelUnavailable(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	notifier := setupNotifiers(t, NotifyChannelEmail)
+	createTestUser(t, models.Users{Username: "iris", Phone: "13800000000", Email: "iris@example.com"}, "Old-Passw0rd")
+
+	// 停用的渠道无论用户是否存在都返回相同的错误
+	for _, username := range []string{"iris", "nobody"} {
+		w := performRequest(router, http.MethodPost, "/api/user/password-reset/request", `{"username":"`+username+`","channel":"sms"}`, nil)
+		if w.Code != http.StatusServiceUnavailable || decodeBody(t, w)["channel_unavailable"] != true {
+			t.Fatalf("%s: 短信停用时应返回503 channel_unavailable，实际 %d %s", username, w.Code, w.Body.String())
+		}
+	}
+
+	// 未指定渠道时跳过停用的短信，改用邮件
+	w := performRequest(router, http.MethodPost, "/api/user/password-reset/request", `{"username":"iris"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("申请验证码失败: %d %s", w.Code, w.Body.String())
+	}
+	if len(notifier.sent) != 1 || notifier.sent[0].Channel != NotifyChannelEmail || notifier.sent[0].To != "iris@example.com" {
+		t.Fatalf("验证码应通过邮件发送: %+v", notifier.sent)
+	}
+
+	// 全部渠道停用时不能申请
+	setupNotifiers(t)
+	w = performRequest(router, http.MethodPost, "/api/user/password-reset/request", `{"username":"iris"}`, nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("全部渠道停用时应返回503，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestPasswordResetSendFailure(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	notifier := setupNotifiers(t, NotifyChannelSMS)
+	notifier.err = errors.New("gateway down")
+	createTestUser(t, models.Users{Username: "judy", Phone: "13800000001"}, "Old-Passw0rd")
+
+	// 发送失败时与不存在的用户返回相同的响应
+	existing := performRequest(router, http.MethodPost, "/api/user/password-reset/request", `{"username":"judy"}`, nil)
+	missing := performRequest(router, http.MethodPost, "/api/user/password-reset/request", `{"username":"nobody"}`, nil)
+	if existing.Code != http.StatusOK || existing.Code != missing.Code || existing.Body.String() != missing.Body.String() {
+		t.Fatalf("响应应当一致: %d %s / %d %s", existing.Code, existing.Body.String(), missing.Code, missing.Body.String())
+	}
+}
+
+func TestConfirmPasswordResetThrottled(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "kate"}, "Old-Passw0rd")
+
+	// 没有验证码的用户名同样计入失败，达到阈值后返回429
+	body := `{"username":"kate","code":"000000","newPassword":"New-Passw0rd!"}`
+	for i := 0; i < loginGuard.DelayAfter; i++ {
+		w := performRequest(router, http.MethodPost, "/api/user/password-reset/confirm", body, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("第%d次应返回400，实际 %d %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	w := performRequest(router, http.MethodPost, "/api/user/password-reset/confirm", body, nil)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("应限制频繁校验，实际 %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"server-env.com/server/models"
+)
+
+// 资料字段的长度和取值限制
+const (
+	maxDisplayNameLength  = 30
+	maxCropVarieties      = 20
+	maxCropVarietyLength  = 30
+	maxFarmSize           = 1000000
+	maxProfileEmailLength = 100
+)
+
+var (
+	phonePattern  = regexp.MustCompile(`^\+?[0-9]{6,19}$`)
+	adcodePattern = regexp.MustCompile(`^[1-9][0-9]{5}$`)
+)
+
+// 前端支持的界面语言
+var supportedLanguages = strings.Split(getEnvOrDefault("SUPPORTED_LANGUAGES", "zh-CN,en-US"), ",")
+
+// normalizePhone 去掉手机号中的空格和连字符
+func normalizePhone(phone string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(phone)
+}
+
+// validEmail 判断邮箱是否为不带显示名的合法地址
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email && len(email) <= maxProfileEmailLength
+}
+
+// userProfileView 返回给用户本人的资料，字段逐一列出，不包含密码哈希等敏感信息
+func userProfileView(user *models.Users) gin.H {
+	return gin.H{
+		"username":          user.Username,
+		"avatar":            avatarURL(user.Avatar),
+		"avatar_thumbnails": avatarURLs(user.Avatar),
+		"role":              user.Role,
+		"display_name":      user.DisplayName,
+		"phone":             user.Phone,
+		"email":             user.Email,
+		"region_adcode":     user.RegionAdcode,
+		"crop_varieties":    user.CropVarietyList(),
+		"farm_size":         user.FarmSize,
+		"language":          user.Language,
+		"timezone":          user.Timezone,
+		"totp_enabled":      user.TOTPEnabled,
+		"created_at":        user.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// hasControlCharacters 判断文本是否包含换行等控制字符
+func hasControlCharacters(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// normalizeCropVarieties 清理并去重种植品种
+func normalizeCropVarieties(varieties []string) ([]string, error) {
+	result := []string{}
+	for _, variety := range varieties {
+		variety = strings.TrimSpace(variety)
+		if variety == "" || slices.Contains(result, variety) {
+			continue
+		}
+		if utf8.RuneCountInString(variety) > maxCropVarietyLength || strings.Contains(variety, ",") || hasControlCharacters(variety) {
+			return nil, fmt.Errorf("品种名称不合法: %s", variety)
+		}
+		result = append(result, variety)
+	}
+	if len(result) > maxCropVarieties {
+		return nil, fmt.Errorf("种植品种最多%d个", maxCropVarieties)
+	}
+	return result, nil
+}
+
+// UpdateProfile 修改当前用户的资料，只更新请求中出现的字段
+func UpdateProfile(c *gin.Context) {
+	var requestData struct {
+		DisplayName   *string   `json:"display_name"`
+		Phone         *string   `json:"phone"`
+		Email         *string   `json:"email"`
+		RegionAdcode  *string   `json:"region_adcode"`
+		CropVarieties *[]string `json:"crop_varieties"`
+		FarmSize      *float64  `json:"farm_size"`
+		Language      *string   `json:"language"`
+		Timezone      *string   `json:"timezone"`
+	}
+
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	updates := map[string]interface{}{}
+
+	if requestData.DisplayName != nil {
+		displayName := strings.TrimSpace(*requestData.DisplayName)
+		if utf8.RuneCountInString(displayName) > maxDisplayNameLength || hasControlCharacters(displayName) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("昵称不能超过%d个字符且不能包含控制字符", maxDisplayNameLength)})
+			return
+		}
+		updates["display_name"] = displayName
+	}
+
+	if requestData.Phone != nil {
+		phone := normalizePhone(*requestData.Phone)
+		if phone != "" && !phonePattern.MatchString(phone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "手机号格式不正确"})
+			return
+		}
+		updates["phone"] = phone
+	}
+
+	if requestData.Email != nil {
+		email := strings.TrimSpace(*requestData.Email)
+		if email != "" {
+			if !validEmail(email) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "邮箱格式不正确"})
+				return
+			}
+		}
+		updates["email"] = email
+	}
+
+	if requestData.RegionAdcode != nil {
+		adcode := strings.TrimSpace(*requestData.RegionAdcode)
+		if adcode != "" && !adcodePattern.MatchString(adcode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "地区编码应为6位行政区划代码"})
+			return
+		}
+		updates["region_adcode"] = adcode
+	}
+
+	if requestData.CropVarieties != nil {
+		varieties, err := normalizeCropVarieties(*requestData.CropVarieties)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		updates["crop_varieties"] = strings.Join(varieties, ",")
+	}
+
+	if requestData.FarmSize != nil {
+		farmSize := *requestData.FarmSize
+		if math.IsNaN(farmSize) || farmSize < 0 || farmSize > maxFarmSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "种植面积不合法"})
+			return
+		}
+		updates["farm_size"] = farmSize
+	}
+
+	if requestData.Language != nil {
+		if !slices.Contains(supportedLanguages, *requestData.Language) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "不支持的语言", "languages": supportedLanguages})
+			return
+		}
+		updates["language"] = *requestData.Language
+	}
+
+	if requestData.Timezone != nil {
+		if _, err := time.LoadLocation(*requestData.Timezone); err != nil || *requestData.Timezone == "" || *requestData.Timezone == "Local" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "时区不合法，请使用IANA时区名称，如Asia/Shanghai"})
+			return
+		}
+		updates["timezone"] = *requestData.Timezone
+	}
+
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	if len(updates) > 0 {
+		if err := DB.Model(user).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "资料保存失败"})
+			return
+		}
+
+		fields := make([]string, 0, len(updates))
+		for field := range updates {
+			fields = append(fields, field)
+		}
+		slices.Sort(fields)
+		RecordAudit(c, AuditEvent{
+			Action:  AuditProfileUpdate,
+			Target:  user.Username,
+			Outcome: AuditSuccess,
+			Detail:  gin.H{"fields": fields},
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "资料已更新",
+		"data":    userProfileView(user),
+	})
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+// 记录字段的长度限制
+const (
+	maxDiseaseLength   = 100
+	maxFieldNameLength = 50
+	maxCropLength      = 30
+	maxNotesLength     = 2000
+)
+
+// diagnosisRecordView 诊断记录的接口输出
+func diagnosisRecordView(record *models.DiagnosisRecords) gin.H {
+	view := gin.H{
+		"id":              record.ID,
+		"username":        record.Username,
+		"disease":         record.Disease,
+		"confidence":      record.Confidence,
+		"image_key":       record.ImageKey,
+		"image_url":       nil,
+		"conversation_id": record.ConversationID,
+		"notes":           record.Notes,
+		"created_at":      record.CreatedAt.Format(time.RFC3339),
+	}
+	if record.ImageKey != "" {
+		view["image_url"] = BlobURL(record.ImageKey)
+	}
+	return view
+}
+
+// fieldRecordView 地块数据的接口输出
+func fieldRecordView(record *models.FieldRecords) gin.H {
+	return gin.H{
+		"id":            record.ID,
+		"username":      record.Username,
+		"name":          record.Name,
+		"region_adcode": record.RegionAdcode,
+		"crop":          record.Crop,
+		"area":          record.Area,
+		"notes":         record.Notes,
+		"created_at":    record.CreatedAt.Format(time.RFC3339),
+		"updated_at":    record.UpdatedAt.Format(time.RFC3339),
+	}
+}
+
+// parseIDParam 解析路径中的数字ID，失败时直接写入响应
+func parseIDParam(c *gin.Context, name, label string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": label + "ID不合法"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// findDiagnosisRecord 查询用户的一条诊断记录
+func findDiagnosisRecord(owner string, id uint) (*models.DiagnosisRecords, error) {
+	var record models.DiagnosisRecords
+	if err := DB.Where("id = ? AND username = ?", id, owner).First(&record).Error; err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// findFieldRecord 查询用户的一条地块数据
+func findFieldRecord(owner string, id uint) (*models.FieldRecords, error) {
+	var record models.FieldRecords
+	if err := DB.Where("id = ? AND username = ?", id, owner).First(&record).Error; err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// validNotes 判断备注长度是否合法
+func validNotes(notes string) bool {
+	return utf8.RuneCountInString(notes) <= maxNotesLength
+}
+
+// CreateDiagnosisRecord 保存一条诊断记录
+func CreateDiagnosisRecord(c *gin.Context) {
+	var requestData struct {
+		Disease        string  `json:"disease"`
+		Confidence     float64 `json:"confidence"`
+		ImageKey       string  `json:"image_key"`
+		ConversationID string  `json:"conversation_id"`
+		Notes          string  `json:"notes"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	disease := strings.TrimSpace(requestData.Disease)
+	if disease == "" || utf8.RuneCountInString(disease) > maxDiseaseLength || hasControlCharacters(disease) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("病害名称为必填项且不超过%d个字符", maxDiseaseLength)})
+		return
+	}
+	if math.IsNaN(requestData.Confidence) || requestData.Confidence < 0 || requestData.Confidence > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "置信度应在0到1之间"})
+		return
+	}
+	// 只允许引用通过上传接口保存的图片
+	if requestData.ImageKey != "" && (!strings.HasPrefix(requestData.ImageKey, uploadKeyPrefix) || !ValidBlobKey(requestData.ImageKey)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "图片键不合法"})
+		return
+	}
+	if len(requestData.ConversationID) > 64 || !validNotes(requestData.Notes) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("对话ID或备注过长，备注不超过%d个字符", maxNotesLength)})
+		return
+	}
+
+	record := models.DiagnosisRecords{
+		Username:       CurrentIdentity(c).Username,
+		Disease:        disease,
+		Confidence:     requestData.Confidence,
+		ImageKey:       requestData.ImageKey,
+		ConversationID: requestData.ConversationID,
+		Notes:          requestData.Notes,
+	}
+	if err := DB.Create(&record).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "诊断记录保存失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "诊断记录已保存", "data": diagnosisRecordView(&record)})
+}
+
+// ListDiagnosisRecords 分页列出当前用户的诊断记录
+func ListDiagnosisRecords(c *gin.Context) {
+	page, pageSize := parsePagination(c)
+	query := DB.Model(&models.DiagnosisRecords{}).Where("username = ?", CurrentIdentity(c).Username)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var records []models.DiagnosisRecords
+	err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&records).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(records))
+	for i := range records {
+		data[i] = diagnosisRecordView(&records[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"records": data, "total": total, "page": page, "page_size": pageSize})
+}
+
+// GetDiagnosisRecord 查看当前用户的一条诊断记录
+func GetDiagnosisRecord(c *gin.Context) {
+	id, ok := parseIDParam(c, "record_id", "记录")
+	if !ok {
+		return
+	}
+
+	record, err := findDiagnosisRecord(CurrentIdentity(c).Username, id)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": diagnosisRecordView(record)})
+}
+
+// DeleteDiagnosisRecord 删除当前用户的一条诊断记录，同时取消共享
+func DeleteDiagnosisRecord(c *gin.Context) {
+	id, ok := parseIDParam(c, "record_id", "记录")
+	if !ok {
+		return
+	}
+	username := CurrentIdentity(c).Username
+
+	result := DB.Where("id = ? AND username = ?", id, username).Delete(&models.DiagnosisRecords{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "记录删除失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+		return
+	}
+	unshareResource(models.ResourceDiagnosis, strconv.FormatUint(uint64(id), 10), username)
+
+	c.JSON(http.StatusOK, gin.H{"message": "记录已删除", "id": id})
+}
+
+// fieldRecordRequest 地块数据的创建和修改请求，修改时只更新出现的字段
+type fieldRecordRequest struct {
+	Name         *string  `json:"name"`
+	RegionAdcode *string  `json:"region_adcode"`
+	Crop         *string  `json:"crop"`
+	Area         *float64 `json:"area"`
+	Notes        *string  `json:"notes"`
+}
+
+// updates 校验请求并转换为需要更新的字段
+func (r *fieldRecordRequest) updates() (map[string]interface{}, error) {
+	updates := map[string]interface{}{}
+
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		if name == "" || utf8.RuneCountInString(name) > maxFieldNameLength || hasControlCharacters(name) {
+			return nil, fmt.Errorf("地块名称为必填项且不超过%d个字符", maxFieldNameLength)
+		}
+		updates["name"] = name
+	}
+	if r.RegionAdcode != nil {
+		adcode := strings.TrimSpace(*r.RegionAdcode)
+		if adcode != "" && !adcodePattern.MatchString(adcode) {
+			return nil, fmt.Errorf("地区编码应为6位行政区划代码")
+		}
+		updates["region_adcode"] = adcode
+	}
+	if r.Crop != nil {
+		crop := strings.TrimSpace(*r.Crop)
+		if utf8.RuneCountInString(crop) > maxCropLength || hasControlCharacters(crop) {
+			return nil, fmt.Errorf("作物名称不超过%d个字符", maxCropLength)
+		}
+		updates["crop"] = crop
+	}
+	if r.Area != nil {
+		if math.IsNaN(*r.Area) || *r.Area < 0 || *r.Area > maxFarmSize {
+			return nil, fmt.Errorf("地块面积不合法")
+		}
+		updates["area"] = *r.Area
+	}
+	if r.Notes != nil {
+		if !validNotes(*r.Notes) {
+			return nil, fmt.Errorf("备注不超过%d个字符", maxNotesLength)
+		}
+		updates["notes"] = *r.Notes
+	}
+	return updates, nil
+}
+
+// CreateFieldRecord 保存一条地块数据
+func CreateFieldRecord(c *gin.Context) {
+	var requestData fieldRecordRequest
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	if requestData.Name == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "地块名称为必填项"})
+		return
+	}
+	updates, err := requestData.updates()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record := models.FieldRecords{Username: CurrentIdentity(c).Username}
+	record.Name, _ = updates["name"].(string)
+	record.RegionAdcode, _ = updates["region_adcode"].(string)
+	record.Crop, _ = updates["crop"].(string)
+	record.Area, _ = updates["area"].(float64)
+	record.Notes, _ = updates["notes"].(string)
+	if err := DB.Create(&record).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "地块数据保存失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "地块数据已保存", "data": fieldRecordView(&record)})
+}
+
+// ListFieldRecords 列出当前用户的全部地块数据
+func ListFieldRecords(c *gin.Context) {
+	var records []models.FieldRecords
+	if err := DB.Where("username = ?", CurrentIdentity(c).Username).Order("id ASC").Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(records))
+	for i := range records {
+		data[i] = fieldRecordView(&records[i])
+	}
+	c.JSON(http.StatusOK, gin.H{"fields": data})
+}
+
+// GetFieldRecord 查看当前用户的一条地块数据
+func GetFieldRecord(c *gin.Context) {
+	id, ok := parseIDParam(c, "record_id", "地块")
+	if !ok {
+		return
+	}
+
+	record, err := findFieldRecord(CurrentIdentity(c).Username, id)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "地块不存在"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": fieldRecordView(record)})
+}
+
+// UpdateFieldRecord 修改当前用户的一条地块数据
+func UpdateFieldRecord(c *gin.Context) {
+	id, ok := parseIDParam(c, "record_id", "地块")
+	if !ok {
+		return
+	}
+
+	var requestData fieldRecordRequest
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+	updates, err := requestData.updates()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	record, err := findFieldRecord(CurrentIdentity(c).Username, id)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "地块不存在"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	if len(updates) > 0 {
+		if err := DB.Model(record).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "地块数据保存失败"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "地块数据已更新", "data": fieldRecordView(record)})
+}
+
+// DeleteFieldRecord 删除当前用户的一条地块数据，同时取消共享
+func DeleteFieldRecord(c *gin.Context) {
+	id, ok := parseIDParam(c, "record_id", "地块")
+	if !ok {
+		return
+	}
+	username := CurrentIdentity(c).Username
+
+	result := DB.Where("id = ? AND username = ?", id, username).Delete(&models.FieldRecords{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "地块删除失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "地块不存在"})
+		return
+	}
+	unshareResource(models.ResourceField, strconv.FormatUint(uint64(id), 10), username)
+
+	c.JSON(http.StatusOK, gin.H{"message": "地块已删除", "id": id})
+}
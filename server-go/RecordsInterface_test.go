@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+func TestCreateDiagnosisRecordValidation(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "fred"}, "")
+	fred := testAccessToken(t, "fred")
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"病害为空", `{"disease":" "}`, http.StatusBadRequest},
+		{"置信度超出范围", `{"disease":"大斑病","confidence":1.5}`, http.StatusBadRequest},
+		{"图片不是上传文件", `{"disease":"大斑病","image_key":"avatars/a.jpg"}`, http.StatusBadRequest},
+		{"图片键跳出目录", `{"disease":"大斑病","image_key":"uploads/../avatars/a.jpg"}`, http.StatusBadRequest},
+		{"保存成功", `{"disease":"大斑病","confidence":0.92,"notes":"叶片出现长条斑"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := performRequest(router, http.MethodPost, "/api/records/diagnosis", tt.body, bearer(fred))
+		if w.Code != tt.code {
+			t.Errorf("%s: 期望 %d，实际 %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	var count int64
+	DB.Model(&models.DiagnosisRecords{}).Where("username = ?", "fred").Count(&count)
+	if count != 1 {
+		t.Fatalf("只应保存一条诊断记录，实际 %d", count)
+	}
+}
+
+func TestRecordsScopedToOwner(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "fred"}, "")
+	createTestUser(t, models.Users{Username: "gina"}, "")
+	fred, gina := testAccessToken(t, "fred"), testAccessToken(t, "gina")
+
+	diagnosis := models.DiagnosisRecords{Username: "fred", Disease: "锈病"}
+	DB.Create(&diagnosis)
+	w := performRequest(router, http.MethodPost, "/api/records/fields", `{"name":"东地","region_adcode":"220102","crop":"玉米","area":12.5}`, bearer(fred))
+	if w.Code != http.StatusOK {
+		t.Fatalf("保存地块失败: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Data struct {
+			ID uint `json:"id"`
+		} `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	diagnosisPath := fmt.Sprintf("/api/records/diagnosis/%d", diagnosis.ID)
+	fieldPath := fmt.Sprintf("/api/records/fields/%d", resp.Data.ID)
+
+	// 其他用户的记录与不存在的记录返回相同的错误
+	for _, req := range []struct{ method, target, body string }{
+		{http.MethodGet, diagnosisPath, ""},
+		{http.MethodDelete, diagnosisPath, ""},
+		{http.MethodGet, fieldPath, ""},
+		{http.MethodPatch, fieldPath, `{"crop":"大豆"}`},
+		{http.MethodDelete, fieldPath, ""},
+	} {
+		if w := performRequest(router, req.method, req.target, req.body, bearer(gina)); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: 他人记录应返回404，实际 %d", req.method, req.target, w.Code)
+		}
+	}
+	if w := performRequest(router, http.MethodGet, "/api/records/fields", "", bearer(gina)); w.Body.String() != `{"fields":[]}` {
+		t.Fatalf("他人的地块不应出现在列表中: %s", w.Body.String())
+	}
+
+	// 修改时只更新出现的字段
+	w = performRequest(router, http.MethodPatch, fieldPath, `{"crop":"大豆"}`, bearer(fred))
+	if w.Code != http.StatusOK {
+		t.Fatalf("修改地块失败: %d %s", w.Code, w.Body.String())
+	}
+	var field models.FieldRecords
+	DB.First(&field, resp.Data.ID)
+	if field.Crop != "大豆" || field.Name != "东地" || field.Area != 12.5 {
+		t.Fatalf("地块修改结果错误: %+v", field)
+	}
+	if w := performRequest(router, http.MethodPatch, fieldPath, `{"region_adcode":"22010"}`, bearer(fred)); w.Code != http.StatusBadRequest {
+		t.Fatalf("地区编码不合法应返回400，实际 %d", w.Code)
+	}
+}
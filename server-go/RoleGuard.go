@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+// 启动时提升为管理员的用户名，逗号分隔，用于初始化第一个管理员
+var ADMIN_USERNAMES = os.Getenv("ADMIN_USERNAMES")
+
+// RequireRoles 角色守卫中间件，必须挂在AuthRequired之后
+func RequireRoles(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := CurrentIdentity(c)
+		if identity == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录或登录已过期"})
+			return
+		}
+		if !identity.HasRole(roles...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "权限不足"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// IsValidRole 判断角色名是否合法
+func IsValidRole(role string) bool {
+	return slices.Contains(models.Roles, role)
+}
+
+// EnsureBootstrapAdmins 将ADMIN_USERNAMES中已注册的用户提升为管理员
+func EnsureBootstrapAdmins() error {
+	if ADMIN_USERNAMES == "" {
+		return nil
+	}
+
+	var usernames []string
+	for _, name := range strings.Split(ADMIN_USERNAMES, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			usernames = append(usernames, name)
+		}
+	}
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	result := DB.Model(&models.Users{}).
+		Where("username IN ? AND role <> ?", usernames, models.RoleAdmin).
+		Update("role", models.RoleAdmin)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		fmt.Printf("已将 %d 个用户提升为管理员\n", result.RowsAffected)
+	}
+	return nil
+}
+
+// SetUserRole 管理员修改用户角色
+func SetUserRole(c *gin.Context) {
+	username := c.Param("username")
+
+	var requestData struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	if !IsValidRole(requestData.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "角色不合法", "roles": models.Roles})
+		return
+	}
+
+	// 防止管理员误将自己降级后无人可管理
+	if username == CurrentIdentity(c).Username && requestData.Role != models.RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能修改自己的管理员角色"})
+		return
+	}
+
+	result := DB.Model(&models.Users{}).Where("username = ?", username).Update("role", requestData.Role)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "角色修改失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		var count int64
+		DB.Model(&models.Users{}).Where("username = ?", username).Count(&count)
+		if count == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "角色修改成功",
+		"username": username,
+		"role":     requestData.Role,
+	})
+}
+
+// GetFarmerInfo 专家查看用户的基本信息
+func GetFarmerInfo(c *gin.Context) {
+	username := c.Param("username")
+
+	var user models.Users
+	result := DB.Where("username = ?", username).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	} else if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": gin.H{
+			"username":       user.Username,
+			"avatar":         avatarURL(user.Avatar),
+			"role":           user.Role,
+			"display_name":   user.DisplayName,
+			"region_adcode":  user.RegionAdcode,
+			"crop_varieties": user.CropVarietyList(),
+			"farm_size":      user.FarmSize,
+		},
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+func TestRoleGuards(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	tokens := map[string]string{}
+	for _, role := range models.Roles {
+		createTestUser(t, models.Users{Username: role + "_user", Role: role}, "")
+		tokens[role] = testAccessToken(t, role+"_user")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		codes  map[string]int
+	}{
+		{"专家接口", http.MethodGet, "/api/expert/users/farmer_user", "", map[string]int{
+			models.RoleFarmer: http.StatusForbidden, models.RoleExpert: http.StatusOK,
+			models.RoleManager: http.StatusForbidden, models.RoleAdmin: http.StatusOK,
+		}},
+		{"管理员接口", http.MethodPut, "/api/admin/users/farmer_user/role", `{"role":"farmer"}`, map[string]int{
+			models.RoleFarmer: http.StatusForbidden, models.RoleExpert: http.StatusForbidden,
+			models.RoleManager: http.StatusForbidden, models.RoleAdmin: http.StatusOK,
+		}},
+	}
+	for _, tt := range tests {
+		for role, code := range tt.codes {
+			w := performRequest(router, tt.method, tt.target, tt.body, bearer(tokens[role]))
+			if w.Code != code {
+				t.Errorf("%s %s: 期望 %d，实际 %d %s", tt.name, role, code, w.Code, w.Body.String())
+			}
+		}
+		if w := performRequest(router, tt.method, tt.target, tt.body, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s 未登录: 期望 401，实际 %d", tt.name, w.Code)
+		}
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	setupTestDB(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "root", Role: models.RoleAdmin}, "")
+	createTestUser(t, models.Users{Username: "fred"}, "")
+	admin, fred := testAccessToken(t, "root"), testAccessToken(t, "fred")
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		code   int
+	}{
+		{"角色不合法", "fred", `{"role":"owner"}`, http.StatusBadRequest},
+		{"用户不存在", "nobody", `{"role":"expert"}`, http.StatusNotFound},
+		{"不能降级自己", "root", `{"role":"farmer"}`, http.StatusBadRequest},
+		{"提升为专家", "fred", `{"role":"expert"}`, http.StatusOK},
+		{"角色未变化", "fred", `{"role":"expert"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := performRequest(router, http.MethodPut, "/api/admin/users/"+tt.target+"/role", tt.body, bearer(admin))
+		if w.Code != tt.code {
+			t.Errorf("%s: 期望 %d，实际 %d %s", tt.name, tt.code, w.Code, w.Body.String())
+		}
+	}
+
+	// 角色以数据库为准，已签发的令牌立即获得新角色
+	w := performRequest(router, http.MethodGet, "/api/expert/users/root", "", bearer(fred))
+	if w.Code != http.StatusOK {
+		t.Fatalf("提升为专家后应能访问专家接口，实际 %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEnsureBootstrapAdmins(t *testing.T) {
+	setupTestDB(t)
+	createTestUser(t, models.Users{Username: "gina"}, "")
+	createTestUser(t, models.Users{Username: "hank"}, "")
+	previous := ADMIN_USERNAMES
+	ADMIN_USERNAMES = " gina, nobody ,"
+	t.Cleanup(func() { ADMIN_USERNAMES = previous })
+
+	if err := EnsureBootstrapAdmins(); err != nil {
+		t.Fatalf("初始化管理员失败: %v", err)
+	}
+	for username, role := range map[string]string{"gina": models.RoleAdmin, "hank": models.RoleFarmer} {
+		var user models.Users
+		DB.First(&user, "username = ?", username)
+		if user.Role != role {
+			t.Errorf("%s 的角色应为 %s，实际 %s", username, role, user.Role)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3兼容存储的配置，可对接MinIO等自建服务
+var (
+	S3_ENDPOINT          = os.Getenv("S3_ENDPOINT")
+	S3_REGION            = getEnvOrDefault("S3_REGION", "us-east-1")
+	S3_BUCKET            = os.Getenv("S3_BUCKET")
+	S3_ACCESS_KEY_ID     = os.Getenv("S3_ACCESS_KEY_ID")
+	S3_SECRET_ACCESS_KEY = os.Getenv("S3_SECRET_ACCESS_KEY")
+	// 路径风格访问 endpoint/bucket/key，MinIO默认使用该方式
+	S3_PATH_STYLE = getEnvOrDefault("S3_PATH_STYLE", "true") == "true"
+	// 所有文件键的公共前缀，多个环境共用一个bucket时使用
+	S3_PREFIX = os.Getenv("S3_PREFIX")
+)
+
+const (
+	s3SigningAlgorithm = "AWS4-HMAC-SHA256"
+	s3Service          = "s3"
+	s3TimeFormat       = "20060102T150405Z"
+	s3DateFormat       = "20060102"
+)
+
+// S3BlobStore S3兼容的对象存储，请求使用Signature Version 4签名
+type S3BlobStore struct {
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool
+	Prefix          string
+	Client          *http.Client
+}
+
+// NewS3BlobStoreFromEnv 从环境变量创建S3存储
+func NewS3BlobStoreFromEnv() (*S3BlobStore, error) {
+	if S3_ENDPOINT == "" || S3_BUCKET == "" || S3_ACCESS_KEY_ID == "" || S3_SECRET_ACCESS_KEY == "" {
+		return nil, errors.New("使用S3存储时 S3_ENDPOINT、S3_BUCKET、S3_ACCESS_KEY_ID、S3_SECRET_ACCESS_KEY 均为必填项")
+	}
+	endpoint, err := url.Parse(S3_ENDPOINT)
+	if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT 不是合法的地址: %s", S3_ENDPOINT)
+	}
+
+	prefix := strings.Trim(S3_PREFIX, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3BlobStore{
+		Endpoint:        endpoint,
+		Region:          S3_REGION,
+		Bucket:          S3_BUCKET,
+		AccessKeyID:     S3_ACCESS_KEY_ID,
+		SecretAccessKey: S3_SECRET_ACCESS_KEY,
+		PathStyle:       S3_PATH_STYLE,
+		Prefix:          prefix,
+		Client:          &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// S3Error S3返回的错误
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("S3请求失败: %d %s %s", e.StatusCode, e.Code, e.Message)
+}
+
+// objectURL 生成对象的访问地址，key为空时为bucket地址
+func (s *S3BlobStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.Endpoint
+	objectPath := strings.TrimSuffix(u.Path, "/")
+	if s.PathStyle {
+		objectPath += "/" + s.Bucket
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	if key != "" {
+		objectPath += "/" + s.Prefix + key
+	} else {
+		objectPath += "/"
+	}
+	u.Path = objectPath
+	u.RawPath = s3URIEncode(objectPath, false)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// s3URIEncode 按SigV4的规则编码，只保留RFC 3986中的非保留字符
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery 按键名排序并编码查询参数
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign 为请求添加SigV4签名头
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3TimeFormat)
+	date := now.UTC().Format(s3DateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// 参与签名的请求头，名称小写并排序
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/" + s3Service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3SigningAlgorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgorithm, s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// do 发送签名请求，非2xx响应转换为S3Error，404转换为ErrBlobNotFound
+func (s *S3BlobStore) do(ctx context.Context, method, key string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	if key != "" && !ValidBlobKey(key) {
+		return nil, fmt.Errorf("文件键不合法: %s", key)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, sha256Hex(body), time.Now())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrBlobNotFound
+	}
+	s3Err := &S3Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	_ = xml.Unmarshal(data, s3Err)
+	return nil, s3Err
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	if contentType == "" {
+		contentType = blobContentType(key)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, data, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, *BlobInfo, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := &BlobInfo{
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if info.ContentType == "" {
+		info.ContentType = blobContentType(key)
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return resp.Body, info, nil
+}
+
+func (s *S3BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, "")
+	if err == ErrBlobNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, "")
+	if err == ErrBlobNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ListResult ListObjectsV2的响应
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3BlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {s.Prefix + prefix},
+			"max-keys":  {strconv.Itoa(1000)},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, content := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(content.Key, s.Prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return keys, nil
+}
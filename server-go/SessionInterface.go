@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+// 会话最近活跃时间的最小刷新间隔，避免每个请求都写库
+const sessionTouchInterval = time.Minute
+
+var ErrSessionInvalid = errors.New("会话不存在或已注销")
+
+// newSessionID 生成随机会话ID
+func newSessionID() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// CreateSession 为登录成功的用户创建会话并签发访问令牌
+func CreateSession(c *gin.Context, username string) (string, *models.Sessions, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, expiresAt, err := IssueAccessToken(username, sessionID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	session := models.Sessions{
+		ID:         sessionID,
+		Username:   username,
+		UserAgent:  truncateRunes(c.Request.UserAgent(), 255),
+		IP:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  expiresAt,
+	}
+	if err := DB.Create(&session).Error; err != nil {
+		return "", nil, err
+	}
+
+	return token, &session, nil
+}
+
+// ValidateSession 检查会话是否有效，并按间隔刷新最近活跃时间
+func ValidateSession(sessionID, username string) error {
+	var session models.Sessions
+	result := DB.Where("id = ? AND username = ?", sessionID, username).First(&session)
+	if result.Error == gorm.ErrRecordNotFound {
+		return ErrSessionInvalid
+	} else if result.Error != nil {
+		return result.Error
+	}
+
+	now := time.Now()
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return ErrSessionInvalid
+	}
+
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		DB.Model(&models.Sessions{}).Where("id = ?", sessionID).Update("last_seen_at", now)
+	}
+	return nil
+}
+
+// RevokeUserSessions 注销用户的所有有效会话，exceptID不为空时保留该会话
+func RevokeUserSessions(username, exceptID string) (int64, error) {
+	query := DB.Model(&models.Sessions{}).
+		Where("username = ? AND revoked_at IS NULL AND expires_at > ?", username, time.Now())
+	if exceptID != "" {
+		query = query.Where("id <> ?", exceptID)
+	}
+	result := query.Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+// ListSessions 列出当前用户的有效会话
+func ListSessions(c *gin.Context) {
+	identity := CurrentIdentity(c)
+
+	var sessions []models.Sessions
+	result := DB.Where("username = ? AND revoked_at IS NULL AND expires_at > ?", identity.Username, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	data := make([]gin.H, len(sessions))
+	for i, session := range sessions {
+		data[i] = gin.H{
+			"id":           session.ID,
+			"user_agent":   session.UserAgent,
+			"ip":           session.IP,
+			"created_at":   session.CreatedAt.Format(time.RFC3339),
+			"last_seen_at": session.LastSeenAt.Format(time.RFC3339),
+			"expires_at":   session.ExpiresAt.Format(time.RFC3339),
+			"current":      session.ID == identity.SessionID,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": data})
+}
+
+// RevokeSession 注销当前用户的指定会话
+func RevokeSession(c *gin.Context) {
+	identity := CurrentIdentity(c)
+	sessionID := c.Param("session_id")
+
+	result := DB.Model(&models.Sessions{}).
+		Where("id = ? AND username = ? AND revoked_at IS NULL", sessionID, identity.Username).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "会话注销失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "会话不存在"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditSessionRevoke,
+		Target:  identity.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"session_id": sessionID},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "会话已注销", "session_id": sessionID})
+}
+
+// RevokeOtherSessions 注销当前用户除本次登录外的所有会话
+func RevokeOtherSessions(c *gin.Context) {
+	identity := CurrentIdentity(c)
+
+	count, err := RevokeUserSessions(identity.Username, identity.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "会话注销失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{
+		Action:  AuditSessionRevoke,
+		Target:  identity.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"scope": "others", "revoked": count},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"message": "其他会话已注销", "revoked": count})
+}
+
+// Logout 注销本次登录的会话
+func Logout(c *gin.Context) {
+	identity := CurrentIdentity(c)
+
+	result := DB.Model(&models.Sessions{}).
+		Where("id = ? AND revoked_at IS NULL", identity.SessionID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "退出登录失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{Action: AuditLogout, Target: identity.Username, Outcome: AuditSuccess})
+
+	c.JSON(http.StatusOK, gin.H{"message": "已退出登录"})
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"server-env.com/server/models"
+)
+
+// 身份验证器App中显示的签发方名称
+var TOTP_ISSUER = getEnvOrDefault("TOTP_ISSUER", "CornAssistant")
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// 允许前后各一个时间步长的时钟偏差
+	totpSkewSteps = 1
+
+	recoveryCodeCount = 10
+
+	// 登录第二步的挑战令牌用途和有效期
+	twoFactorChallengePurpose = "login_2fa"
+	twoFactorChallengeTTL     = 5 * time.Minute
+
+	// 要求启用两步验证的角色列表在系统设置中的键
+	twoFactorRolesSettingKey = "two_factor_required_roles"
+	twoFactorRolesCacheTTL   = 30 * time.Second
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// twoFactorChallenge 是密码验证通过后签发的登录挑战
+type twoFactorChallenge struct {
+	Username  string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// totpCode 按RFC 6238计算某个时间步长的验证码
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// verifyTOTP 校验验证码，成功时返回匹配的时间步长
+// 不接受小于等于lastStep的步长，防止同一验证码被重复使用
+func verifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI 生成身份验证器App扫码使用的otpauth地址
+func provisioningURI(username, secret string) string {
+	label := url.PathEscape(TOTP_ISSUER + ":" + username)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {TOTP_ISSUER},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// normalizeRecoveryCode 统一恢复码格式，忽略大小写和连字符
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// regenerateRecoveryCodes 作废旧恢复码并生成一组新的，返回明文
+func regenerateRecoveryCodes(tx *gorm.DB, username string) ([]string, error) {
+	if err := tx.Where("username = ?", username).Delete(&models.RecoveryCodes{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	records := make([]models.RecoveryCodes, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := hex.EncodeToString(buf)
+		codes[i] = raw[:5] + "-" + raw[5:]
+		records[i] = models.RecoveryCodes{Username: username, CodeHash: hashRecoveryCode(raw)}
+	}
+
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// verifySecondFactor 校验TOTP验证码或恢复码，恢复码使用后立即作废
+func verifySecondFactor(user *models.Users, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		// 只有步长仍大于记录值时才更新，并发请求中只有一个能成功
+		result := DB.Model(&models.Users{}).
+			Where("username = ? AND totp_last_step < ?", user.Username, step).
+			Update("totp_last_step", step)
+		if result.Error != nil {
+			return false, result.Error
+		}
+		user.TOTPLastStep = step
+		return result.RowsAffected == 1, nil
+	}
+
+	if recoveryCode != "" {
+		result := DB.Model(&models.RecoveryCodes{}).
+			Where("username = ? AND code_hash = ? AND used_at IS NULL", user.Username, hashRecoveryCode(recoveryCode)).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return false, result.Error
+		}
+		return result.RowsAffected == 1, nil
+	}
+
+	return false, nil
+}
+
+// 要求两步验证的角色列表缓存，避免每个请求都查询系统设置
+var twoFactorRolesCache struct {
+	mu       sync.Mutex
+	roles    []string
+	loadedAt time.Time
+}
+
+// TwoFactorRequiredRoles 返回必须启用两步验证的角色
+func TwoFactorRequiredRoles() ([]string, error) {
+	twoFactorRolesCache.mu.Lock()
+	defer twoFactorRolesCache.mu.Unlock()
+
+	if !twoFactorRolesCache.loadedAt.IsZero() && time.Since(twoFactorRolesCache.loadedAt) < twoFactorRolesCacheTTL {
+		return twoFactorRolesCache.roles, nil
+	}
+
+	value, err := GetSetting(twoFactorRolesSettingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := []string{}
+	for _, role := range strings.Split(value, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	twoFactorRolesCache.roles = roles
+	twoFactorRolesCache.loadedAt = time.Now()
+	return roles, nil
+}
+
+// twoFactorEnrollmentRequired 判断用户的角色要求两步验证但用户尚未启用
+func twoFactorEnrollmentRequired(user *models.Users) (bool, error) {
+	if user.TOTPEnabled {
+		return false, nil
+	}
+	roles, err := TwoFactorRequiredRoles()
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(roles, user.Role), nil
+}
+
+// twoFactorEnrollmentAllowed 未完成两步验证绑定时仍可访问的接口
+func twoFactorEnrollmentAllowed(c *gin.Context) bool {
+	path := c.FullPath()
+	return strings.HasPrefix(path, "/api/user/2fa/") || path == "/api/user/logout"
+}
+
+// issueTwoFactorChallenge 签发登录第二步使用的挑战令牌
+func issueTwoFactorChallenge(username string) (string, error) {
+	return encodeSignedValue(twoFactorChallengePurpose, &twoFactorChallenge{
+		Username:  username,
+		ExpiresAt: time.Now().Add(twoFactorChallengeTTL).Unix(),
+	})
+}
+
+// twoFactorChallengeResponse 密码验证通过但需要第二步验证时的响应
+func twoFactorChallengeResponse(username string) (gin.H, error) {
+	challenge, err := issueTwoFactorChallenge(username)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"message":             "请输入两步验证码",
+		"two_factor_required": true,
+		"challenge_token":     challenge,
+		"expires_in":          int(twoFactorChallengeTTL.Seconds()),
+	}, nil
+}
+
+// LoginTwoFactor 登录第二步，校验TOTP验证码或恢复码后签发访问令牌
+func LoginTwoFactor(ctx *gin.Context) {
+	var requestData struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	if err := ctx.ShouldBindJSON(&requestData); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	if requestData.ChallengeToken == "" || (requestData.Code == "" && requestData.RecoveryCode == "") {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "挑战令牌和验证码为必填项"})
+		return
+	}
+
+	var challenge twoFactorChallenge
+	err := decodeSignedValue(twoFactorChallengePurpose, requestData.ChallengeToken, &challenge)
+	if err != nil || time.Now().Unix() >= challenge.ExpiresAt {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "登录已超时，请重新输入密码"})
+		return
+	}
+
+	// 第二步同样受登录失败计数限制
+	clientIP := ctx.ClientIP()
+	wait, err := loginGuard.Check(challenge.Username, clientIP)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if wait > 0 {
+		auditLoginFailure(ctx, AuditLoginTwoFactor, challenge.Username, "throttled")
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "登录尝试过于频繁，请稍后再试",
+			"retry_after": retryAfter,
+		})
+		return
+	}
+
+	var user models.Users
+	result := DB.Where("username = ?", challenge.Username).First(&user)
+	if result.Error != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "登录已超时，请重新输入密码"})
+		return
+	}
+	if user.Disabled {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "账户已被禁用"})
+		return
+	}
+
+	ok := false
+	if user.TOTPEnabled {
+		ok, err = verifySecondFactor(&user, requestData.Code, requestData.RecoveryCode)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+			return
+		}
+	}
+	if !ok {
+		if err := loginGuard.RecordFailure(challenge.Username, clientIP); err != nil {
+			fmt.Println("记录登录失败出错:", err)
+		}
+		auditLoginFailure(ctx, AuditLoginTwoFactor, challenge.Username, "bad_code")
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "两步验证码错误"})
+		return
+	}
+
+	if err := loginGuard.RecordSuccess(user.Username); err != nil {
+		fmt.Println("清除登录失败计数出错:", err)
+	}
+
+	response, err := loginSuccessResponse(ctx, &user)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+		return
+	}
+	RecordAudit(ctx, AuditEvent{
+		Action:  AuditLoginTwoFactor,
+		Actor:   user.Username,
+		Target:  user.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"session_id": response["session_id"], "recovery_code": requestData.Code == ""},
+	})
+	ctx.JSON(http.StatusOK, response)
+}
+
+// loadCurrentUser 查询当前请求方的完整用户记录
+func loadCurrentUser(c *gin.Context) (*models.Users, bool) {
+	var user models.Users
+	result := DB.Where("username = ?", CurrentIdentity(c).Username).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return nil, false
+	} else if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return nil, false
+	}
+	return &user, true
+}
+
+// GetTwoFactorStatus 查看当前用户的两步验证状态
+func GetTwoFactorStatus(c *gin.Context) {
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	required, err := twoFactorEnrollmentRequired(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	var remaining int64
+	err = DB.Model(&models.RecoveryCodes{}).
+		Where("username = ? AND used_at IS NULL", user.Username).
+		Count(&remaining).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  user.TOTPEnabled,
+		"enrollment_required":      required,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// EnrollTwoFactor 生成新的TOTP密钥，需要再调用确认接口才会启用
+func EnrollTwoFactor(c *gin.Context) {
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "两步验证已启用"})
+		return
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密钥生成失败"})
+		return
+	}
+	secret := totpEncoding.EncodeToString(key)
+
+	err := DB.Model(user).Updates(map[string]interface{}{
+		"totp_secret":    secret,
+		"totp_last_step": 0,
+	}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "密钥保存失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "请使用身份验证器扫描二维码，并输入验证码完成绑定",
+		"secret":           secret,
+		"provisioning_uri": provisioningURI(user.Username, secret),
+	})
+}
+
+// ConfirmTwoFactor 校验第一个验证码后启用两步验证并返回恢复码
+func ConfirmTwoFactor(c *gin.Context) {
+	var requestData struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "两步验证已启用"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请先生成两步验证密钥"})
+		return
+	}
+
+	step, valid := verifyTOTP(user.TOTPSecret, requestData.Code, user.TOTPLastStep)
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "验证码错误"})
+		return
+	}
+
+	var codes []string
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = regenerateRecoveryCodes(tx, user.Username)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "两步验证启用失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{Action: AuditTwoFactorEnable, Target: user.Username, Outcome: AuditSuccess})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "两步验证已启用，请妥善保存恢复码，每个恢复码只能使用一次",
+		"recovery_codes": codes,
+	})
+}
+
+// DisableTwoFactor 关闭两步验证，需要密码和当前验证码
+func DisableTwoFactor(c *gin.Context) {
+	var requestData struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "两步验证未启用"})
+		return
+	}
+
+	roles, err := TwoFactorRequiredRoles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if slices.Contains(roles, user.Role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "当前角色必须启用两步验证"})
+		return
+	}
+
+	// 第三方登录创建的账户没有本地密码，只校验验证码
+	if user.Password != "" {
+		if !passwordHasher.Verify(user.Password, requestData.Password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "密码错误"})
+			return
+		}
+	}
+
+	valid, err := verifySecondFactor(user, requestData.Code, requestData.RecoveryCode)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "两步验证码错误"})
+		return
+	}
+
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled":   false,
+			"totp_secret":    "",
+			"totp_last_step": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("username = ?", user.Username).Delete(&models.RecoveryCodes{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "两步验证关闭失败"})
+		return
+	}
+
+	RecordAudit(c, AuditEvent{Action: AuditTwoFactorDisable, Target: user.Username, Outcome: AuditSuccess})
+
+	c.JSON(http.StatusOK, gin.H{"message": "两步验证已关闭"})
+}
+
+// RegenerateRecoveryCodes 重新生成恢复码，旧恢复码全部作废
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var requestData struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	user, ok := loadCurrentUser(c)
+	if !ok {
+		return
+	}
+
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "两步验证未启用"})
+		return
+	}
+
+	valid, err := verifySecondFactor(user, requestData.Code, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "两步验证码错误"})
+		return
+	}
+
+	var codes []string
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		codes, err = regenerateRecoveryCodes(tx, user.Username)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "恢复码生成失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "恢复码已重新生成，旧恢复码已失效",
+		"recovery_codes": codes,
+	})
+}
+
+// GetTwoFactorRoles 管理员查看必须启用两步验证的角色
+func GetTwoFactorRoles(c *gin.Context) {
+	roles, err := TwoFactorRequiredRoles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// SetTwoFactorRoles 管理员设置必须启用两步验证的角色
+func SetTwoFactorRoles(c *gin.Context) {
+	var requestData struct {
+		Roles []string `json:"roles"`
+	}
+	if err := c.ShouldBindJSON(&requestData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
+		return
+	}
+
+	roles := []string{}
+	for _, role := range requestData.Roles {
+		if !IsValidRole(role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "角色不合法: " + role, "roles": models.Roles})
+			return
+		}
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	if err := PutSetting(twoFactorRolesSettingKey, strings.Join(roles, ","), CurrentIdentity(c).Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "设置保存失败"})
+		return
+	}
+
+	// 立即刷新本实例的缓存，其他实例在缓存过期后生效
+	twoFactorRolesCache.mu.Lock()
+	twoFactorRolesCache.roles = roles
+	twoFactorRolesCache.loadedAt = time.Now()
+	twoFactorRolesCache.mu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"message": "设置已保存", "roles": roles})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"server-env.com/server/models"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 附录B的SHA1测试向量，取8位验证码的后6位
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.code {
+			t.Errorf("T=%d 验证码应为 %s，实际 %s", tt.unix, tt.code, got)
+		}
+	}
+}
+
+func TestVerifyTOTPWindow(t *testing.T) {
+	key := []byte("12345678901234567890")
+	secret := totpEncoding.EncodeToString(key)
+	current := time.Now().Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"当前步长", secret, totpCode(key, current), 0, current, true},
+		{"小写密钥", strings.ToLower(secret), totpCode(key, current), 0, current, true},
+		{"前一步长", secret, totpCode(key, current-1), 0, current - 1, true},
+		{"后一步长", secret, totpCode(key, current+1), 0, current + 1, true},
+		{"超出窗口之前", secret, totpCode(key, current-2), 0, 0, false},
+		{"超出窗口之后", secret, totpCode(key, current+2), 0, 0, false},
+		{"已使用的步长", secret, totpCode(key, current), current, 0, false},
+		{"早于已使用的步长", secret, totpCode(key, current-1), current, 0, false},
+		{"位数不对", secret, totpCode(key, current)[:5], 0, 0, false},
+		{"密钥无效", "not base32!", totpCode(key, current), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := verifyTOTP(tt.secret, tt.code, tt.lastStep)
+			// 临近步长边界时当前步长可能变化，只在未跨越边界时比较步长
+			if ok != tt.ok || (ok && step != tt.step && time.Now().Unix()/totpPeriod == current) {
+				t.Fatalf("期望 %v %d，实际 %v %d", tt.ok, tt.step, ok, step)
+			}
+		})
+	}
+}
+
+func TestVerifySecondFactorRejectsReuse(t *testing.T) {
+	setupTestDB(t)
+	key := []byte("12345678901234567890")
+	user := createTestUser(t, models.Users{
+		Username:    "nina",
+		TOTPSecret:  totpEncoding.EncodeToString(key),
+		TOTPEnabled: true,
+	}, "Nina-Passw0rd")
+	codes, err := regenerateRecoveryCodes(DB, user.Username)
+	if err != nil {
+		t.Fatalf("生成恢复码失败: %v", err)
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	tests := []struct {
+		name         string
+		code         string
+		recoveryCode string
+		ok           bool
+	}{
+		{"验证码", code, "", true},
+		{"重复使用验证码", code, "", false},
+		{"恢复码", "", codes[0], true},
+		{"重复使用恢复码", "", codes[0], false},
+		{"恢复码忽略大小写和连字符", "", strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")), true},
+		{"错误的恢复码", "", "00000-00000", false},
+		{"都为空", "", "", false},
+	}
+	for _, tt := range tests {
+		// 每次从数据库重新加载，模拟不同的请求
+		var current models.Users
+		DB.First(&current, "username = ?", user.Username)
+		ok, err := verifySecondFactor(&current, tt.code, tt.recoveryCode)
+		if err != nil || ok != tt.ok {
+			t.Errorf("%s: 期望 %v，实际 %v %v", tt.name, tt.ok, ok, err)
+		}
+	}
+
+	// 旧恢复码在重新生成后全部作废
+	regenerateRecoveryCodes(DB, user.Username)
+	if ok, _ := verifySecondFactor(user, "", codes[2]); ok {
+		t.Fatal("重新生成后旧恢复码不应再可用")
+	}
+}
@@ -1,28 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 	"server-env.com/server/models"
 )
 
+// 用户不存在时用于对比的占位密码哈希
+var dummyPasswordHash = func() string {
+	hash, err := passwordHasher.Hash("dummy-password")
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}()
+
 // RegisterUser 注册用户
 func RegisterUser(ctx *gin.Context) {
 	username := ctx.PostForm("username")
 	password := ctx.PostForm("password")
+	phone := normalizePhone(ctx.PostForm("phone"))
+	email := strings.TrimSpace(ctx.PostForm("email"))
+	inviteCode := ctx.PostForm("invite_code")
 
-	// 获取头像文件
+	// 获取头像文件，头像为可选项
 	file, _, err := ctx.Request.FormFile("avatar")
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "服务器获取用户头像错误"})
+	if err != nil && err != http.ErrMissingFile {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "头像文件上传失败"})
+		return
+	}
+	if file != nil {
+		defer file.Close()
 	}
 
 	if username == "" || password == "" {
@@ -30,9 +48,41 @@ func RegisterUser(ctx *gin.Context) {
 		return
 	}
 
+	// 注册必须通过图形验证码，防止批量注册
+	if !captchaErrorResponse(ctx, VerifyCaptcha(ctx.PostForm("captcha_id"), ctx.PostForm("captcha_answer"))) {
+		return
+	}
+
+	// 校验用户名和密码是否符合账户策略
+	if violation := accountPolicy.ValidateUsername(username); violation != nil {
+		ctx.JSON(http.StatusBadRequest, violation.Response())
+		return
+	}
+	if violation := accountPolicy.ValidatePassword(username, password); violation != nil {
+		ctx.JSON(http.StatusBadRequest, violation.Response())
+		return
+	}
+
+	// 手机号和邮箱为可选项，填写时校验格式
+	if phone != "" && !phonePattern.MatchString(phone) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "手机号格式不正确"})
+		return
+	}
+	if email != "" && !validEmail(email) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "邮箱格式不正确"})
+		return
+	}
+
 	var existingUser models.Users
 	result := DB.Where("username = ?", username).First(&existingUser)
 	if result.Error == nil {
+		RecordAudit(ctx, AuditEvent{
+			Action:  AuditRegister,
+			Actor:   username,
+			Target:  username,
+			Outcome: AuditFailure,
+			Detail:  gin.H{"reason": "username_taken"},
+		})
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "用户已存在"})
 		return
 	} else if result.Error != gorm.ErrRecordNotFound {
@@ -40,7 +90,27 @@ func RegisterUser(ctx *gin.Context) {
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	// 仅限邀请注册时必须提供邀请码，开放注册时邀请码可选，用于预设角色和组织
+	var invitation *models.InvitationCodes
+	if inviteCode != "" || REGISTRATION_MODE == RegistrationInvite {
+		invitation, err = findInvitationCode(inviteCode)
+		if err == ErrInvitationCodeInvalid {
+			RecordAudit(ctx, AuditEvent{
+				Action:  AuditRegister,
+				Actor:   username,
+				Target:  username,
+				Outcome: AuditFailure,
+				Detail:  gin.H{"reason": "invalid_invite_code"},
+			})
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "invite_code_required": REGISTRATION_MODE == RegistrationInvite})
+			return
+		} else if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+			return
+		}
+	}
+
+	hashedPassword, err := passwordHasher.Hash(password)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "密码加密失败"})
 		return
@@ -49,51 +119,57 @@ func RegisterUser(ctx *gin.Context) {
 	// 创建新用户
 	newUser := models.Users{
 		Username: username,
-		Password: string(hashedPassword),
+		Password: hashedPassword,
 		Avatar:   "", // 默认头像为空
+		Phone:    phone,
+		Email:    email,
+	}
+	if invitation != nil {
+		newUser.Role = invitation.Role
 	}
 
-	// 如果有上传头像文件，则保存头像
+	// 如果有上传头像文件，则处理并保存头像
 	if file != nil {
-		defer file.Close()
-
-		// 生成头像文件名
-		avatarFileName := fmt.Sprintf("%s_%d%s", username, time.Now().Unix(), ".jpg")
-		avatarPath := filepath.Join("static", "avatars", avatarFileName)
-
-		// 确保头像目录存在
-		err = os.MkdirAll(filepath.Dir(avatarPath), 0755)
+		avatar, err := avatarService.Save(ctx.Request.Context(), file)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像目录创建失败"})
+			status, message := avatarErrorMessage(err)
+			ctx.JSON(status, gin.H{"error": message})
 			return
 		}
+		newUser.Avatar = avatar.Key
+	}
 
-		// 保存头像文件
-		dst, err := os.Create(avatarPath)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像保存失败"})
-			return
+	// 保存到数据库，使用邀请码时在同一事务中扣减次数并加入组织
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newUser).Error; err != nil {
+			return err
 		}
-		defer dst.Close()
-
-		// 复制文件内容
-		_, err = io.Copy(dst, file)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像保存失败"})
+		if invitation == nil {
+			return nil
+		}
+		if err := consumeInvitationCode(tx, invitation); err != nil {
+			return err
+		}
+		return joinPresetOrganization(tx, username, invitation.OrganizationID, invitation.OrgRole)
+	})
+	if err != nil {
+		if err := avatarService.Remove(ctx.Request.Context(), newUser.Avatar); err != nil {
+			fmt.Println("头像文件删除失败:", err)
+		}
+		if err == ErrInvitationCodeInvalid {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
 			return
 		}
-
-		// 更新用户头像路径
-		newUser.Avatar = avatarPath
-	}
-
-	// 保存到数据库
-	result = DB.Create(&newUser)
-	if result.Error != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "用户注册失败"})
 		return
 	}
 
+	auditDetail := gin.H{}
+	if invitation != nil {
+		auditDetail = gin.H{"invite_code_id": invitation.ID, "role": invitation.Role, "organization_id": invitation.OrganizationID}
+	}
+	RecordAudit(ctx, AuditEvent{Action: AuditRegister, Actor: username, Target: username, Outcome: AuditSuccess, Detail: auditDetail})
+
 	ctx.JSON(http.StatusOK, gin.H{"message": "用户注册成功！"})
 }
 
@@ -101,8 +177,10 @@ func RegisterUser(ctx *gin.Context) {
 func LoginUser(ctx *gin.Context) {
 	// 解析JSON请求体
 	var requestData struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		CaptchaID     string `json:"captcha_id"`
+		CaptchaAnswer string `json:"captcha_answer"`
 	}
 
 	if err := ctx.ShouldBindJSON(&requestData); err != nil {
@@ -116,31 +194,177 @@ func LoginUser(ctx *gin.Context) {
 		return
 	}
 
-	// 查询用户
+	// 失败次数过多时要求等待或临时锁定
+	clientIP := ctx.ClientIP()
+	wait, err := loginGuard.Check(requestData.Username, clientIP)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if wait > 0 {
+		auditLoginFailure(ctx, AuditLogin, requestData.Username, "throttled")
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "登录尝试过于频繁，请稍后再试",
+			"retry_after": retryAfter,
+		})
+		return
+	}
+
+	// 失败次数达到阈值后要求图形验证码
+	captchaRequired, err := loginCaptchaRequired(requestData.Username, clientIP)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if captchaRequired {
+		if err := VerifyCaptcha(requestData.CaptchaID, requestData.CaptchaAnswer); err != nil {
+			if err != ErrCaptchaRequired {
+				auditLoginFailure(ctx, AuditLogin, requestData.Username, "bad_captcha")
+			}
+			captchaErrorResponse(ctx, err)
+			return
+		}
+	}
+
+	// 查询用户，用户不存在与密码错误返回相同的错误信息
 	var user models.Users
 	result := DB.Where("username = ?", requestData.Username).First(&user)
+	if result.Error != nil && result.Error != gorm.ErrRecordNotFound {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+
+	// 验证密码，用户不存在时对比占位哈希以保持响应耗时一致
+	passwordHash := user.Password
 	if result.Error == gorm.ErrRecordNotFound {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "用户不存在"})
+		passwordHash = dummyPasswordHash
+	}
+	valid := passwordHasher.Verify(passwordHash, requestData.Password)
+	if result.Error == gorm.ErrRecordNotFound || !valid {
+		if err := loginGuard.RecordFailure(requestData.Username, clientIP); err != nil {
+			fmt.Println("记录登录失败出错:", err)
+		}
+		auditLoginFailure(ctx, AuditLogin, requestData.Username, "bad_credentials")
+		response := gin.H{"error": "用户名或密码错误"}
+		// 提前告知前端下次登录需要图形验证码
+		if required, err := loginCaptchaRequired(requestData.Username, clientIP); err == nil && required {
+			response["captcha_required"] = true
+		}
+		ctx.JSON(http.StatusUnauthorized, response)
 		return
-	} else if result.Error != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+	}
+	// 密码正确时顺便把旧算法或旧参数的哈希升级为当前配置
+	rehashPasswordIfNeeded(user.Username, user.Password, requestData.Password)
+
+	if !loginAllowed(ctx, AuditLogin, &user) {
+		return
+	}
+
+	// 启用了两步验证时先返回挑战令牌，失败计数在第二步通过后才清除
+	if user.TOTPEnabled {
+		response, err := twoFactorChallengeResponse(user.Username)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
+			return
+		}
+		RecordAudit(ctx, AuditEvent{
+			Action:  AuditLogin,
+			Actor:   user.Username,
+			Target:  user.Username,
+			Outcome: AuditSuccess,
+			Detail:  gin.H{"stage": "two_factor_required"},
+		})
+		ctx.JSON(http.StatusOK, response)
 		return
 	}
 
-	// 验证密码
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(requestData.Password))
+	if err := loginGuard.RecordSuccess(user.Username); err != nil {
+		fmt.Println("清除登录失败计数出错:", err)
+	}
+
+	// 登录成功，创建会话并签发访问令牌
+	response, err := loginSuccessResponse(ctx, &user)
 	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "密码错误"})
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "令牌签发失败"})
 		return
 	}
+	RecordAudit(ctx, AuditEvent{
+		Action:  AuditLogin,
+		Actor:   user.Username,
+		Target:  user.Username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"session_id": response["session_id"]},
+	})
+	ctx.JSON(http.StatusOK, response)
+}
+
+// loginAllowed 检查账户是否被禁用或需要先重置密码，返回false表示已写入响应
+func loginAllowed(ctx *gin.Context, action string, user *models.Users) bool {
+	if user.Disabled {
+		auditLoginFailure(ctx, action, user.Username, "disabled")
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "账户已被禁用"})
+		return false
+	}
+	if user.PasswordResetRequired {
+		auditLoginFailure(ctx, action, user.Username, "password_reset_required")
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":                   "请先通过验证码重置密码",
+			"password_reset_required": true,
+		})
+		return false
+	}
+	return true
+}
+
+// auditLoginFailure 记录登录失败，username为请求中提交的用户名
+func auditLoginFailure(ctx *gin.Context, action, username, reason string) {
+	RecordAudit(ctx, AuditEvent{
+		Action:  action,
+		Actor:   username,
+		Target:  username,
+		Outcome: AuditFailure,
+		Detail:  gin.H{"reason": reason},
+	})
+}
+
+// loginSuccessResponse 创建会话并生成登录成功的响应
+func loginSuccessResponse(ctx *gin.Context, user *models.Users) (gin.H, error) {
+	token, session, err := CreateSession(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
 
-	// 登录成功
-	ctx.JSON(http.StatusOK, gin.H{"message": "登录成功"})
+	response := gin.H{
+		"message":      "登录成功",
+		"access_token": token,
+		"token_type":   "Bearer",
+		"session_id":   session.ID,
+		"role":         user.Role,
+		"expires_at":   session.ExpiresAt.Format(time.RFC3339),
+	}
+
+	// 角色要求两步验证但尚未启用时，提示前端引导用户绑定
+	required, err := twoFactorEnrollmentRequired(user)
+	if err != nil {
+		fmt.Println("查询两步验证要求出错:", err)
+	}
+	if required {
+		response["two_factor_enrollment_required"] = true
+	}
+	if user.PasswordChangeRequired {
+		response["password_change_required"] = true
+	}
+	return response, nil
 }
 
 // GetUserInfo 获取用户信息
 func GetUserInfo(ctx *gin.Context) {
-	username := ctx.Param("username")
+	username, ok := resolveUsername(ctx, ctx.Param("username"))
+	if !ok {
+		return
+	}
 
 	// 查询用户
 	var user models.Users
@@ -157,10 +381,7 @@ func GetUserInfo(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{
 		"code":    200,
 		"message": "获取用户信息成功",
-		"data": gin.H{
-			"username": user.Username,
-			"avatar":   user.Avatar,
-		},
+		"data":    userProfileView(&user),
 	})
 }
 
@@ -178,21 +399,26 @@ func ChangePassword(ctx *gin.Context) {
 		return
 	}
 
+	username, ok := resolveUsername(ctx, requestData.Username)
+	if !ok {
+		return
+	}
+
 	// 检查必要字段
-	if requestData.Username == "" || requestData.CurrentPassword == "" || requestData.NewPassword == "" {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "用户名、当前密码和新密码都为必填项"})
+	if requestData.CurrentPassword == "" || requestData.NewPassword == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "当前密码和新密码都为必填项"})
 		return
 	}
 
-	// 验证新密码长度
-	if len(requestData.NewPassword) < 6 {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "新密码长度至少为6位"})
+	// 校验新密码是否符合账户策略
+	if violation := accountPolicy.ValidatePassword(username, requestData.NewPassword); violation != nil {
+		ctx.JSON(http.StatusBadRequest, violation.Response())
 		return
 	}
 
 	// 查询用户
 	var user models.Users
-	result := DB.Where("username = ?", requestData.Username).First(&user)
+	result := DB.Where("username = ?", username).First(&user)
 	if result.Error == gorm.ErrRecordNotFound {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
 		return
@@ -202,91 +428,363 @@ func ChangePassword(ctx *gin.Context) {
 	}
 
 	// 验证当前密码
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(requestData.CurrentPassword))
-	if err != nil {
+	if !passwordHasher.Verify(user.Password, requestData.CurrentPassword) {
+		RecordAudit(ctx, AuditEvent{
+			Action:  AuditPasswordChange,
+			Target:  username,
+			Outcome: AuditFailure,
+			Detail:  gin.H{"reason": "bad_current_password"},
+		})
 		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "当前密码错误"})
 		return
 	}
 
 	// 加密新密码
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(requestData.NewPassword), bcrypt.DefaultCost)
+	hashedPassword, err := passwordHasher.Hash(requestData.NewPassword)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "密码加密失败"})
 		return
 	}
 
 	// 更新密码
-	user.Password = string(hashedPassword)
+	user.Password = hashedPassword
+	user.PasswordChangeRequired = false
 	result = DB.Save(&user)
 	if result.Error != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "密码修改失败"})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "密码修改成功"})
+	// 密码修改后注销该用户的全部会话，需要重新登录
+	if _, err := RevokeUserSessions(username, ""); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "密码已修改，但会话注销失败"})
+		return
+	}
+
+	RecordAudit(ctx, AuditEvent{Action: AuditPasswordChange, Target: username, Outcome: AuditSuccess})
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "密码修改成功，请重新登录"})
 }
 
 // UpdateUserAvatar 更新用户头像
 func UpdateUserAvatar(ctx *gin.Context) {
 	// 从表单数据获取用户名和头像文件
-	username := ctx.PostForm("username")
-	file, header, err := ctx.Request.FormFile("avatar")
+	username, ok := resolveUsername(ctx, ctx.PostForm("username"))
+	if !ok {
+		return
+	}
+	file, _, err := ctx.Request.FormFile("avatar")
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": "头像文件上传失败"})
 		return
 	}
 	defer file.Close()
 
-	// 验证文件类型
-	if header.Header.Get("Content-Type") != "image/jpeg" && header.Header.Get("Content-Type") != "image/png" {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "只允许上传JPEG或PNG格式的图片"})
+	var user models.Users
+	result := DB.Where("username = ?", username).First(&user)
+	if result.Error == gorm.ErrRecordNotFound {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
+		return
+	} else if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
 		return
 	}
 
-	// 生成头像文件名
-	avatarFileName := fmt.Sprintf("%s_%d%s", username, time.Now().Unix(), filepath.Ext(header.Filename))
-	avatarPath := filepath.Join("static", "avatars", avatarFileName)
-
-	// 确保头像目录存在
-	err = os.MkdirAll(filepath.Dir(avatarPath), 0755)
+	// 识别格式、重新编码并生成缩略图
+	avatar, err := avatarService.Save(ctx.Request.Context(), file)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像目录创建失败"})
+		status, message := avatarErrorMessage(err)
+		ctx.JSON(status, gin.H{"error": message})
 		return
 	}
 
-	// 保存头像文件
-	dst, err := os.Create(avatarPath)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像保存失败"})
+	// 更新数据库中的头像路径
+	oldAvatar := user.Avatar
+	if err := DB.Model(&user).Update("avatar", avatar.Key).Error; err != nil {
+		if err := avatarService.Remove(ctx.Request.Context(), avatar.Key); err != nil {
+			fmt.Println("头像文件删除失败:", err)
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像更新失败"})
 		return
 	}
-	defer dst.Close()
 
-	// 复制文件内容
-	_, err = io.Copy(dst, file)
+	// 删除旧头像
+	if oldAvatar != avatar.Key {
+		if err := avatarService.Remove(ctx.Request.Context(), oldAvatar); err != nil {
+			fmt.Println("旧头像文件删除失败:", err)
+		}
+	}
+
+	RecordAudit(ctx, AuditEvent{
+		Action:  AuditAvatarChange,
+		Target:  username,
+		Outcome: AuditSuccess,
+		Detail:  gin.H{"avatar": avatar.Key, "previous": oldAvatar},
+	})
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"message":    "头像更新成功",
+		"avatarUrl":  avatarURL(avatar.Key),
+		"thumbnails": avatarURLs(avatar.Key),
+	})
+}
+
+// AccountDeletionReport 账户删除结果
+type AccountDeletionReport struct {
+	Username              string   `json:"username"`
+	ConversationsDeleted  int      `json:"conversations_deleted"`
+	ConversationsFailed   []string `json:"conversations_failed"`
+	AvatarFilesDeleted    []string `json:"avatar_files_deleted"`
+	AvatarFilesFailed     []string `json:"avatar_files_failed"`
+	SessionsDeleted       int64    `json:"sessions_deleted"`
+	PasswordResetsDeleted int64    `json:"password_resets_deleted"`
+	APIKeysDeleted        int64    `json:"api_keys_deleted"`
+	RecoveryCodesDeleted  int64    `json:"recovery_codes_deleted"`
+	RecordsDeleted        int64    `json:"records_deleted"`
+	ChatMessagesDeleted   int64    `json:"chat_messages_deleted"`
+	OrganizationsLeft     int64    `json:"organizations_left"`
+}
+
+// deleteUserAccount 删除用户的聊天会话、头像文件和数据库记录
+// 会话未能全部删除时不删除账户，便于重试
+func deleteUserAccount(ctx context.Context, user *models.Users) (*AccountDeletionReport, error) {
+	report := &AccountDeletionReport{
+		Username:            user.Username,
+		ConversationsFailed: []string{},
+		AvatarFilesDeleted:  []string{},
+		AvatarFilesFailed:   []string{},
+	}
+
+	// 删除聊天后端中的全部会话
+	conversationIDs, err := chatBackend.ListAllConversationIDs(ctx, user.Username)
+	if err != nil {
+		return report, fmt.Errorf("获取会话列表失败: %w", err)
+	}
+	deleteConversations := func(owner string, ids []string) {
+		for _, conversationID := range ids {
+			err := chatBackend.DeleteConversation(ctx, owner, conversationID)
+			if err != nil && err != ErrConversationNotFound {
+				report.ConversationsFailed = append(report.ConversationsFailed, conversationID)
+				continue
+			}
+			report.ConversationsDeleted++
+		}
+	}
+	deleteConversations(user.Username, conversationIDs)
+
+	// 诊断会话挂在公共诊断用户名下，按记录的发起者删除
+	diagnosisIDs, err := diagnosisConversationIDs(user.Username)
+	if err != nil {
+		return report, fmt.Errorf("获取诊断会话失败: %w", err)
+	}
+	deleteConversations(DiagnosisUsername, diagnosisIDs)
+	if len(report.ConversationsFailed) > 0 {
+		return report, fmt.Errorf("%d 个会话删除失败", len(report.ConversationsFailed))
+	}
+
+	// 删除数据库记录
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("username = ?", user.Username).Delete(&models.Sessions{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.SessionsDeleted = result.RowsAffected
+
+		result = tx.Where("username = ?", user.Username).Delete(&models.PasswordResets{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.PasswordResetsDeleted = result.RowsAffected
+
+		if err := tx.Where("username = ?", user.Username).Delete(&models.DiagnosisMessages{}).Error; err != nil {
+			return err
+		}
+
+		result = tx.Where("username = ?", user.Username).Delete(&models.APIKeys{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.APIKeysDeleted = result.RowsAffected
+
+		result = tx.Where("username = ?", user.Username).Delete(&models.RecoveryCodes{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.RecoveryCodesDeleted = result.RowsAffected
+
+		if err := tx.Where("username = ?", user.Username).Delete(&models.ExternalIdentities{}).Error; err != nil {
+			return err
+		}
+
+		for _, model := range []interface{}{&models.DiagnosisRecords{}, &models.FieldRecords{}} {
+			result = tx.Where("username = ?", user.Username).Delete(model)
+			if result.Error != nil {
+				return result.Error
+			}
+			report.RecordsDeleted += result.RowsAffected
+		}
+
+		result = tx.Where("username = ?", user.Username).Delete(&models.ChatMessages{})
+		if result.Error != nil {
+			return result.Error
+		}
+		report.ChatMessagesDeleted = result.RowsAffected
+		for _, model := range []interface{}{&models.ChatConversations{}, &models.ChatSyncStates{}} {
+			if err := tx.Where("username = ?", user.Username).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		// 诊断会话保存在公共诊断用户名下
+		for _, conversationID := range diagnosisIDs {
+			if _, err := deleteStoredConversation(tx, DiagnosisUsername, conversationID); err != nil {
+				return err
+			}
+		}
+
+		left, err := leaveAllOrganizations(tx, user.Username)
+		if err != nil {
+			return err
+		}
+		report.OrganizationsLeft = left
+		if err := tx.Where("owner = ?", user.Username).Delete(&models.SharedResources{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(user).Error
+	})
+	if err != nil {
+		return report, fmt.Errorf("删除用户记录失败: %w", err)
+	}
+
+	if err := loginGuard.RecordSuccess(user.Username); err != nil {
+		fmt.Println("清除登录失败计数出错:", err)
+	}
+
+	// 删除当前头像及缩略图，其他用户仍在使用同一文件时保留
+	if key := avatarKey(user.Avatar); key != "" {
+		if err := avatarService.Remove(ctx, user.Avatar); err != nil {
+			report.AvatarFilesFailed = append(report.AvatarFilesFailed, key)
+		} else {
+			report.AvatarFilesDeleted = append(report.AvatarFilesDeleted, key)
+		}
+	}
+
+	// 删除旧版本遗留的头像文件
+	legacyKeys, err := listLegacyAvatarKeys(ctx, user.Username)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像保存失败"})
+		fmt.Println("读取头像文件列表失败:", err)
+	}
+	for _, key := range legacyKeys {
+		if key == avatarKey(user.Avatar) {
+			continue
+		}
+		if err := blobStore.Delete(ctx, key); err != nil {
+			report.AvatarFilesFailed = append(report.AvatarFilesFailed, key)
+			continue
+		}
+		report.AvatarFilesDeleted = append(report.AvatarFilesDeleted, key)
+	}
+
+	return report, nil
+}
+
+// accountDeletionRequest 注销账户时的身份验证，任选一种
+// 第三方账号没有本地密码，可以使用两步验证码或重新登录第三方账号得到的凭证
+type accountDeletionRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	ReauthToken  string `json:"reauth_token"`
+}
+
+// verifyAccountDeletion 校验注销账户时提交的凭证，验证失败时返回原因
+func verifyAccountDeletion(user *models.Users, req *accountDeletionRequest) (string, error) {
+	switch {
+	case req.ReauthToken != "":
+		username, err := parseOIDCReauthToken(req.ReauthToken)
+		if err != nil || username != user.Username {
+			return "bad_reauth_token", nil
+		}
+	case req.Password != "":
+		if user.Password == "" || !passwordHasher.Verify(user.Password, req.Password) {
+			return "bad_password", nil
+		}
+	case req.Code != "" || req.RecoveryCode != "":
+		if !user.TOTPEnabled {
+			return "two_factor_disabled", nil
+		}
+		ok, err := verifySecondFactor(user, req.Code, req.RecoveryCode)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "bad_two_factor_code", nil
+		}
+	}
+	return "", nil
+}
+
+// DeleteAccount 用户注销自己的账户，需要再次验证密码、两步验证码或第三方登录
+func DeleteAccount(ctx *gin.Context) {
+	var requestData accountDeletionRequest
+
+	if err := ctx.ShouldBindJSON(&requestData); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "请求数据格式错误"})
 		return
 	}
 
-	// 更新数据库中的头像路径
+	if requestData.Password == "" && requestData.Code == "" && requestData.RecoveryCode == "" && requestData.ReauthToken == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "请提供密码、两步验证码或第三方登录验证凭证"})
+		return
+	}
+
+	username := CurrentIdentity(ctx).Username
+
 	var user models.Users
 	result := DB.Where("username = ?", username).First(&user)
-	if result.Error != nil {
+	if result.Error == gorm.ErrRecordNotFound {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": "用户不存在"})
 		return
+	} else if result.Error != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
 	}
 
-	user.Avatar = avatarPath
-	result = DB.Save(&user)
-	if result.Error != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "头像更新失败"})
+	// 验证身份
+	reason, err := verifyAccountDeletion(&user, &requestData)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "数据库查询出错"})
+		return
+	}
+	if reason != "" {
+		RecordAudit(ctx, AuditEvent{
+			Action:  AuditAccountDelete,
+			Target:  username,
+			Outcome: AuditFailure,
+			Detail:  gin.H{"reason": reason},
+		})
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "身份验证失败"})
+		return
+	}
+
+	report, err := deleteUserAccount(ctx.Request.Context(), &user)
+	RecordAudit(ctx, AuditEvent{
+		Action:  AuditAccountDelete,
+		Target:  username,
+		Outcome: auditResult(err),
+		Detail:  gin.H{"report": report},
+	})
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{
+			"error":  fmt.Sprintf("账户删除失败: %v", err),
+			"report": report,
+		})
 		return
 	}
 
 	ctx.JSON(http.StatusOK, gin.H{
-		"message":   "头像更新成功",
-		"avatarUrl": "/" + avatarPath,
+		"message": "账户已删除",
+		"report":  report,
 	})
 }
 
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"server-env.com/server/models"
+)
+
+// fakeDifyConversations 模拟Dify中各用户的会话，列表每页返回两个会话
+type fakeDifyConversations struct {
+	mu    sync.Mutex
+	users map[string][]string
+	// 删除时返回错误的会话
+	failing map[string]bool
+}
+
+func (f *fakeDifyConversations) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conversations", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		ids := f.users[r.URL.Query().Get("user")]
+		start := 0
+		if lastID := r.URL.Query().Get("last_id"); lastID != "" {
+			start = slices.Index(ids, lastID) + 1
+		}
+		end := min(start+2, len(ids))
+		data := []map[string]string{}
+		for _, id := range ids[start:end] {
+			data = append(data, map[string]string{"id": id})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data, "has_more": end < len(ids)})
+	})
+	mux.HandleFunc("DELETE /conversations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			User string `json:"user"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		id := r.PathValue("id")
+		if f.failing[id] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		index := slices.Index(f.users[body.User], id)
+		if index < 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.users[body.User] = slices.Delete(f.users[body.User], index, index+1)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// setupAvatarDir 使用临时目录作为文件存储并创建头像文件，返回头像目录
+func setupAvatarDir(t *testing.T, names ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	previous := blobStore
+	blobStore = &LocalBlobStore{Root: root}
+	t.Cleanup(func() { blobStore = previous })
+	dir := filepath.Join(root, "avatars")
+	os.MkdirAll(dir, 0755)
+	for _, name := range names {
+		os.WriteFile(filepath.Join(dir, name), []byte("avatar"), 0644)
+	}
+	return dir
+}
+
+func TestDeleteAccount(t *testing.T) {
+	setupTestDB(t)
+	dify := &fakeDifyConversations{users: map[string][]string{
+		"kate":            {"k1", "k2", "k3"},
+		"kate_2":          {"o1"},
+		DiagnosisUsername: {"d1", "d2"},
+	}}
+	setupDifyServer(t, dify.handler())
+	avatarDir := setupAvatarDir(t, "kate_1.png", "kate_2.jpg", "kate_2_3.png")
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "kate", Avatar: "static/avatars/kate_2.jpg"}, "Kate-Passw0rd")
+	createTestUser(t, models.Users{Username: "kate_2"}, "Kate2-Passw0rd")
+	DB.Create(&models.DiagnosisMessages{ID: "m1", ConversationID: "d1", Username: "kate"})
+	DB.Create(&models.DiagnosisMessages{ID: "m2", ConversationID: "d1", Username: "kate"})
+	DB.Create(&models.DiagnosisMessages{ID: "m3", ConversationID: "d2", Username: "kate_2"})
+	token := testAccessToken(t, "kate")
+
+	w := performRequest(router, http.MethodDelete, "/api/user/account", `{"password":"wrong"}`, bearer(token))
+	if w.Code != http.StatusUnauthorized || len(dify.users["kate"]) != 3 {
+		t.Fatalf("密码错误时不应删除任何数据，实际 %d %s", w.Code, w.Body.String())
+	}
+
+	w = performRequest(router, http.MethodDelete, "/api/user/account", `{"password":"Kate-Passw0rd"}`, bearer(token))
+	if w.Code != http.StatusOK {
+		t.Fatalf("注销账户失败: %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Report AccountDeletionReport `json:"report"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Report.ConversationsDeleted != 4 || resp.Report.SessionsDeleted != 1 || len(resp.Report.AvatarFilesDeleted) != 2 {
+		t.Fatalf("删除结果错误: %+v", resp.Report)
+	}
+
+	// 分页取到的全部会话和本人发起的诊断会话都被删除，其他用户的不受影响
+	if len(dify.users["kate"]) != 0 || !slices.Equal(dify.users[DiagnosisUsername], []string{"d2"}) || len(dify.users["kate_2"]) != 1 {
+		t.Fatalf("Dify会话删除错误: %v", dify.users)
+	}
+	var count int64
+	DB.Model(&models.Users{}).Where("username = ?", "kate").Count(&count)
+	if count != 0 {
+		t.Fatal("用户记录应被删除")
+	}
+	DB.Model(&models.DiagnosisMessages{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("只应删除本人的诊断记录，剩余 %d", count)
+	}
+	for name, exists := range map[string]bool{"kate_1.png": false, "kate_2.jpg": false, "kate_2_3.png": true} {
+		if _, err := os.Stat(filepath.Join(avatarDir, name)); (err == nil) != exists {
+			t.Errorf("头像 %s 应存在: %v", name, exists)
+		}
+	}
+
+	// 账户删除后令牌失效
+	if w := performRequest(router, http.MethodGet, "/api/user/info/kate", "", bearer(token)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("账户删除后令牌应失效，实际 %d", w.Code)
+	}
+}
+
+func TestDeleteAccountKeepsUserWhenConversationDeletionFails(t *testing.T) {
+	setupTestDB(t)
+	dify := &fakeDifyConversations{
+		users:   map[string][]string{"leo": {"l1", "l2"}},
+		failing: map[string]bool{"l2": true},
+	}
+	setupDifyServer(t, dify.handler())
+	setupAvatarDir(t)
+	router := newTestRouter()
+	createTestUser(t, models.Users{Username: "leo"}, "Leo-Passw0rd")
+
+	w := performRequest(router, http.MethodDelete, "/api/user/account", `{"password":"Leo-Passw0rd"}`, bearer(testAccessToken(t, "leo")))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("会话删除失败时应返回502，实际 %d %s", w.Code, w.Body.String())
+	}
+	var count int64
+	DB.Model(&models.Users{}).Where("username = ?", "leo").Count(&count)
+	if count != 1 {
+		t.Fatal("会话未能全部删除时应保留账户以便重试")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 
 	"github.com/gin-gonic/gin"
+	"server-env.com/server/models"
 )
 
 // 高德地图API密钥
@@ -102,6 +103,18 @@ func GetWeather(c *gin.Context) {
 	cityAdcode := c.Query("city")                      // 城市编码
 	extensions := c.DefaultQuery("extensions", "base") // 默认实时天气
 
+	// 未指定城市时使用用户资料中的常住地区
+	if cityAdcode == "" {
+		var user models.Users
+		if DB.Select("region_adcode").Where("username = ?", CurrentIdentity(c).Username).First(&user).Error == nil {
+			cityAdcode = user.RegionAdcode
+		}
+	}
+	if cityAdcode == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请指定城市编码或在个人资料中设置常住地区"})
+		return
+	}
+
 	url := "https://restapi.amap.com/v3/weather/weatherInfo?key=" + AMapKey +
 		"&city=" + cityAdcode + "&extensions=" + extensions
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"server-env.com/server/models"
 )
 
 var (
@@ -50,6 +52,31 @@ func main() {
 	}
 	fmt.Println("Database connected successfully")
 
+	// 初始化文件存储
+	blobStore, err = NewBlobStoreFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to initialize blob store: %v", err))
+	}
+	migrated, err := migrateLegacyAvatars(context.Background(), blobStore, AVATAR_LEGACY_DIR)
+	if err != nil {
+		fmt.Println("迁移旧头像文件出错:", err)
+	}
+	if migrated > 0 {
+		fmt.Printf("已迁移 %d 个旧头像文件到文件存储\n", migrated)
+	}
+
+	notifiers = NewNotifiersFromEnv()
+
+	chatBackend, err = NewChatBackendFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to initialize chat backend: %v", err))
+	}
+
+	// 初始化管理员账号
+	if err := EnsureBootstrapAdmins(); err != nil {
+		panic(fmt.Sprintf("Failed to bootstrap admin users: %v", err))
+	}
+
 	setupRoutes(router)
 	fmt.Println("Server starting on :8080")
 	router.Run(":8080")
@@ -57,12 +84,18 @@ func main() {
 
 // setupRoutes 设置路由
 func setupRoutes(router *gin.Engine) {
-	// 用户控制接口
+	// 用户控制接口（无需登录）
 	router.POST("/api/user/register", RegisterUser)
 	router.POST("/api/user/login", LoginUser)
-	router.GET("/api/user/info/:username", GetUserInfo)
-	router.POST("/api/user/change-password", ChangePassword)
-	router.POST("/api/user/update-avatar", UpdateUserAvatar)
+	router.POST("/api/user/login/2fa", LoginTwoFactor)
+	router.POST("/api/user/password-reset/request", RequestPasswordReset)
+	router.POST("/api/user/password-reset/confirm", ConfirmPasswordReset)
+	router.POST("/api/user/activate", ActivateAccount)
+	router.GET("/api/captcha", NewCaptcha)
+	router.GET("/api/user/invitation-codes/check", CheckInvitationCode)
+	router.GET("/api/user/oidc/login", OIDCLogin)
+	router.GET("/api/user/oidc/callback", OIDCCallback)
+	router.POST("/api/user/oidc/link", OIDCLink)
 
 	// 静态文件服务接口
 	router.GET("/auth/login", ServeLogin)
@@ -70,15 +103,116 @@ func setupRoutes(router *gin.Engine) {
 	router.GET("/auth/register", ServeRegister)
 	router.GET("/auth/register.txt", ServeRegisterTxt)
 
+	// 以下接口均需要携带访问令牌
+	api := router.Group("/api", AuthRequired())
+
+	// 用户控制接口
+	api.GET("/user/info/:username", GetUserInfo)
+	api.PATCH("/user/profile", UpdateProfile)
+	api.POST("/user/change-password", ChangePassword)
+	api.POST("/user/update-avatar", UpdateUserAvatar)
+	api.POST("/user/logout", Logout)
+	api.DELETE("/user/account", DeleteAccount)
+
+	// 登录会话管理接口
+	api.GET("/user/sessions", ListSessions)
+	api.DELETE("/user/sessions/:session_id", RevokeSession)
+	api.POST("/user/sessions/revoke-others", RevokeOtherSessions)
+
+	// API Key管理接口
+	api.GET("/user/api-keys", ListAPIKeys)
+	api.POST("/user/api-keys", CreateAPIKey)
+	api.DELETE("/user/api-keys/:key_id", RevokeAPIKey)
+
+	// 两步验证接口
+	api.GET("/user/2fa/status", GetTwoFactorStatus)
+	api.POST("/user/2fa/enroll", EnrollTwoFactor)
+	api.POST("/user/2fa/confirm", ConfirmTwoFactor)
+	api.POST("/user/2fa/disable", DisableTwoFactor)
+	api.POST("/user/2fa/recovery-codes", RegenerateRecoveryCodes)
+
+	// 诊断记录和地块数据接口
+	api.GET("/records/diagnosis", ListDiagnosisRecords)
+	api.POST("/records/diagnosis", CreateDiagnosisRecord)
+	api.GET("/records/diagnosis/:record_id", GetDiagnosisRecord)
+	api.DELETE("/records/diagnosis/:record_id", DeleteDiagnosisRecord)
+	api.GET("/records/fields", ListFieldRecords)
+	api.POST("/records/fields", CreateFieldRecord)
+	api.GET("/records/fields/:record_id", GetFieldRecord)
+	api.PATCH("/records/fields/:record_id", UpdateFieldRecord)
+	api.DELETE("/records/fields/:record_id", DeleteFieldRecord)
+
+	// 组织(合作社)接口，组织由合作社管理员、专家或系统管理员创建，其他用户通过邀请加入
+	api.GET("/user/invitations", ListMyInvitations)
+	api.POST("/user/invitations/:invitation_id/accept", AcceptInvitation)
+	api.POST("/user/invitations/:invitation_id/decline", DeclineInvitation)
+	// 邀请码和批量导入接口，合作社管理员只能为自己管理的组织邀请农户
+	inviterGroup := api.Group("", RequireRoles(models.RoleManager, models.RoleAdmin))
+	{
+		inviterGroup.GET("/invitation-codes", ListInvitationCodes)
+		inviterGroup.POST("/invitation-codes", CreateInvitationCode)
+		inviterGroup.DELETE("/invitation-codes/:code_id", RevokeInvitationCode)
+		inviterGroup.POST("/users/import", ImportUsers)
+	}
+
+	api.GET("/orgs", ListOrganizations)
+	api.POST("/orgs", RequireRoles(models.RoleManager, models.RoleExpert, models.RoleAdmin), CreateOrganization)
+	orgGroup := api.Group("/orgs/:org_id")
+	{
+		orgGroup.GET("", GetOrganization)
+		orgGroup.PATCH("", UpdateOrganization)
+		orgGroup.DELETE("", DeleteOrganization)
+		orgGroup.GET("/invitations", ListOrganizationInvitations)
+		orgGroup.POST("/invitations", InviteMember)
+		orgGroup.DELETE("/invitations/:invitation_id", RevokeInvitation)
+		orgGroup.PUT("/members/:username/role", SetMemberRole)
+		orgGroup.DELETE("/members/:username", RemoveMember)
+		orgGroup.GET("/members/:username/records/:resource_type", ListMemberResources)
+		orgGroup.GET("/members/:username/records/:resource_type/:resource_id", GetMemberResource)
+		orgGroup.PUT("/sharing", UpdateMySharing)
+		orgGroup.GET("/shared", ListSharedResources)
+		orgGroup.POST("/shared", ShareResource)
+		orgGroup.GET("/shared/:share_id", GetSharedResource)
+		orgGroup.DELETE("/shared/:share_id", UnshareResource)
+	}
+
+	// 专家接口
+	expertGroup := api.Group("/expert", RequireRoles(models.RoleExpert, models.RoleAdmin))
+	{
+		expertGroup.GET("/users/:username", GetFarmerInfo)
+	}
+
+	// 管理员接口
+	adminGroup := api.Group("/admin", AuditAdminActions(), RequireRoles(models.RoleAdmin))
+	{
+		adminGroup.GET("/users", AdminListUsers)
+		adminGroup.GET("/users/:username", AdminGetUser)
+		adminGroup.DELETE("/users/:username", AdminDeleteUser)
+		adminGroup.PUT("/users/:username/role", SetUserRole)
+		adminGroup.POST("/users/:username/disable", AdminDisableUser)
+		adminGroup.POST("/users/:username/enable", AdminEnableUser)
+		adminGroup.POST("/users/:username/force-password-reset", AdminForcePasswordReset)
+		adminGroup.DELETE("/users/:username/avatar", AdminClearAvatar)
+		adminGroup.GET("/security/two-factor-roles", GetTwoFactorRoles)
+		adminGroup.PUT("/security/two-factor-roles", SetTwoFactorRoles)
+		adminGroup.GET("/audit-logs", ListAuditLogs)
+		adminGroup.GET("/audit-logs/export", ExportAuditLogs)
+	}
+
+	// 以下接口同时接受访问令牌和API Key，API Key需要对应的权限范围
+	keyed := router.Group("/api", AuthRequiredOrAPIKey())
+
 	// 聊天接口
-	router.POST("/api/chat", Chat)
-	router.GET("/api/chat/next_suggest/:message_id", GetNextProblemSuggestion)
-	router.GET("/api/conversations/list/:username", ListConversations)
-	router.GET("/api/conversations/:conversation_id/history", GetChatHistory)
-	router.DELETE("/api/conversations/:conversation_id/delete", DeleteConversation)
-	router.POST("/api/file/upload", UploadFiles)
-
-	geoGroup := router.Group("/api/geo")
+	keyed.POST("/chat", RequireScope(ScopeChat, ScopeDiagnosis), Chat)
+	keyed.POST("/chat/:task_id/stop", RequireScope(ScopeChat, ScopeDiagnosis), StopChat)
+	keyed.GET("/chat/next_suggest/:message_id", RequireScope(ScopeChat, ScopeDiagnosis), GetNextProblemSuggestion)
+	keyed.GET("/conversations/list/:username", RequireScope(ScopeChat), ListConversations)
+	keyed.GET("/conversations/search", RequireScope(ScopeChat), SearchChatHistory)
+	keyed.GET("/conversations/:conversation_id/history", RequireScope(ScopeChat), GetChatHistory)
+	keyed.DELETE("/conversations/:conversation_id/delete", RequireScope(ScopeChat), DeleteConversation)
+	keyed.POST("/file/upload", RequireScope(ScopeUpload), UploadFiles)
+
+	geoGroup := keyed.Group("/geo", RequireScope(ScopeWeather))
 	{
 		geoGroup.GET("/location", GetIPLocation)
 		geoGroup.GET("/weather", GetWeather)
@@ -87,18 +221,14 @@ func setupRoutes(router *gin.Engine) {
 	// 静态文件服务
 	router.Static("/_next", filepath.Join(frontendStaticOutDir, "_next"))
 	router.Static("/images", filepath.Join(frontendStaticOutDir, "images"))
-	router.Static("/static/avatars", filepath.Join(staticDir, "avatars"))
 
 	// 主页和图标
 	router.GET("/", func(c *gin.Context) {
 		c.File(filepath.Join(frontendStaticOutDir, "index.html"))
 	})
 
-	// 用户头像
-	router.GET("/avatars/*filepath", func(c *gin.Context) {
-		filePath := c.Param("filepath")
-		c.File(filepath.Join("static/avatars", filePath))
-	})
+	// 头像和上传的图片，通过文件存储读取
+	router.GET(blobRoutePrefix+"*key", ServeBlob)
 
 	// 诊断页
 	router.GET("/diagnosis", func(c *gin.Context) {
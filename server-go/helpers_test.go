@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"server-env.com/server/models"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// setupTestDB 用临时SQLite数据库替换全局DB和登录失败计数，测试结束后恢复
+// chat_messages的全文索引是MySQL特有的，改用不带索引的建表语句
+func setupTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+
+	tables := []interface{}{}
+	for _, model := range databaseModels {
+		if _, ok := model.(*models.ChatMessages); !ok {
+			tables = append(tables, model)
+		}
+	}
+	if err := db.AutoMigrate(tables...); err != nil {
+		t.Fatalf("迁移测试数据库失败: %v", err)
+	}
+	err = db.Exec(`CREATE TABLE chat_messages (
+		id varchar(64) PRIMARY KEY,
+		conversation_id varchar(64) NOT NULL,
+		username varchar(50) NOT NULL,
+		task_id varchar(64),
+		query text,
+		answer text,
+		files text,
+		stopped numeric NOT NULL DEFAULT false,
+		prompt_tokens integer NOT NULL DEFAULT 0,
+		completion_tokens integer NOT NULL DEFAULT 0,
+		total_tokens integer NOT NULL DEFAULT 0,
+		created_at datetime
+	)`).Error
+	if err != nil {
+		t.Fatalf("创建chat_messages失败: %v", err)
+	}
+
+	// 登录失败计数保存在全局变量中，每个测试使用新的计数
+	previous, previousGuard := DB, loginGuard
+	DB = db
+	loginGuard = NewLoginGuard(NewMemoryLoginAttemptStore())
+	t.Cleanup(func() {
+		DB = previous
+		loginGuard = previousGuard
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// createTestUser 创建使用给定密码的测试用户，password为空时不设置本地密码
+func createTestUser(t *testing.T, user models.Users, password string) *models.Users {
+	t.Helper()
+	if password != "" {
+		hash, err := passwordHasher.Hash(password)
+		if err != nil {
+			t.Fatalf("密码加密失败: %v", err)
+		}
+		user.Password = hash
+	}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatalf("创建测试用户失败: %v", err)
+	}
+	return &user
+}
+
+// createTestCaptcha 保存一个答案已知的图形验证码
+func createTestCaptcha(t *testing.T, id, answer string) {
+	t.Helper()
+	err := captchaStore.Save(id, CaptchaChallenge{
+		AnswerHash: hashCaptchaAnswer(id, answer),
+		ExpiresAt:  time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("保存验证码失败: %v", err)
+	}
+}
+
+// testAccessToken 为用户创建会话并返回访问令牌
+func testAccessToken(t *testing.T, username string) string {
+	t.Helper()
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	token, _, err := CreateSession(c, username)
+	if err != nil {
+		t.Fatalf("创建会话失败: %v", err)
+	}
+	return token
+}
+
+// newTestRouter 创建注册了全部接口的路由
+func newTestRouter() *gin.Engine {
+	router := gin.New()
+	setupRoutes(router)
+	return router
+}
+
+// performRequest 向路由发送请求并返回响应
+func performRequest(router http.Handler, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
@@ -1,14 +1,61 @@
 package models
 
 import (
+	"errors"
+	"strings"
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// 用户角色
+const (
+	RoleFarmer  = "farmer"  // 普通农户
+	RoleExpert  = "expert"  // 农技专家
+	RoleManager = "manager" // 合作社管理员
+	RoleAdmin   = "admin"   // 系统管理员
+)
+
+// Roles 所有合法的用户角色
+var Roles = []string{RoleFarmer, RoleExpert, RoleManager, RoleAdmin}
+
+// 用户资料的默认语言和时区
+const (
+	DefaultLanguage = "zh-CN"
+	DefaultTimezone = "Asia/Shanghai"
+)
+
 // Users 用户模型
 type Users struct {
 	Username string `gorm:"primaryKey;type:varchar(50);index" json:"username"`
-	Password string `gorm:"type:varchar(255);not null" json:"password"`
+	// Password 为密码哈希，任何情况下都不参与JSON序列化
+	Password string `gorm:"type:varchar(255);not null" json:"-"`
 	Avatar   string `gorm:"type:varchar(255)" json:"avatar"`
+	Phone    string `gorm:"type:varchar(20)" json:"phone"`
+	Email    string `gorm:"type:varchar(100)" json:"email"`
+	Role     string `gorm:"type:varchar(20);not null;default:farmer;index" json:"role"`
+	// 农户资料
+	DisplayName string `gorm:"type:varchar(50)" json:"display_name"`
+	// RegionAdcode 常住地区的高德行政区划编码，天气查询默认使用该地区
+	RegionAdcode string `gorm:"type:varchar(6);index" json:"region_adcode"`
+	// CropVarieties 主要种植品种，逗号分隔
+	CropVarieties string `gorm:"type:varchar(500)" json:"crop_varieties"`
+	// FarmSize 种植面积，单位为亩
+	FarmSize float64 `gorm:"not null;default:0" json:"farm_size"`
+	Language string  `gorm:"type:varchar(10);not null;default:zh-CN" json:"language"`
+	Timezone string  `gorm:"type:varchar(50);not null;default:Asia/Shanghai" json:"timezone"`
+	// Disabled 为true时禁止登录，已有会话立即失效
+	Disabled bool `gorm:"not null;default:false" json:"disabled"`
+	// PasswordResetRequired 为true时必须通过验证码重置密码后才能登录
+	PasswordResetRequired bool `gorm:"not null;default:false" json:"password_reset_required"`
+	// PasswordChangeRequired 为true时登录后必须先修改密码，批量导入的账户使用初始密码时设置
+	PasswordChangeRequired bool `gorm:"not null;default:false" json:"password_change_required"`
+	// TOTP两步验证，TOTPSecret在确认启用前为待确认状态
+	TOTPSecret   string    `gorm:"column:totp_secret;type:varchar(64)" json:"-"`
+	TOTPEnabled  bool      `gorm:"column:totp_enabled;not null;default:false" json:"totp_enabled"`
+	TOTPLastStep int64     `gorm:"column:totp_last_step;not null;default:0" json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 // TableName 指定表名
@@ -16,7 +63,415 @@ func (Users) TableName() string {
 	return "users"
 }
 
+// CropVarietyList 返回种植品种列表
+func (u *Users) CropVarietyList() []string {
+	if u.CropVarieties == "" {
+		return []string{}
+	}
+	return strings.Split(u.CropVarieties, ",")
+}
+
 // BeforeCreate 在创建用户前执行的Hook
 func (u *Users) BeforeCreate(tx *gorm.DB) error {
+	if u.Role == "" {
+		u.Role = RoleFarmer
+	}
+	if u.Language == "" {
+		u.Language = DefaultLanguage
+	}
+	if u.Timezone == "" {
+		u.Timezone = DefaultTimezone
+	}
 	return nil
 }
+
+// DiagnosisMessages 诊断消息的发起者
+// 诊断会话都挂在公共诊断用户名下，按发起者区分会话归属
+type DiagnosisMessages struct {
+	ID             string    `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	ConversationID string    `gorm:"type:varchar(64);not null;index" json:"conversation_id"`
+	Username       string    `gorm:"type:varchar(50);not null;index" json:"username"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// TableName 指定表名
+func (DiagnosisMessages) TableName() string {
+	return "diagnosis_messages"
+}
+
+// Sessions 登录会话模型，每次登录成功记录一条
+type Sessions struct {
+	ID         string     `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	Username   string     `gorm:"type:varchar(50);not null;index" json:"username"`
+	UserAgent  string     `gorm:"type:varchar(255)" json:"user_agent"`
+	IP         string     `gorm:"type:varchar(64)" json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"index" json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// TableName 指定表名
+func (Sessions) TableName() string {
+	return "sessions"
+}
+
+// LoginAttempts 登录失败计数模型，Key为 "user:用户名" 或 "ip:地址"
+type LoginAttempts struct {
+	Key           string    `gorm:"primaryKey;type:varchar(191)" json:"key"`
+	Failures      int       `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+// TableName 指定表名
+func (LoginAttempts) TableName() string {
+	return "login_attempts"
+}
+
+// CaptchaChallenges 图形验证码模型，只保存答案的哈希，校验一次后删除
+type CaptchaChallenges struct {
+	ID         string    `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	AnswerHash string    `gorm:"type:varchar(64);not null" json:"-"`
+	ExpiresAt  time.Time `gorm:"index" json:"expires_at"`
+}
+
+// TableName 指定表名
+func (CaptchaChallenges) TableName() string {
+	return "captcha_challenges"
+}
+
+// PasswordResets 密码重置验证码模型，只保存验证码的哈希
+type PasswordResets struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Username  string     `gorm:"type:varchar(50);not null;index" json:"username"`
+	Channel   string     `gorm:"type:varchar(20)" json:"channel"`
+	CodeSalt  string     `gorm:"type:varchar(32);not null" json:"-"`
+	CodeHash  string     `gorm:"type:varchar(64);not null" json:"-"`
+	Attempts  int        `gorm:"not null;default:0" json:"attempts"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// TableName 指定表名
+func (PasswordResets) TableName() string {
+	return "password_resets"
+}
+
+// ExternalIdentities 外部身份提供方(OIDC)账号与本地用户的关联
+type ExternalIdentities struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Provider  string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_provider_subject" json:"provider"`
+	Subject   string    `gorm:"type:varchar(191);not null;uniqueIndex:idx_provider_subject" json:"subject"`
+	Username  string    `gorm:"type:varchar(50);not null;index" json:"username"`
+	Email     string    `gorm:"type:varchar(100)" json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName 指定表名
+func (ExternalIdentities) TableName() string {
+	return "external_identities"
+}
+
+// APIKeys 程序化客户端使用的API Key，只保存Key的哈希
+type APIKeys struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	Username string `gorm:"type:varchar(50);not null;index" json:"username"`
+	Name     string `gorm:"type:varchar(50);not null" json:"name"`
+	// Prefix 是Key的公开前缀，用于在列表中辨认
+	Prefix  string `gorm:"type:varchar(20);not null" json:"prefix"`
+	KeyHash string `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	// Scopes 逗号分隔的权限范围
+	Scopes     string     `gorm:"type:varchar(255);not null" json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TableName 指定表名
+func (APIKeys) TableName() string {
+	return "api_keys"
+}
+
+// ScopeList 返回权限范围列表
+func (k *APIKeys) ScopeList() []string {
+	if k.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// RecoveryCodes 两步验证的一次性恢复码，只保存哈希
+type RecoveryCodes struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	Username  string     `gorm:"type:varchar(50);not null;index" json:"username"`
+	CodeHash  string     `gorm:"type:varchar(64);not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TableName 指定表名
+func (RecoveryCodes) TableName() string {
+	return "recovery_codes"
+}
+
+// Settings 管理员可修改的系统设置，键值对形式保存
+type Settings struct {
+	Key       string    `gorm:"primaryKey;type:varchar(100)" json:"key"`
+	Value     string    `gorm:"type:text" json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UpdatedBy string    `gorm:"type:varchar(50)" json:"updated_by"`
+}
+
+// TableName 指定表名
+func (Settings) TableName() string {
+	return "settings"
+}
+
+// ErrAuditLogImmutable 审计日志只允许追加
+var ErrAuditLogImmutable = errors.New("审计日志不允许修改或删除")
+
+// AuditLogs 安全审计日志，只追加不修改
+type AuditLogs struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	Action string `gorm:"type:varchar(100);not null;index" json:"action"`
+	// Actor 执行操作的用户，登录失败时为尝试登录的用户名
+	Actor     string `gorm:"type:varchar(50);index" json:"actor"`
+	Target    string `gorm:"type:varchar(255);index" json:"target"`
+	IP        string `gorm:"type:varchar(64)" json:"ip"`
+	UserAgent string `gorm:"type:varchar(255)" json:"user_agent"`
+	// Outcome 为 success 或 failure
+	Outcome string `gorm:"type:varchar(20);not null;index" json:"outcome"`
+	// Detail 补充信息，JSON格式
+	Detail    string    `gorm:"type:text" json:"detail"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// TableName 指定表名
+func (AuditLogs) TableName() string {
+	return "audit_logs"
+}
+
+// BeforeUpdate 禁止通过ORM修改审计日志
+func (AuditLogs) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditLogImmutable
+}
+
+// BeforeDelete 禁止通过ORM删除审计日志
+func (AuditLogs) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditLogImmutable
+}
+
+// 组织(合作社)内的成员角色
+const (
+	OrgRoleOwner  = "owner"  // 创建者，可删除组织
+	OrgRoleAdmin  = "admin"  // 管理成员和邀请
+	OrgRoleAgent  = "agent"  // 农技员，可查看开启全部共享的成员记录
+	OrgRoleMember = "member" // 普通成员
+)
+
+// OrgRoles 所有合法的组织成员角色
+var OrgRoles = []string{OrgRoleOwner, OrgRoleAdmin, OrgRoleAgent, OrgRoleMember}
+
+// 可在组织内共享的资源类型
+const (
+	ResourceConversation = "conversation" // Dify中的对话
+	ResourceDiagnosis    = "diagnosis"    // 病害诊断记录
+	ResourceField        = "field"        // 地块数据
+)
+
+// ResourceTypes 所有可共享的资源类型
+var ResourceTypes = []string{ResourceConversation, ResourceDiagnosis, ResourceField}
+
+// Organizations 组织，如合作社、农技站
+type Organizations struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Name        string    `gorm:"type:varchar(100);not null" json:"name"`
+	Description string    `gorm:"type:varchar(500)" json:"description"`
+	CreatedBy   string    `gorm:"type:varchar(50);not null" json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// TableName 指定表名
+func (Organizations) TableName() string {
+	return "organizations"
+}
+
+// OrganizationMembers 组织成员及其在组织内的角色
+type OrganizationMembers struct {
+	ID             uint   `gorm:"primaryKey" json:"id"`
+	OrganizationID uint   `gorm:"not null;uniqueIndex:idx_org_member" json:"organization_id"`
+	Username       string `gorm:"type:varchar(50);not null;uniqueIndex:idx_org_member;index" json:"username"`
+	Role           string `gorm:"type:varchar(20);not null;default:member" json:"role"`
+	// ShareAll 为true时组织的管理员和农技员可查看该成员的全部对话和记录
+	ShareAll  bool      `gorm:"not null;default:false" json:"share_all"`
+	CreatedAt time.Time `json:"joined_at"`
+}
+
+// TableName 指定表名
+func (OrganizationMembers) TableName() string {
+	return "organization_members"
+}
+
+// OrganizationInvitations 加入组织的邀请，被邀请人接受后成为成员
+type OrganizationInvitations struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	OrganizationID uint       `gorm:"not null;index" json:"organization_id"`
+	Username       string     `gorm:"type:varchar(50);not null;index" json:"username"`
+	Role           string     `gorm:"type:varchar(20);not null" json:"role"`
+	InvitedBy      string     `gorm:"type:varchar(50);not null" json:"invited_by"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	AcceptedAt     *time.Time `json:"accepted_at"`
+	DeclinedAt     *time.Time `json:"declined_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+}
+
+// TableName 指定表名
+func (OrganizationInvitations) TableName() string {
+	return "organization_invitations"
+}
+
+// SharedResources 成员共享到组织内的对话、诊断记录或地块数据
+type SharedResources struct {
+	ID             uint   `gorm:"primaryKey" json:"id"`
+	OrganizationID uint   `gorm:"not null;uniqueIndex:idx_org_resource" json:"organization_id"`
+	ResourceType   string `gorm:"type:varchar(20);not null;uniqueIndex:idx_org_resource" json:"resource_type"`
+	ResourceID     string `gorm:"type:varchar(64);not null;uniqueIndex:idx_org_resource" json:"resource_id"`
+	// Owner 资源所属的用户，对话按该用户名向Dify查询
+	Owner     string    `gorm:"type:varchar(50);not null;index" json:"owner"`
+	Title     string    `gorm:"type:varchar(100)" json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName 指定表名
+func (SharedResources) TableName() string {
+	return "shared_resources"
+}
+
+// DiagnosisRecords 病害诊断记录
+type DiagnosisRecords struct {
+	ID         uint    `gorm:"primaryKey" json:"id"`
+	Username   string  `gorm:"type:varchar(50);not null;index" json:"username"`
+	Disease    string  `gorm:"type:varchar(100);not null" json:"disease"`
+	Confidence float64 `gorm:"not null;default:0" json:"confidence"`
+	// ImageKey 诊断图片在文件存储中的键
+	ImageKey string `gorm:"type:varchar(255)" json:"image_key"`
+	// ConversationID 诊断后继续追问的Dify对话
+	ConversationID string    `gorm:"type:varchar(64)" json:"conversation_id"`
+	Notes          string    `gorm:"type:text" json:"notes"`
+	CreatedAt      time.Time `gorm:"index" json:"created_at"`
+}
+
+// TableName 指定表名
+func (DiagnosisRecords) TableName() string {
+	return "diagnosis_records"
+}
+
+// FieldRecords 地块数据
+type FieldRecords struct {
+	ID           uint   `gorm:"primaryKey" json:"id"`
+	Username     string `gorm:"type:varchar(50);not null;index" json:"username"`
+	Name         string `gorm:"type:varchar(50);not null" json:"name"`
+	RegionAdcode string `gorm:"type:varchar(6)" json:"region_adcode"`
+	Crop         string `gorm:"type:varchar(30)" json:"crop"`
+	// Area 地块面积，单位为亩
+	Area      float64   `gorm:"not null;default:0" json:"area"`
+	Notes     string    `gorm:"type:text" json:"notes"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName 指定表名
+func (FieldRecords) TableName() string {
+	return "field_records"
+}
+
+// InvitationCodes 注册邀请码，只保存邀请码的哈希
+type InvitationCodes struct {
+	ID uint `gorm:"primaryKey" json:"id"`
+	// Prefix 是邀请码的前几位，用于在列表中辨认
+	Prefix   string `gorm:"type:varchar(10);not null" json:"prefix"`
+	CodeHash string `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	// MaxUses 最多可注册的账户数，UsedCount 为已注册数
+	MaxUses   int `gorm:"not null;default:1" json:"max_uses"`
+	UsedCount int `gorm:"not null;default:0" json:"used_count"`
+	// 使用邀请码注册的用户的角色，以及自动加入的组织和组织内角色
+	Role           string     `gorm:"type:varchar(20);not null;default:farmer" json:"role"`
+	OrganizationID uint       `gorm:"not null;default:0;index" json:"organization_id"`
+	OrgRole        string     `gorm:"type:varchar(20)" json:"org_role"`
+	Note           string     `gorm:"type:varchar(100)" json:"note"`
+	CreatedBy      string     `gorm:"type:varchar(50);not null;index" json:"created_by"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// TableName 指定表名
+func (InvitationCodes) TableName() string {
+	return "invitation_codes"
+}
+
+// ChatConversations 本地保存的聊天会话，ID与聊天后端中的会话ID相同
+type ChatConversations struct {
+	ID       string `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	Username string `gorm:"type:varchar(50);not null;index" json:"username"`
+	Name     string `gorm:"type:varchar(100)" json:"name"`
+	// Backend 会话所在的聊天后端，切换后端后旧会话只从本地读取
+	Backend string `gorm:"type:varchar(20);not null" json:"backend"`
+	// Synced 为true时全部消息和文件都已保存在本地，查看历史不再访问聊天后端
+	Synced    bool      `gorm:"not null;default:false" json:"synced"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	// UpdatedAt 为最后一条消息的时间，由代码维护
+	UpdatedAt time.Time `gorm:"autoUpdateTime:false" json:"updated_at"`
+}
+
+// TableName 指定表名
+func (ChatConversations) TableName() string {
+	return "chat_conversations"
+}
+
+// ChatMessages 本地保存的一轮问答，ID与聊天后端中的消息ID相同
+type ChatMessages struct {
+	ID             string `gorm:"primaryKey;type:varchar(64)" json:"id"`
+	ConversationID string `gorm:"type:varchar(64);not null;index" json:"conversation_id"`
+	Username       string `gorm:"type:varchar(50);not null;index" json:"username"`
+	// TaskID 生成该回答的任务，从聊天后端同步的消息为空
+	TaskID string `gorm:"type:varchar(64)" json:"task_id"`
+	// 提问和回答上建有ngram分词的全文索引，用于搜索聊天记录
+	Query  string `gorm:"type:text;index:idx_chat_messages_fulltext,class:FULLTEXT,option:WITH PARSER ngram" json:"query"`
+	Answer string `gorm:"type:mediumtext;index:idx_chat_messages_fulltext,class:FULLTEXT,option:WITH PARSER ngram" json:"answer"`
+	// Files 提问和回答附带的文件，JSON数组
+	Files string `gorm:"type:text" json:"files"`
+	// Stopped 为true时回答被用户停止或客户端断开，Answer只是已生成的部分
+	Stopped          bool      `gorm:"not null;default:false" json:"stopped"`
+	PromptTokens     int       `gorm:"not null;default:0" json:"prompt_tokens"`
+	CompletionTokens int       `gorm:"not null;default:0" json:"completion_tokens"`
+	TotalTokens      int       `gorm:"not null;default:0" json:"total_tokens"`
+	CreatedAt        time.Time `gorm:"index" json:"created_at"`
+}
+
+// TableName 指定表名
+func (ChatMessages) TableName() string {
+	return "chat_messages"
+}
+
+// ChatSyncStates 记录用户在某个聊天后端中的会话列表导入本地的进度
+type ChatSyncStates struct {
+	Username string `gorm:"primaryKey;type:varchar(50)" json:"username"`
+	Backend  string `gorm:"primaryKey;type:varchar(20)" json:"backend"`
+	// SyncedAt 最近一次导入会话的时间，之后的新会话由聊天接口直接保存
+	SyncedAt time.Time `json:"synced_at"`
+	// LastID 已导入的最后一个会话，会话按创建时间倒序分页导入，中断后从这里继续
+	LastID string `gorm:"type:varchar(64)" json:"last_id"`
+	// Completed 为true时全部会话都已导入
+	Completed bool `gorm:"not null;default:false" json:"completed"`
+}
+
+// TableName 指定表名
+func (ChatSyncStates) TableName() string {
+	return "chat_sync_states"
+}